@@ -0,0 +1,641 @@
+package archive
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// Minimal 7z reader: only folders with single coder (copy, LZMA, LZMA2, Deflate or BZip2) are supported, which covers archives
+// produced by 7-Zip with default settings for text files. See 7zFormat.txt from 7-Zip distribution for details.
+
+const (
+	szSignatureHeaderSize = 32
+
+	szEnd                   = 0x00
+	szHeader                = 0x01
+	szArchiveProperties     = 0x02
+	szAdditionalStreamsInfo = 0x03
+	szMainStreamsInfo       = 0x04
+	szFilesInfo             = 0x05
+	szPackInfo              = 0x06
+	szUnpackInfo            = 0x07
+	szSubStreamsInfo        = 0x08
+	szSize                  = 0x09
+	szCRC                   = 0x0A
+	szFolderInfo            = 0x0B
+	szCodersUnpackSize      = 0x0C
+	szNumUnpackStream       = 0x0D
+	szEmptyStream           = 0x0E
+	szEmptyFile             = 0x0F
+	szAnti                  = 0x10
+	szName                  = 0x11
+	szEncodedHeader         = 0x17
+)
+
+var errSzCorrupted = errors.New("7z: corrupted archive header")
+
+type szCoder struct {
+	id     []byte
+	numIn  int
+	numOut int
+	props  []byte
+}
+
+type szFolder struct {
+	coders      []szCoder
+	numPacked   int
+	numOut      int
+	unpackSizes []uint64
+	hasCRC      bool
+}
+
+// unpackSize returns size of folder final output stream.
+func (f *szFolder) unpackSize() uint64 {
+	if len(f.unpackSizes) == 0 {
+		return 0
+	}
+	return f.unpackSizes[len(f.unpackSizes)-1]
+}
+
+type szStreams struct {
+	packPos   uint64
+	packSizes []uint64
+	folders   []szFolder
+	// substreams
+	numUnpack []int
+	sizes     []uint64
+}
+
+type szFile struct {
+	name      string
+	legacy    bool // name was stored in legacy encoding, see legacyName
+	hasStream bool
+	isDir     bool
+	anti      bool
+}
+
+// szBuffer reads 7z header structures, first error is remembered and all consequent reads return zero values.
+type szBuffer struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (b *szBuffer) byte() byte {
+	if b.err != nil {
+		return 0
+	}
+	if b.pos >= len(b.data) {
+		b.err = errSzCorrupted
+		return 0
+	}
+	b.pos++
+	return b.data[b.pos-1]
+}
+
+func (b *szBuffer) bytes(n uint64) []byte {
+	if b.err != nil {
+		return nil
+	}
+	if n > uint64(len(b.data)-b.pos) {
+		b.err = errSzCorrupted
+		return nil
+	}
+	b.pos += int(n)
+	return b.data[b.pos-int(n) : b.pos]
+}
+
+func (b *szBuffer) uint32() uint32 {
+	if v := b.bytes(4); v != nil {
+		return binary.LittleEndian.Uint32(v)
+	}
+	return 0
+}
+
+// number reads variable length 7z UINT64.
+func (b *szBuffer) number() uint64 {
+	first := b.byte()
+	var value uint64
+	for i, mask := 0, byte(0x80); i < 8; i, mask = i+1, mask>>1 {
+		if first&mask == 0 {
+			return value | uint64(first&(mask-1))<<(8*i)
+		}
+		value |= uint64(b.byte()) << (8 * i)
+	}
+	return value
+}
+
+// count reads number of items making sure it is sane.
+func (b *szBuffer) count() int {
+	n := b.number()
+	if n > uint64(len(b.data)) {
+		if b.err == nil {
+			b.err = errSzCorrupted
+		}
+		return 0
+	}
+	return int(n)
+}
+
+func (b *szBuffer) bits(n int) []bool {
+	res := make([]bool, n)
+	var v, mask byte
+	for i := range res {
+		if mask == 0 {
+			v, mask = b.byte(), 0x80
+		}
+		res[i] = v&mask != 0
+		mask >>= 1
+	}
+	return res
+}
+
+// digests skips CRC values returning which ones are defined.
+func (b *szBuffer) digests(n int) []bool {
+	var defined []bool
+	if b.byte() != 0 {
+		defined = make([]bool, n)
+		for i := range defined {
+			defined[i] = true
+		}
+	} else {
+		defined = b.bits(n)
+	}
+	for _, d := range defined {
+		if d {
+			b.uint32()
+		}
+	}
+	return defined
+}
+
+func (b *szBuffer) expect(id byte) {
+	if v := b.byte(); v != id && b.err == nil {
+		b.err = fmt.Errorf("7z: unexpected property %#x, expected %#x", v, id)
+	}
+}
+
+func (b *szBuffer) packInfo(s *szStreams) {
+	s.packPos = b.number()
+	s.packSizes = make([]uint64, b.count())
+	for b.err == nil {
+		switch id := b.byte(); id {
+		case szEnd:
+			return
+		case szSize:
+			for i := range s.packSizes {
+				s.packSizes[i] = b.number()
+			}
+		case szCRC:
+			b.digests(len(s.packSizes))
+		default:
+			b.err = fmt.Errorf("7z: unexpected property %#x in pack info", id)
+		}
+	}
+}
+
+func (b *szBuffer) folder() szFolder {
+	var (
+		f                      szFolder
+		totalIn, totalOut      int
+		numCoders, numBindings int
+	)
+	numCoders = b.count()
+	for i := 0; i < numCoders && b.err == nil; i++ {
+		flags := b.byte()
+		c := szCoder{id: b.bytes(uint64(flags & 0x0F)), numIn: 1, numOut: 1}
+		if flags&0x10 != 0 {
+			c.numIn, c.numOut = b.count(), b.count()
+		}
+		if flags&0x20 != 0 {
+			c.props = b.bytes(b.number())
+		}
+		totalIn += c.numIn
+		totalOut += c.numOut
+		f.coders = append(f.coders, c)
+	}
+	numBindings = totalOut - 1
+	for i := 0; i < numBindings && b.err == nil; i++ {
+		b.number()
+		b.number()
+	}
+	f.numPacked = totalIn - numBindings
+	if f.numPacked > 1 {
+		for i := 0; i < f.numPacked; i++ {
+			b.number()
+		}
+	}
+	f.numOut = totalOut
+	return f
+}
+
+func (b *szBuffer) unpackInfo(s *szStreams) {
+	b.expect(szFolderInfo)
+	s.folders = make([]szFolder, b.count())
+	if b.byte() != 0 && b.err == nil {
+		b.err = errors.New("7z: external folders are not supported")
+	}
+	for i := range s.folders {
+		s.folders[i] = b.folder()
+	}
+	b.expect(szCodersUnpackSize)
+	for i := range s.folders {
+		for j := 0; j < s.folders[i].numOut; j++ {
+			s.folders[i].unpackSizes = append(s.folders[i].unpackSizes, b.number())
+		}
+	}
+	for b.err == nil {
+		switch id := b.byte(); id {
+		case szEnd:
+			return
+		case szCRC:
+			for i, d := range b.digests(len(s.folders)) {
+				s.folders[i].hasCRC = d
+			}
+		default:
+			b.err = fmt.Errorf("7z: unexpected property %#x in unpack info", id)
+		}
+	}
+}
+
+func (b *szBuffer) subStreamsInfo(s *szStreams) {
+	s.numUnpack = make([]int, len(s.folders))
+	for i := range s.numUnpack {
+		s.numUnpack[i] = 1
+	}
+	id := b.byte()
+	if id == szNumUnpackStream {
+		for i := range s.numUnpack {
+			s.numUnpack[i] = b.count()
+		}
+		id = b.byte()
+	}
+	hasSizes := id == szSize
+	for i, f := range s.folders {
+		if s.numUnpack[i] == 0 {
+			continue
+		}
+		var sum uint64
+		for j := 1; j < s.numUnpack[i] && hasSizes; j++ {
+			size := b.number()
+			s.sizes = append(s.sizes, size)
+			sum += size
+		}
+		if sum > f.unpackSize() && b.err == nil {
+			b.err = errSzCorrupted
+		}
+		s.sizes = append(s.sizes, f.unpackSize()-sum)
+	}
+	if hasSizes {
+		id = b.byte()
+	}
+	for b.err == nil {
+		switch id {
+		case szEnd:
+			return
+		case szCRC:
+			n := 0
+			for i, f := range s.folders {
+				if s.numUnpack[i] != 1 || !f.hasCRC {
+					n += s.numUnpack[i]
+				}
+			}
+			b.digests(n)
+		default:
+			b.err = fmt.Errorf("7z: unexpected property %#x in substreams info", id)
+		}
+		id = b.byte()
+	}
+}
+
+func (b *szBuffer) streamsInfo() *szStreams {
+	s := &szStreams{}
+	for b.err == nil {
+		switch id := b.byte(); id {
+		case szEnd:
+			if s.numUnpack == nil {
+				// no substreams - every folder is a single stream
+				s.numUnpack = make([]int, len(s.folders))
+				for i, f := range s.folders {
+					s.numUnpack[i] = 1
+					s.sizes = append(s.sizes, f.unpackSize())
+				}
+			}
+			return s
+		case szPackInfo:
+			b.packInfo(s)
+		case szUnpackInfo:
+			b.unpackInfo(s)
+		case szSubStreamsInfo:
+			b.subStreamsInfo(s)
+		default:
+			b.err = fmt.Errorf("7z: unexpected property %#x in streams info", id)
+		}
+	}
+	return s
+}
+
+func (b *szBuffer) filesInfo() []szFile {
+	files := make([]szFile, b.count())
+	var emptyStream, emptyFile, anti []bool
+	for b.err == nil {
+		id := b.byte()
+		if id == szEnd {
+			break
+		}
+		prop := &szBuffer{data: b.bytes(b.number())}
+		switch id {
+		case szEmptyStream:
+			emptyStream = prop.bits(len(files))
+		case szEmptyFile, szAnti:
+			n := 0
+			for _, e := range emptyStream {
+				if e {
+					n++
+				}
+			}
+			if id == szEmptyFile {
+				emptyFile = prop.bits(n)
+			} else {
+				anti = prop.bits(n)
+			}
+		case szName:
+			if prop.byte() != 0 {
+				b.err = errors.New("7z: external file names are not supported")
+				break
+			}
+			for i := range files {
+				var name []uint16
+				for prop.err == nil {
+					c := uint16(prop.byte()) | uint16(prop.byte())<<8
+					if c == 0 {
+						break
+					}
+					name = append(name, c)
+				}
+				files[i].name, files[i].legacy = legacyName(strings.ReplaceAll(string(utf16.Decode(name)), `\`, "/"))
+			}
+		}
+		if prop.err != nil && b.err == nil {
+			b.err = prop.err
+		}
+	}
+	empty := 0
+	for i := range files {
+		files[i].hasStream = emptyStream == nil || !emptyStream[i]
+		if !files[i].hasStream {
+			files[i].isDir = empty >= len(emptyFile) || !emptyFile[empty]
+			files[i].anti = empty < len(anti) && anti[empty]
+			empty++
+		}
+	}
+	return files
+}
+
+// skipProperties skips archive properties record.
+func (b *szBuffer) skipProperties() {
+	for b.err == nil {
+		if b.byte() == szEnd {
+			return
+		}
+		b.bytes(b.number())
+	}
+}
+
+// sevenZip is parsed 7z archive.
+type sevenZip struct {
+	r       io.ReaderAt
+	size    int64
+	streams *szStreams
+	files   []szFile
+}
+
+// folderReader returns reader for unpacked content of the folder.
+func (z *sevenZip) folderReader(s *szStreams, folder int) (io.Reader, error) {
+
+	f := &s.folders[folder]
+	if len(f.coders) != 1 || f.coders[0].numIn != 1 || f.coders[0].numOut != 1 {
+		return nil, errors.New("7z: complex coders are not supported")
+	}
+
+	pack := 0
+	for i := 0; i < folder; i++ {
+		pack += s.folders[i].numPacked
+	}
+	if pack >= len(s.packSizes) {
+		return nil, errSzCorrupted
+	}
+	offset := szSignatureHeaderSize + int64(s.packPos)
+	for i := 0; i < pack; i++ {
+		offset += int64(s.packSizes[i])
+	}
+	if offset+int64(s.packSizes[pack]) > z.size {
+		return nil, errSzCorrupted
+	}
+	packed := io.NewSectionReader(z.r, offset, int64(s.packSizes[pack]))
+
+	size := f.unpackSize()
+	// dictionary never needs to be larger than data
+	dictCap := func(dict uint64) int {
+		if dict > size {
+			dict = size
+		}
+		if dict < lzma.MinDictCap {
+			dict = lzma.MinDictCap
+		}
+		return int(dict)
+	}
+
+	c := f.coders[0]
+	var (
+		r   io.Reader
+		err error
+	)
+	switch string(c.id) {
+	case "\x00":
+		r = packed
+	case "\x03\x01\x01":
+		if len(c.props) != 5 {
+			return nil, errSzCorrupted
+		}
+		// restore header of the standalone lzma stream
+		header := make([]byte, 13)
+		header[0] = c.props[0]
+		binary.LittleEndian.PutUint32(header[1:], uint32(dictCap(uint64(binary.LittleEndian.Uint32(c.props[1:])))))
+		binary.LittleEndian.PutUint64(header[5:], size)
+		r, err = lzma.NewReader(io.MultiReader(bytes.NewReader(header), packed))
+	case "\x21":
+		if len(c.props) != 1 || c.props[0] > 40 {
+			return nil, errSzCorrupted
+		}
+		dict := uint64(0xFFFFFFFF)
+		if p := c.props[0]; p < 40 {
+			dict = uint64(2|p&1) << (p/2 + 11)
+		}
+		r, err = lzma.Reader2Config{DictCap: dictCap(dict)}.NewReader2(packed)
+	case "\x04\x01\x08":
+		r = flate.NewReader(packed)
+	case "\x04\x02\x02":
+		r = bzip2.NewReader(packed)
+	default:
+		return nil, fmt.Errorf("7z: unsupported compression method %x", c.id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return io.LimitReader(r, int64(size)), nil
+}
+
+// openSevenZip reads archive headers.
+func openSevenZip(r io.ReaderAt, size int64) (*sevenZip, error) {
+
+	sig := make([]byte, szSignatureHeaderSize)
+	if _, err := r.ReadAt(sig, 0); err != nil {
+		return nil, err
+	}
+	offset := szSignatureHeaderSize + int64(binary.LittleEndian.Uint64(sig[12:]))
+	length := int64(binary.LittleEndian.Uint64(sig[20:]))
+	if offset < szSignatureHeaderSize || length <= 0 || offset+length > size {
+		return nil, errSzCorrupted
+	}
+	data := make([]byte, length)
+	if _, err := r.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+
+	z := &sevenZip{r: r, size: size}
+	b := &szBuffer{data: data}
+	for id := b.byte(); id == szEncodedHeader && b.err == nil; id = b.byte() {
+		// header itself is packed
+		s := b.streamsInfo()
+		if b.err != nil {
+			return nil, b.err
+		}
+		if len(s.folders) == 0 {
+			return nil, errSzCorrupted
+		}
+		hr, err := z.folderReader(s, 0)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(hr); err != nil {
+			return nil, err
+		}
+		b = &szBuffer{data: data}
+	}
+	b.pos--
+	b.expect(szHeader)
+
+	for b.err == nil {
+		switch id := b.byte(); id {
+		case szEnd:
+			if z.streams == nil {
+				z.streams = &szStreams{}
+			}
+			return z, nil
+		case szArchiveProperties:
+			b.skipProperties()
+		case szAdditionalStreamsInfo:
+			b.streamsInfo()
+		case szMainStreamsInfo:
+			z.streams = b.streamsInfo()
+		case szFilesInfo:
+			z.files = b.filesInfo()
+		default:
+			b.err = fmt.Errorf("7z: unexpected property %#x in header", id)
+		}
+	}
+	return nil, b.err
+}
+
+// legacyName recognizes names archivers running in non UTF-8 locale store in 7z: every byte of the name in legacy
+// encoding becomes separate UTF-16 character. Such names are turned back into bytes, so their encoding could be
+// detected as for legacy zip archives.
+func legacyName(name string) (string, bool) {
+	var legacy bool
+	for _, r := range name {
+		if r > 0xFF {
+			return name, false
+		}
+		legacy = legacy || r >= 0x80
+	}
+	if !legacy {
+		return name, false
+	}
+	buf := make([]byte, 0, len(name))
+	for _, r := range name {
+		buf = append(buf, byte(r))
+	}
+	return string(buf), true
+}
+
+// walkSevenZip calls visit for every file in archive for which wanted returns true. Content of solid blocks is
+// unpacked sequentially, blocks without wanted files are skipped.
+func walkSevenZip(r io.ReaderAt, size int64, wanted func(name string) bool, visit func(name string, legacy bool, r io.Reader) error) error {
+
+	z, err := openSevenZip(r, size)
+	if err != nil {
+		return err
+	}
+	s := z.streams
+
+	next := 0 // index of the next file with stream
+	sizes := s.sizes
+	for folder := range s.folders {
+		var files []int
+		for len(files) < s.numUnpack[folder] && next < len(z.files) {
+			if z.files[next].hasStream {
+				files = append(files, next)
+			}
+			next++
+		}
+		if len(files) != s.numUnpack[folder] || len(sizes) < len(files) {
+			return errSzCorrupted
+		}
+		fsizes := sizes[:len(files)]
+		sizes = sizes[len(files):]
+
+		need := false
+		for _, i := range files {
+			need = need || wanted(z.files[i].name)
+		}
+		if !need {
+			continue
+		}
+
+		fr, err := z.folderReader(s, folder)
+		if err != nil {
+			return err
+		}
+		for k, i := range files {
+			lr := io.LimitReader(fr, int64(fsizes[k]))
+			if wanted(z.files[i].name) {
+				if err := visit(z.files[i].name, z.files[i].legacy, lr); err != nil {
+					return err
+				}
+			}
+			// skip unread data to get to the next file in solid block
+			if _, err := io.Copy(io.Discard, lr); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, f := range z.files {
+		if !f.hasStream && !f.isDir && !f.anti && wanted(f.name) {
+			if err := visit(f.name, f.legacy, bytes.NewReader(nil)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -1,33 +1,370 @@
-// Package archive builds Walk abstraction on top of "archive/zip".
+// Package archive builds Walk abstraction on top of various archive formats: zip, tar (plain or compressed), 7z and
+// single compressed files. Archives found inside archives are walked transparently.
 package archive
 
 import (
+	"archive/tar"
 	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
 	"strings"
+	"unicode/utf8"
+
+	"github.com/ulikunitz/xz"
 )
 
+// File is a file in archive visited by Walk.
+type File interface {
+	// Name returns path of the file inside archive. For files in nested archives path starts with the nested archive
+	// path followed by "/".
+	Name() string
+	// NonUTF8 reports that file name encoding is unknown (legacy zip, tar and 7z archives).
+	NonUTF8() bool
+	// Open returns reader for file content. It could be called more than once, but only before WalkFunc returns.
+	Open() (io.ReadCloser, error)
+}
+
 // WalkFunc is the type of the function called for each file in archive
 // visited by Walk. The archive argument contains path to archive passed to Walk
-// The file argument is the zip.File structure for file in archive which satisfies
-// match condition. If an error is returned, processing stops.
-type WalkFunc func(archive string, file *zip.File) error
+// The file argument is the file in archive which satisfies match condition.
+// If an error is returned, processing stops.
+type WalkFunc func(archive string, file File) error
+
+// maxDepth limits nesting of archives.
+const maxDepth = 4
+
+// maxReadSize limits size of nested archives and files from sequentially read archives, which are kept in memory.
+var maxReadSize int64 = 512 << 20
+
+type format int
+
+const (
+	formatUnknown format = iota
+	formatZip
+	formatTar
+	formatGzip
+	formatBzip2
+	formatXz
+	format7z
+)
+
+// extensions of supported archives, longer ones first.
+var extensions = []string{".tar.gz", ".tar.bz2", ".tar.xz", ".zip", ".tar", ".tgz", ".tbz2", ".tbz", ".txz", ".7z", ".gz", ".bz2", ".xz"}
+
+// compressed lists extensions of single compressed files.
+var compressed = []string{".gz", ".bz2", ".xz"}
+
+// detect recognizes archive format by its signature.
+func detect(header []byte) format {
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		return formatZip
+	case bytes.HasPrefix(header, []byte("7z\xBC\xAF\x27\x1C")):
+		return format7z
+	case bytes.HasPrefix(header, []byte{0x1F, 0x8B}):
+		return formatGzip
+	case bytes.HasPrefix(header, []byte("BZh")):
+		return formatBzip2
+	case bytes.HasPrefix(header, []byte("\xFD7zXZ\x00")):
+		return formatXz
+	case len(header) >= 262 && string(header[257:262]) == "ustar":
+		return formatTar
+	}
+	return formatUnknown
+}
+
+// hasArchiveExt checks if name has extension of supported archive.
+func hasArchiveExt(name string) bool {
+	return len(archiveExt(name)) > 0
+}
+
+func archiveExt(name string) string {
+	lname := strings.ToLower(name)
+	for _, ext := range extensions {
+		if strings.HasSuffix(lname, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// IsArchive detects if file is supported archive: it should have proper extension and signature.
+func IsArchive(fname string) (bool, error) {
+
+	if !hasArchiveExt(fname) {
+		return false, nil
+	}
+
+	file, err := os.Open(fname)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 262)
+	count, err := io.ReadFull(file, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, err
+	}
+	return detect(header[:count]) != formatUnknown, nil
+}
 
 // Walk walks the all files in the archive which satisfy match condition,
-// calling walkFn for each item.
+// calling walkFn for each item. Condition is a prefix of the file path
+// inside archive.
 func Walk(archive, pattern string, walkFn WalkFunc) error {
 
-	r, err := zip.OpenReader(archive)
+	file, err := os.Open(archive)
 	if err != nil {
 		return err
 	}
-	defer r.Close()
+	defer file.Close()
 
-	for _, f := range r.File {
-		if !f.FileInfo().IsDir() && strings.HasPrefix(f.FileHeader.Name, pattern) {
-			if err := walkFn(archive, f); err != nil {
-				return err
-			}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	w := &walker{
+		pattern: pattern,
+		walkFn:  func(f File) error { return walkFn(archive, f) },
+	}
+	return w.walk(file, info.Size(), filepath.Base(archive), "", 0)
+}
+
+type walker struct {
+	pattern string
+	walkFn  func(File) error
+}
+
+// wanted checks if file or nested archive with this path could have files satisfying match condition.
+func (w *walker) wanted(name string) bool {
+	if strings.HasPrefix(name, w.pattern) {
+		return true
+	}
+	return hasArchiveExt(name) && strings.HasPrefix(w.pattern, name+"/")
+}
+
+// walk detects archive format and walks its content, prefix is path of the archive for nested archives.
+func (w *walker) walk(r io.ReaderAt, size int64, name, prefix string, depth int) error {
+
+	header := make([]byte, 262)
+	count, err := r.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	switch f := detect(header[:count]); f {
+	case formatZip:
+		return w.walkZip(r, size, prefix, depth)
+	case format7z:
+		return walkSevenZip(r, size, func(fname string) bool { return w.wanted(prefix + fname) }, func(fname string, legacy bool, r io.Reader) error {
+			return w.visit(&streamFile{name: prefix + fname, nonUTF8: legacy, r: r}, depth)
+		})
+	case formatTar:
+		return w.walkTar(io.NewSectionReader(r, 0, size), prefix, depth)
+	case formatGzip, formatBzip2, formatXz:
+		return w.walkCompressed(f, io.NewSectionReader(r, 0, size), name, prefix, depth)
+	}
+	return fmt.Errorf("unsupported archive format: %s", prefix+name)
+}
+
+// visit calls walkFn for file satisfying match condition, nested archives are walked recursively.
+func (w *walker) visit(f File, depth int) error {
+
+	name := f.Name()
+	if !w.wanted(name) {
+		return nil
+	}
+	if hasArchiveExt(name) && depth < maxDepth {
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		data, err := readLimited(r, name)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("unable to read nested archive %s: %w", name, err)
+		}
+		header := data
+		if len(header) > 262 {
+			header = header[:262]
+		}
+		if detect(header) != formatUnknown {
+			return w.walk(bytes.NewReader(data), int64(len(data)), path.Base(name), name+"/", depth+1)
+		}
+		f = &memFile{name: name, nonUTF8: f.NonUTF8(), data: data}
+	}
+	if !strings.HasPrefix(name, w.pattern) {
+		return nil
+	}
+	return w.walkFn(f)
+}
+
+func (w *walker) walkZip(r io.ReaderAt, size int64, prefix string, depth int) error {
+
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if err := w.visit(&zipFile{name: prefix + f.FileHeader.Name, f: f}, depth); err != nil {
+			return err
 		}
 	}
 	return nil
 }
+
+func (w *walker) walkTar(r io.Reader, prefix string, depth int) error {
+
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		// tar stores names as is, only PAX records are always UTF-8
+		name := strings.TrimPrefix(h.Name, "./")
+		if err := w.visit(&streamFile{name: prefix + name, nonUTF8: !utf8.ValidString(name), r: tr}, depth); err != nil {
+			return err
+		}
+	}
+}
+
+// walkCompressed handles compressed tar archives and single compressed files.
+func (w *walker) walkCompressed(f format, r io.Reader, name, prefix string, depth int) error {
+
+	var (
+		cr   io.Reader
+		err  error
+		base = name
+	)
+	switch f {
+	case formatGzip:
+		var gr *gzip.Reader
+		if gr, err = gzip.NewReader(r); err == nil {
+			defer gr.Close()
+			if len(gr.Name) > 0 && !strings.ContainsAny(gr.Name, `/\`) {
+				// original file name is stored in gzip header
+				name = gr.Name + path.Ext(name)
+			}
+			cr = gr
+		}
+	case formatBzip2:
+		cr = bzip2.NewReader(r)
+	case formatXz:
+		cr, err = xz.NewReader(r)
+	}
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReaderSize(cr, 4096)
+	if header, _ := br.Peek(262); detect(header) == formatTar {
+		return w.walkTar(br, prefix, depth)
+	}
+
+	// single compressed file is named after archive and replaces it
+	prefix = strings.TrimSuffix(prefix, base+"/")
+	for _, ext := range compressed {
+		if strings.EqualFold(path.Ext(name), ext) {
+			name = name[:len(name)-len(ext)]
+			break
+		}
+	}
+	return w.visit(&streamFile{name: prefix + name, nonUTF8: !utf8.ValidString(name), r: br}, depth)
+}
+
+// zipFile is a file in zip archive, it could be read directly.
+type zipFile struct {
+	name string
+	f    *zip.File
+}
+
+func (z *zipFile) Name() string {
+	return z.name
+}
+
+func (z *zipFile) NonUTF8() bool {
+	return z.f.FileHeader.NonUTF8
+}
+
+func (z *zipFile) Open() (io.ReadCloser, error) {
+	return z.f.Open()
+}
+
+// memFile is a file which content is already read.
+type memFile struct {
+	name    string
+	nonUTF8 bool
+	data    []byte
+}
+
+func (m *memFile) Name() string {
+	return m.name
+}
+
+func (m *memFile) NonUTF8() bool {
+	return m.nonUTF8
+}
+
+func (m *memFile) Open() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(m.data)), nil
+}
+
+// streamFile is a file in sequentially read archive, its content is read into memory when file is opened first time.
+type streamFile struct {
+	name    string
+	nonUTF8 bool
+	r       io.Reader
+	data    []byte
+	err     error
+}
+
+func (s *streamFile) Name() string {
+	return s.name
+}
+
+func (s *streamFile) NonUTF8() bool {
+	return s.nonUTF8
+}
+
+func (s *streamFile) Open() (io.ReadCloser, error) {
+	if s.r != nil {
+		s.data, s.err = readLimited(s.r, s.name)
+		s.r = nil
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	return io.NopCloser(bytes.NewReader(s.data)), nil
+}
+
+// readLimited reads file content into memory refusing files larger than maxReadSize.
+func readLimited(r io.Reader, name string) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxReadSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxReadSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", name, maxReadSize)
+	}
+	return data, nil
+}
@@ -0,0 +1,356 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+type testFile struct {
+	name string
+	body string
+}
+
+var testFiles = []testFile{
+	{"books/a.fb2", "first book"},
+	{"books/b.fb2", "second book"},
+	{"other/c.txt", "not a book"},
+}
+
+func makeZip(t *testing.T, files []testFile) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(f.body))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeTar(t *testing.T, files []testFile) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.body)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(f.body))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipData(t *testing.T, name string, data []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Name = name
+	gw.Write(data)
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func xzData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	xw, err := xz.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw.Write(data)
+	if err := xw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// lzmaData returns raw LZMA stream (without header) and its properties as stored in 7z.
+func lzmaData(t *testing.T, data []byte) ([]byte, []byte) {
+	var buf bytes.Buffer
+	lw, err := lzma.WriterConfig{SizeInHeader: true, Size: int64(len(data))}.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lw.Write(data)
+	if err := lw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()[13:], buf.Bytes()[:5]
+}
+
+func szNumber(buf *bytes.Buffer, n uint64) {
+	if n < 0x80 {
+		buf.WriteByte(byte(n))
+		return
+	}
+	buf.WriteByte(0xFF)
+	binary.Write(buf, binary.LittleEndian, n)
+}
+
+// szStreamsInfo writes streams info for single folder with files of specified sizes.
+func szStreamsInfo(buf *bytes.Buffer, packPos, packSize uint64, props []byte, sizes []uint64) {
+	var total uint64
+	for _, s := range sizes {
+		total += s
+	}
+	buf.WriteByte(szPackInfo)
+	szNumber(buf, packPos)
+	szNumber(buf, 1)
+	buf.WriteByte(szSize)
+	szNumber(buf, packSize)
+	buf.WriteByte(szEnd)
+	buf.WriteByte(szUnpackInfo)
+	buf.WriteByte(szFolderInfo)
+	szNumber(buf, 1)
+	buf.WriteByte(0)
+	szNumber(buf, 1)
+	if props == nil {
+		buf.Write([]byte{0x01, 0x00})
+	} else {
+		buf.Write([]byte{0x23, 0x03, 0x01, 0x01})
+		szNumber(buf, uint64(len(props)))
+		buf.Write(props)
+	}
+	buf.WriteByte(szCodersUnpackSize)
+	szNumber(buf, total)
+	buf.WriteByte(szEnd)
+	if len(sizes) > 1 {
+		buf.WriteByte(szSubStreamsInfo)
+		buf.WriteByte(szNumUnpackStream)
+		szNumber(buf, uint64(len(sizes)))
+		buf.WriteByte(szSize)
+		for _, s := range sizes[:len(sizes)-1] {
+			szNumber(buf, s)
+		}
+		buf.WriteByte(szEnd)
+	}
+	buf.WriteByte(szEnd)
+}
+
+// make7z produces solid 7z archive, optionally compressed with LZMA and with compressed header.
+func make7z(t *testing.T, files []testFile, compress, encodeHeader bool) []byte {
+
+	var (
+		content bytes.Buffer
+		sizes   []uint64
+		names   bytes.Buffer
+	)
+	names.WriteByte(0)
+	for _, f := range files {
+		content.WriteString(f.body)
+		sizes = append(sizes, uint64(len(f.body)))
+		for _, c := range utf16.Encode([]rune(f.name)) {
+			binary.Write(&names, binary.LittleEndian, c)
+		}
+		names.Write([]byte{0, 0})
+	}
+	packed, props := content.Bytes(), []byte(nil)
+	if compress {
+		packed, props = lzmaData(t, content.Bytes())
+	}
+
+	var header bytes.Buffer
+	header.WriteByte(szHeader)
+	header.WriteByte(szMainStreamsInfo)
+	szStreamsInfo(&header, 0, uint64(len(packed)), props, sizes)
+	header.WriteByte(szFilesInfo)
+	szNumber(&header, uint64(len(files)))
+	header.WriteByte(szName)
+	szNumber(&header, uint64(names.Len()))
+	header.Write(names.Bytes())
+	header.WriteByte(szEnd)
+	header.WriteByte(szEnd)
+
+	body := append([]byte(nil), packed...)
+	if encodeHeader {
+		hpacked, hprops := lzmaData(t, header.Bytes())
+		var encoded bytes.Buffer
+		encoded.WriteByte(szEncodedHeader)
+		szStreamsInfo(&encoded, uint64(len(body)), uint64(len(hpacked)), hprops, []uint64{uint64(header.Len())})
+		body = append(body, hpacked...)
+		header = encoded
+	}
+
+	var res bytes.Buffer
+	res.WriteString("7z\xBC\xAF\x27\x1C\x00\x04")
+	binary.Write(&res, binary.LittleEndian, uint32(0))
+	binary.Write(&res, binary.LittleEndian, uint64(len(body)))
+	binary.Write(&res, binary.LittleEndian, uint64(header.Len()))
+	binary.Write(&res, binary.LittleEndian, uint32(0))
+	res.Write(body)
+	res.Write(header.Bytes())
+	return res.Bytes()
+}
+
+// walkAll returns content of the files found in archive.
+func walkAll(t *testing.T, data []byte, name, pattern string) map[string]string {
+
+	fname := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fname, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := IsArchive(fname); err != nil || !ok {
+		t.Fatalf("%s is not recognized as archive: %v", name, err)
+	}
+
+	res := make(map[string]string)
+	err := Walk(fname, pattern, func(archive string, f File) error {
+		// files must be readable more than once
+		for i := 0; i < 2; i++ {
+			r, err := f.Open()
+			if err != nil {
+				return err
+			}
+			body, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+			res[f.Name()] = string(body)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return res
+}
+
+func TestWalk(t *testing.T) {
+
+	expected := make(map[string]string)
+	for _, f := range testFiles {
+		expected[f.name] = f.body
+	}
+
+	nested := makeTar(t, []testFile{
+		{"top.fb2", "top book"},
+		{"inner.zip", string(makeZip(t, testFiles))},
+	})
+
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		pattern  string
+		expected map[string]string
+	}{
+		{"books.zip", makeZip(t, testFiles), "", expected},
+		{"books.tar", makeTar(t, testFiles), "", expected},
+		{"books.tar.gz", gzipData(t, "", makeTar(t, testFiles)), "", expected},
+		{"books.txz", xzData(t, makeTar(t, testFiles)), "", expected},
+		{"books.7z", make7z(t, testFiles, false, false), "", expected},
+		{"books-lzma.7z", make7z(t, testFiles, true, true), "", expected},
+		{"books.7z", make7z(t, testFiles, true, false), "books/", map[string]string{"books/a.fb2": "first book", "books/b.fb2": "second book"}},
+		{"download.gz", gzipData(t, "book.fb2", []byte("single book")), "", map[string]string{"book.fb2": "single book"}},
+		{"book.fb2.xz", xzData(t, []byte("single book")), "", map[string]string{"book.fb2": "single book"}},
+		{"nested.tar", nested, "", map[string]string{
+			"top.fb2":               "top book",
+			"inner.zip/books/a.fb2": "first book",
+			"inner.zip/books/b.fb2": "second book",
+			"inner.zip/other/c.txt": "not a book",
+		}},
+		{"nested.tar", nested, "inner.zip/books/b", map[string]string{"inner.zip/books/b.fb2": "second book"}},
+	} {
+		if res := walkAll(t, tc.data, tc.name, tc.pattern); !reflect.DeepEqual(res, tc.expected) {
+			names := make([]string, 0, len(res))
+			for n := range res {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			t.Errorf("%s [%s]: unexpected files %v", tc.name, tc.pattern, names)
+		}
+	}
+}
+
+func TestWalkNames(t *testing.T) {
+
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		expected string
+		nonUTF8  bool
+	}{
+		{"utf8.tar", makeTar(t, []testFile{{"Привет.fb2", "book"}}), "Привет.fb2", false},
+		{"legacy.tar", makeTar(t, []testFile{{"\xcf\xf0\xe8\xe2\xe5\xf2.fb2", "book"}}), "\xcf\xf0\xe8\xe2\xe5\xf2.fb2", true},
+		{"utf16.7z", make7z(t, []testFile{{"Привет.fb2", "book"}}, false, false), "Привет.fb2", false},
+		{"ascii.7z", make7z(t, []testFile{{"book.fb2", "book"}}, false, false), "book.fb2", false},
+		// every byte of cp1251 name became separate character
+		{"legacy.7z", make7z(t, []testFile{{"Ïðèâåò.fb2", "book"}}, false, false), "\xcf\xf0\xe8\xe2\xe5\xf2.fb2", true},
+	} {
+		fname := filepath.Join(t.TempDir(), tc.name)
+		if err := os.WriteFile(fname, tc.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		err := Walk(fname, "", func(archive string, f File) error {
+			names = append(names, f.Name())
+			if f.NonUTF8() != tc.nonUTF8 {
+				t.Errorf("%s: expected NonUTF8 %v for %q", tc.name, tc.nonUTF8, f.Name())
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if len(names) != 1 || names[0] != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, names)
+		}
+	}
+}
+
+func TestWalkSizeLimit(t *testing.T) {
+
+	defer func(size int64) { maxReadSize = size }(maxReadSize)
+	maxReadSize = 64
+
+	large := testFile{"books/large.fb2", string(bytes.Repeat([]byte("x"), 65))}
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"large.tar", makeTar(t, []testFile{large})},
+		{"large.7z", make7z(t, []testFile{large}, true, false)},
+		{"nested.tar", makeTar(t, []testFile{{"inner.zip", string(makeZip(t, testFiles))}})},
+	} {
+		fname := filepath.Join(t.TempDir(), tc.name)
+		if err := os.WriteFile(fname, tc.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := Walk(fname, "", func(archive string, f File) error {
+			r, err := f.Open()
+			if err != nil {
+				return err
+			}
+			return r.Close()
+		})
+		if err == nil || !strings.Contains(err.Error(), "larger than 64 bytes") {
+			t.Errorf("%s: expected size limit error, got %v", tc.name, err)
+		}
+	}
+
+	// files within limit are still read
+	if res := walkAll(t, makeTar(t, testFiles), "books.tar", ""); len(res) != len(testFiles) {
+		t.Errorf("unexpected files %v", res)
+	}
+}
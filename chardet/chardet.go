@@ -0,0 +1,181 @@
+// Package chardet guesses legacy single byte encoding of texts which have no other indication of their character set.
+// Text is decoded with every supported code page and scored by letter pairs statistics of languages using it, so
+// confidence of Cyrillic, Western and Central European guesses could be compared directly.
+package chardet
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Result describes detected encoding.
+type Result struct {
+	// Name is IANA name of the character set.
+	Name     string
+	Encoding encoding.Encoding
+	// Confidence is in [0, 1] range, higher is better.
+	Confidence float64
+}
+
+// sampleSize limits amount of text looked at, beginning of the book is enough.
+const sampleSize = 256 * 1024
+
+// minimal score for language model to be trusted, wrong code page produces negative scores.
+const threshold = 0.25
+
+type codePage struct {
+	name string
+	cm   *charmap.Charmap
+}
+
+var (
+	cyrillicPages = []codePage{
+		{"windows-1251", charmap.Windows1251},
+		{"KOI8-R", charmap.KOI8R},
+		{"IBM866", charmap.CodePage866},
+	}
+	westernPages = []codePage{{"windows-1252", charmap.Windows1252}}
+	centralPages = []codePage{{"windows-1250", charmap.Windows1250}}
+)
+
+//go:generate go run gen_models.go -out models.go
+
+// language is letter pairs model of the language and code pages it is usually encoded with.
+type language struct {
+	pairs map[[2]rune]float64
+	pages []codePage
+}
+
+var languages = []language{
+	newLanguage(russianPairs, cyrillicPages),
+	newLanguage(frenchPairs, westernPages),
+	newLanguage(germanPairs, westernPages),
+	newLanguage(spanishPairs, westernPages),
+	newLanguage(italianPairs, westernPages),
+	newLanguage(portuguesePairs, westernPages),
+	newLanguage(dutchPairs, westernPages),
+	newLanguage(swedishPairs, westernPages),
+	newLanguage(danishPairs, westernPages),
+	newLanguage(czechPairs, centralPages),
+	newLanguage(slovakPairs, centralPages),
+	newLanguage(polishPairs, centralPages),
+	newLanguage(hungarianPairs, centralPages),
+	newLanguage(slovenianPairs, centralPages),
+	newLanguage(croatianPairs, centralPages),
+}
+
+// newLanguage weights pairs by their frequency rank: most frequent pair weights 1, the least frequent one close to 0.
+func newLanguage(pairs string, pages []codePage) language {
+	list := strings.Split(strings.TrimSuffix(pairs, "|"), "|")
+	res := language{pairs: make(map[[2]rune]float64, len(list)), pages: pages}
+	for i, p := range list {
+		r := []rune(p)
+		res.pairs[[2]rune{r[0], r[1]}] = 1 - float64(i)/float64(len(list))
+	}
+	return res
+}
+
+// Detect guesses legacy encoding of text. It returns nil if text is valid UTF-8 (including plain ASCII) or if encoding
+// could not be guessed.
+func Detect(data []byte) *Result {
+
+	if utf8.Valid(data) {
+		return nil
+	}
+	if len(data) > sampleSize {
+		data = data[:sampleSize]
+	}
+
+	var (
+		best    *Result
+		decoded = make(map[*charmap.Charmap][]rune)
+	)
+	for _, lang := range languages {
+		for _, cp := range lang.pages {
+			text, ok := decoded[cp.cm]
+			if !ok {
+				text = decode(data, cp.cm)
+				decoded[cp.cm] = text
+			}
+			if score := lang.score(text); score >= threshold && (best == nil || score > best.Confidence) {
+				best = &Result{Name: cp.name, Encoding: cp.cm, Confidence: score}
+			}
+		}
+	}
+	return best
+}
+
+// DecodeString converts short legacy encoded string (like file name) to UTF-8. If string is valid UTF-8 or its
+// encoding cannot be guessed it is returned unchanged.
+func DecodeString(s string) (string, *Result) {
+
+	res := Detect([]byte(s))
+	if res == nil {
+		return s, nil
+	}
+	d, err := res.Encoding.NewDecoder().String(s)
+	if err != nil {
+		return s, nil
+	}
+	return d, res
+}
+
+const (
+	boundary  = ' '
+	otherChar = utf8.RuneError
+)
+
+// classify maps decoded character to the alphabet of language models: letters in lower case, word boundary and
+// characters unlikely to be found in text. gen_models.go has the copy of it.
+func classify(r rune) rune {
+	switch {
+	case unicode.IsLetter(r):
+		return unicode.ToLower(r)
+	case unicode.IsSpace(r), unicode.IsPunct(r), unicode.IsDigit(r), r < utf8.RuneSelf:
+		return boundary
+	}
+	return otherChar
+}
+
+// decode converts data with code page and classifies resulting characters.
+func decode(data []byte, cm *charmap.Charmap) []rune {
+	res := make([]rune, len(data))
+	for i, b := range data {
+		res[i] = classify(cm.DecodeByte(b))
+	}
+	return res
+}
+
+// score returns average weight of pairs with non-ASCII characters in classified text: frequent pairs of the language
+// weight close to 1, rare and impossible ones -1.
+func (lang *language) score(text []rune) float64 {
+
+	var (
+		total float64
+		pairs int
+		prev  = boundary
+	)
+	for i := 0; i <= len(text); i++ {
+		cur := boundary
+		if i < len(text) {
+			cur = text[i]
+		}
+		if prev >= utf8.RuneSelf || cur >= utf8.RuneSelf {
+			pairs++
+			if w, ok := lang.pairs[[2]rune{prev, cur}]; ok {
+				total += w
+			} else {
+				total--
+			}
+		}
+		prev = cur
+	}
+	if pairs == 0 {
+		return -1
+	}
+	return total / float64(pairs)
+}
@@ -0,0 +1,122 @@
+package chardet
+
+import (
+	"testing"
+	"unicode"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+const (
+	russianText = `Все счастливые семьи похожи друг на друга, каждая несчастливая семья несчастлива по-своему.
+Всё смешалось в доме Облонских. Жена узнала, что муж был в связи с бывшею в их доме француженкою-гувернанткой, и
+объявила мужу, что не может жить с ним в одном доме.`
+	russianDialog = `- Ты опять опоздал, - сказала она, не поднимая глаз от книги. - Поезд ушёл в семь, а теперь уже
+почти девять. Он снял мокрое пальто, повесил его у двери и долго молчал, глядя в окно на пустую улицу, где под
+фонарём кружился снег. - Я шёл пешком через весь город, - наконец ответил он. - Хотелось подумать.`
+	frenchText = `Longtemps, je me suis couché de bonne heure. Parfois, à peine ma bougie éteinte, mes yeux se fermaient si
+vite que je n'avais pas le temps de me dire : « Je m'endors. » Et, une demi-heure après, la pensée qu'il était temps
+de chercher le sommeil m'éveillait.`
+	germanText = `Als er am nächsten Morgen erwachte, war es draußen schon hell. Die Straße vor dem Fenster lag still, nur
+ein Hund bellte irgendwo hinter den Gärten. Er hörte, wie unten jemand die Tür öffnete und über den Hof ging, und
+fühlte sich müde, als hätte er überhaupt nicht geschlafen.`
+	spanishText = `En un lugar de la Mancha, de cuyo nombre no quiero acordarme, no ha mucho tiempo que vivía un hidalgo de
+los de lanza en astillero, adarga antigua, rocín flaco y galgo corredor. Una olla de algo más vaca que carnero,
+salpicón las más noches, duelos y quebrantos los sábados, lentejas los viernes.`
+	czechText = `Když se Řehoř Samsa jednoho rána probudil z nepokojných snů, shledal, že se v posteli proměnil v obrovský
+hmyz. Ležel na zádech tvrdých jako pancíř, a když trochu nadzvedl hlavu, uviděl své klenuté, hnědé břicho.`
+	polishText = `Był pogodny wieczór i słońce powoli chowało się za lasem. Dzieci wróciły już ze szkoły, a matka
+przygotowała kolację, której zapach rozchodził się po całym domu. Ojciec siedział przy oknie i czytał gazetę,
+od czasu do czasu zerkając na drogę, którą miał przyjechać jego brat.`
+	hungarianText = `Az öreg halász minden reggel kiment a partra, és hosszan nézte a vizet. Tudta, hogy a folyó egyszer
+majd visszaadja, amit elvett tőle, de már nem sietett. Esténként a tűz mellett ült, és a fiúknak mesélt azokról
+az időkről, amikor még a hídon is ökrös szekerek jártak.`
+)
+
+func TestDetect(t *testing.T) {
+
+	for _, tc := range []struct {
+		text     string
+		cm       *charmap.Charmap
+		expected string
+	}{
+		{russianText, charmap.Windows1251, "windows-1251"},
+		{russianText, charmap.KOI8R, "KOI8-R"},
+		{russianText, charmap.CodePage866, "IBM866"},
+		{russianDialog, charmap.Windows1251, "windows-1251"},
+		{russianDialog, charmap.KOI8R, "KOI8-R"},
+		{russianDialog, charmap.CodePage866, "IBM866"},
+		{frenchText, charmap.Windows1252, "windows-1252"},
+		{frenchText, charmap.ISO8859_1, "windows-1252"},
+		{germanText, charmap.Windows1252, "windows-1252"},
+		{spanishText, charmap.Windows1252, "windows-1252"},
+		{czechText, charmap.Windows1250, "windows-1250"},
+		{polishText, charmap.Windows1250, "windows-1250"},
+		{hungarianText, charmap.Windows1250, "windows-1250"},
+		{"Война и мир.fb2", charmap.CodePage866, "IBM866"},
+		{"Толстой - Анна Каренина.fb2", charmap.Windows1251, "windows-1251"},
+	} {
+		data, err := tc.cm.NewEncoder().Bytes([]byte(tc.text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := Detect(data)
+		if res == nil {
+			t.Errorf("%s: encoding not detected for %.20q", tc.expected, tc.text)
+			continue
+		}
+		if res.Name != tc.expected {
+			t.Errorf("%s: detected %s (%.2f) for %.20q", tc.expected, res.Name, res.Confidence, tc.text)
+		}
+	}
+
+	if res := Detect([]byte(russianText)); res != nil {
+		t.Errorf("UTF-8 text detected as %s", res.Name)
+	}
+
+	if s, _ := DecodeString("\x82\xAE\xA9\xAD\xA0.fb2"); s != "Война.fb2" {
+		t.Errorf("unexpected decoded name %q", s)
+	}
+}
+
+// TestDetectCloseCalls checks texts which are valid in both code pages: short Cyrillic names and capitals decode to
+// letters with KOI8-R and windows-1251 alike, while many accented letters have the same codes in windows-1250 and
+// windows-1252, so only letter pairs tell the language.
+func TestDetectCloseCalls(t *testing.T) {
+
+	for _, tc := range []struct {
+		text      string
+		cm, rival *charmap.Charmap
+		expected  string
+	}{
+		{"Бесы", charmap.KOI8R, charmap.Windows1251, "KOI8-R"},
+		{"Бесы", charmap.Windows1251, charmap.KOI8R, "windows-1251"},
+		{"Обломов.fb2", charmap.KOI8R, charmap.Windows1251, "KOI8-R"},
+		{"ВОЙНА И МИР.fb2", charmap.KOI8R, charmap.Windows1251, "KOI8-R"},
+		{"ВОЙНА И МИР.fb2", charmap.Windows1251, charmap.KOI8R, "windows-1251"},
+		{"Чехов - Рассказы.fb2", charmap.Windows1251, charmap.KOI8R, "windows-1251"},
+		{"Na stole byla káva a vedle ní malý košík s ovocem, který tam nechala babička.", charmap.Windows1250, charmap.Windows1252, "windows-1250"},
+		{"Mäso bolo dobré a víno tiež, povedal starý pán pri stole.", charmap.Windows1250, charmap.Windows1252, "windows-1250"},
+		{"Después de la canción, el público salió del salón sin decir más.", charmap.Windows1252, charmap.Windows1250, "windows-1252"},
+		{"Über den Hügeln stand schon der Mond, und die Vögel schwiegen.", charmap.Windows1252, charmap.Windows1250, "windows-1252"},
+	} {
+		data, err := tc.cm.NewEncoder().Bytes([]byte(tc.text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range data {
+			if r := tc.rival.DecodeByte(b); !unicode.IsLetter(r) && !unicode.IsSpace(r) && !unicode.IsPunct(r) && !unicode.IsDigit(r) {
+				t.Errorf("%.20q: not a close call, %q is not text in rival code page", tc.text, r)
+				break
+			}
+		}
+		res := Detect(data)
+		if res == nil {
+			t.Errorf("%s: encoding not detected for %.20q", tc.expected, tc.text)
+			continue
+		}
+		if res.Name != tc.expected {
+			t.Errorf("%s: detected %s (%.2f) for %.20q", tc.expected, res.Name, res.Confidence, tc.text)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+//go:build ignore
+
+// gen_models builds letter pairs frequency tables for chardet from gettext catalogs of installed programs - translated
+// messages are plenty of real text in every language we care about:
+//
+//	go run gen_models.go -locale /usr/share/locale -out models.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// languages lists model names and locale directories to take text from.
+var languages = []struct {
+	name    string
+	locales []string
+}{
+	{"russian", []string{"ru"}},
+	{"french", []string{"fr"}},
+	{"german", []string{"de"}},
+	{"spanish", []string{"es"}},
+	{"italian", []string{"it"}},
+	{"portuguese", []string{"pt", "pt_BR"}},
+	{"dutch", []string{"nl"}},
+	{"swedish", []string{"sv"}},
+	{"danish", []string{"da"}},
+	{"czech", []string{"cs"}},
+	{"slovak", []string{"sk"}},
+	{"polish", []string{"pl"}},
+	{"hungarian", []string{"hu"}},
+	{"slovenian", []string{"sl"}},
+	{"croatian", []string{"hr"}},
+}
+
+const (
+	// share of pairs occurrences table should cover, the rest is noise: foreign words, typos and symbols
+	coverage = 0.995
+	// pairs seen less often are never kept
+	minCount = 3
+	// pairs per line of generated table
+	lineSize = 25
+)
+
+// classify must match classify in chardet.go.
+func classify(r rune) rune {
+	switch {
+	case unicode.IsLetter(r):
+		return unicode.ToLower(r)
+	case unicode.IsSpace(r), unicode.IsPunct(r), unicode.IsDigit(r), r < utf8.RuneSelf:
+		return ' '
+	}
+	return utf8.RuneError
+}
+
+// readCatalog returns translated messages of UTF-8 encoded gettext catalog.
+func readCatalog(fname string) ([]string, error) {
+
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 28 {
+		return nil, fmt.Errorf("%s: too short", fname)
+	}
+	var order binary.ByteOrder
+	switch binary.LittleEndian.Uint32(data) {
+	case 0x950412de:
+		order = binary.LittleEndian
+	case 0xde120495:
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("%s: not a gettext catalog", fname)
+	}
+	count, table := order.Uint32(data[8:]), order.Uint32(data[16:])
+
+	var res []string
+	for i := uint32(0); i < count; i++ {
+		pos := table + i*8
+		if int(pos)+8 > len(data) {
+			return nil, fmt.Errorf("%s: broken table", fname)
+		}
+		size, off := order.Uint32(data[pos:]), order.Uint32(data[pos+4:])
+		if int(off)+int(size) > len(data) {
+			return nil, fmt.Errorf("%s: broken message", fname)
+		}
+		msg := string(data[off : off+size])
+		if i == 0 && strings.Contains(msg, "Content-Type:") {
+			if !strings.Contains(strings.ToLower(msg), "charset=utf-8") {
+				return nil, nil
+			}
+			continue
+		}
+		// plural forms are separated by zero
+		res = append(res, strings.Split(msg, "\x00")...)
+	}
+	return res, nil
+}
+
+// countPairs counts pairs of classified characters with at least one non-ASCII letter.
+func countPairs(texts []string, counts map[[2]rune]int) {
+	for _, text := range texts {
+		if !utf8.ValidString(text) {
+			continue
+		}
+		prev := ' '
+		for _, r := range text + " " {
+			cur := classify(r)
+			if (prev >= utf8.RuneSelf || cur >= utf8.RuneSelf) && prev != utf8.RuneError && cur != utf8.RuneError {
+				counts[[2]rune{prev, cur}]++
+			}
+			prev = cur
+		}
+	}
+}
+
+func main() {
+
+	dir := flag.String("locale", "/usr/share/locale", "directory with gettext catalogs")
+	out := flag.String("out", "models.go", "name of generated file")
+	flag.Parse()
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by gen_models.go; DO NOT EDIT.\n\npackage chardet\n")
+	for _, lang := range languages {
+		var (
+			catalogs, size int
+			counts         = make(map[[2]rune]int)
+		)
+		for _, locale := range lang.locales {
+			names, err := filepath.Glob(filepath.Join(*dir, locale, "LC_MESSAGES", "*.mo"))
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, name := range names {
+				// names of countries, languages and currencies are mostly transliterated
+				if strings.HasPrefix(filepath.Base(name), "iso_") {
+					continue
+				}
+				texts, err := readCatalog(name)
+				if err != nil {
+					log.Fatal(err)
+				}
+				if len(texts) == 0 {
+					continue
+				}
+				catalogs++
+				for _, t := range texts {
+					size += len(t)
+				}
+				countPairs(texts, counts)
+			}
+		}
+		if catalogs == 0 {
+			log.Fatalf("%s: no catalogs found", lang.name)
+		}
+
+		pairs := make([][2]rune, 0, len(counts))
+		var total int
+		for p, n := range counts {
+			pairs = append(pairs, p)
+			total += n
+		}
+		sort.Slice(pairs, func(i, j int) bool {
+			if counts[pairs[i]] != counts[pairs[j]] {
+				return counts[pairs[i]] > counts[pairs[j]]
+			}
+			return string(pairs[i][:]) < string(pairs[j][:])
+		})
+		var covered int
+		for i, p := range pairs {
+			if float64(covered) >= coverage*float64(total) || counts[p] < minCount {
+				pairs = pairs[:i]
+				break
+			}
+			covered += counts[p]
+		}
+
+		fmt.Fprintf(&buf, "\n// %sPairs lists %d most frequent pairs of letters with non-ASCII ones, ordered by frequency, space marks\n", lang.name, len(pairs))
+		fmt.Fprintf(&buf, "// word boundary. Built from %d gettext catalogs (%d KiB of text), it covers %.1f%% of such pairs found there.\n", catalogs, size/1024, 100*float64(covered)/float64(total))
+		fmt.Fprintf(&buf, "const %sPairs = \"\" +\n", lang.name)
+		var line strings.Builder
+		for i, p := range pairs {
+			line.WriteString(string(p[:]) + "|")
+			switch {
+			case i == len(pairs)-1:
+				fmt.Fprintf(&buf, "\t%q\n", line.String())
+			case (i+1)%lineSize == 0:
+				fmt.Fprintf(&buf, "\t%q +\n", line.String())
+				line.Reset()
+			}
+		}
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*out, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 
 	"github.com/pkg/profile"
 	"github.com/urfave/cli/v2"
@@ -207,11 +208,14 @@ func main() {
 			Before: wrap.beforeCommandRun,
 			After:  wrap.afterCommandRun,
 			Flags: []cli.Flag{
-				&cli.StringFlag{Name: "to", Value: "epub", Usage: "conversion output `TYPE` (supported types: epub, kepub, azw3, mobi)"},
+				&cli.StringFlag{Name: "to", Value: "epub", Usage: "conversion output `TYPE`, comma separated list for several outputs (supported types: epub, kepub, azw3, mobi, txt, md, html, pdf, docx, odt)"},
+				&cli.StringSliceFlag{Name: "profile", Usage: "convert for device `PROFILE` from configuration (could be repeated)"},
 				&cli.BoolFlag{Name: "nodirs", Usage: "when producing output do not keep input directory structure"},
-				&cli.BoolFlag{Name: "stk", Usage: "send converted file to kindle (epub only)"},
+				&cli.BoolFlag{Name: "stk", Usage: "send converted file to kindle (epub, azw3 or mobi)"},
 				&cli.BoolFlag{Name: "ow", Usage: "continue even if destination exits, overwrite files"},
-				&cli.StringFlag{Name: "force-zip-cp", Usage: "Force `ENCODING` for ALL file names in archives (see IANA.org for character set names)"},
+				&cli.BoolFlag{Name: "dry-run", Usage: "do not convert anything, print where every book would be stored"},
+				&cli.StringFlag{Name: "bundle-by", Usage: "when DESTINATION is an archive produce separate archive for every `KEY` (author or series)"},
+				&cli.StringFlag{Name: "force-zip-cp", Usage: "Force `ENCODING` for ALL non UTF-8 file names in archives instead of detecting it (see IANA.org for character set names)"},
 			},
 			ArgsUsage: "SOURCE [DESTINATION]",
 			CustomHelpTemplate: fmt.Sprintf(`%sSOURCE:
@@ -221,11 +225,154 @@ func main() {
         path to archive with path inside archive to a particular fb2 file: [path]archive.zip[archive path]/file.fb2
         path to archive with path inside archive: [path]archive.zip[archive path] - recursively process all fb2 files under archive path
 
-    When working on archive recursively only fb2 files will be considered, processing of archives inside archives is not supported.
+    Supported archives are zip, tar (plain, gz, bz2 or xz compressed), 7z (copy, LZMA, LZMA2, Deflate or BZip2 methods) and
+    single compressed fb2 files (fb2.gz, fb2.bz2, fb2.xz). When working on archive recursively only fb2 files will be
+    considered, archives inside archives are processed transparently, their path becomes part of the archive path.
+
+    Encoding of books without BOM and XML encoding declaration is detected when they are not UTF-8 (Cyrillic windows-1251,
+    KOI8-R, IBM866 and Latin windows-1252, windows-1250 are recognized). The same is done for non UTF-8 file names in
+    archives unless --force-zip-cp is specified.
+
+    Manuscripts in docx, odt and html are imported into FB2 first: paragraph styles (Title, Heading N, Epigraph, Cite,
+    Verse, Text Author...) and html headings become sections, titles, epigraphs, citations and poems, footnotes go to
+    notes body and document properties to book description. Author names in properties are read in "author_format" order.
 
 DESTINATION:
     always a path, output file name(s) and extension will be derived from other parameters
     if absent - current working directory
+    when output file already exists it is handled according to "file_name_collision" configuration setting unless
+    "--ow" is specified, "--dry-run" prints planned "source -> destination" mapping without converting books
+    path to archive (zip, tar, tar.gz or tgz) - converted books are streamed into archive keeping directory layout, with
+    "--bundle-by author" or "--bundle-by series" books are split between archives named "DESTINATION - KEY.zip" (books
+    without series stay in DESTINATION), "--ow" allows replacing existing archives
+
+TYPE:
+    when several output types are requested (ex: "--to epub,kepub,azw3") book is parsed and processed once, only format
+    specific steps are performed for every output
+    txt and md produce plain text and Markdown without images, see [document.text] configuration section
+    html produces single file with everything embedded or directory with page per chapter, see [document.html]
+    configuration section
+    pdf is typeset directly with bundled or configured fonts, see [document.pdf] configuration section
+    docx and odt map book structure to named paragraph and character styles, notes become footnotes
+
+PROFILE:
+    name of device profile from "profiles" section of configuration, profile specifies output format and document
+    settings overwriting configured ones (built-in profiles: kindle-paperwhite, kobo-libra, pocketbook)
+    every book is parsed once and converted for all requested profiles, when "--to" is specified explicitly
+    book is converted to this format too, with more than one output results for each profile are placed into
+    subdirectory of DESTINATION named after the profile
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "watch",
+			Usage:  "Watches directory and converts FB2 file(s) as they arrive",
+			Action: commands.Watch,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "to", Value: "epub", Usage: "conversion output `TYPE`, comma separated list for several outputs (supported types: epub, kepub, azw3, mobi, txt, md, html, pdf, docx, odt)"},
+				&cli.BoolFlag{Name: "nodirs", Usage: "when producing output do not keep input directory structure"},
+				&cli.DurationFlag{Name: "delay", Value: 3 * time.Second, Usage: "wait for `DURATION` after last change to the file before converting it"},
+				&cli.StringFlag{Name: "status", Usage: "keep log of recent activity (JSON lines) in `FILE`"},
+			},
+			ArgsUsage: "SOURCE [DESTINATION]",
+			CustomHelpTemplate: fmt.Sprintf(`%s
+SOURCE:
+	path to existing directory to watch (recursively), fb2 files, archives with fb2 files and documents which could be
+	imported (docx, odt, html) will be converted when created or modified, one at a time
+
+DESTINATION:
+	always a path, output file name(s) and extension will be derived from other parameters
+	if absent - current working directory
+
+Runs until interrupted. Existing results are always overwritten. When configuration file(s) change, configuration is reloaded
+without restart (logging settings excluded).
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "serve",
+			Usage:  "Runs HTTP conversion service",
+			Action: commands.Serve,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "listen", Value: "localhost:8080", Usage: "listen on `ADDRESS`"},
+				&cli.IntFlag{Name: "max-jobs", Value: runtime.NumCPU(), Usage: "maximum `NUMBER` of simultaneous conversions"},
+				&cli.IntFlag{Name: "max-queue", Value: 100, Usage: "maximum `NUMBER` of asynchronous conversions waiting to be started"},
+				&cli.Int64Flag{Name: "max-size", Value: 50, Usage: "maximum upload `SIZE` in megabytes"},
+				&cli.DurationFlag{Name: "keep", Value: time.Hour, Usage: "keep results of asynchronous conversions for `DURATION`"},
+				&cli.StringFlag{Name: "workdir", Usage: "keep uploads and results in `DIRECTORY` (default: system temporary directory)"},
+			},
+			CustomHelpTemplate: fmt.Sprintf(`%s
+ENDPOINTS:
+	GET    /health              service status
+	POST   /convert             convert book, returns converted file or job description when "async=true"
+	POST   /meta                returns book meta information (JSON)
+	GET    /jobs/ID             asynchronous job status
+	GET    /jobs/ID/result      asynchronous job result
+	DELETE /jobs/ID             remove finished job and its result
+
+	Book (fb2 or archive with fb2 files) is sent either as multipart form field "file" or as request body with file name
+	in "name" query parameter. Other parameters (form fields or query parameters): "to" - output format (epub, kepub, azw3,
+	mobi), "config" - JSON to be merged on top of the active configuration (only "document" presentation settings, anything
+	referring to files or programs on server is rejected), "async" - do not wait for conversion to finish.
+	Asynchronous conversions are queued, when queue is full request is rejected with 503. Jobs nobody requested for
+	"--keep" duration are removed with their results, including jobs still waiting in the queue.
+	When more than one book is produced results are returned as zip archive.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "opds",
+			Usage:  "Runs OPDS catalog server for converted library",
+			Action: commands.Opds,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "listen", Value: "localhost:8080", Usage: "listen on `ADDRESS`"},
+				&cli.StringFlag{Name: "source", Usage: "`DIRECTORY` with original fb2 files to be offered with on the fly conversion"},
+				&cli.StringFlag{Name: "formats", Value: "epub,kepub,azw3", Usage: "comma separated `LIST` of formats source books could be converted to"},
+				&cli.StringFlag{Name: "cache", Usage: "keep converted books and covers in `DIRECTORY` (default: temporary directory, removed on exit)"},
+				&cli.StringFlag{Name: "title", Value: "fb2converter library", Usage: "catalog `TITLE`"},
+				&cli.DurationFlag{Name: "rescan", Value: 10 * time.Minute, Usage: "rescan library every `DURATION`"},
+			},
+			ArgsUsage: "LIBRARY",
+			CustomHelpTemplate: fmt.Sprintf(`%s
+LIBRARY:
+	path to directory with converted books (epub, kepub, azw3, mobi)
+
+Serves OPDS 1.2 catalog at /opds with navigation by author, series, genre and language and search. Books in library and
+source directories are matched by relative path and name, meta information is taken from epub OPF, fb2 description or
+mobi EXTH records.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "dedupe",
+			Usage:  "Finds different versions of the same book in FB2 library",
+			Action: commands.Dedupe,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.Float64Flag{Name: "similarity", Value: 0.7, Usage: "minimal estimated `SHARE` of common text for books to be considered versions of the same book"},
+				&cli.StringFlag{Name: "report", Usage: "write report to `FILE` instead of STDOUT"},
+				&cli.BoolFlag{Name: "json", Usage: "produce report in JSON"},
+				&cli.StringFlag{Name: "to", Usage: "convert the best version of every book to `TYPE`, comma separated list for several outputs"},
+				&cli.StringFlag{Name: "dest", Usage: "put converted books into `DIRECTORY` (default: current working directory)"},
+				&cli.BoolFlag{Name: "nodirs", Usage: "when producing output do not keep input directory structure"},
+				&cli.BoolFlag{Name: "ow", Usage: "overwrite existing report and converted files"},
+			},
+			ArgsUsage: "SOURCE [SOURCE...]",
+			CustomHelpTemplate: fmt.Sprintf(`%s
+SOURCE:
+	path to fb2 file, directory, archive or INPX index - directories and archives are processed recursively, archives
+	listed in INPX index found in directory are processed according to the index (books marked as deleted are skipped)
+
+Books are fingerprinted by title, authors and MinHash signature of the main text. Books are versions of the same book
+when their texts are similar enough or when they have the same title, authors and language and share at least half of
+required similarity (or one of them has no text). Versions are ranked by document-info version and date, file size and
+number of images.
+
+Report lists books with more than one version, the best version is marked with "*". With "--to" the best version of every
+book is converted (report is written only when "--report" is specified).
 `, cli.CommandHelpTemplate),
 		},
 		{
@@ -238,6 +385,10 @@ DESTINATION:
 				&cli.IntFlag{Name: "width", Value: 330, Usage: "width of the resulting thumbnail (default: 330)"},
 				&cli.IntFlag{Name: "height", Value: 470, Usage: "height of the resulting thumbnail (default: 470)"},
 				&cli.BoolFlag{Name: "stretch", Usage: "do not preserve thumbnail aspect ratio when resizing"},
+				&cli.StringFlag{Name: "model", Value: "auto", Usage: "Kindle `MODEL` to produce thumbnails for: auto, kindle, colorsoft, scribe"},
+				&cli.BoolFlag{Name: "fix-meta", Usage: "change books Kindle would not show thumbnails for (cdetype, ASIN)"},
+				&cli.BoolFlag{Name: "cleanup", Usage: "remove thumbnails of sideloaded books which are no longer on device"},
+				&cli.BoolFlag{Name: "dry-run", Usage: "with --cleanup only report thumbnails which would be removed"},
 			},
 			ArgsUsage: "SOURCE",
 			CustomHelpTemplate: fmt.Sprintf(`%s
@@ -245,6 +396,39 @@ SOURCE:
 	full path to file/directory on mounted device
 
 Synchronizes kindle thumbnails with books already in Kindle memory so Kindle home page looks better.
+
+Thumbnail size is selected by Kindle model, "auto" detects model by thumbnails already on device. Explicitly
+specified width and height take precedence.
+
+Kindle only shows thumbnails for sideloaded books marked as EBOK which have ASIN. With --fix-meta such books are
+changed in place (encrypted books are never touched), otherwise they are reported.
+
+With --cleanup thumbnails of sideloaded books (EBOK with ASIN not from Amazon store) which do not belong to any book
+on device are removed, thumbnails of store books and personal documents are left to Kindle. Cleanup is skipped if
+device has books in KFX format, --dry-run only reports thumbnails which would be removed.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "train-sentences",
+			Usage:  "Builds sentences tokenizer training data from FB2 books",
+			Action: commands.TrainSentences,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "lang", Usage: "use only books in `LANGUAGE` (default: language of the first suitable book)"},
+				&cli.BoolFlag{Name: "ow", Usage: "overwrite destination file if it exists"},
+			},
+			ArgsUsage: "SOURCE [DESTINATION]",
+			CustomHelpTemplate: fmt.Sprintf(`%s
+SOURCE:
+	path to fb2 file, directory or archive - directories and archives are processed recursively
+
+DESTINATION:
+	file name to write training data to (JSON, gzip compressed if name ends with .gz)
+	if absent - "<language name>.json" in current working directory
+
+Produces NLTK punkt compatible training data for sentences segmentation (used when producing kepub). Put resulting file into
+directory specified by document.sentences.path configuration setting for it to be used.
 `, cli.CommandHelpTemplate),
 		},
 		{
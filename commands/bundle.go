@@ -0,0 +1,253 @@
+package commands
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/processor"
+)
+
+// bundleExtensions lists supported destination archives, longer ones first.
+var bundleExtensions = []string{".tar.gz", ".tgz", ".tar", ".zip"}
+
+// bundleKeywords maps values of "--bundle-by" to file name keywords used to name archives.
+var bundleKeywords = map[string]string{
+	"author": "#author",
+	"series": "#series",
+}
+
+// bundleExt returns extension of supported destination archive or empty string.
+func bundleExt(dst string) string {
+	ldst := strings.ToLower(dst)
+	for _, ext := range bundleExtensions {
+		if strings.HasSuffix(ldst, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// bundle streams converted books into archives instead of leaving them in destination directory. Books are produced
+// one by one in temporary directory, layout of this directory becomes layout of the archive.
+type bundle struct {
+	path      string
+	ext       string
+	keyword   string
+	overwrite bool
+	tmp       string
+	names     map[string]map[string]bool
+	archives  map[string]*bundleArchive
+	log       *zap.Logger
+}
+
+// bundleArchive is a single destination archive being written.
+type bundleArchive struct {
+	file    *os.File
+	gw      *gzip.Writer
+	tw      *tar.Writer
+	zw      *zip.Writer
+	entries map[string]bool
+}
+
+// newBundle prepares writing results to archive dst. When by is not empty there will be separate archive for every
+// author or series, named after destination archive.
+func newBundle(dst, by string, overwrite bool, log *zap.Logger) (*bundle, error) {
+
+	b := &bundle{
+		path:      dst,
+		ext:       bundleExt(dst),
+		overwrite: overwrite,
+		names:     make(map[string]map[string]bool),
+		archives:  make(map[string]*bundleArchive),
+		log:       log,
+	}
+	if len(b.ext) == 0 {
+		return nil, fmt.Errorf("unsupported destination archive %s, expecting one of %s", dst, strings.Join(bundleExtensions, ", "))
+	}
+	if len(by) > 0 {
+		var ok bool
+		if b.keyword, ok = bundleKeywords[strings.ToLower(by)]; !ok {
+			return nil, fmt.Errorf("unable to split archives by %q, expecting author or series", by)
+		}
+	}
+	if !overwrite && len(b.keyword) == 0 {
+		if _, err := os.Stat(dst); err == nil {
+			return nil, fmt.Errorf("destination archive already exists: %s", dst)
+		}
+	}
+
+	var err error
+	if b.tmp, err = os.MkdirTemp("", "fb2c-bundle-"); err != nil {
+		return nil, fmt.Errorf("unable to create temporary directory: %w", err)
+	}
+	return b, nil
+}
+
+// locate returns path of the archive and name of the entry in it for the book produced as fname.
+func (b *bundle) locate(p *processor.Processor, fname string) (string, string, error) {
+
+	entry, err := filepath.Rel(b.tmp, fname)
+	if err != nil {
+		return "", "", err
+	}
+	return b.archive(p), filepath.ToSlash(entry), nil
+}
+
+// archive returns path of the archive book belongs to.
+func (b *bundle) archive(p *processor.Processor) string {
+	if len(b.keyword) > 0 {
+		if key := strings.TrimSpace(p.FileNameKeyword(b.keyword)); len(key) > 0 {
+			return b.path[:len(b.path)-len(b.ext)] + " - " + config.CleanFileName(key) + b.ext
+		}
+	}
+	return b.path
+}
+
+// reserved returns names already taken in the archive book belongs to, so books stored in different archives do not
+// get renamed because of each other.
+func (b *bundle) reserved(p *processor.Processor) map[string]bool {
+	arc := b.archive(p)
+	names, ok := b.names[arc]
+	if !ok {
+		names = make(map[string]bool)
+		b.names[arc] = names
+	}
+	return names
+}
+
+// add moves produced book into proper archive, returning its location. Book could be a directory (html site), then
+// all its files are added.
+func (b *bundle) add(p *processor.Processor, fname string) (string, error) {
+
+	arc, entry, err := b.locate(p, fname)
+	if err != nil {
+		return "", err
+	}
+	a, err := b.open(arc)
+	if err != nil {
+		return "", err
+	}
+
+	err = filepath.Walk(fname, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(b.tmp, name)
+		if err != nil {
+			return err
+		}
+		return b.write(a, arc, filepath.ToSlash(rel), name, info)
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := os.RemoveAll(fname); err != nil {
+		return "", err
+	}
+	return filepath.Join(arc, entry), nil
+}
+
+// write stores single file as archive entry.
+func (b *bundle) write(a *bundleArchive, arc, entry, name string, info os.FileInfo) error {
+
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if a.entries[entry] {
+		b.log.Warn("Duplicate entry in destination archive", zap.String("archive", arc), zap.String("entry", entry))
+	}
+	a.entries[entry] = true
+
+	var w io.Writer
+	if a.zw != nil {
+		h, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		h.Name, h.Method = entry, zip.Deflate
+		if w, err = a.zw.CreateHeader(h); err != nil {
+			return err
+		}
+	} else {
+		h, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		h.Name = entry
+		if err := a.tw.WriteHeader(h); err != nil {
+			return err
+		}
+		w = a.tw
+	}
+	if _, err := io.Copy(w, file); err != nil {
+		return fmt.Errorf("unable to write %s to archive %s: %w", entry, arc, err)
+	}
+	return nil
+}
+
+// open returns destination archive creating it when necessary.
+func (b *bundle) open(arc string) (*bundleArchive, error) {
+
+	if a, ok := b.archives[arc]; ok {
+		return a, nil
+	}
+	if _, err := os.Stat(arc); err == nil {
+		if !b.overwrite {
+			return nil, fmt.Errorf("destination archive already exists: %s", arc)
+		}
+		b.log.Warn("Overwriting existing archive", zap.String("archive", arc))
+	}
+	if err := os.MkdirAll(filepath.Dir(arc), 0700); err != nil {
+		return nil, fmt.Errorf("unable to create output directory: %w", err)
+	}
+	file, err := os.Create(arc)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &bundleArchive{file: file, entries: make(map[string]bool)}
+	switch b.ext {
+	case ".zip":
+		a.zw = zip.NewWriter(file)
+	case ".tar":
+		a.tw = tar.NewWriter(file)
+	default:
+		a.gw = gzip.NewWriter(file)
+		a.tw = tar.NewWriter(a.gw)
+	}
+	b.archives[arc] = a
+	return a, nil
+}
+
+// close finishes all archives and removes temporary directory.
+func (b *bundle) close() error {
+
+	var errs []error
+	for arc, a := range b.archives {
+		if a.zw != nil {
+			errs = append(errs, a.zw.Close())
+		} else {
+			errs = append(errs, a.tw.Close())
+		}
+		if a.gw != nil {
+			errs = append(errs, a.gw.Close())
+		}
+		errs = append(errs, a.file.Close())
+		b.log.Debug("Destination archive completed", zap.String("archive", arc), zap.Int("books", len(a.entries)))
+	}
+	errs = append(errs, os.RemoveAll(b.tmp))
+	return errors.Join(errs...)
+}
@@ -2,7 +2,6 @@
 package commands
 
 import (
-	"archive/zip"
 	"errors"
 	"fmt"
 	"io"
@@ -19,51 +18,220 @@ import (
 	"golang.org/x/text/encoding/ianaindex"
 
 	"fb2converter/archive"
+	"fb2converter/chardet"
 	"fb2converter/config"
+	"fb2converter/etree"
+	"fb2converter/importer"
 	"fb2converter/processor"
 	"fb2converter/state"
 )
 
+// target describes single conversion result: output format, destination and environment with configuration (possibly
+// modified by device profile) to be used.
+type target struct {
+	profile string
+	format  processor.OutputFmt
+	dst     string
+	stk     bool
+	env     *state.LocalEnv
+	// planned collects output names on dry run, nothing is converted when it is set
+	planned map[string]bool
+	// bundle receives results when destination is an archive
+	bundle *bundle
+}
+
 // processBook processes single FB2 file. "src" is part of the source path (always including file name) relative to the original
 // path. When actual file was specified it will be just base file name without a path. When looking inside archive or directory
 // it will be relative path inside archive or directory (including base file name).
 func processBook(r io.Reader, enc srcEncoding, src, dst string, nodirs, stk, overwrite bool, format processor.OutputFmt, env *state.LocalEnv) error {
+	return processTargets(r, enc, src, nodirs, overwrite, []target{{format: format, dst: dst, stk: stk, env: env}}, env)
+}
+
+// processTargets parses single FB2 file (or imports document) once and converts it for every target.
+func processTargets(r io.Reader, enc srcEncoding, src string, nodirs, overwrite bool, targets []target, env *state.LocalEnv) error {
+
+	doc, err := parseBook(r, enc, src, env)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for len(targets) > 0 {
+		// targets sharing environment are produced together
+		n := 1
+		for n < len(targets) && targets[n].env == targets[0].env {
+			n++
+		}
+		if err := convertDocument(doc, src, nodirs, overwrite, targets[:n]); err != nil {
+			if len(targets[0].profile) > 0 {
+				err = fmt.Errorf("profile %s: %w", targets[0].profile, err)
+			}
+			errs = append(errs, err)
+		}
+		targets = targets[n:]
+	}
+	return errors.Join(errs...)
+}
 
-	var fname, id string
+// convertDocument produces targets sharing the same environment out of parsed FB2 document. Format independent
+// processing is done only once, every target gets its own copy of the results to finish.
+func convertDocument(doc *etree.Document, src string, nodirs, overwrite bool, targets []target) error {
 
-	env.Log.Info("Conversion starting", zap.String("from", src))
+	var (
+		fnames []string
+		id     string
+	)
+
+	env := targets[0].env
+	fields := []zap.Field{zap.String("from", src)}
+	if len(targets[0].profile) > 0 {
+		fields = append(fields, zap.String("profile", targets[0].profile))
+	}
+
+	env.Log.Info("Conversion starting", fields...)
 	defer func(start time.Time) {
 		if r := recover(); r != nil {
-			env.Log.Error("Conversion ended with panic", zap.Any("panic", r), zap.Duration("elapsed", time.Since(start)), zap.String("to", fname), zap.ByteString("stack", debug.Stack()))
+			env.Log.Error("Conversion ended with panic", zap.Any("panic", r), zap.Duration("elapsed", time.Since(start)), zap.Strings("to", fnames), zap.ByteString("stack", debug.Stack()))
 		} else {
-			env.Log.Info("Conversion completed", zap.Duration("elapsed", time.Since(start)), zap.String("to", fname), zap.String("ref_id", id))
+			env.Log.Info("Conversion completed", zap.Duration("elapsed", time.Since(start)), zap.Strings("to", fnames), zap.String("ref_id", id))
 		}
 	}(time.Now())
 
-	p, err := processor.NewFB2(selectReader(r, enc), enc == encUnknown, src, dst, nodirs, stk, overwrite, format, env)
+	base := targets[0]
+	if len(targets) > 1 {
+		// shared processor is never finalized, so its format does not matter - every target is produced by its fork
+		base.format, base.stk = processor.OEpub, false
+	}
+	p, err := processor.NewFB2Document(doc, src, base.dst, nodirs, base.stk, overwrite, base.format, env)
 	if err != nil {
 		return err
 	}
 	id = p.Book.ID.String() // store for reference in the log
 
-	if err = p.Process(); err != nil {
+	if base.planned != nil {
+		fnames, err = planDocument(p, src, targets)
 		return err
 	}
-	if fname, err = p.Save(); err != nil {
+
+	if len(targets) == 1 {
+		fname, err := finishTarget(p, id, base.bundle, env)
+		if len(fname) > 0 {
+			fnames = append(fnames, fname)
+		}
 		return err
 	}
 
+	if err := p.Prepare(); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, t := range targets {
+		q, err := p.Fork(t.format, t.dst, t.stk)
+		if err == nil {
+			var fname string
+			fname, err = finishTarget(q, id, t.bundle, env)
+			if len(fname) > 0 {
+				fnames = append(fnames, fname)
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", t.format, err))
+		}
+	}
+	if err := p.Clean(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// planDocument prints where targets would be stored without converting anything.
+func planDocument(p *processor.Processor, src string, targets []target) ([]string, error) {
+
+	if err := p.ProcessDescription(); err != nil {
+		return nil, err
+	}
+	var fnames []string
+	for _, t := range targets {
+		fname, err := p.OutputName(t.format, t.dst, t.planned)
+		switch {
+		case err != nil:
+			fmt.Printf("%s -> %v\n", src, err)
+		case len(fname) == 0:
+			fmt.Printf("%s -> skipped, output file already exists\n", src)
+		default:
+			if t.bundle != nil {
+				arc, entry, err := t.bundle.locate(p, fname)
+				if err != nil {
+					return fnames, err
+				}
+				fname = filepath.Join(arc, entry)
+			}
+			fmt.Printf("%s -> %s\n", src, fname)
+			fnames = append(fnames, fname)
+		}
+	}
+	return fnames, p.Clean()
+}
+
+// finishTarget performs format specific processing, stores results and cleans up. When bundle is not nil results are
+// moved there.
+func finishTarget(p *processor.Processor, id string, b *bundle, env *state.LocalEnv) (string, error) {
+
+	if err := p.Process(); err != nil {
+		return "", err
+	}
+	if b != nil {
+		p.Reserve(b.reserved(p))
+	}
+	fname, err := p.Save()
+	if err != nil {
+		return "", err
+	}
+	if len(fname) == 0 {
+		// book was skipped
+		return "", p.Clean()
+	}
+
 	// store convertion result
 	env.Rpt.Store(fmt.Sprintf("fb2c-%s/%s", id, filepath.Base(fname)), fname)
 
 	if err = p.SendToKindle(fname); err != nil {
-		return err
+		return fname, err
 	}
-	return p.Clean()
+	if b != nil {
+		if fname, err = b.add(p, fname); err != nil {
+			return "", errors.Join(err, p.Clean())
+		}
+	}
+	return fname, p.Clean()
+}
+
+// parseBook reads FB2 book, documents of other supported formats are imported.
+func parseBook(r io.Reader, enc srcEncoding, src string, env *state.LocalEnv) (*etree.Document, error) {
+
+	if isImportFile(src) {
+		// relative references in HTML could be resolved for files on disk only
+		var dir string
+		if f, ok := r.(*os.File); ok {
+			dir = filepath.Dir(f.Name())
+		}
+		env.Log.Debug("Importing document", zap.String("file", src))
+		return importer.Import(r, src, dir, env.Cfg.Doc.AuthorFormat, env.Log)
+	}
+
+	r, detected, err := bookReader(r, enc)
+	if err != nil {
+		return nil, err
+	}
+	if detected != nil {
+		env.Log.Info("Legacy encoding detected", zap.String("file", src), zap.String("charset", detected.Name), zap.Float64("confidence", detected.Confidence))
+	}
+	return processor.ParseFB2(r, enc == encUnknown)
 }
 
 // processDir walks directory tree finding fb2 files and processes them.
-func processDir(dir string, format processor.OutputFmt, nodirs, stk, overwrite bool, cpage encoding.Encoding, dst string, env *state.LocalEnv) (err error) {
+func processDir(dir string, targets []target, nodirs, overwrite bool, cpage encoding.Encoding, env *state.LocalEnv) (err error) {
 
 	count := 0
 	defer func() {
@@ -81,21 +249,21 @@ func processDir(dir string, format processor.OutputFmt, nodirs, stk, overwrite b
 				// checking format - but cannot open target file
 				env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
 			} else if ok {
-				if err := processArchive(path, "", filepath.Dir(strings.TrimPrefix(path, dir)), format, nodirs, stk, overwrite, cpage, dst, env); err != nil {
+				if err := processArchive(path, "", filepath.Dir(strings.TrimPrefix(path, dir)), targets, nodirs, overwrite, cpage, env); err != nil {
 					env.Log.Error("Unable to process archive", zap.String("file", path), zap.Error(err))
 				}
 			} else if ok, enc, err = isBookFile(path); err != nil {
 				env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
-			} else if ok {
+			} else if ok || isImportFile(path) {
 				count++
 				// encoding will be handled properly by processBook
 				if file, err := os.Open(path); err != nil {
 					env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
 				} else {
 					defer file.Close()
-					if err := processBook(file, enc,
-						strings.TrimPrefix(strings.TrimPrefix(path, dir), string(filepath.Separator)), dst,
-						nodirs, stk, overwrite, format, env); err != nil {
+					if err := processTargets(file, enc,
+						strings.TrimPrefix(strings.TrimPrefix(path, dir), string(filepath.Separator)),
+						nodirs, overwrite, targets, env); err != nil {
 
 						env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
 					}
@@ -110,7 +278,7 @@ func processDir(dir string, format processor.OutputFmt, nodirs, stk, overwrite b
 }
 
 // processArchive walks all files inside archive, finds fb2 files under "pathIn" and processes them.
-func processArchive(path, pathIn, pathOut string, format processor.OutputFmt, nodirs, stk, overwrite bool, cpage encoding.Encoding, dst string, env *state.LocalEnv) (err error) {
+func processArchive(path, pathIn, pathOut string, targets []target, nodirs, overwrite bool, cpage encoding.Encoding, env *state.LocalEnv) (err error) {
 
 	count := 0
 	defer func() {
@@ -119,24 +287,24 @@ func processArchive(path, pathIn, pathOut string, format processor.OutputFmt, no
 		}
 	}()
 
-	err = archive.Walk(path, pathIn, func(archive string, f *zip.File) error {
+	err = archive.Walk(path, pathIn, func(archive string, f archive.File) error {
 		if ok, enc, err := isBookInArchive(f); err != nil {
 			env.Log.Warn("Skipping file in archive",
 				zap.String("archive", archive),
-				zap.String("path", f.FileHeader.Name),
+				zap.String("path", f.Name()),
 				zap.Error(err))
-		} else if ok {
+		} else if ok || isImportFile(f.Name()) {
 			count++
 			// encoding will be handled properly by processBook
 			if r, err := f.Open(); err != nil {
 				env.Log.Error("Unable to process file in archive",
 					zap.String("archive", archive),
-					zap.String("file", f.FileHeader.Name),
+					zap.String("file", f.Name()),
 					zap.Error(err))
 			} else {
 				defer r.Close()
-				apath := f.FileHeader.Name
-				if cpage != nil && f.FileHeader.NonUTF8 {
+				apath := f.Name()
+				if cpage != nil && f.NonUTF8() {
 					// forcing zip file name encoding
 					if n, err := cpage.NewDecoder().String(apath); err == nil {
 						apath = n
@@ -144,16 +312,21 @@ func processArchive(path, pathIn, pathOut string, format processor.OutputFmt, no
 						n, _ = ianaindex.IANA.Name(cpage)
 						env.Log.Warn("Unable to convert archive name from specified encoding", zap.String("charset", n), zap.String("path", apath), zap.Error(err))
 					}
+				} else if f.NonUTF8() {
+					if n, detected := chardet.DecodeString(apath); detected != nil {
+						env.Log.Debug("Legacy encoding of archive name detected", zap.String("path", n), zap.String("charset", detected.Name))
+						apath = n
+					}
 				}
-				if err := processBook(r, enc, filepath.Join(pathOut, apath), dst, nodirs, stk, overwrite, format, env); err != nil {
+				if err := processTargets(r, enc, filepath.Join(pathOut, apath), nodirs, overwrite, targets, env); err != nil {
 					env.Log.Error("Unable to process file in archive",
 						zap.String("archive", archive),
-						zap.String("file", f.FileHeader.Name),
+						zap.String("file", f.Name()),
 						zap.Error(err))
 				}
 			}
 		} else {
-			env.Log.Debug("Skipping file, not recognized as book", zap.String("archive", archive), zap.String("file", f.FileHeader.Name))
+			env.Log.Debug("Skipping file, not recognized as book", zap.String("archive", archive), zap.String("file", f.Name()))
 		}
 		return nil
 	})
@@ -193,7 +366,10 @@ func Convert(ctx *cli.Context) (err error) {
 		}
 	}
 
-	var format processor.OutputFmt
+	var (
+		format  processor.OutputFmt
+		formats []processor.OutputFmt
+	)
 	switch env.Mhl {
 	case config.MhlMobi:
 		format = processor.ParseFmtString(env.Cfg.Fb2Mobi.OutputFormat)
@@ -208,15 +384,31 @@ func Convert(ctx *cli.Context) (err error) {
 			format = processor.OEpub
 		}
 	default:
-		format = processor.ParseFmtString(ctx.String("to"))
-		if format == processor.UnsupportedOutputFmt {
-			env.Log.Warn("Unknown output format requested, switching to epub", zap.String("format", ctx.String("to")))
-			format = processor.OEpub
-		}
+		formats = parseFormats(ctx.String("to"), env)
+		format = formats[0]
+	}
+	if len(formats) == 0 {
+		formats = []processor.OutputFmt{format}
 	}
 	nodirs := ctx.Bool("nodirs")
 	overwrite := ctx.Bool("ow")
 
+	var bnd *bundle
+	if fi, err := os.Stat(dst); len(bundleExt(dst)) > 0 && (err != nil || !fi.IsDir()) {
+		if bnd, err = newBundle(dst, ctx.String("bundle-by"), overwrite, env.Log); err != nil {
+			return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+		}
+		defer func() {
+			if e := bnd.close(); e != nil && err == nil {
+				err = cli.Exit(fmt.Errorf("%sunable to complete destination archive: %w", errPrefix, e), errCode)
+			}
+		}()
+		// books are produced in temporary directory, with archive as destination "--ow" only allows replacing it
+		dst, overwrite = bnd.tmp, false
+	} else if ctx.IsSet("bundle-by") {
+		env.Log.Warn("Destination is not an archive, ignoring", zap.String("bundle-by", ctx.String("bundle-by")))
+	}
+
 	if !env.Cfg.Doc.ChapterPerFile && (env.Cfg.Doc.PagesPerFile != math.MaxInt32 || len(env.Cfg.Doc.ChapterDividers) > 0) {
 		env.Log.Warn("With chapter_per_file=false settings to control resulting content size (ex: pages_per_file, chapter_subtitle_dividers) will be ignored")
 	}
@@ -239,15 +431,53 @@ func Convert(ctx *cli.Context) (err error) {
 	if env.Mhl == config.MhlEpub {
 		stk = env.Cfg.Fb2Epub.SendToKindle
 	}
-	if stk && format != processor.OEpub {
-		env.Log.Warn("Send to Kindle could only be used with epub output format, turning off", zap.Stringer("format", format))
-		stk = false
+	if stk {
+		var supported bool
+		for _, f := range formats {
+			supported = supported || processor.CanSendToKindle(f)
+		}
+		if !supported {
+			env.Log.Warn("Send to Kindle could not be used with requested output format, turning off", zap.String("format", ctx.String("to")))
+			stk = false
+		}
 	}
 	if stk {
 		env.Cfg.Doc.Cover.Convert = true
 	}
 
-	env.Log.Info("Processing starting", zap.String("source", src), zap.String("destination", dst), zap.Stringer("format", format))
+	targets := make([]target, 0, len(formats))
+	for _, f := range formats {
+		targets = append(targets, target{format: f, dst: dst, stk: stk && processor.CanSendToKindle(f), env: env})
+	}
+	if profiles := ctx.StringSlice("profile"); len(profiles) > 0 && env.Mhl == config.MhlNone {
+		if !ctx.IsSet("to") {
+			// device profiles replace default output
+			targets = nil
+		}
+		if targets, err = profileTargets(profiles, targets, ctx.Bool("stk"), dst, env); err != nil {
+			return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+		}
+	}
+
+	if ctx.Bool("dry-run") {
+		planned := make(map[string]bool)
+		for i := range targets {
+			targets[i].planned = planned
+		}
+	}
+	destination := dst
+	if bnd != nil {
+		for i := range targets {
+			targets[i].bundle = bnd
+		}
+		destination = bnd.path
+	}
+
+	names := make([]string, 0, len(formats))
+	for _, f := range formats {
+		names = append(names, f.String())
+	}
+	env.Log.Info("Processing starting", zap.String("source", src), zap.String("destination", destination), zap.Strings("format", names))
 	defer func(start time.Time) {
 		env.Log.Info("Processing completed", zap.Duration("elapsed", time.Since(start)))
 	}(time.Now())
@@ -268,7 +498,7 @@ func Convert(ctx *cli.Context) (err error) {
 				// directory cannot have tail - it would be simple file
 				return cli.Exit(fmt.Errorf("%sinput source was not found (%s) => (%s)", errPrefix, head, strings.TrimPrefix(src, head)), errCode)
 			}
-			if err := processDir(head, format, nodirs, stk, overwrite, cpage, dst, env); err != nil {
+			if err := processDir(head, targets, nodirs, overwrite, cpage, env); err != nil {
 				return cli.Exit(fmt.Errorf("%sunable to process directory", errPrefix), errCode)
 			}
 			break
@@ -285,7 +515,7 @@ func Convert(ctx *cli.Context) (err error) {
 			if ok {
 				// we need to look inside to see if path makes sense
 				tail = strings.TrimPrefix(strings.TrimPrefix(src, head), string(filepath.Separator))
-				if err := processArchive(head, tail, "", format, nodirs, stk, overwrite, cpage, dst, env); err != nil {
+				if err := processArchive(head, tail, "", targets, nodirs, overwrite, cpage, env); err != nil {
 					return cli.Exit(fmt.Errorf("%sunable to process archive: %w", errPrefix, err), errCode)
 				}
 				break
@@ -299,14 +529,14 @@ func Convert(ctx *cli.Context) (err error) {
 
 			}
 
-			if ok && len(tail) == 0 {
+			if (ok || isImportFile(head)) && len(tail) == 0 {
 				// we have book, it cannot have tail
 				// encoding will be handled properly by processBook
 				if file, err := os.Open(head); err != nil {
 					env.Log.Error("Unable to process file", zap.String("file", head), zap.Error(err))
 				} else {
 					defer file.Close()
-					if err := processBook(file, enc, filepath.Base(head), dst, nodirs, stk, overwrite, format, env); err != nil {
+					if err := processTargets(file, enc, filepath.Base(head), nodirs, overwrite, targets, env); err != nil {
 						env.Log.Error("Unable to process file", zap.String("file", head), zap.Error(err))
 					}
 				}
@@ -324,3 +554,60 @@ func Convert(ctx *cli.Context) (err error) {
 
 	return nil
 }
+
+// parseFormats parses comma separated list of requested output formats, duplicates are removed.
+func parseFormats(list string, env *state.LocalEnv) []processor.OutputFmt {
+
+	var formats []processor.OutputFmt
+	for _, name := range strings.Split(list, ",") {
+		format := processor.ParseFmtString(strings.TrimSpace(name))
+		if format == processor.UnsupportedOutputFmt {
+			env.Log.Warn("Unknown output format requested, switching to epub", zap.String("format", name))
+			format = processor.OEpub
+		}
+		var found bool
+		for _, f := range formats {
+			found = found || f == format
+		}
+		if !found {
+			formats = append(formats, format)
+		}
+	}
+	return formats
+}
+
+// profileTargets adds target for each requested device profile. When there is more than one target, results for
+// profile are placed into subdirectory named after it.
+func profileTargets(names []string, targets []target, stk bool, dst string, env *state.LocalEnv) ([]target, error) {
+
+	for _, name := range names {
+		cfg, prof, err := env.Cfg.ApplyProfile(name)
+		if err != nil {
+			return nil, err
+		}
+		format := processor.ParseFmtString(prof.Format)
+		if format == processor.UnsupportedOutputFmt {
+			return nil, fmt.Errorf("device profile %s has unsupported output format %q", name, prof.Format)
+		}
+		t := target{
+			profile: name,
+			format:  format,
+			dst:     dst,
+			stk:     stk && processor.CanSendToKindle(format),
+			env:     &state.LocalEnv{Mhl: env.Mhl, Cfg: cfg, Log: env.Log, Rpt: env.Rpt},
+		}
+		if t.stk {
+			cfg.Doc.Cover.Convert = true
+		}
+		env.Log.Debug("Using device profile", zap.String("profile", name), zap.String("description", prof.Description), zap.Stringer("format", format))
+		targets = append(targets, t)
+	}
+	if len(targets) > 1 {
+		for i := range targets {
+			if len(targets[i].profile) > 0 {
+				targets[i].dst = filepath.Join(dst, targets[i].profile)
+			}
+		}
+	}
+	return targets, nil
+}
@@ -0,0 +1,168 @@
+package commands
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+func TestProfileTargets(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatalf("unable to build configuration: %v", err)
+	}
+	env := &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}
+	dst := t.TempDir()
+
+	targets, err := profileTargets([]string{"kobo-libra", "pocketbook"}, []target{{format: processor.OEpub, dst: dst, env: env}}, false, dst, env)
+	if err != nil {
+		t.Fatalf("unable to prepare targets: %v", err)
+	}
+	if len(targets) != 3 || targets[1].format != processor.OKepub || targets[2].env.Cfg.Doc.Cover.Width != 1072 {
+		t.Fatalf("unexpected targets %+v", targets)
+	}
+	if env.Cfg.Doc.Cover.Width != 1264 {
+		t.Errorf("profile modified main configuration")
+	}
+
+	if err := processTargets(strings.NewReader(testBook), encUTF8, "book.fb2", true, true, targets, env); err != nil {
+		t.Fatalf("unable to convert: %v", err)
+	}
+	for _, name := range []string{"book.epub", "kobo-libra/book.kepub.epub", "pocketbook/book.epub"} {
+		if _, err := os.Stat(filepath.Join(dst, name)); err != nil {
+			t.Errorf("result is missing: %v", err)
+		}
+	}
+
+	if _, err := profileTargets([]string{"unknown"}, nil, false, dst, env); err == nil {
+		t.Error("unknown profile accepted")
+	}
+}
+
+func TestMultipleFormats(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatalf("unable to build configuration: %v", err)
+	}
+	env := &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}
+	dst := t.TempDir()
+
+	formats := parseFormats("epub, kepub,epub", env)
+	if len(formats) != 2 || formats[0] != processor.OEpub || formats[1] != processor.OKepub {
+		t.Fatalf("unexpected formats %v", formats)
+	}
+	targets := []target{{format: processor.OEpub, dst: dst, env: env}, {format: processor.OKepub, dst: dst, env: env}}
+	if err := processTargets(strings.NewReader(testBook), encUTF8, "book.fb2", true, true, targets, env); err != nil {
+		t.Fatalf("unable to convert: %v", err)
+	}
+
+	content := func(name string) string {
+		r, err := zip.OpenReader(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatalf("unable to open result: %v", err)
+		}
+		defer r.Close()
+		var sb strings.Builder
+		for _, f := range r.File {
+			if filepath.Ext(f.Name) == ".xhtml" {
+				rc, err := f.Open()
+				if err != nil {
+					t.Fatalf("unable to read result: %v", err)
+				}
+				io.Copy(&sb, rc)
+				rc.Close()
+			}
+		}
+		return sb.String()
+	}
+	if epub := content("book.epub"); strings.Contains(epub, "koboSpan") || strings.Contains(epub, "book-columns") {
+		t.Error("epub has Kobo formatting")
+	}
+	if kepub := content("book.kepub.epub"); !strings.Contains(kepub, `id="kobo.1.1"`) || !strings.Contains(kepub, "book-columns") {
+		t.Error("kepub has no Kobo formatting")
+	}
+}
+
+func TestBundle(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatalf("unable to build configuration: %v", err)
+	}
+	cfg.Doc.FileNameCollision = "counter"
+	env := &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}
+	dst := filepath.Join(t.TempDir(), "library.zip")
+
+	b, err := newBundle(dst, "", false, env.Log)
+	if err != nil {
+		t.Fatalf("unable to create bundle: %v", err)
+	}
+	targets := []target{{format: processor.OEpub, dst: b.tmp, env: env, bundle: b}}
+	for i := 0; i < 2; i++ {
+		if err := processTargets(strings.NewReader(testBook), encUTF8, "books/book.fb2", false, false, targets, env); err != nil {
+			t.Fatalf("unable to convert: %v", err)
+		}
+	}
+	if err := b.close(); err != nil {
+		t.Fatalf("unable to close bundle: %v", err)
+	}
+	if _, err := os.Stat(b.tmp); !os.IsNotExist(err) {
+		t.Error("temporary directory was not removed")
+	}
+
+	r, err := zip.OpenReader(dst)
+	if err != nil {
+		t.Fatalf("unable to open result: %v", err)
+	}
+	defer r.Close()
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, "|") != "books/book.epub|books/book (2).epub" {
+		t.Errorf("unexpected archive content %v", names)
+	}
+
+	// books of different authors go to different archives and do not affect each other names
+	b, err = newBundle(filepath.Join(filepath.Dir(dst), "authors.zip"), "author", false, env.Log)
+	if err != nil {
+		t.Fatalf("unable to create bundle: %v", err)
+	}
+	targets[0].dst, targets[0].bundle = b.tmp, b
+	for _, book := range []string{testBook, strings.Replace(testBook, "<last-name>Author</last-name>", "<last-name>Writer</last-name>", 1)} {
+		if err := processTargets(strings.NewReader(book), encUTF8, "books/book.fb2", false, false, targets, env); err != nil {
+			t.Fatalf("unable to convert: %v", err)
+		}
+	}
+	if err := b.close(); err != nil {
+		t.Fatalf("unable to close bundle: %v", err)
+	}
+	for _, name := range []string{"authors - Author Test.zip", "authors - Writer Test.zip"} {
+		r, err := zip.OpenReader(filepath.Join(filepath.Dir(dst), name))
+		if err != nil {
+			t.Fatalf("unable to open result: %v", err)
+		}
+		if len(r.File) != 1 || r.File[0].Name != "books/book.epub" {
+			t.Errorf("unexpected content of %s", name)
+		}
+		r.Close()
+	}
+
+	if _, err := newBundle(dst, "", false, env.Log); err == nil {
+		t.Error("existing archive accepted")
+	}
+	if _, err := newBundle(dst, "genre", true, env.Log); err == nil {
+		t.Error("unsupported split accepted")
+	}
+}
@@ -0,0 +1,655 @@
+package commands
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/archive"
+	"fb2converter/chardet"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// dedupeBands is number of locality sensitive hashing bands signature is split into. With 4 hashes per band books
+// sharing 70% of text are compared with probability above 99%.
+const dedupeBands = processor.SignatureSize / 4
+
+// inpxFields is the order of fields in INPX records when index does not have "structure.info".
+var inpxFields = []string{"AUTHOR", "GENRE", "TITLE", "SERIES", "SERNO", "FILE", "SIZE", "LIBID", "DEL", "EXT", "DATE", "LANG", "LIBRATE", "KEYWORDS"}
+
+// dedupeBook is a single book found in sources.
+type dedupeBook struct {
+	fp    *processor.Fingerprint
+	key   string
+	path  string // file or archive
+	entry string // path inside archive, empty for files
+	src   string // path relative to the source, used to name conversion results
+	enc   srcEncoding
+	size  int64
+	// estimated share of text common with the best version of the book
+	similarity float64
+}
+
+func (b *dedupeBook) location() string {
+	if len(b.entry) == 0 {
+		return b.path
+	}
+	return filepath.Join(b.path, b.entry)
+}
+
+// dedupeScanner collects fingerprints of books in sources.
+type dedupeScanner struct {
+	env   *state.LocalEnv
+	books []*dedupeBook
+}
+
+// add reads and fingerprints single book.
+func (s *dedupeScanner) add(r io.Reader, enc srcEncoding, fpath, entry, src string) {
+
+	name := fpath
+	if len(entry) > 0 {
+		name = filepath.Join(fpath, entry)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		s.env.Log.Warn("Skipping book", zap.String("file", name), zap.Error(err))
+		return
+	}
+	br, detected, err := bookReader(bytes.NewReader(data), enc)
+	if err != nil {
+		s.env.Log.Warn("Skipping book", zap.String("file", name), zap.Error(err))
+		return
+	}
+	if detected != nil {
+		s.env.Log.Debug("Legacy encoding detected", zap.String("file", name), zap.String("charset", detected.Name), zap.Float64("confidence", detected.Confidence))
+	}
+	doc, err := processor.ParseFB2(br, enc == encUnknown)
+	if err != nil {
+		s.env.Log.Warn("Skipping book", zap.String("file", name), zap.Error(err))
+		return
+	}
+	fp := processor.NewFingerprint(doc)
+	s.books = append(s.books, &dedupeBook{fp: fp, key: fp.Key(), path: fpath, entry: entry, src: src, enc: enc, size: int64(len(data))})
+	s.env.Log.Debug("Book fingerprinted", zap.String("file", name), zap.String("title", fp.Title), zap.Int("words", fp.Words))
+}
+
+// scan processes source: directory, INPX index, archive or single book.
+func (s *dedupeScanner) scan(src string) error {
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return s.scanDir(src)
+	}
+	if strings.EqualFold(filepath.Ext(src), ".inpx") {
+		_, err := s.scanInpx(src, filepath.Dir(src), "")
+		return err
+	}
+	if ok, err := isArchiveFile(src); err != nil {
+		return err
+	} else if ok {
+		return s.scanArchive(src, "", nil)
+	}
+	ok, enc, err := isBookFile(src)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("input was not recognized as FB2 book, archive or INPX index: %s", src)
+	}
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	s.add(file, enc, src, "", filepath.Base(src))
+	return nil
+}
+
+// scanDir walks directory tree. Archives described by INPX indexes found in directory are scanned according to index,
+// so books marked as deleted are skipped.
+func (s *dedupeScanner) scanDir(dir string) error {
+
+	var indexes, archives, books []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			s.env.Log.Warn("Skipping path", zap.String("path", path), zap.Error(err))
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if strings.EqualFold(filepath.Ext(path), ".inpx") {
+			indexes = append(indexes, path)
+		} else if ok, err := isArchiveFile(path); err != nil {
+			s.env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
+		} else if ok {
+			archives = append(archives, path)
+		} else {
+			books = append(books, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	rel := func(path string) string {
+		return strings.TrimPrefix(strings.TrimPrefix(path, dir), string(filepath.Separator))
+	}
+
+	indexed := make(map[string]bool)
+	for _, path := range indexes {
+		scanned, err := s.scanInpx(path, filepath.Dir(path), filepath.Dir(rel(path)))
+		if err != nil {
+			s.env.Log.Error("Unable to process INPX index", zap.String("file", path), zap.Error(err))
+		}
+		for _, a := range scanned {
+			indexed[a] = true
+		}
+	}
+	for _, path := range archives {
+		if indexed[path] {
+			continue
+		}
+		if err := s.scanArchive(path, filepath.Dir(rel(path)), nil); err != nil {
+			s.env.Log.Error("Unable to process archive", zap.String("file", path), zap.Error(err))
+		}
+	}
+	for _, path := range books {
+		if ok, enc, err := isBookFile(path); err != nil {
+			s.env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
+		} else if ok {
+			file, err := os.Open(path)
+			if err != nil {
+				s.env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
+				continue
+			}
+			s.add(file, enc, path, "", rel(path))
+			file.Close()
+		} else {
+			s.env.Log.Debug("Skipping file, not recognized as book or archive", zap.String("file", path))
+		}
+	}
+	return nil
+}
+
+// scanInpx scans archives listed in INPX index located in dir, returns paths of archives which were scanned.
+func (s *dedupeScanner) scanInpx(fname, dir, pathOut string) ([]string, error) {
+
+	index, err := readInpx(fname)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(index))
+	for name := range index {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var scanned []string
+	for _, name := range names {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if _, err := os.Stat(path); err != nil {
+			s.env.Log.Warn("Archive listed in INPX index is not accessible", zap.String("index", fname), zap.String("archive", name), zap.Error(err))
+			continue
+		}
+		if err := s.scanArchive(path, filepath.Join(pathOut, filepath.Dir(filepath.FromSlash(name))), index[name]); err != nil {
+			s.env.Log.Error("Unable to process archive", zap.String("file", path), zap.Error(err))
+		}
+		scanned = append(scanned, path)
+	}
+	return scanned, nil
+}
+
+// scanArchive walks archive, when wanted is not nil only listed books are processed.
+func (s *dedupeScanner) scanArchive(fname, pathOut string, wanted map[string]bool) error {
+
+	return archive.Walk(fname, "", func(archive string, f archive.File) error {
+		if wanted != nil && !wanted[f.Name()] {
+			return nil
+		}
+		if ok, enc, err := isBookInArchive(f); err != nil {
+			s.env.Log.Warn("Skipping file in archive", zap.String("archive", archive), zap.String("path", f.Name()), zap.Error(err))
+		} else if ok {
+			r, err := f.Open()
+			if err != nil {
+				s.env.Log.Warn("Skipping file in archive", zap.String("archive", archive), zap.String("path", f.Name()), zap.Error(err))
+				return nil
+			}
+			defer r.Close()
+			apath := f.Name()
+			if f.NonUTF8() {
+				if n, detected := chardet.DecodeString(apath); detected != nil {
+					apath = n
+				}
+			}
+			s.add(r, enc, archive, f.Name(), filepath.Join(pathOut, apath))
+		}
+		return nil
+	})
+}
+
+// readInpx reads INPX index (zip archive with "inp" files, one per library archive) and returns names of books which
+// are not marked as deleted grouped by archive.
+func readInpx(fname string) (map[string]map[string]bool, error) {
+
+	zr, err := zip.OpenReader(fname)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open INPX index: %w", err)
+	}
+	defer zr.Close()
+
+	read := func(f *zip.File) (string, error) {
+		r, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		return string(data), err
+	}
+
+	fields := inpxFields
+	for _, f := range zr.File {
+		if strings.EqualFold(f.Name, "structure.info") {
+			data, err := read(f)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read INPX structure: %w", err)
+			}
+			fields = strings.Split(strings.ToUpper(strings.Trim(strings.TrimSpace(data), ";")), ";")
+		}
+	}
+
+	index := make(map[string]map[string]bool)
+	for _, f := range zr.File {
+		if !strings.EqualFold(path.Ext(f.Name), ".inp") {
+			continue
+		}
+		data, err := read(f)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s from INPX index: %w", f.Name, err)
+		}
+		for _, line := range strings.Split(data, "\n") {
+			values := strings.Split(strings.TrimRight(line, "\r"), "\x04")
+			rec := make(map[string]string, len(fields))
+			for i, name := range fields {
+				if i < len(values) {
+					rec[name] = strings.TrimSpace(values[i])
+				}
+			}
+			if len(rec["FILE"]) == 0 || rec["DEL"] == "1" {
+				continue
+			}
+			ext := rec["EXT"]
+			if len(ext) == 0 {
+				ext = "fb2"
+			}
+			// archive is named after inp file unless record specifies it
+			arc := rec["FOLDER"]
+			if len(arc) == 0 {
+				arc = strings.TrimSuffix(path.Base(f.Name), path.Ext(f.Name)) + ".zip"
+			}
+			if index[arc] == nil {
+				index[arc] = make(map[string]bool)
+			}
+			index[arc][rec["FILE"]+"."+ext] = true
+		}
+	}
+	return index, nil
+}
+
+// groupBooks finds versions of the same book. Books are the same when their texts are similar enough or when they
+// have the same title, authors and language and either share at least half of required similarity (heavily corrected
+// copies, editions) or one of them has no text to compare. Books in every group are ordered from the best version.
+func groupBooks(books []*dedupeBook, similarity float64) [][]*dedupeBook {
+
+	parent := make([]int, len(books))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	compare := func(i, j int) {
+		ri, rj := find(i), find(j)
+		if ri == rj {
+			return
+		}
+		a, b := books[i], books[j]
+		sim := a.fp.Similarity(b.fp)
+		if sim < similarity {
+			if len(a.key) == 0 || a.key != b.key || a.fp.Lang != b.fp.Lang && len(a.fp.Lang) > 0 && len(b.fp.Lang) > 0 {
+				return
+			}
+			if len(a.fp.Signature) > 0 && len(b.fp.Signature) > 0 && sim < similarity/2 {
+				return
+			}
+		}
+		parent[ri] = rj
+	}
+
+	// only books sharing meta information or signature band are compared
+	byKey := make(map[string][]int)
+	byBand := make(map[uint64][]int)
+	for i, b := range books {
+		if len(b.key) > 0 {
+			for _, j := range byKey[b.key] {
+				compare(j, i)
+			}
+			byKey[b.key] = append(byKey[b.key], i)
+		}
+		for _, h := range b.fp.Bands(dedupeBands) {
+			for _, j := range byBand[h] {
+				compare(j, i)
+			}
+			byBand[h] = append(byBand[h], i)
+		}
+	}
+
+	roots := make(map[int]int)
+	var groups [][]*dedupeBook
+	for i, b := range books {
+		r := find(i)
+		n, ok := roots[r]
+		if !ok {
+			n = len(groups)
+			roots[r] = n
+			groups = append(groups, nil)
+		}
+		groups[n] = append(groups[n], b)
+	}
+	for _, g := range groups {
+		sort.SliceStable(g, func(i, j int) bool { return betterVersion(g[i], g[j]) })
+		for _, b := range g {
+			b.similarity = g[0].fp.Similarity(b.fp)
+		}
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		a, b := groups[i][0], groups[j][0]
+		if a.key != b.key {
+			return a.key < b.key
+		}
+		return a.location() < b.location()
+	})
+	return groups
+}
+
+// betterVersion reports whether book a should be preferred to book b: later document version first, then later
+// document date, bigger file and more images.
+func betterVersion(a, b *dedupeBook) bool {
+	if c := compareVersions(a.fp.Version, b.fp.Version); c != 0 {
+		return c > 0
+	}
+	switch {
+	case a.fp.Date != b.fp.Date:
+		return a.fp.Date > b.fp.Date
+	case a.size != b.size:
+		return a.size > b.size
+	case a.fp.Images != b.fp.Images:
+		return a.fp.Images > b.fp.Images
+	}
+	return a.location() < b.location()
+}
+
+// compareVersions compares dotted versions component by component as numbers, so "1.10" is later than "1.9". Missing
+// components and empty version are zeros.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y string
+		if i < len(as) {
+			x = strings.TrimLeft(as[i], "0")
+		}
+		if i < len(bs) {
+			y = strings.TrimLeft(bs[i], "0")
+		}
+		// components are digits only, longer number is bigger
+		switch {
+		case len(x) != len(y):
+			if len(x) > len(y) {
+				return 1
+			}
+			return -1
+		case x != y:
+			return strings.Compare(x, y)
+		}
+	}
+	return 0
+}
+
+type dedupeVersion struct {
+	Path       string  `json:"path"`
+	Best       bool    `json:"best"`
+	Similarity float64 `json:"similarity"`
+	Version    string  `json:"version,omitempty"`
+	Date       string  `json:"date,omitempty"`
+	Size       int64   `json:"size"`
+	Images     int     `json:"images"`
+	Words      int     `json:"words"`
+}
+
+type dedupeGroup struct {
+	Title    string          `json:"title"`
+	Authors  []string        `json:"authors,omitempty"`
+	Versions []dedupeVersion `json:"versions"`
+}
+
+type dedupeReport struct {
+	Books     int           `json:"books"`
+	Redundant int           `json:"redundant"`
+	Groups    []dedupeGroup `json:"groups"`
+}
+
+// writeReport lists books which have more than one version, the best version goes first.
+func writeReport(w io.Writer, groups [][]*dedupeBook, asJSON bool) error {
+
+	rpt := dedupeReport{Groups: []dedupeGroup{}}
+	for _, g := range groups {
+		rpt.Books++
+		if len(g) < 2 {
+			continue
+		}
+		rpt.Redundant += len(g) - 1
+		grp := dedupeGroup{Title: g[0].fp.Title, Authors: g[0].fp.Authors}
+		for i, b := range g {
+			grp.Versions = append(grp.Versions, dedupeVersion{
+				Path:       b.location(),
+				Best:       i == 0,
+				Similarity: b.similarity,
+				Version:    b.fp.Version,
+				Date:       b.fp.Date,
+				Size:       b.size,
+				Images:     b.fp.Images,
+				Words:      b.fp.Words,
+			})
+		}
+		rpt.Groups = append(rpt.Groups, grp)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rpt)
+	}
+
+	var buf bytes.Buffer
+	for _, g := range rpt.Groups {
+		title := g.Title
+		if len(g.Authors) > 0 {
+			title = strings.Join(g.Authors, ", ") + " - " + title
+		}
+		fmt.Fprintf(&buf, "%s: %d versions\n", title, len(g.Versions))
+		for _, v := range g.Versions {
+			mark := " "
+			if v.Best {
+				mark = "*"
+			}
+			fmt.Fprintf(&buf, "  %s %s (similarity %.2f, version %s, date %s, %d bytes, %d images, %d words)\n",
+				mark, v.Path, v.Similarity, nonEmptyOr(v.Version, "unknown"), nonEmptyOr(v.Date, "unknown"), v.Size, v.Images, v.Words)
+		}
+	}
+	fmt.Fprintf(&buf, "%d books, %d with duplicates, %d redundant files\n", rpt.Books, len(rpt.Groups), rpt.Redundant)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func nonEmptyOr(s, def string) string {
+	if len(s) == 0 {
+		return def
+	}
+	return s
+}
+
+// convertBest converts the best version of every book, archives are walked once for all books they contain.
+func convertBest(groups [][]*dedupeBook, targets []target, nodirs, overwrite bool, env *state.LocalEnv) {
+
+	inArchives := make(map[string]map[string]*dedupeBook)
+	var archives []string
+	for _, g := range groups {
+		b := g[0]
+		if len(b.entry) == 0 {
+			file, err := os.Open(b.path)
+			if err != nil {
+				env.Log.Error("Unable to process file", zap.String("file", b.path), zap.Error(err))
+				continue
+			}
+			if err := processTargets(file, b.enc, b.src, nodirs, overwrite, targets, env); err != nil {
+				env.Log.Error("Unable to process file", zap.String("file", b.path), zap.Error(err))
+			}
+			file.Close()
+			continue
+		}
+		if inArchives[b.path] == nil {
+			inArchives[b.path] = make(map[string]*dedupeBook)
+			archives = append(archives, b.path)
+		}
+		inArchives[b.path][b.entry] = b
+	}
+
+	for _, path := range archives {
+		books := inArchives[path]
+		err := archive.Walk(path, "", func(archive string, f archive.File) error {
+			b, ok := books[f.Name()]
+			if !ok {
+				return nil
+			}
+			r, err := f.Open()
+			if err != nil {
+				env.Log.Error("Unable to process file in archive", zap.String("archive", archive), zap.String("file", f.Name()), zap.Error(err))
+				return nil
+			}
+			defer r.Close()
+			if err := processTargets(r, b.enc, b.src, nodirs, overwrite, targets, env); err != nil {
+				env.Log.Error("Unable to process file in archive", zap.String("archive", archive), zap.String("file", f.Name()), zap.Error(err))
+			}
+			return nil
+		})
+		if err != nil {
+			env.Log.Error("Unable to process archive", zap.String("file", path), zap.Error(err))
+		}
+	}
+}
+
+// Dedupe is "dedupe" command body. It finds different versions of the same book in sources and either reports them or
+// converts the best version of every book.
+func Dedupe(ctx *cli.Context) (err error) {
+
+	const (
+		errPrefix = "dedupe: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	if ctx.Args().Len() == 0 {
+		return cli.Exit(errors.New(errPrefix+"no input source has been specified"), errCode)
+	}
+	similarity := ctx.Float64("similarity")
+	if similarity <= 0 || similarity > 1 {
+		return cli.Exit(fmt.Errorf("%ssimilarity must be greater than 0 and not greater than 1: %g", errPrefix, similarity), errCode)
+	}
+
+	s := &dedupeScanner{env: env}
+
+	env.Log.Info("Deduplication starting", zap.Strings("sources", ctx.Args().Slice()), zap.Float64("similarity", similarity))
+	defer func(start time.Time) {
+		env.Log.Info("Deduplication completed", zap.Duration("elapsed", time.Since(start)), zap.Int("books", len(s.books)))
+	}(time.Now())
+
+	for _, src := range ctx.Args().Slice() {
+		if src, err = filepath.Abs(src); err != nil {
+			return cli.Exit(fmt.Errorf("%snormalizing source path failed", errPrefix), errCode)
+		}
+		if err := s.scan(src); err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to process source: %w", errPrefix, err), errCode)
+		}
+	}
+	if len(s.books) == 0 {
+		return cli.Exit(errors.New(errPrefix+"no books were found in the sources"), errCode)
+	}
+
+	groups := groupBooks(s.books, similarity)
+	env.Log.Info("Books grouped", zap.Int("books", len(s.books)), zap.Int("unique", len(groups)))
+
+	to := ctx.String("to")
+	if fname := ctx.String("report"); len(fname) > 0 {
+		if _, err := os.Stat(fname); err == nil && !ctx.Bool("ow") {
+			return cli.Exit(fmt.Errorf("%sreport file already exists: %s", errPrefix, fname), errCode)
+		}
+		out, err := os.Create(fname)
+		if err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to create report file: %w", errPrefix, err), errCode)
+		}
+		err = writeReport(out, groups, ctx.Bool("json"))
+		if e := out.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to write report: %w", errPrefix, err), errCode)
+		}
+	} else if len(to) == 0 {
+		if err := writeReport(os.Stdout, groups, ctx.Bool("json")); err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to write report: %w", errPrefix, err), errCode)
+		}
+	}
+
+	if len(to) == 0 {
+		return nil
+	}
+
+	dst := ctx.String("dest")
+	if len(dst) == 0 {
+		if dst, err = os.Getwd(); err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to get working directory", errPrefix), errCode)
+		}
+	} else if dst, err = filepath.Abs(dst); err != nil {
+		return cli.Exit(fmt.Errorf("%snormalizing destination path failed", errPrefix), errCode)
+	}
+
+	var targets []target
+	for _, f := range parseFormats(to, env) {
+		targets = append(targets, target{format: f, dst: dst, env: env})
+	}
+	convertBest(groups, targets, ctx.Bool("nodirs"), ctx.Bool("ow"), env)
+	return nil
+}
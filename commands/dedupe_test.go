@@ -0,0 +1,140 @@
+package commands
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/state"
+)
+
+// dedupeText produces deterministic pseudo random text, every n-th word is replaced when n is not 0.
+func dedupeText(seed uint32, words, n int) string {
+	vocabulary := strings.Fields("the a river stone light dark house old new road wind sea sky quiet long night morning city")
+	var buf strings.Builder
+	for i := 0; i < words; i++ {
+		seed = seed*1664525 + 1013904223
+		w := vocabulary[seed>>16%uint32(len(vocabulary))]
+		if n > 0 && i%n == 0 {
+			w = "changed"
+		}
+		if i%12 == 0 {
+			buf.WriteString("</p><p>")
+		}
+		buf.WriteString(w + " ")
+	}
+	return "<p>" + buf.String() + "</p>"
+}
+
+func dedupeBookData(title, version, text string) []byte {
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+<description>
+<title-info><author><first-name>Test</first-name><last-name>Author</last-name></author><book-title>%s</book-title><lang>en</lang></title-info>
+<document-info><version>%s</version></document-info>
+</description>
+<body><section>%s</section></body>
+</FictionBook>`, title, version, text))
+}
+
+func TestDedupe(t *testing.T) {
+
+	dir := t.TempDir()
+	a := dedupeText(1, 2000, 0)
+	b := dedupeText(2, 2000, 0)
+
+	for name, data := range map[string][]byte{
+		"a1.fb2": dedupeBookData("Test Book", "1.9", a),
+		"a2.fb2": dedupeBookData("Test book!", "1.10", dedupeText(1, 2000, 200)),
+		"b.fb2":  dedupeBookData("Another Book", "1.0", b),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	zipFiles := func(name string, files map[string][]byte) {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for n, data := range files {
+			w, err := zw.Create(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	zipFiles("lib.zip", map[string][]byte{
+		"100.fb2": dedupeBookData("Renamed", "1,9,1", a),
+		"101.fb2": dedupeBookData("Another Book", "3.0", b),
+	})
+	record := func(fields ...string) string { return strings.Join(fields, "\x04") + "\r\n" }
+	zipFiles("lib.inpx", map[string][]byte{
+		"lib.inp": []byte(record("Author,Test:", "sf:", "Renamed", "", "", "100", "1", "100", "0", "fb2", "2020-01-01", "en", "", "") +
+			record("Author,Test:", "sf:", "Another Book", "", "", "101", "1", "101", "1", "fb2", "2020-01-01", "en", "", "")),
+	})
+
+	s := &dedupeScanner{env: &state.LocalEnv{Log: zap.NewNop()}}
+	if err := s.scan(dir); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.books) != 4 {
+		t.Fatalf("expected 4 books (deleted one skipped), got %d", len(s.books))
+	}
+
+	groups := groupBooks(s.books, 0.7)
+	if len(groups) != 2 {
+		t.Fatalf("expected 2 books, got %d groups", len(groups))
+	}
+	var versions []string
+	for _, b := range groups[1] {
+		versions = append(versions, b.src)
+	}
+	if expected := []string{"a2.fb2", "100.fb2", "a1.fb2"}; strings.Join(versions, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected versions %v, got %v", expected, versions)
+	}
+
+	var buf bytes.Buffer
+	if err := writeReport(&buf, groups, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(buf.String(), "2 books, 1 with duplicates, 2 redundant files\n") {
+		t.Errorf("unexpected report:\n%s", buf.String())
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+
+	for _, tc := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.10", "1.9", 1},
+		{"1.9", "1.10", -1},
+		{"2.0", "1.99", 1},
+		{"1.0", "1", 0},
+		{"1.01", "1.1", 0},
+		{"1.0.1", "1.0", 1},
+		{"", "0.1", -1},
+		{"", "", 0},
+		{"12345678901234567890.1", "9.1", 1},
+	} {
+		if res := compareVersions(tc.a, tc.b); res != tc.expected {
+			t.Errorf("compareVersions(%q, %q) = %d, expected %d", tc.a, tc.b, res, tc.expected)
+		}
+	}
+}
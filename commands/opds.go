@@ -0,0 +1,934 @@
+package commands
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// OPDS related constants.
+const (
+	opdsPageSize = 50
+
+	opdsNavigation  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAcquisition = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	opdsSearch      = "application/opensearchdescription+xml"
+
+	opdsRelAcquisition = "http://opds-spec.org/acquisition"
+	opdsRelImage       = "http://opds-spec.org/image"
+	opdsRelThumbnail   = "http://opds-spec.org/image/thumbnail"
+
+	opdsThumbWidth  = 330
+	opdsThumbHeight = 470
+)
+
+// supported book formats and their mime types
+var opdsFormats = map[string]string{
+	"epub":  "application/epub+zip",
+	"kepub": "application/kepub+zip",
+	"azw3":  "application/vnd.amazon.ebook",
+	"mobi":  "application/x-mobipocket-ebook",
+	"fb2":   "application/x-fictionbook+xml",
+	"txt":   "text/plain; charset=utf-8",
+	"md":    "text/markdown; charset=utf-8",
+	"pdf":   "application/pdf",
+	"docx":  "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"odt":   "application/vnd.oasis.opendocument.text",
+}
+
+type atomLink struct {
+	Rel   string `xml:"rel,attr,omitempty"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomCategory struct {
+	Term  string `xml:"term,attr"`
+	Label string `xml:"label,attr,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Text string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Authors    []atomAuthor   `xml:"author"`
+	Categories []atomCategory `xml:"category"`
+	Language   string         `xml:"dc:language,omitempty"`
+	Issued     string         `xml:"dc:issued,omitempty"`
+	Summary    *atomText      `xml:"summary,omitempty"`
+	Content    *atomText      `xml:"content,omitempty"`
+	Links      []atomLink     `xml:"link"`
+}
+
+type atomFeed struct {
+	XMLName   xml.Name    `xml:"feed"`
+	Xmlns     string      `xml:"xmlns,attr"`
+	XmlnsDC   string      `xml:"xmlns:dc,attr"`
+	XmlnsOPDS string      `xml:"xmlns:opds,attr"`
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Links     []atomLink  `xml:"link"`
+	Entries   []atomEntry `xml:"entry"`
+}
+
+type openSearch struct {
+	XMLName     xml.Name `xml:"OpenSearchDescription"`
+	Xmlns       string   `xml:"xmlns,attr"`
+	ShortName   string   `xml:"ShortName"`
+	Description string   `xml:"Description"`
+	URL         struct {
+		Type     string `xml:"type,attr"`
+		Template string `xml:"template,attr"`
+	} `xml:"Url"`
+}
+
+// opdsBook is a single catalog entry: all formats of the book found in library and its source if known.
+type opdsBook struct {
+	id      string
+	info    *processor.BookInfo
+	files   map[string]string // format -> path
+	source  string            // path to fb2 in source tree
+	updated time.Time
+}
+
+type opdsInfo struct {
+	mod  time.Time
+	info *processor.BookInfo
+}
+
+// catalog implements OPDS server over converted library and optionally source tree.
+type catalog struct {
+	env     *state.LocalEnv
+	library string
+	source  string
+	cache   string
+	title   string
+	formats []string // formats books from source could be converted to
+	mux     *http.ServeMux
+	//
+	mu      sync.RWMutex
+	books   []*opdsBook
+	byID    map[string]*opdsBook
+	infos   map[string]opdsInfo
+	updated time.Time
+	//
+	convert sync.Mutex
+}
+
+// newCatalog returns http handler for OPDS catalog, call scan() to populate it.
+func newCatalog(env *state.LocalEnv, library, source, cache, title string, formats []string) *catalog {
+
+	c := &catalog{
+		env:     env,
+		library: library,
+		source:  source,
+		cache:   cache,
+		title:   title,
+		formats: formats,
+		mux:     http.NewServeMux(),
+		byID:    make(map[string]*opdsBook),
+		infos:   make(map[string]opdsInfo),
+	}
+	c.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, "/opds", http.StatusFound)
+	})
+	c.mux.HandleFunc("/opds", c.handleRoot)
+	c.mux.HandleFunc("/opds/books", c.handleBooks)
+	c.mux.HandleFunc("/opds/authors", c.handleGroups("authors", "author", "Authors", func(b *opdsBook) []string { return b.info.Authors }, nil))
+	c.mux.HandleFunc("/opds/author", c.handleGroup("author", func(b *opdsBook) []string { return b.info.Authors }, nil))
+	c.mux.HandleFunc("/opds/series", c.handleGroups("series", "sequence", "Series", func(b *opdsBook) []string { return nonEmpty(b.info.SeqName) }, nil))
+	c.mux.HandleFunc("/opds/sequence", c.handleGroup("sequence", func(b *opdsBook) []string { return nonEmpty(b.info.SeqName) }, nil))
+	c.mux.HandleFunc("/opds/genres", c.handleGroups("genres", "genre", "Genres", func(b *opdsBook) []string { return b.info.Genres }, c.genreName))
+	c.mux.HandleFunc("/opds/genre", c.handleGroup("genre", func(b *opdsBook) []string { return b.info.Genres }, c.genreName))
+	c.mux.HandleFunc("/opds/languages", c.handleGroups("languages", "language", "Languages", func(b *opdsBook) []string { return nonEmpty(b.info.Lang) }, nil))
+	c.mux.HandleFunc("/opds/language", c.handleGroup("language", func(b *opdsBook) []string { return nonEmpty(b.info.Lang) }, nil))
+	c.mux.HandleFunc("/opds/search", c.handleSearch)
+	c.mux.HandleFunc("/opds/opensearch.xml", c.handleOpenSearch)
+	c.mux.HandleFunc("/opds/cover", c.handleCover(false))
+	c.mux.HandleFunc("/opds/thumbnail", c.handleCover(true))
+	c.mux.HandleFunc("/opds/get", c.handleGet)
+	return c
+}
+
+func (c *catalog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mux.ServeHTTP(w, r)
+}
+
+func nonEmpty(s string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return []string{s}
+}
+
+// bookFormat returns format of the book file by its name and name without format extension.
+func bookFormat(fname string) (string, string) {
+	lname := strings.ToLower(fname)
+	if strings.HasSuffix(lname, ".kepub.epub") {
+		return "kepub", fname[:len(fname)-len(".kepub.epub")]
+	}
+	ext := strings.TrimPrefix(filepath.Ext(lname), ".")
+	if _, ok := opdsFormats[ext]; ok {
+		return ext, strings.TrimSuffix(fname, filepath.Ext(fname))
+	}
+	return "", fname
+}
+
+// readInfo returns book meta information, cached unless file was modified.
+func (c *catalog) readInfo(path, format string, mod time.Time) (*processor.BookInfo, error) {
+
+	c.mu.RLock()
+	cached, ok := c.infos[path]
+	c.mu.RUnlock()
+	if ok && cached.mod.Equal(mod) {
+		return cached.info, nil
+	}
+
+	var (
+		info *processor.BookInfo
+		err  error
+	)
+	switch format {
+	case "epub", "kepub":
+		info, err = processor.ReadEpubInfo(path)
+	case "azw3", "mobi":
+		info, err = processor.ReadMobiInfo(path)
+	case "fb2":
+		info, err = readBookInfo(path, c.env)
+	default:
+		err = fmt.Errorf("unsupported format: %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// do not keep images in memory
+	info.CoverData = nil
+
+	c.mu.Lock()
+	c.infos[path] = opdsInfo{mod: mod, info: info}
+	c.mu.Unlock()
+	return info, nil
+}
+
+// scan walks library and source directories and rebuilds catalog.
+func (c *catalog) scan() error {
+
+	start := time.Now()
+	byKey := make(map[string]*opdsBook)
+
+	walk := func(root string, source bool) error {
+		return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				c.env.Log.Warn("Skipping path", zap.String("path", path), zap.Error(err))
+				return nil
+			}
+			if fi.IsDir() {
+				if len(c.cache) > 0 && path == c.cache {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			format, name := bookFormat(fi.Name())
+			if len(format) == 0 || source != (format == "fb2") {
+				return nil
+			}
+			rel, _ := filepath.Rel(root, filepath.Join(filepath.Dir(path), name))
+			key := filepath.ToSlash(rel)
+
+			b, ok := byKey[key]
+			if !ok {
+				sum := sha1.Sum([]byte(key))
+				b = &opdsBook{id: hex.EncodeToString(sum[:10]), files: make(map[string]string)}
+				byKey[key] = b
+			}
+			if source {
+				b.source = path
+			} else {
+				b.files[format] = path
+			}
+			if fi.ModTime().After(b.updated) {
+				b.updated = fi.ModTime()
+			}
+			return nil
+		})
+	}
+
+	if err := walk(c.library, false); err != nil {
+		return err
+	}
+	if len(c.source) > 0 {
+		if err := walk(c.source, true); err != nil {
+			return err
+		}
+	}
+
+	books := make([]*opdsBook, 0, len(byKey))
+	for key, b := range byKey {
+		// meta information source preference: epub OPF, original fb2, EXTH
+		var candidates [][2]string
+		for _, f := range []string{"epub", "kepub"} {
+			if p, ok := b.files[f]; ok {
+				candidates = append(candidates, [2]string{p, f})
+			}
+		}
+		if len(b.source) > 0 {
+			candidates = append(candidates, [2]string{b.source, "fb2"})
+		}
+		for _, f := range []string{"azw3", "mobi"} {
+			if p, ok := b.files[f]; ok {
+				candidates = append(candidates, [2]string{p, f})
+			}
+		}
+		for _, cand := range candidates {
+			fi, err := os.Stat(cand[0])
+			if err != nil {
+				continue
+			}
+			if b.info, err = c.readInfo(cand[0], cand[1], fi.ModTime()); err == nil {
+				break
+			}
+			c.env.Log.Debug("Unable to read book meta information", zap.String("file", cand[0]), zap.Error(err))
+		}
+		if b.info == nil {
+			b.info = &processor.BookInfo{}
+		}
+		if len(b.info.Title) == 0 {
+			// cached information is shared
+			info := *b.info
+			info.Title = filepath.Base(key)
+			b.info = &info
+		}
+		books = append(books, b)
+	}
+	sort.Slice(books, func(i, j int) bool {
+		ti, tj := strings.ToLower(books[i].info.Title), strings.ToLower(books[j].info.Title)
+		if ti != tj {
+			return ti < tj
+		}
+		return books[i].id < books[j].id
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.books = books
+	c.byID = make(map[string]*opdsBook, len(books))
+	for _, b := range books {
+		c.byID[b.id] = b
+	}
+	c.updated = time.Now()
+
+	c.env.Log.Info("Catalog updated", zap.Int("books", len(books)), zap.Duration("elapsed", time.Since(start)))
+	return nil
+}
+
+func (c *catalog) newFeed(id, title, self, kind string) *atomFeed {
+	c.mu.RLock()
+	updated := c.updated
+	c.mu.RUnlock()
+	return &atomFeed{
+		Xmlns:     "http://www.w3.org/2005/Atom",
+		XmlnsDC:   "http://purl.org/dc/terms/",
+		XmlnsOPDS: "http://opds-spec.org/2010/catalog",
+		ID:        "urn:fb2c:" + id,
+		Title:     title,
+		Updated:   updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Href: self, Type: kind},
+			{Rel: "start", Href: "/opds", Type: opdsNavigation},
+			{Rel: "search", Href: "/opds/opensearch.xml", Type: opdsSearch},
+		},
+	}
+}
+
+func writeFeed(w http.ResponseWriter, feed interface{}, kind string) {
+	w.Header().Set("Content-Type", kind+";charset=utf-8")
+	_, _ = w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	_ = enc.Encode(feed)
+}
+
+func (c *catalog) navEntry(id, title, href, kind, content string) atomEntry {
+	c.mu.RLock()
+	updated := c.updated
+	c.mu.RUnlock()
+	e := atomEntry{
+		Title:   title,
+		ID:      "urn:fb2c:" + id,
+		Updated: updated.UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Rel: "subsection", Href: href, Type: kind}},
+	}
+	if len(content) > 0 {
+		e.Content = &atomText{Type: "text", Text: content}
+	}
+	return e
+}
+
+func (c *catalog) handleRoot(w http.ResponseWriter, r *http.Request) {
+
+	feed := c.newFeed("root", c.title, "/opds", opdsNavigation)
+
+	c.mu.RLock()
+	count := len(c.books)
+	c.mu.RUnlock()
+
+	feed.Entries = append(feed.Entries,
+		c.navEntry("books", "All books", "/opds/books", opdsAcquisition, fmt.Sprintf("%d books", count)),
+		c.navEntry("authors", "Authors", "/opds/authors", opdsNavigation, "Books by author"),
+		c.navEntry("series", "Series", "/opds/series", opdsNavigation, "Books by series"),
+		c.navEntry("genres", "Genres", "/opds/genres", opdsNavigation, "Books by genre"),
+		c.navEntry("languages", "Languages", "/opds/languages", opdsNavigation, "Books by language"),
+	)
+	writeFeed(w, feed, opdsNavigation)
+}
+
+func pageNumber(r *http.Request) int {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		return 1
+	}
+	return page
+}
+
+// paginate adds navigation links to the feed and returns range of items for requested page.
+func paginate(feed *atomFeed, r *http.Request, total int, kind string) (int, int) {
+
+	page := pageNumber(r)
+	from, to := (page-1)*opdsPageSize, page*opdsPageSize
+	if from > total {
+		from = total
+	}
+	if to > total {
+		to = total
+	}
+
+	link := func(rel string, page int) atomLink {
+		q := r.URL.Query()
+		q.Set("page", strconv.Itoa(page))
+		return atomLink{Rel: rel, Href: r.URL.Path + "?" + q.Encode(), Type: kind}
+	}
+	if page > 1 {
+		feed.Links = append(feed.Links, link("first", 1), link("previous", page-1))
+	}
+	if to < total {
+		feed.Links = append(feed.Links, link("next", page+1))
+	}
+	return from, to
+}
+
+func (c *catalog) bookEntry(b *opdsBook) atomEntry {
+
+	e := atomEntry{
+		Title:    b.info.Title,
+		ID:       "urn:fb2c:book:" + b.id,
+		Updated:  b.updated.UTC().Format(time.RFC3339),
+		Language: b.info.Lang,
+		Issued:   b.info.Date,
+	}
+	if len(b.info.ID) > 0 {
+		e.ID = "urn:uuid:" + b.info.ID
+	}
+	for _, a := range b.info.Authors {
+		e.Authors = append(e.Authors, atomAuthor{Name: a})
+	}
+	for _, g := range b.info.Genres {
+		e.Categories = append(e.Categories, atomCategory{Term: g, Label: c.genreName(g)})
+	}
+	summary := b.info.Annotation
+	if len(b.info.SeqName) > 0 {
+		seq := b.info.SeqName
+		if b.info.SeqNum > 0 {
+			seq = fmt.Sprintf("%s #%d", seq, b.info.SeqNum)
+		}
+		summary = strings.TrimSpace(seq + "\n" + summary)
+	}
+	if len(summary) > 0 {
+		e.Summary = &atomText{Type: "text", Text: summary}
+	}
+
+	e.Links = append(e.Links,
+		atomLink{Rel: opdsRelImage, Href: "/opds/cover?id=" + b.id, Type: "image/jpeg"},
+		atomLink{Rel: opdsRelThumbnail, Href: "/opds/thumbnail?id=" + b.id, Type: "image/jpeg"},
+	)
+
+	for _, f := range c.bookFormats(b) {
+		e.Links = append(e.Links, atomLink{
+			Rel:   opdsRelAcquisition,
+			Href:  "/opds/get?" + url.Values{"id": {b.id}, "format": {f}}.Encode(),
+			Type:  opdsFormats[f],
+			Title: strings.ToUpper(f),
+		})
+	}
+	return e
+}
+
+// bookFormats returns list of formats in which book is available either directly or by conversion.
+func (c *catalog) bookFormats(b *opdsBook) []string {
+
+	var res []string
+	for _, f := range []string{"epub", "kepub", "azw3", "mobi"} {
+		if _, ok := b.files[f]; ok {
+			res = append(res, f)
+		}
+	}
+	if len(b.source) > 0 {
+		for _, f := range c.formats {
+			res = processor.AppendIfMissing(res, f)
+		}
+		res = append(res, "fb2")
+	}
+	return res
+}
+
+func (c *catalog) writeBooks(w http.ResponseWriter, r *http.Request, feed *atomFeed, books []*opdsBook) {
+	from, to := paginate(feed, r, len(books), opdsAcquisition)
+	for _, b := range books[from:to] {
+		feed.Entries = append(feed.Entries, c.bookEntry(b))
+	}
+	writeFeed(w, feed, opdsAcquisition)
+}
+
+func (c *catalog) handleBooks(w http.ResponseWriter, r *http.Request) {
+
+	c.mu.RLock()
+	books := c.books
+	c.mu.RUnlock()
+
+	c.writeBooks(w, r, c.newFeed("books", "All books", r.URL.RequestURI(), opdsAcquisition), books)
+}
+
+// genreName returns human readable genre name to be shown instead of FB2 genre code.
+func (c *catalog) genreName(code string) string {
+	return processor.GenreName(code, c.env.Cfg)
+}
+
+// handleGroups returns navigation feed handler listing all values of the book property. When label is not nil it
+// produces titles shown for values, values themselves are kept in links.
+func (c *catalog) handleGroups(name, item, title string, values func(*opdsBook) []string, label func(string) string) http.HandlerFunc {
+	if label == nil {
+		label = func(v string) string { return v }
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		counts := make(map[string]int)
+		c.mu.RLock()
+		for _, b := range c.books {
+			for _, v := range values(b) {
+				counts[v]++
+			}
+		}
+		c.mu.RUnlock()
+
+		keys := make([]string, 0, len(counts))
+		for k := range counts {
+			keys = append(keys, k)
+		}
+		labels := make(map[string]string, len(keys))
+		for _, k := range keys {
+			labels[k] = label(k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if li, lj := strings.ToLower(labels[keys[i]]), strings.ToLower(labels[keys[j]]); li != lj {
+				return li < lj
+			}
+			return keys[i] < keys[j]
+		})
+
+		feed := c.newFeed(name, title, r.URL.RequestURI(), opdsNavigation)
+		feed.Links = append(feed.Links, atomLink{Rel: "up", Href: "/opds", Type: opdsNavigation})
+
+		from, to := paginate(feed, r, len(keys), opdsNavigation)
+		for _, k := range keys[from:to] {
+			sum := sha1.Sum([]byte(k))
+			feed.Entries = append(feed.Entries, c.navEntry(item+":"+hex.EncodeToString(sum[:10]), labels[k],
+				"/opds/"+item+"?"+url.Values{"name": {k}}.Encode(), opdsAcquisition, fmt.Sprintf("%d books", counts[k])))
+		}
+		writeFeed(w, feed, opdsNavigation)
+	}
+}
+
+// handleGroup returns acquisition feed handler listing books with specified value of the book property. When label
+// is not nil it produces feed title for the value.
+func (c *catalog) handleGroup(item string, values func(*opdsBook) []string, label func(string) string) http.HandlerFunc {
+	if label == nil {
+		label = func(v string) string { return v }
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		name := r.URL.Query().Get("name")
+		if len(name) == 0 {
+			http.Error(w, "name is not specified", http.StatusBadRequest)
+			return
+		}
+
+		var books []*opdsBook
+		c.mu.RLock()
+		for _, b := range c.books {
+			for _, v := range values(b) {
+				if v == name {
+					books = append(books, b)
+					break
+				}
+			}
+		}
+		c.mu.RUnlock()
+
+		if item == "sequence" {
+			sort.SliceStable(books, func(i, j int) bool { return books[i].info.SeqNum < books[j].info.SeqNum })
+		}
+
+		sum := sha1.Sum([]byte(name))
+		feed := c.newFeed(item+":"+hex.EncodeToString(sum[:10]), label(name), r.URL.RequestURI(), opdsAcquisition)
+		c.writeBooks(w, r, feed, books)
+	}
+}
+
+func (c *catalog) handleSearch(w http.ResponseWriter, r *http.Request) {
+
+	q := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+
+	var books []*opdsBook
+	if len(q) > 0 {
+		c.mu.RLock()
+		for _, b := range c.books {
+			fields := append([]string{b.info.Title, b.info.SeqName}, b.info.Authors...)
+			for _, f := range fields {
+				if strings.Contains(strings.ToLower(f), q) {
+					books = append(books, b)
+					break
+				}
+			}
+		}
+		c.mu.RUnlock()
+	}
+
+	feed := c.newFeed("search", "Search results", r.URL.RequestURI(), opdsAcquisition)
+	c.writeBooks(w, r, feed, books)
+}
+
+func (c *catalog) handleOpenSearch(w http.ResponseWriter, r *http.Request) {
+
+	desc := openSearch{
+		Xmlns:       "http://a9.com/-/spec/opensearch/1.1/",
+		ShortName:   c.title,
+		Description: "Search by title, author or series",
+	}
+	desc.URL.Type = opdsAcquisition
+	desc.URL.Template = "/opds/search?q={searchTerms}"
+
+	writeFeed(w, desc, opdsSearch)
+}
+
+func (c *catalog) lookup(w http.ResponseWriter, r *http.Request) *opdsBook {
+	c.mu.RLock()
+	b, ok := c.byID[r.URL.Query().Get("id")]
+	c.mu.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return nil
+	}
+	return b
+}
+
+// handleCover returns handler serving cover images or thumbnails, results are cached.
+func (c *catalog) handleCover(thumb bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		b := c.lookup(w, r)
+		if b == nil {
+			return
+		}
+
+		width, height := opdsThumbWidth, opdsThumbHeight
+		name := "thumbnail.jpg"
+		if !thumb {
+			cfg := c.env.Cfg.Doc.Cover
+			width, height = cfg.Width, cfg.Height
+			name = "cover.jpg"
+		}
+		cached := filepath.Join(c.cache, b.id, name)
+		if fi, err := os.Stat(cached); err == nil && !fi.ModTime().Before(b.updated) {
+			http.ServeFile(w, r, cached)
+			return
+		}
+
+		var data []byte
+		for _, f := range []string{"epub", "kepub", "fb2", "azw3", "mobi"} {
+			fname := b.files[f]
+			if f == "fb2" {
+				fname = b.source
+			}
+			if len(fname) == 0 {
+				continue
+			}
+			var (
+				info *processor.BookInfo
+				err  error
+			)
+			switch f {
+			case "epub", "kepub":
+				info, err = processor.ReadEpubInfo(fname)
+			case "fb2":
+				info, err = readBookInfo(fname, c.env)
+			}
+			if err != nil {
+				c.env.Log.Debug("Unable to read book", zap.String("file", fname), zap.Error(err))
+				continue
+			}
+			if data, err = processor.ReadThumbnail(fname, info, width, height, c.env.Log); err == nil && len(data) > 0 {
+				break
+			}
+		}
+		if len(data) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		if err := os.MkdirAll(filepath.Dir(cached), 0755); err == nil {
+			if err := os.WriteFile(cached, data, 0644); err != nil {
+				c.env.Log.Debug("Unable to cache image", zap.String("file", cached), zap.Error(err))
+			}
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		_, _ = w.Write(data)
+	}
+}
+
+func (c *catalog) handleGet(w http.ResponseWriter, r *http.Request) {
+
+	b := c.lookup(w, r)
+	if b == nil {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if fname, ok := b.files[format]; ok {
+		sendResult(w, r, fname)
+		return
+	}
+	if len(b.source) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if format == "fb2" {
+		sendResult(w, r, b.source)
+		return
+	}
+
+	var convertible bool
+	for _, f := range c.formats {
+		convertible = convertible || f == format
+	}
+	if !convertible {
+		http.Error(w, fmt.Sprintf("unsupported format: %s", format), http.StatusBadRequest)
+		return
+	}
+
+	fname, err := c.convertSource(b, format)
+	if err != nil {
+		c.env.Log.Error("Unable to convert book", zap.String("file", b.source), zap.String("format", format), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sendResult(w, r, fname)
+}
+
+// convertSource converts source book to requested format, results are cached until source changes.
+func (c *catalog) convertSource(b *opdsBook, format string) (string, error) {
+
+	c.convert.Lock()
+	defer c.convert.Unlock()
+
+	fi, err := os.Stat(b.source)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(c.cache, b.id, format)
+	find := func() string {
+		var res string
+		_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() && !info.ModTime().Before(fi.ModTime()) {
+				if f, _ := bookFormat(info.Name()); f == format || (f == "epub" && format == "kepub") {
+					res = path
+				}
+			}
+			return nil
+		})
+		return res
+	}
+	if fname := find(); len(fname) > 0 {
+		return fname, nil
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	ok, enc, err := isBookFile(b.source)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("not an FB2 book: %s", b.source)
+	}
+	file, err := os.Open(b.source)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if err := processBook(file, enc, filepath.Base(b.source), dir, true, false, true, processor.ParseFmtString(format), c.env); err != nil {
+		return "", err
+	}
+	if fname := find(); len(fname) > 0 {
+		return fname, nil
+	}
+	return "", errors.New("conversion produced no results")
+}
+
+// Opds is "opds" command body. It serves OPDS catalog of the library until interrupted.
+func Opds(ctx *cli.Context) (err error) {
+
+	const (
+		errPrefix = "opds: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	library := ctx.Args().Get(0)
+	if len(library) == 0 {
+		return cli.Exit(errors.New(errPrefix+"no library directory has been specified"), errCode)
+	}
+	if library, err = filepath.Abs(library); err != nil {
+		return cli.Exit(fmt.Errorf("%snormalizing library path failed", errPrefix), errCode)
+	}
+	if fi, err := os.Stat(library); err != nil || !fi.IsDir() {
+		return cli.Exit(fmt.Errorf("%slibrary must be existing directory (%s)", errPrefix, library), errCode)
+	}
+
+	source := ctx.String("source")
+	if len(source) > 0 {
+		if source, err = filepath.Abs(source); err != nil {
+			return cli.Exit(fmt.Errorf("%snormalizing source path failed", errPrefix), errCode)
+		}
+	}
+
+	var formats []string
+	for _, f := range strings.Split(ctx.String("formats"), ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if len(f) == 0 {
+			continue
+		}
+		if processor.ParseFmtString(f) == processor.UnsupportedOutputFmt {
+			env.Log.Warn("Unknown conversion format requested, ignoring", zap.String("format", f))
+			continue
+		}
+		formats = append(formats, f)
+	}
+
+	cache := ctx.String("cache")
+	if len(cache) == 0 {
+		if cache, err = os.MkdirTemp("", "fb2c-opds-"); err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to create cache directory: %w", errPrefix, err), errCode)
+		}
+		defer os.RemoveAll(cache)
+	} else if cache, err = filepath.Abs(cache); err != nil {
+		return cli.Exit(fmt.Errorf("%snormalizing cache path failed", errPrefix), errCode)
+	}
+
+	c := newCatalog(env, library, source, cache, ctx.String("title"), formats)
+	if err := c.scan(); err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to scan library: %w", errPrefix, err), errCode)
+	}
+
+	srv := &http.Server{
+		Addr:              ctx.String("listen"),
+		Handler:           c,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	interruptions := make(chan os.Signal, 1)
+	signal.Notify(interruptions, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interruptions)
+
+	rescan := ctx.Duration("rescan")
+	if rescan <= 0 {
+		rescan = time.Hour
+	}
+	ticker := time.NewTicker(rescan)
+	defer ticker.Stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	env.Log.Info("Catalog starting", zap.String("address", srv.Addr), zap.String("library", library), zap.String("source", source))
+	defer func(start time.Time) {
+		env.Log.Info("Catalog stopped", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	for {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, http.ErrServerClosed) {
+				return cli.Exit(fmt.Errorf("%sunable to serve: %w", errPrefix, err), errCode)
+			}
+			return nil
+		case <-ticker.C:
+			if err := c.scan(); err != nil {
+				env.Log.Error("Unable to rescan library", zap.Error(err))
+			}
+		case <-interruptions:
+			sctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if err := srv.Shutdown(sctx); err != nil {
+				env.Log.Warn("Unable to shutdown catalog gracefully", zap.Error(err))
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+func newTestCatalog(t *testing.T) *catalog {
+	t.Helper()
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatalf("unable to build configuration: %v", err)
+	}
+	env := &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}
+
+	library, source := t.TempDir(), t.TempDir()
+	if err := os.MkdirAll(filepath.Join(source, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// same book converted and as a source, plus one available only as a source
+	if err := processBook(strings.NewReader(testBook), encUTF8, "book.fb2", library, true, false, true, processor.OEpub, env); err != nil {
+		t.Fatalf("unable to convert: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "book.fb2"), []byte(testBook), 0644); err != nil {
+		t.Fatal(err)
+	}
+	other := strings.NewReplacer("Test Book", "Other Book", "1b3c5e7a", "2b3c5e7a", "Tests", "Others").Replace(testBook)
+	if err := os.WriteFile(filepath.Join(source, "sub", "other.fb2"), []byte(other), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newCatalog(env, library, source, t.TempDir(), "Test", []string{"epub", "kepub"})
+	if err := c.scan(); err != nil {
+		t.Fatalf("unable to scan: %v", err)
+	}
+	return c
+}
+
+func getFeed(t *testing.T, c *catalog, target string) *atomFeed {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: unexpected status %d", target, w.Code)
+	}
+	var feed atomFeed
+	if err := xml.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+		t.Fatalf("%s: unable to parse feed: %v", target, err)
+	}
+	return &feed
+}
+
+func TestOpdsCatalog(t *testing.T) {
+	c := newTestCatalog(t)
+
+	if feed := getFeed(t, c, "/opds"); len(feed.Entries) != 5 {
+		t.Errorf("root: unexpected number of entries %d", len(feed.Entries))
+	}
+
+	feed := getFeed(t, c, "/opds/books")
+	if len(feed.Entries) != 2 {
+		t.Fatalf("books: unexpected number of entries %d", len(feed.Entries))
+	}
+	// converted book meta information comes from epub, so title is decorated according to configuration
+	var converted *atomEntry
+	for i := range feed.Entries {
+		if strings.Contains(feed.Entries[i].ID, "1b3c5e7a") {
+			converted = &feed.Entries[i]
+		}
+	}
+	if converted == nil || !strings.HasSuffix(converted.Title, "Test Book") {
+		t.Fatalf("books: converted book not found %+v", feed.Entries)
+	}
+	var formats []string
+	for _, l := range converted.Links {
+		if l.Rel == opdsRelAcquisition {
+			formats = append(formats, l.Title)
+		}
+	}
+	if strings.Join(formats, ",") != "EPUB,KEPUB,FB2" {
+		t.Errorf("books: unexpected acquisition links %v", formats)
+	}
+
+	if feed := getFeed(t, c, "/opds/author?name=Test+Author"); len(feed.Entries) != 1 || feed.Entries[0].Title != "Other Book" {
+		t.Errorf("author: unexpected entries %+v", feed.Entries)
+	}
+	if feed := getFeed(t, c, "/opds/sequence?name=Others"); len(feed.Entries) != 1 || feed.Entries[0].Title != "Other Book" {
+		t.Errorf("sequence: unexpected entries %+v", feed.Entries)
+	}
+	if feed := getFeed(t, c, "/opds/search?q=other"); len(feed.Entries) != 1 {
+		t.Errorf("search: unexpected number of entries %d", len(feed.Entries))
+	}
+
+	// genres are shown by names, codes stay in links
+	feed = getFeed(t, c, "/opds/genres")
+	if len(feed.Entries) != 1 || feed.Entries[0].Title != "Science Fiction" ||
+		len(feed.Entries[0].Links) == 0 || feed.Entries[0].Links[0].Href != "/opds/genre?name=sf" {
+		t.Errorf("genres: unexpected entries %+v", feed.Entries)
+	}
+	feed = getFeed(t, c, "/opds/genre?name=sf")
+	if feed.Title != "Science Fiction" || len(feed.Entries) != 2 {
+		t.Errorf("genre: unexpected feed %q with %d entries", feed.Title, len(feed.Entries))
+	}
+	for _, e := range feed.Entries {
+		if len(e.Categories) != 1 || e.Categories[0].Term != "sf" || e.Categories[0].Label != "Science Fiction" {
+			t.Errorf("genre: unexpected categories %+v", e.Categories)
+		}
+	}
+}
+
+func TestOpdsGet(t *testing.T) {
+	c := newTestCatalog(t)
+
+	feed := getFeed(t, c, "/opds/search?q=other")
+	if len(feed.Entries) != 1 {
+		t.Fatalf("search: unexpected number of entries %d", len(feed.Entries))
+	}
+	var href string
+	for _, l := range feed.Entries[0].Links {
+		if l.Rel == opdsRelAcquisition && l.Title == "EPUB" {
+			href = l.Href
+		}
+	}
+	if len(href) == 0 {
+		t.Fatal("get: no epub acquisition link")
+	}
+
+	// converted on the fly, second time from cache
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, httptest.NewRequest(http.MethodGet, href, nil))
+		if w.Code != http.StatusOK || !bytes.HasPrefix(w.Body.Bytes(), []byte("PK")) {
+			t.Fatalf("get: unexpected status %d", w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest(http.MethodGet, strings.Replace(href, "format=epub", "format=azw3", 1), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("get: unexpected status for unsupported format %d", w.Code)
+	}
+}
+
+// writeTestAzw3 writes minimal sideloaded Kindle book: record 0 with mobi and EXTH headers and cover image as the only
+// resource.
+func writeTestAzw3(t *testing.T, fname string) {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 60, 80))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+	img.Set(1, 1, color.Black)
+	cover := new(bytes.Buffer)
+	if err := jpeg.Encode(cover, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	exth := new(bytes.Buffer)
+	records := []struct {
+		id   uint32
+		data []byte
+	}{
+		{113, []byte("B000000001")},
+		{501, []byte("EBOK")},
+		{201, []byte{0, 0, 0, 0}},
+	}
+	for _, r := range records {
+		_ = binary.Write(exth, binary.BigEndian, r.id)
+		_ = binary.Write(exth, binary.BigEndian, uint32(8+len(r.data)))
+		exth.Write(r.data)
+	}
+
+	const headerLen = 232
+	rec0 := make([]byte, 16+headerLen)
+	copy(rec0[16:], "MOBI")
+	binary.BigEndian.PutUint32(rec0[20:], headerLen)
+	binary.BigEndian.PutUint32(rec0[108:], 1) // first resource record
+	rec0 = append(rec0, "EXTH"...)
+	rec0 = binary.BigEndian.AppendUint32(rec0, uint32(12+exth.Len()))
+	rec0 = binary.BigEndian.AppendUint32(rec0, uint32(len(records)))
+	rec0 = append(rec0, exth.Bytes()...)
+	binary.BigEndian.PutUint32(rec0[84:], uint32(len(rec0))) // title offset
+	rec0 = append(rec0, "Title"...)
+
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 60))
+	buf.WriteString("BOOKMOBI")
+	buf.Write(make([]byte, 8))
+	_ = binary.Write(&buf, binary.BigEndian, uint16(2))
+	ofs := 78 + 2*8
+	for i, r := range [][]byte{rec0, cover.Bytes()} {
+		_ = binary.Write(&buf, binary.BigEndian, uint32(ofs))
+		_ = binary.Write(&buf, binary.BigEndian, uint32(2*i))
+		ofs += len(r)
+	}
+	buf.Write(rec0)
+	buf.Write(cover.Bytes())
+	if err := os.WriteFile(fname, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpdsCoverFallback(t *testing.T) {
+	c := newTestCatalog(t)
+
+	dir := t.TempDir()
+	broken, azw3 := filepath.Join(dir, "book.epub"), filepath.Join(dir, "book.azw3")
+	if err := os.WriteFile(broken, []byte("not a zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeTestAzw3(t, azw3)
+
+	// epub is tried first and fails, cover must still come from azw3
+	b := &opdsBook{
+		id:      "fallback",
+		info:    &processor.BookInfo{Title: "Fallback"},
+		files:   map[string]string{"epub": broken, "azw3": azw3},
+		updated: time.Now(),
+	}
+	c.mu.Lock()
+	c.byID[b.id] = b
+	c.mu.Unlock()
+
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/opds/thumbnail?id="+b.id, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("thumbnail: unexpected status %d", w.Code)
+	}
+	if _, _, err := image.Decode(w.Body); err != nil {
+		t.Errorf("thumbnail: unable to decode image: %v", err)
+	}
+}
@@ -0,0 +1,747 @@
+package commands
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// Job states for asynchronous conversions.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// job keeps state of a single asynchronous conversion.
+type job struct {
+	ID       string     `json:"id"`
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+	//
+	dir    string
+	fname  string
+	format processor.OutputFmt
+	env    *state.LocalEnv
+	result string
+	seen   time.Time // last time job was requested
+}
+
+// server implements conversion REST API.
+type server struct {
+	env      *state.LocalEnv
+	mux      *http.ServeMux
+	sem      chan struct{}
+	maxQueue int
+	maxSize  int64
+	workDir  string
+	ttl      time.Duration
+	//
+	mu      sync.Mutex
+	jobs    map[string]*job
+	pending []*job     // asynchronous jobs waiting for worker
+	ready   *sync.Cond // signals new pending jobs and closing
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// newServer returns http handler for conversion service. It allows up to maxJobs simultaneous conversions and up to
+// maxQueue asynchronous conversions waiting for them, uploads up to maxSize bytes and keeps results of asynchronous
+// conversions for ttl.
+func newServer(env *state.LocalEnv, workDir string, maxJobs, maxQueue int, maxSize int64, ttl time.Duration) *server {
+
+	if maxJobs <= 0 {
+		maxJobs = 1
+	}
+	if maxQueue < 0 {
+		maxQueue = 0
+	}
+	s := &server{
+		env:      env,
+		mux:      http.NewServeMux(),
+		sem:      make(chan struct{}, maxJobs),
+		maxQueue: maxQueue,
+		maxSize:  maxSize,
+		workDir:  workDir,
+		ttl:      ttl,
+		jobs:     make(map[string]*job),
+	}
+	s.ready = sync.NewCond(&s.mu)
+	s.mux.HandleFunc("/health", s.handleHealth)
+	s.mux.HandleFunc("/convert", s.handleConvert)
+	s.mux.HandleFunc("/meta", s.handleMeta)
+	s.mux.HandleFunc("/jobs/", s.handleJobs)
+
+	// asynchronous conversions are performed by fixed number of workers
+	for i := 0; i < maxJobs; i++ {
+		s.wg.Add(1)
+		go s.worker()
+	}
+	return s
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// close waits for running conversions, drops queued ones and removes all results.
+func (s *server) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.ready.Broadcast()
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, j := range s.jobs {
+		os.RemoveAll(j.dir)
+		delete(s.jobs, id)
+	}
+}
+
+// expire removes asynchronous conversions nobody asked about for more than ttl: finished ones with their results and
+// abandoned ones still waiting in the queue. Running conversions are kept until they finish.
+func (s *server) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, j := range s.jobs {
+		last := j.seen
+		if j.Finished != nil && j.Finished.After(last) {
+			last = *j.Finished
+		}
+		if j.Status == jobRunning || now.Sub(last) <= s.ttl {
+			continue
+		}
+		s.env.Log.Debug("Removing expired job", zap.String("job", id), zap.String("status", j.Status))
+		os.RemoveAll(j.dir)
+		delete(s.jobs, id)
+	}
+	pending := s.pending[:0]
+	for _, j := range s.pending {
+		if s.jobs[j.ID] == j {
+			pending = append(pending, j)
+		}
+	}
+	s.pending = pending
+}
+
+// worker performs queued asynchronous conversions until server is closed. Jobs removed while waiting are skipped.
+func (s *server) worker() {
+	defer s.wg.Done()
+
+	for {
+		s.mu.Lock()
+		for len(s.pending) == 0 && !s.closed {
+			s.ready.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		j := s.pending[0]
+		s.pending = s.pending[1:]
+		s.mu.Unlock()
+
+		s.sem <- struct{}{}
+		s.mu.Lock()
+		if s.closed || s.jobs[j.ID] != j {
+			s.mu.Unlock()
+			<-s.sem
+			continue
+		}
+		j.Status = jobRunning
+		s.mu.Unlock()
+
+		res, err := convertUpload(j.fname, j.dir, j.format, j.env)
+		<-s.sem
+
+		s.mu.Lock()
+		now := time.Now()
+		j.Finished = &now
+		if err != nil {
+			j.Status, j.Error = jobFailed, err.Error()
+		} else {
+			j.Status, j.result = jobDone, res
+		}
+		s.mu.Unlock()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	s.mu.Lock()
+	jobs, queued := len(s.jobs), len(s.pending)
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":   "ok",
+		"running":  len(s.sem),
+		"capacity": cap(s.sem),
+		"queued":   queued,
+		"queue":    s.maxQueue,
+		"jobs":     jobs,
+	})
+}
+
+// receive stores uploaded book in a new working directory. Book could be sent as multipart form field "file" or as
+// request body with file name in "name" parameter.
+func (s *server) receive(w http.ResponseWriter, r *http.Request) (dir, fname string, err error) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxSize)
+
+	var (
+		in   io.Reader
+		name string
+	)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		if err = r.ParseMultipartForm(32 << 20); err != nil {
+			return "", "", fmt.Errorf("unable to parse request: %w", err)
+		}
+		f, h, err := r.FormFile("file")
+		if err != nil {
+			return "", "", fmt.Errorf("no book in request: %w", err)
+		}
+		defer f.Close()
+		in, name = f, h.Filename
+	} else {
+		in, name = r.Body, r.URL.Query().Get("name")
+	}
+
+	name = filepath.Base(filepath.Clean("/" + filepath.FromSlash(name)))
+	if name == string(filepath.Separator) || name == "." {
+		return "", "", errors.New("book file name is not specified")
+	}
+
+	if dir, err = os.MkdirTemp(s.workDir, "fb2c-serve-"); err != nil {
+		return "", "", fmt.Errorf("unable to create working directory: %w", err)
+	}
+	fname = filepath.Join(dir, "in", name)
+
+	err = func() error {
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			return err
+		}
+		out, err := os.Create(fname)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		_, err = io.Copy(out, in)
+		return err
+	}()
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", "", fmt.Errorf("unable to receive book: %w", err)
+	}
+	return dir, fname, nil
+}
+
+// serveOverwritable lists "document" configuration keys clients are allowed to change, key allows its whole subtree.
+// Only presentation settings are accepted: nothing referring to files on the server or programs to run.
+var serveOverwritable = map[string]bool{
+	"title_format":                    true,
+	"author_format":                   true,
+	"author_format_meta":              true,
+	"transliterate_meta":              true,
+	"open_from_cover":                 true,
+	"chapter_per_file":                true,
+	"chapter_level":                   true,
+	"series_number_positions":         true,
+	"remove_png_transparency":         true,
+	"images_scale_factor":             true,
+	"characters_per_page":             true,
+	"pages_per_file":                  true,
+	"max_file_size":                   true,
+	"chapter_subtitle_dividers":       true,
+	"insert_soft_hyphen":              true,
+	"ignore_nonbreakable_space":       true,
+	"use_broken_images":               true,
+	"fix_zip_format":                  true,
+	"dropcaps":                        true,
+	"notes":                           true,
+	"annotation":                      true,
+	"toc":                             true,
+	"cover.always_convert":            true,
+	"cover.default":                   true,
+	"cover.width":                     true,
+	"cover.height":                    true,
+	"cover.resize":                    true,
+	"cover.stamp_placement":           true,
+	"vignettes.create":                true,
+	"fonts.subset":                    true,
+	"fonts.obfuscation":               true,
+	"sentences.abbreviations":         true,
+	"genres.subjects":                 true,
+	"genres.language":                 true,
+	"genres.names":                    true,
+	"text":                            true,
+	"html":                            true,
+	"pdf":                             true,
+	"transform":                       true,
+	"kindlegen.compression_level":     true,
+	"kindlegen.no_mobi_optimization":  true,
+	"kindlegen.remove_personal_label": true,
+	"kindlegen.generate_apnx":         true,
+	"kindlegen.force_asin_on_azw3":    true,
+}
+
+// checkOverwrite makes sure configuration overwrite sent by client only changes allowed document settings.
+func checkOverwrite(overwrite string) error {
+
+	var sections map[string]interface{}
+	if err := json.Unmarshal([]byte(overwrite), &sections); err != nil {
+		return fmt.Errorf("unable to parse configuration overwrite: %w", err)
+	}
+	var check func(prefix string, values map[string]interface{}) error
+	check = func(prefix string, values map[string]interface{}) error {
+		for k, v := range values {
+			key := prefix + k
+			if serveOverwritable[key] {
+				continue
+			}
+			sub, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("configuration setting document.%s could not be changed", key)
+			}
+			var partial bool
+			for allowed := range serveOverwritable {
+				partial = partial || strings.HasPrefix(allowed, key+".")
+			}
+			if !partial {
+				return fmt.Errorf("configuration setting document.%s could not be changed", key)
+			}
+			if err := check(key+".", sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for name, v := range sections {
+		doc, ok := v.(map[string]interface{})
+		if name != "document" || !ok {
+			return fmt.Errorf("configuration section %s could not be changed", name)
+		}
+		if err := check("", doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requestEnv prepares request scoped environment with optional configuration overwrite (JSON).
+func (s *server) requestEnv(id, overwrite string) (*state.LocalEnv, error) {
+
+	env := &state.LocalEnv{
+		Mhl: config.MhlNone,
+		Cfg: s.env.Cfg,
+		Log: s.env.Log.With(zap.String("job", id)),
+	}
+	if len(overwrite) > 0 {
+		if err := checkOverwrite(overwrite); err != nil {
+			return nil, err
+		}
+		cfg, err := s.env.Cfg.Overwrite([]byte(overwrite))
+		if err != nil {
+			return nil, err
+		}
+		env.Cfg = cfg
+	}
+	return env, nil
+}
+
+// convertUpload processes uploaded book or archive and returns path to the result. When more than one book is produced
+// results are packed in zip archive.
+func convertUpload(fname, dir string, format processor.OutputFmt, env *state.LocalEnv) (string, error) {
+
+	out := filepath.Join(dir, "out")
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return "", err
+	}
+
+	if ok, err := isArchiveFile(fname); err != nil {
+		return "", err
+	} else if ok {
+		if err := processArchive(fname, "", "", []target{{format: format, dst: out, env: env}}, true, true, nil, env); err != nil {
+			return "", err
+		}
+	} else {
+		ok, enc, err := isBookFile(fname)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", errors.New("input was not recognized as FB2 book or archive")
+		}
+		file, err := os.Open(fname)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		if err := processBook(file, enc, filepath.Base(fname), out, true, false, true, format, env); err != nil {
+			return "", err
+		}
+	}
+
+	var results []string
+	err := filepath.Walk(out, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			results = append(results, path)
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	switch len(results) {
+	case 0:
+		return "", errors.New("conversion produced no results")
+	case 1:
+		return results[0], nil
+	}
+
+	// pack everything together
+	res := filepath.Join(dir, "results.zip")
+	err = func() error {
+		f, err := os.Create(res)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		zw := zip.NewWriter(f)
+		for _, path := range results {
+			rel, _ := filepath.Rel(out, path)
+			w, err := zw.Create(filepath.ToSlash(rel))
+			if err != nil {
+				return err
+			}
+			in, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(w, in)
+			in.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	}()
+	if err != nil {
+		return "", err
+	}
+	return res, nil
+}
+
+func sendResult(w http.ResponseWriter, r *http.Request, fname string) {
+
+	f, err := os.Open(fname)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	name := filepath.Base(fname)
+	ct := "application/octet-stream"
+	switch {
+	case strings.HasSuffix(strings.ToLower(name), ".epub"):
+		ct = "application/epub+zip"
+	case strings.EqualFold(filepath.Ext(name), ".mobi"):
+		ct = "application/x-mobipocket-ebook"
+	case strings.EqualFold(filepath.Ext(name), ".azw3"):
+		ct = "application/vnd.amazon.ebook"
+	case strings.EqualFold(filepath.Ext(name), ".zip"):
+		ct = "application/zip"
+	case strings.EqualFold(filepath.Ext(name), ".txt"):
+		ct = "text/plain"
+	case strings.EqualFold(filepath.Ext(name), ".md"):
+		ct = "text/markdown"
+	case strings.EqualFold(filepath.Ext(name), ".pdf"):
+		ct = "application/pdf"
+	case strings.EqualFold(filepath.Ext(name), ".docx"):
+		ct = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	case strings.EqualFold(filepath.Ext(name), ".odt"):
+		ct = "application/vnd.oasis.opendocument.text"
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+func (s *server) handleConvert(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	dir, fname, err := s.receive(w, r)
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			writeError(w, http.StatusRequestEntityTooLarge, err)
+		} else {
+			writeError(w, http.StatusBadRequest, err)
+		}
+		return
+	}
+
+	to := r.FormValue("to")
+	if len(to) == 0 {
+		to = "epub"
+	}
+	format := processor.ParseFmtString(to)
+	if format == processor.UnsupportedOutputFmt {
+		os.RemoveAll(dir)
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unsupported output format: %s", to))
+		return
+	}
+
+	id := uuid.New().String()
+	env, err := s.requestEnv(id, r.FormValue("config"))
+	if err != nil {
+		os.RemoveAll(dir)
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if async, _ := strconv.ParseBool(r.FormValue("async")); async {
+		now := time.Now()
+		j := &job{ID: id, Status: jobQueued, Created: now, dir: dir, fname: fname, format: format, env: env, seen: now}
+
+		s.mu.Lock()
+		queued := !s.closed && len(s.pending) < s.maxQueue
+		if queued {
+			s.jobs[id] = j
+			s.pending = append(s.pending, j)
+			s.ready.Signal()
+		}
+		// job is changed by worker under lock, reply with its state at the moment it was accepted
+		accepted := *j
+		s.mu.Unlock()
+
+		if !queued {
+			os.RemoveAll(dir)
+			writeError(w, http.StatusServiceUnavailable, errors.New("too many conversions waiting, try again later"))
+			return
+		}
+		w.Header().Set("Location", "/jobs/"+id)
+		writeJSON(w, http.StatusAccepted, &accepted)
+		return
+	}
+
+	defer os.RemoveAll(dir)
+
+	select {
+	case s.sem <- struct{}{}:
+		defer func() { <-s.sem }()
+	case <-r.Context().Done():
+		return
+	}
+
+	start := time.Now()
+	res, err := convertUpload(fname, dir, format, env)
+	if err != nil {
+		env.Log.Error("Conversion failed", zap.String("file", filepath.Base(fname)), zap.Error(err))
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	env.Log.Info("Conversion served", zap.String("file", filepath.Base(fname)), zap.Duration("elapsed", time.Since(start)))
+	sendResult(w, r, res)
+}
+
+func (s *server) handleJobs(w http.ResponseWriter, r *http.Request) {
+
+	id, tail, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	var (
+		cp     job
+		result string
+	)
+	if ok {
+		j.seen = time.Now()
+		cp, result = *j, j.result
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job not found: %s", id))
+		return
+	}
+
+	switch {
+	case tail == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, cp)
+	case tail == "" && r.Method == http.MethodDelete:
+		if cp.Finished == nil {
+			writeError(w, http.StatusConflict, errors.New("job is not finished"))
+			return
+		}
+		s.mu.Lock()
+		delete(s.jobs, id)
+		s.mu.Unlock()
+		os.RemoveAll(cp.dir)
+		w.WriteHeader(http.StatusNoContent)
+	case tail == "result" && r.Method == http.MethodGet:
+		switch cp.Status {
+		case jobDone:
+			sendResult(w, r, result)
+		case jobFailed:
+			writeError(w, http.StatusUnprocessableEntity, errors.New(cp.Error))
+		default:
+			writeError(w, http.StatusConflict, errors.New("job is not finished"))
+		}
+	case tail == "" || tail == "result":
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown resource: %s", r.URL.Path))
+	}
+}
+
+func (s *server) handleMeta(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	dir, fname, err := s.receive(w, r)
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			writeError(w, http.StatusRequestEntityTooLarge, err)
+		} else {
+			writeError(w, http.StatusBadRequest, err)
+		}
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	env, err := s.requestEnv(uuid.New().String(), r.FormValue("config"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	info, err := readBookInfo(fname, env)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// Serve is "serve" command body. It runs HTTP conversion service until interrupted.
+func Serve(ctx *cli.Context) (err error) {
+
+	const (
+		errPrefix = "serve: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	workDir := ctx.String("workdir")
+	if len(workDir) > 0 {
+		if workDir, err = filepath.Abs(workDir); err != nil {
+			return cli.Exit(fmt.Errorf("%snormalizing working directory path failed", errPrefix), errCode)
+		}
+		if err = os.MkdirAll(workDir, 0755); err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to create working directory: %w", errPrefix, err), errCode)
+		}
+	}
+
+	s := newServer(env, workDir, ctx.Int("max-jobs"), ctx.Int("max-queue"), ctx.Int64("max-size")<<20, ctx.Duration("keep"))
+	defer s.close()
+
+	srv := &http.Server{
+		Addr:              ctx.String("listen"),
+		Handler:           s,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	interruptions := make(chan os.Signal, 1)
+	signal.Notify(interruptions, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interruptions)
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	env.Log.Info("Service starting", zap.String("address", srv.Addr), zap.Int("jobs", cap(s.sem)))
+	defer func(start time.Time) {
+		env.Log.Info("Service stopped", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	for {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, http.ErrServerClosed) {
+				return cli.Exit(fmt.Errorf("%sunable to serve: %w", errPrefix, err), errCode)
+			}
+			return nil
+		case now := <-ticker.C:
+			s.expire(now)
+		case <-interruptions:
+			sctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if err := srv.Shutdown(sctx); err != nil {
+				env.Log.Warn("Unable to shutdown service gracefully", zap.Error(err))
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+const testBook = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description>
+<title-info>
+<genre>sf</genre>
+<author><first-name>Test</first-name><last-name>Author</last-name></author>
+<book-title>Test Book</book-title>
+<lang>en</lang>
+<sequence name="Tests" number="2"/>
+</title-info>
+<document-info><id>1b3c5e7a-1111-2222-3333-444455556666</id></document-info>
+</description>
+<body><section><title><p>Chapter</p></title><p>Some text. And some more.</p></section></body>
+</FictionBook>`
+
+func newTestServer(t *testing.T, maxSize int64) *server {
+	t.Helper()
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatalf("unable to build configuration: %v", err)
+	}
+	s := newServer(&state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}, t.TempDir(), 2, 4, maxSize, time.Hour)
+	t.Cleanup(s.close)
+	return s
+}
+
+func uploadRequest(t *testing.T, target, name, content string, fields map[string]string) *http.Request {
+	t.Helper()
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for k, v := range fields {
+		if err := mw.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fw, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, target, body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestServeHealth(t *testing.T) {
+	s := newTestServer(t, 1<<20)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("health: unexpected status %d", w.Code)
+	}
+	var res map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res["status"] != "ok" {
+		t.Fatalf("health: unexpected response %q (%v)", w.Body.String(), err)
+	}
+}
+
+func TestServeMeta(t *testing.T) {
+	s := newTestServer(t, 1<<20)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, uploadRequest(t, "/meta", "book.fb2", testBook, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("meta: unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	var meta processor.BookInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Title != "Test Book" || meta.Lang != "en" || meta.SeqName != "Tests" || meta.SeqNum != 2 {
+		t.Errorf("meta: unexpected result %+v", meta)
+	}
+	if len(meta.Authors) != 1 || meta.Authors[0] != "Test Author" {
+		t.Errorf("meta: unexpected authors %v", meta.Authors)
+	}
+}
+
+func TestServeConvert(t *testing.T) {
+	s := newTestServer(t, 1<<20)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, uploadRequest(t, "/convert", "book.fb2", testBook, map[string]string{"to": "epub"}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("convert: unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/epub+zip" {
+		t.Errorf("convert: unexpected content type %q", ct)
+	}
+	if !bytes.HasPrefix(w.Body.Bytes(), []byte("PK")) {
+		t.Errorf("convert: result is not zip container")
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, uploadRequest(t, "/convert", "book.fb2", testBook, map[string]string{"to": "djvu"}))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("convert: unsupported format, unexpected status %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, uploadRequest(t, "/convert", "book.fb2", testBook, map[string]string{"config": "{broken"}))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("convert: broken configuration, unexpected status %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/convert", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("convert: wrong method, unexpected status %d", w.Code)
+	}
+}
+
+func TestServeConfigOverwrite(t *testing.T) {
+	s := newTestServer(t, 1<<20)
+
+	for _, tc := range []struct {
+		config string
+		status int
+	}{
+		{`{"document":{"notes":{"mode":"inline"},"chapter_per_file":false}}`, http.StatusOK},
+		{`{"document":{"cover":{"resize":"none"},"kindlegen":{"compression_level":0}}}`, http.StatusOK},
+		{`{"document":{"kindlegen":{"path":"/bin/sh"}}}`, http.StatusBadRequest},
+		{`{"document":{"cover":{"image_path":"/etc/passwd"}}}`, http.StatusBadRequest},
+		{`{"document":{"style":"/etc/passwd"}}`, http.StatusBadRequest},
+		{`{"document":{"kindlegen":"/bin/sh"}}`, http.StatusBadRequest},
+		{`{"sendtokindle":{"smtp_server":"example.com"}}`, http.StatusBadRequest},
+		{`{"logger":{}}`, http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, uploadRequest(t, "/convert", "book.fb2", testBook, map[string]string{"to": "epub", "config": tc.config}))
+		if w.Code != tc.status {
+			t.Errorf("convert with %s: expected status %d, got %d: %s", tc.config, tc.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestServeConvertAsync(t *testing.T) {
+	s := newTestServer(t, 1<<20)
+
+	r := httptest.NewRequest(http.MethodPost, "/convert?name=book.fb2&async=true", strings.NewReader(testBook))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("async: unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	var j job
+	if err := json.Unmarshal(w.Body.Bytes(), &j); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/jobs/"+j.ID, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("async: unexpected status %d: %s", w.Code, w.Body.String())
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &j); err != nil {
+			t.Fatal(err)
+		}
+		if j.Status == jobDone || j.Status == jobFailed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("async: job did not finish")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if j.Status != jobDone {
+		t.Fatalf("async: job failed: %s", j.Error)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/jobs/"+j.ID+"/result", nil))
+	if w.Code != http.StatusOK || !bytes.HasPrefix(w.Body.Bytes(), []byte("PK")) {
+		t.Fatalf("async: unexpected result status %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/jobs/"+j.ID, nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("async: unexpected delete status %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/jobs/"+j.ID, nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("async: job still exists after delete, status %d", w.Code)
+	}
+}
+
+func TestServeUploadLimit(t *testing.T) {
+	s := newTestServer(t, 100)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/convert?name=book.fb2", strings.NewReader(testBook)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("limit: unexpected status %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func queued(s *server) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+func TestServeQueue(t *testing.T) {
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatalf("unable to build configuration: %v", err)
+	}
+	s := newServer(&state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}, t.TempDir(), 1, 1, 1<<20, time.Hour)
+	t.Cleanup(s.close)
+
+	submit := func() (int, job) {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/convert?name=book.fb2&async=true", strings.NewReader(testBook)))
+		var j job
+		if w.Code == http.StatusAccepted {
+			if err := json.Unmarshal(w.Body.Bytes(), &j); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, j
+	}
+	dir := func(id string) string {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if j, ok := s.jobs[id]; ok {
+			return j.dir
+		}
+		return ""
+	}
+
+	// occupy the only conversion slot, so worker waits with the first job and the second one stays in the queue
+	s.sem <- struct{}{}
+	code, first := submit()
+	if code != http.StatusAccepted {
+		t.Fatalf("queue: unexpected status %d", code)
+	}
+	for deadline := time.Now().Add(10 * time.Second); queued(s) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("queue: worker did not pick up the job")
+		}
+	}
+	code, second := submit()
+	if code != http.StatusAccepted {
+		t.Fatalf("queue: unexpected status %d", code)
+	}
+	if code, _ := submit(); code != http.StatusServiceUnavailable {
+		t.Fatalf("queue: full queue accepted request, status %d", code)
+	}
+
+	// nobody asked about jobs, they are removed with uploads before being started
+	dirs := []string{dir(first.ID), dir(second.ID)}
+	s.expire(time.Now().Add(2 * time.Hour))
+	for _, d := range dirs {
+		if _, err := os.Stat(d); !os.IsNotExist(err) {
+			t.Errorf("queue: upload of expired job was not removed: %s", d)
+		}
+	}
+	s.mu.Lock()
+	left := len(s.jobs)
+	s.mu.Unlock()
+	if left != 0 {
+		t.Errorf("queue: %d expired jobs left", left)
+	}
+
+	<-s.sem
+	code, last := submit()
+	if code != http.StatusAccepted {
+		t.Fatalf("queue: unexpected status %d", code)
+	}
+	for deadline := time.Now().Add(30 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/jobs/"+last.ID, nil))
+		if err := json.Unmarshal(w.Body.Bytes(), &last); err != nil {
+			t.Fatal(err)
+		}
+		if last.Status == jobDone {
+			break
+		}
+		if last.Status == jobFailed || time.Now().After(deadline) {
+			t.Fatalf("queue: job was not completed, status %s %s", last.Status, last.Error)
+		}
+	}
+}
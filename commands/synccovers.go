@@ -3,8 +3,11 @@ package commands
 import (
 	"errors"
 	"fmt"
+	"image"
+	_ "image/jpeg"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
@@ -32,10 +35,91 @@ func PathExists(path string) (bool, error) {
     return false, err
 }
 
-// SyncCovers reads books in Kindle formats and produces thumbnails for them. Very Kindle specific.
-func SyncCovers(ctx *cli.Context) error {
+// kindleModel describes thumbnails expected by particular Kindle model.
+type kindleModel struct {
+	name          string
+	width, height int
+}
+
+// kindleModels - known thumbnail sizes, first one is used by default.
+var kindleModels = []kindleModel{
+	{"kindle", 330, 470},
+	{"colorsoft", 360, 512},
+	{"scribe", 450, 640},
+}
+
+// detectKindleModel looks at existing thumbnails and selects model with closest thumbnail size.
+func detectKindleModel(sysdir string) (kindleModel, bool) {
+
+	entries, err := os.ReadDir(sysdir)
+	if err != nil {
+		return kindleModels[0], false
+	}
+
+	// Kindle produces thumbnails of the same size for all books it knows about, sample some
+	const samples = 32
+	sizes, n := make(map[image.Point]int), 0
+	for _, e := range entries {
+		if n >= samples {
+			break
+		}
+		if !e.Type().IsRegular() || !strings.EqualFold(filepath.Ext(e.Name()), ".jpg") {
+			continue
+		}
+		f, err := os.Open(filepath.Join(sysdir, e.Name()))
+		if err != nil {
+			continue
+		}
+		cfg, _, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		sizes[image.Pt(cfg.Width, cfg.Height)]++
+		n++
+	}
+
+	var size image.Point
+	for s, c := range sizes {
+		if c > sizes[size] {
+			size = s
+		}
+	}
+	if size.X == 0 {
+		return kindleModels[0], false
+	}
 
-	// var err error
+	res, dist := kindleModels[0], -1
+	for _, m := range kindleModels {
+		dx, dy := m.width-size.X, m.height-size.Y
+		if d := dx*dx + dy*dy; dist < 0 || d < dist {
+			res, dist = m, d
+		}
+	}
+	return res, true
+}
+
+// isKindleBook checks if file could have thumbnail produced by Kindle.
+func isKindleBook(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mobi", ".azw", ".azw3", ".prc":
+		return true
+	}
+	return false
+}
+
+// isKFXBook checks if file is in format we cannot read thumbnail names from.
+func isKFXBook(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".kfx", ".azw8":
+		return true
+	}
+	return false
+}
+
+// SyncCovers reads books in Kindle formats and produces thumbnails for them. Optionally it fixes books Kindle would not
+// show thumbnails for and removes thumbnails of books which are no longer on device. Very Kindle specific.
+func SyncCovers(ctx *cli.Context) error {
 
 	const (
 		errPrefix = "synccovers: "
@@ -63,9 +147,10 @@ func SyncCovers(ctx *cli.Context) error {
 		dir, file = filepath.Split(in)
 	}
 
-	width := ctx.Int("width")
-	height := ctx.Int("height")
 	stretch := ctx.Bool("stretch")
+	fix := ctx.Bool("fix-meta")
+	cleanup := ctx.Bool("cleanup")
+	dryRun := ctx.Bool("dry-run")
 
 	var sysdir string
 	// let's see if we could locate kindle directory
@@ -75,8 +160,8 @@ func SyncCovers(ctx *cli.Context) error {
 			break
 		}
 	}
-	exists, err := PathExists(sysdir)
-	if !exists {
+	device, _ := PathExists(sysdir)
+	if !device {
 		//文件的目录名，取同电子书相同文件夹
 		sysdir = dir
 	}
@@ -85,28 +170,72 @@ func SyncCovers(ctx *cli.Context) error {
 		return cli.Exit(errors.New(errPrefix+"unable to find Kindle system directory along the specified path"), errCode)
 	}
 
-	
-	files, count := 0, 0
+	var model kindleModel
+	switch name := strings.ToLower(ctx.String("model")); name {
+	case "", "auto":
+		var detected bool
+		if model, detected = detectKindleModel(sysdir); detected {
+			env.Log.Info("Kindle model detected by existing thumbnails", zap.String("model", model.name))
+		}
+	default:
+		found := false
+		for _, m := range kindleModels {
+			if m.name == name {
+				model, found = m, true
+				break
+			}
+		}
+		if !found {
+			return cli.Exit(fmt.Errorf("%sunknown Kindle model %s", errPrefix, name), errCode)
+		}
+	}
+	width, height := model.width, model.height
+	if ctx.IsSet("width") {
+		width = ctx.Int("width")
+	}
+	if ctx.IsSet("height") {
+		height = ctx.Int("height")
+	}
+
+	var files, count, fixed, hidden, encrypted, removed int
 
 	makeThumb := func(file, path string) error {
 		ext := filepath.Ext(file)
 		if strings.EqualFold(ext, ".mobi") || strings.EqualFold(ext, ".azw3") {
 			env.Log.Debug("Creating thumbnail", zap.String("file", path))
 			files++
-			created, err := processor.ProduceThumbnail(path, sysdir, width, height, stretch, env.Log)
+			res, err := processor.SyncThumbnail(path, sysdir, width, height, stretch, fix, env.Log)
 			if err != nil {
 				return err
 			}
-			if created {
+			if res.Created {
 				count++
 			}
+			if res.Fixed {
+				fixed++
+				env.Log.Info("Book meta information fixed", zap.String("file", path), zap.String("thumbnail", res.Thumbnail))
+			}
+			if res.Encrypted {
+				encrypted++
+			}
+			if !res.Displayable && !res.Encrypted {
+				hidden++
+				env.Log.Warn("Kindle will not show thumbnail for the book, use --fix-meta to correct", zap.String("file", path))
+			}
 		}
 		return nil
 	}
 
-	env.Log.Info("Thumbnail extraction starting", zap.String("kindle directory", sysdir))
+	env.Log.Info("Thumbnail extraction starting", zap.String("kindle directory", sysdir), zap.Int("width", width), zap.Int("height", height))
 	defer func(start time.Time) {
-		env.Log.Info("Thumbnail extraction completed", zap.Duration("elapsed", time.Since(start)), zap.Int("files", files), zap.Int("extracted", count))
+		env.Log.Info("Thumbnail extraction completed", zap.Duration("elapsed", time.Since(start)),
+			zap.Int("files", files),
+			zap.Int("extracted", count),
+			zap.Int("fixed", fixed),
+			zap.Int("hidden", hidden),
+			zap.Int("encrypted", encrypted),
+			zap.Int("removed", removed),
+		)
 	}(time.Now())
 
 	if len(file) > 0 {
@@ -126,6 +255,94 @@ func SyncCovers(ctx *cli.Context) error {
 
 	if err != nil {
 		env.Log.Error("Unable to process Kindle files", zap.Error(err))
+		return nil
+	}
+
+	if cleanup {
+		if !device {
+			env.Log.Warn("Kindle system directory not found, skipping thumbnails cleanup")
+			return nil
+		}
+		if removed, err = cleanupThumbnails(sysdir, dryRun, env.Log); err != nil {
+			env.Log.Error("Unable to cleanup thumbnails", zap.Error(err))
+		}
 	}
 	return nil
 }
+
+// reStoreASIN matches ASINs of books bought in Amazon store, device manages their thumbnails itself.
+var reStoreASIN = regexp.MustCompile(`^B[0-9A-Z]{9}$`)
+
+// isSideloadedThumbnail checks if thumbnail could belong to sideloaded book: it is for EBOK and its ASIN is not from
+// Amazon store. Thumbnails of personal documents and store books are never touched.
+func isSideloadedThumbnail(name string) bool {
+	if !strings.HasPrefix(name, "thumbnail_") || !strings.HasSuffix(name, "_EBOK_portrait.jpg") {
+		return false
+	}
+	asin := strings.TrimSuffix(strings.TrimPrefix(name, "thumbnail_"), "_EBOK_portrait.jpg")
+	return len(asin) > 0 && !reStoreASIN.MatchString(asin)
+}
+
+// cleanupThumbnails removes thumbnails of sideloaded books which are not present on device anymore. It looks at all
+// books under device root and does nothing if there are books we cannot get thumbnail names from. In dry run mode
+// thumbnails are only reported.
+func cleanupThumbnails(sysdir string, dryRun bool, log *zap.Logger) (int, error) {
+
+	root := filepath.Dir(filepath.Dir(sysdir))
+
+	known := make(map[string]bool)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == filepath.Join(root, "system") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if isKFXBook(info.Name()) {
+			return fmt.Errorf("unable to get thumbnail name from %s", path)
+		}
+		if !isKindleBook(info.Name()) {
+			return nil
+		}
+		name, err := processor.KindleThumbnailName(path)
+		if err != nil {
+			return fmt.Errorf("unable to get thumbnail name from %s: %w", path, err)
+		}
+		if len(name) > 0 {
+			known[name] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	entries, err := os.ReadDir(sysdir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || !isSideloadedThumbnail(name) || known[name] {
+			continue
+		}
+		if dryRun {
+			log.Info("Orphaned thumbnail would be removed", zap.String("thumbnail", name))
+			removed++
+			continue
+		}
+		if err := os.Remove(filepath.Join(sysdir, name)); err != nil {
+			return removed, err
+		}
+		log.Info("Orphaned thumbnail removed", zap.String("thumbnail", name))
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,69 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestCleanupThumbnails(t *testing.T) {
+
+	root := t.TempDir()
+	sysdir := filepath.Join(root, "system", "thumbnails")
+	docs := filepath.Join(root, "documents")
+	for _, dir := range []string{sysdir, docs} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestAzw3(t, filepath.Join(docs, "book.azw3"))
+
+	orphan := "thumbnail_7G4QF2K9XM_EBOK_portrait.jpg"
+	kept := []string{
+		"thumbnail_B000000001_EBOK_portrait.jpg", // book is on device
+		"thumbnail_B07XJ8C8F5_EBOK_portrait.jpg", // store book
+		"thumbnail_7G4QF2K9XM_PDOC_portrait.jpg", // personal document
+		"thumbnail_7G4QF2K9XM_EBOK_landscape.jpg",
+	}
+	for _, name := range append(kept, orphan) {
+		if err := os.WriteFile(filepath.Join(sysdir, name), []byte("jpeg"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(sysdir, name))
+		return err == nil
+	}
+
+	removed, err := cleanupThumbnails(sysdir, true, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 || !exists(orphan) {
+		t.Errorf("dry run: expected 1 thumbnail reported and nothing removed, got %d", removed)
+	}
+
+	removed, err = cleanupThumbnails(sysdir, false, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 || exists(orphan) {
+		t.Errorf("expected orphaned thumbnail removed, got %d", removed)
+	}
+	for _, name := range kept {
+		if !exists(name) {
+			t.Errorf("%s must not be removed", name)
+		}
+	}
+
+	// books we cannot read thumbnail names from stop cleanup
+	if err := os.WriteFile(filepath.Join(docs, "other.kfx"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cleanupThumbnails(sysdir, false, zap.NewNop()); err == nil {
+		t.Error("cleanup must fail when device has KFX books")
+	}
+}
@@ -0,0 +1,189 @@
+package commands
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+	"golang.org/x/text/language"
+
+	"fb2converter/archive"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// TrainSentences is "train-sentences" command body. It builds punkt training data for sentences tokenizer from a
+// corpus of FB2 books.
+func TrainSentences(ctx *cli.Context) (err error) {
+
+	const (
+		errPrefix = "train-sentences: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	src := ctx.Args().Get(0)
+	if len(src) == 0 {
+		return cli.Exit(errors.New(errPrefix+"no input source has been specified"), errCode)
+	}
+	if src, err = filepath.Abs(src); err != nil {
+		return cli.Exit(fmt.Errorf("%snormalizing source path failed", errPrefix), errCode)
+	}
+
+	lang := language.Und
+	if l := ctx.String("lang"); len(l) > 0 {
+		if lang, err = language.Parse(l); err != nil {
+			return cli.Exit(fmt.Errorf("%swrong language has been specified: %w", errPrefix, err), errCode)
+		}
+	}
+
+	abbreviations := func(lang language.Tag) []string {
+		return env.Cfg.GetAbbreviations(append([]string{strings.ToLower(lang.String())}, processor.SentencesLanguageNames(lang)...)...)
+	}
+	trainer := processor.NewSentencesTrainer(lang, abbreviations, env.Log)
+
+	env.Log.Info("Training starting", zap.String("source", src), zap.Stringer("language", lang))
+	defer func(start time.Time) {
+		env.Log.Info("Training completed", zap.Duration("elapsed", time.Since(start)), zap.Int("books", trainer.Books()))
+	}(time.Now())
+
+	train := func(r io.Reader, enc srcEncoding, name string) {
+		r, detected, err := bookReader(r, enc)
+		if err != nil {
+			env.Log.Warn("Skipping book", zap.String("file", name), zap.Error(err))
+			return
+		}
+		if detected != nil {
+			env.Log.Debug("Legacy encoding detected", zap.String("file", name), zap.String("charset", detected.Name), zap.Float64("confidence", detected.Confidence))
+		}
+		blang, used, err := trainer.AddBook(r, enc == encUnknown)
+		switch {
+		case err != nil:
+			env.Log.Warn("Skipping book", zap.String("file", name), zap.Error(err))
+		case !used:
+			env.Log.Debug("Skipping book, wrong language or no text", zap.String("file", name), zap.Stringer("language", blang))
+		default:
+			if lang == language.Und {
+				// first book defines corpus language
+				lang = trainer.Lang()
+				env.Log.Info("Using book language for training", zap.String("file", name), zap.Stringer("language", lang))
+			}
+			env.Log.Debug("Book used for training", zap.String("file", name))
+		}
+	}
+
+	trainArchive := func(path string) error {
+		return archive.Walk(path, "", func(archive string, f archive.File) error {
+			if ok, enc, err := isBookInArchive(f); err != nil {
+				env.Log.Warn("Skipping file in archive", zap.String("archive", archive), zap.String("path", f.Name()), zap.Error(err))
+			} else if ok {
+				r, err := f.Open()
+				if err != nil {
+					env.Log.Warn("Skipping file in archive", zap.String("archive", archive), zap.String("path", f.Name()), zap.Error(err))
+					return nil
+				}
+				defer r.Close()
+				train(r, enc, filepath.Join(archive, f.Name()))
+			}
+			return nil
+		})
+	}
+
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			env.Log.Warn("Skipping path", zap.String("path", path), zap.Error(err))
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if ok, err := isArchiveFile(path); err != nil {
+			env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
+		} else if ok {
+			if err := trainArchive(path); err != nil {
+				env.Log.Error("Unable to process archive", zap.String("file", path), zap.Error(err))
+			}
+		} else if ok, enc, err := isBookFile(path); err != nil {
+			env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
+		} else if ok {
+			file, err := os.Open(path)
+			if err != nil {
+				env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
+				return nil
+			}
+			defer file.Close()
+			train(file, enc, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to process source: %w", errPrefix, err), errCode)
+	}
+
+	if trainer.Books() == 0 {
+		return cli.Exit(errors.New(errPrefix+"no suitable books were found in the source"), errCode)
+	}
+
+	dst := ctx.Args().Get(1)
+	if len(dst) == 0 {
+		dst = processor.SentencesLanguageNames(lang)[0] + ".json"
+	}
+	if dst, err = filepath.Abs(dst); err != nil {
+		return cli.Exit(fmt.Errorf("%snormalizing destination path failed", errPrefix), errCode)
+	}
+	if ctx.Args().Len() > 2 {
+		env.Log.Warn("Mailformed command line, too many destinations", zap.Strings("ignoring", ctx.Args().Slice()[2:]))
+	}
+	if _, err := os.Stat(dst); err == nil && !ctx.Bool("ow") {
+		return cli.Exit(fmt.Errorf("%sdestination file already exists: %s", errPrefix, dst), errCode)
+	}
+
+	data, err := json.Marshal(trainer.Finalize())
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to marshal training data: %w", errPrefix, err), errCode)
+	}
+
+	if err := writeTrainingData(dst, data); err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to write training data: %w", errPrefix, err), errCode)
+	}
+
+	env.Log.Info("Training data saved", zap.String("file", dst), zap.Stringer("language", lang))
+	return nil
+}
+
+// writeTrainingData stores data in file, gzip compressed if file name ends with ".gz". Incomplete file is removed.
+func writeTrainingData(fname string, data []byte) (err error) {
+
+	out, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := out.Close(); e != nil && err == nil {
+			err = e
+		}
+		if err != nil {
+			os.Remove(fname)
+		}
+	}()
+
+	if !strings.EqualFold(filepath.Ext(fname), ".gz") {
+		_, err = out.Write(data)
+		return err
+	}
+	gzw := gzip.NewWriter(out)
+	if _, err = gzw.Write(data); err != nil {
+		gzw.Close()
+		return err
+	}
+	return gzw.Close()
+}
@@ -1,39 +1,30 @@
 package commands
 
 import (
-	"archive/zip"
+	"bytes"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 
 	"github.com/h2non/filetype"
+	"go.uber.org/zap"
 	"golang.org/x/text/encoding/unicode"
 	"golang.org/x/text/encoding/unicode/utf32"
 	"golang.org/x/text/transform"
+
+	"fb2converter/archive"
+	"fb2converter/chardet"
+	"fb2converter/importer"
+	"fb2converter/processor"
+	"fb2converter/state"
 )
 
 // isArchiveFile detects if file is our supported archive.
 func isArchiveFile(fname string) (bool, error) {
-
-	if !strings.EqualFold(filepath.Ext(fname), ".zip") {
-		return false, nil
-	}
-
-	file, err := os.Open(fname)
-	if err != nil {
-		return false, err
-	}
-	defer file.Close()
-
-	header := make([]byte, 262)
-	if count, err := file.Read(header); err != nil {
-		return false, err
-	} else if count < 262 {
-		return false, nil
-	}
-	return filetype.Is(header, "zip"), nil
+	return archive.IsArchive(fname)
 }
 
 type srcEncoding int
@@ -107,6 +98,36 @@ func detectUTF(buf []byte) (enc srcEncoding) {
 	return encUnknown
 }
 
+// xmlEncodingDecl matches XML declaration specifying document encoding.
+var xmlEncodingDecl = regexp.MustCompile(`^\s*<\?xml[^>]*\sencoding\s*=`)
+
+// bookReader handles various unicode encodings and legacy encodings of books without BOM and encoding declaration. In
+// latter case book is read into memory and its encoding is guessed, result of detection is returned for reporting.
+func bookReader(r io.Reader, enc srcEncoding) (io.Reader, *chardet.Result, error) {
+
+	if enc != encUnknown {
+		return selectReader(r, enc), nil, nil
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := data
+	if len(header) > 512 {
+		header = header[:512]
+	}
+	if xmlEncodingDecl.Match(header) {
+		// XML decoder will take care of it
+		return bytes.NewReader(data), nil, nil
+	}
+	res := chardet.Detect(data)
+	if res == nil {
+		return bytes.NewReader(data), nil, nil
+	}
+	return transform.NewReader(bytes.NewReader(data), res.Encoding.NewDecoder()), res, nil
+}
+
 // isBookFile detects if file is fb2/xml file and if it is tries to detect its encoding.
 func isBookFile(fname string) (bool, srcEncoding, error) {
 
@@ -139,10 +160,15 @@ func isBookFile(fname string) (bool, srcEncoding, error) {
 	return filetype.Is(header, "fb2"), enc, nil
 }
 
+// isImportFile detects if file is a document which could be imported as FB2 book: word processor document or HTML.
+func isImportFile(fname string) bool {
+	return importer.Supported(fname)
+}
+
 // isBookInArchive detects if compressed file is fb2/xml file and if it is tries to detect its encoding.
-func isBookInArchive(f *zip.File) (bool, srcEncoding, error) {
+func isBookInArchive(f archive.File) (bool, srcEncoding, error) {
 
-	if !strings.EqualFold(filepath.Ext(f.FileHeader.Name), ".fb2") {
+	if !strings.EqualFold(filepath.Ext(f.Name()), ".fb2") {
 		return false, encUnknown, nil
 	}
 
@@ -178,7 +204,45 @@ func init() {
 	filetype.AddMatcher(
 		filetype.NewType("fb2", "application/x-fictionbook+xml"),
 		func(buf []byte) bool {
-			text := string(buf)
-			return strings.HasPrefix(text, `<?xml`) && strings.Contains(text, `<FictionBook`)
+			// XML declaration could be absent in books with legacy encodings
+			text := strings.TrimSpace(string(buf))
+			return (strings.HasPrefix(text, `<?xml`) || strings.HasPrefix(text, `<FictionBook`)) && strings.Contains(text, `<FictionBook`)
 		})
 }
+
+// readBookInfo parses FB2 book description and returns book meta information.
+func readBookInfo(fname string, env *state.LocalEnv) (*processor.BookInfo, error) {
+
+	ok, enc, err := isBookFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("input was not recognized as FB2 book: %s", fname)
+	}
+
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r, detected, err := bookReader(file, enc)
+	if err != nil {
+		return nil, err
+	}
+	if detected != nil {
+		env.Log.Debug("Legacy encoding detected", zap.String("file", fname), zap.String("charset", detected.Name), zap.Float64("confidence", detected.Confidence))
+	}
+
+	p, err := processor.NewFB2(r, enc == encUnknown, filepath.Base(fname), "", true, false, false, processor.OEpub, env)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Clean()
+
+	if err := p.ProcessDescription(); err != nil {
+		return nil, err
+	}
+	return p.BookInfo(), nil
+}
@@ -0,0 +1,416 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/state"
+)
+
+// maximum number of entries kept in watch status log
+const watchStatusSize = 100
+
+type watchEntry struct {
+	Time    time.Time     `json:"time"`
+	Event   string        `json:"event"`
+	Path    string        `json:"path,omitempty"`
+	Elapsed time.Duration `json:"elapsed,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// watchStatus keeps small rolling log of watch activity, rewritten on every change.
+type watchStatus struct {
+	fname   string
+	log     *zap.Logger
+	mu      sync.Mutex
+	entries []watchEntry
+}
+
+func (s *watchStatus) add(event, path string, elapsed time.Duration, err error) {
+
+	e := watchEntry{Time: time.Now(), Event: event, Path: path, Elapsed: elapsed}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = append(s.entries, e)
+	if len(s.entries) > watchStatusSize {
+		s.entries = s.entries[len(s.entries)-watchStatusSize:]
+	}
+
+	if len(s.fname) == 0 {
+		return
+	}
+
+	var buf []byte
+	for _, e := range s.entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	if err := os.WriteFile(s.fname, buf, 0644); err != nil {
+		s.log.Warn("Unable to write watch status", zap.String("file", s.fname), zap.Error(err))
+	}
+}
+
+// watchState is state of the watch event loop, it is only accessed from the loop goroutine. Conversions are performed
+// one at a time outside of the loop, so long conversion does not delay handling of file system events.
+type watchState struct {
+	env      *state.LocalEnv
+	src      string
+	delay    time.Duration
+	status   *watchStatus
+	fconfig  []string
+	cfgFiles map[string]bool // configuration files to reload, nil when reload is disabled
+	isOutput func(path string) bool
+	addDir   func(dir string) error
+	// convert is called on separate goroutine with environment current at the moment conversion was started
+	convert func(path string, env *state.LocalEnv)
+
+	pending  map[string]time.Time // path -> time of the last event, processed when quiet for delay
+	reloadAt time.Time
+	queue    []string
+	busy     bool
+	done     chan struct{}
+}
+
+func newWatchState(env *state.LocalEnv, src string, delay time.Duration, status *watchStatus) *watchState {
+	return &watchState{
+		env:      env,
+		src:      src,
+		delay:    delay,
+		status:   status,
+		cfgFiles: make(map[string]bool),
+		isOutput: func(string) bool { return false },
+		addDir:   func(string) error { return nil },
+		pending:  make(map[string]time.Time),
+		done:     make(chan struct{}, 1),
+	}
+}
+
+// event registers file system event.
+func (w *watchState) event(event fsnotify.Event, now time.Time) {
+
+	path := filepath.Clean(event.Name)
+
+	if w.cfgFiles[path] {
+		if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) {
+			w.reloadAt = now
+		}
+		return
+	}
+	if path != w.src && !strings.HasPrefix(path, w.src+string(filepath.Separator)) || w.isOutput(path) {
+		return
+	}
+
+	switch {
+	case event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename):
+		// watches on removed directories are dropped automatically
+		delete(w.pending, path)
+	case event.Has(fsnotify.Create) || event.Has(fsnotify.Write):
+		fi, err := os.Stat(path)
+		if err != nil {
+			return
+		}
+		if fi.IsDir() {
+			if event.Has(fsnotify.Create) {
+				if err := w.addDir(path); err != nil {
+					w.env.Log.Warn("Unable to watch directory", zap.String("dir", path), zap.Error(err))
+				}
+				// pick up anything which landed before watch was established
+				_ = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+					if err == nil && info.Mode().IsRegular() {
+						w.pending[p] = now
+					}
+					return nil
+				})
+			}
+			return
+		}
+		if fi.Mode().IsRegular() {
+			w.pending[path] = now
+		}
+	}
+}
+
+// tick reloads configuration and queues files which were not changed for delay.
+func (w *watchState) tick(now time.Time) {
+
+	if !w.reloadAt.IsZero() && now.Sub(w.reloadAt) >= w.delay {
+		w.reloadAt = time.Time{}
+		w.reload()
+	}
+	var ready []string
+	for path, last := range w.pending {
+		if now.Sub(last) >= w.delay {
+			delete(w.pending, path)
+			ready = append(ready, path)
+		}
+	}
+	sort.Strings(ready)
+	for _, path := range ready {
+		queued := false
+		for _, p := range w.queue {
+			queued = queued || p == path
+		}
+		if !queued {
+			w.queue = append(w.queue, path)
+		}
+	}
+	w.dispatch()
+}
+
+// dispatch starts next queued conversion unless one is already running.
+func (w *watchState) dispatch() {
+
+	if w.busy || len(w.queue) == 0 {
+		return
+	}
+	path, env := w.queue[0], w.env
+	w.queue = w.queue[1:]
+	w.busy = true
+	go func() {
+		defer func() { w.done <- struct{}{} }()
+		w.convert(path, env)
+	}()
+}
+
+// finished is called by the loop when conversion completes.
+func (w *watchState) finished() {
+	w.busy = false
+	w.dispatch()
+}
+
+// reload builds new configuration, running conversion keeps using the environment it was started with.
+func (w *watchState) reload() {
+
+	cfg, err := config.BuildConfig(w.fconfig...)
+	if err != nil {
+		w.env.Log.Error("Unable to reload configuration, keeping previous one", zap.Error(err))
+		w.status.add("config", "", 0, err)
+		return
+	}
+	// NOTE: logging settings are not affected by reload
+	w.env = &state.LocalEnv{Mhl: w.env.Mhl, Cfg: cfg, Log: w.env.Log, Rpt: w.env.Rpt}
+	w.env.Log.Info("Configuration reloaded")
+	w.status.add("config", "", 0, nil)
+}
+
+// Watch is "watch" command body. It monitors source directory and converts books and archives as they arrive.
+func Watch(ctx *cli.Context) (err error) {
+
+	const (
+		errPrefix = "watch: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	src := ctx.Args().Get(0)
+	if len(src) == 0 {
+		return cli.Exit(errors.New(errPrefix+"no input directory has been specified"), errCode)
+	}
+	if src, err = filepath.Abs(src); err != nil {
+		return cli.Exit(fmt.Errorf("%snormalizing source path failed", errPrefix), errCode)
+	}
+	if fi, err := os.Stat(src); err != nil || !fi.IsDir() {
+		return cli.Exit(fmt.Errorf("%sinput source must be existing directory (%s)", errPrefix, src), errCode)
+	}
+
+	dst := ctx.Args().Get(1)
+	if len(dst) == 0 {
+		if dst, err = os.Getwd(); err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to get working directory", errPrefix), errCode)
+		}
+	} else {
+		if dst, err = filepath.Abs(dst); err != nil {
+			return cli.Exit(fmt.Errorf("%snormalizing destination path failed", errPrefix), errCode)
+		}
+		if ctx.Args().Len() > 2 {
+			env.Log.Warn("Mailformed command line, too many destinations", zap.Strings("ignoring", ctx.Args().Slice()[2:]))
+		}
+	}
+
+	formats := parseFormats(ctx.String("to"), env)
+	names := make([]string, 0, len(formats))
+	for _, f := range formats {
+		names = append(names, f.String())
+	}
+	nodirs := ctx.Bool("nodirs")
+
+	delay := ctx.Duration("delay")
+	if delay <= 0 {
+		delay = time.Second
+	}
+
+	status := &watchStatus{log: env.Log}
+	if fname := ctx.String("status"); len(fname) > 0 {
+		if status.fname, err = filepath.Abs(fname); err != nil {
+			return cli.Exit(fmt.Errorf("%snormalizing status log path failed", errPrefix), errCode)
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to create file system watcher: %w", errPrefix, err), errCode)
+	}
+	defer watcher.Close()
+
+	w := newWatchState(env, src, delay, status)
+
+	// ignore our own output if it happens to be inside watched directory
+	w.isOutput = func(path string) bool {
+		return path == dst || strings.HasPrefix(path, dst+string(filepath.Separator)) || path == status.fname
+	}
+
+	w.addDir = func(dir string) error {
+		return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				env.Log.Warn("Skipping path", zap.String("path", path), zap.Error(err))
+				return nil
+			}
+			if info.IsDir() {
+				if w.isOutput(path) {
+					return filepath.SkipDir
+				}
+				if err := watcher.Add(path); err != nil {
+					env.Log.Warn("Unable to watch directory", zap.String("dir", path), zap.Error(err))
+				}
+			}
+			return nil
+		})
+	}
+	if err := w.addDir(src); err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to watch source directory: %w", errPrefix, err), errCode)
+	}
+
+	// configuration files to watch for changes, stdin cannot be reloaded
+	w.fconfig = ctx.StringSlice("config")
+	for _, f := range w.fconfig {
+		if f == "-" {
+			env.Log.Warn("Configuration was read from STDIN, configuration reload is disabled")
+			w.cfgFiles = nil
+			break
+		}
+		if len(f) > 0 {
+			if f, err = filepath.Abs(f); err == nil {
+				w.cfgFiles[f] = true
+			}
+		}
+	}
+	for f := range w.cfgFiles {
+		// watch directory rather than file - editors tend to replace files on save
+		if err := watcher.Add(filepath.Dir(f)); err != nil {
+			env.Log.Warn("Unable to watch configuration file", zap.String("file", f), zap.Error(err))
+		}
+	}
+
+	w.convert = func(path string, env *state.LocalEnv) {
+
+		var (
+			ok      bool
+			err     error
+			enc     srcEncoding
+			start   = time.Now()
+			rel     = strings.TrimPrefix(strings.TrimPrefix(path, src), string(filepath.Separator))
+			targets = make([]target, 0, len(formats))
+		)
+		for _, f := range formats {
+			targets = append(targets, target{format: f, dst: dst, env: env})
+		}
+
+		if ok, err = isArchiveFile(path); err != nil {
+			env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
+			return
+		} else if ok {
+			err = processArchive(path, "", filepath.Dir(rel), targets, nodirs, true, nil, env)
+			status.add("archive", path, time.Since(start), err)
+			return
+		}
+
+		if ok, enc, err = isBookFile(path); err != nil {
+			env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
+			return
+		} else if !ok && !isImportFile(path) {
+			env.Log.Debug("Skipping file, not recognized as book or archive", zap.String("file", path))
+			return
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
+			status.add("book", path, time.Since(start), err)
+			return
+		}
+		defer file.Close()
+
+		if err = processTargets(file, enc, rel, nodirs, true, targets, env); err != nil {
+			env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
+		}
+		status.add("book", path, time.Since(start), err)
+	}
+
+	var (
+		ticker        = time.NewTicker(delay / 2)
+		interruptions = make(chan os.Signal, 1)
+	)
+	defer ticker.Stop()
+
+	signal.Notify(interruptions, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interruptions)
+
+	env.Log.Info("Watch starting", zap.String("source", src), zap.String("destination", dst), zap.Strings("format", names), zap.Duration("delay", delay))
+	status.add("start", src, 0, nil)
+	defer func(start time.Time) {
+		if w.busy {
+			// do not leave partial results behind
+			<-w.done
+		}
+		env.Log.Info("Watch completed", zap.Duration("elapsed", time.Since(start)))
+		status.add("stop", src, time.Since(start), nil)
+	}(time.Now())
+
+	for {
+		select {
+		case <-interruptions:
+			return nil
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			env.Log.Warn("File system watcher problem", zap.Error(err))
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			w.event(event, time.Now())
+
+		case <-w.done:
+			w.finished()
+
+		case now := <-ticker.C:
+			w.tick(now)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/state"
+)
+
+func newTestWatch(t *testing.T, delay time.Duration) (*watchState, chan string, chan struct{}) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatalf("unable to build configuration: %v", err)
+	}
+	env := &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}
+	w := newWatchState(env, t.TempDir(), delay, &watchStatus{log: env.Log})
+
+	started, release := make(chan string, 10), make(chan struct{})
+	w.convert = func(path string, env *state.LocalEnv) {
+		started <- path
+		<-release
+	}
+	return w, started, release
+}
+
+func writeWatched(t *testing.T, w *watchState, name string) string {
+	path := filepath.Join(w.src, name)
+	if err := os.WriteFile(path, []byte(testBook), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func expectStarted(t *testing.T, started chan string, expected string) {
+	t.Helper()
+	select {
+	case path := <-started:
+		if path != expected {
+			t.Fatalf("expected conversion of %s, got %s", expected, path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("conversion of %s was not started", expected)
+	}
+}
+
+func expectIdle(t *testing.T, started chan string) {
+	t.Helper()
+	select {
+	case path := <-started:
+		t.Fatalf("unexpected conversion of %s", path)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWatchDebounce(t *testing.T) {
+
+	w, started, release := newTestWatch(t, time.Second)
+	a, b := writeWatched(t, w, "a.fb2"), writeWatched(t, w, "b.fb2")
+
+	t0 := time.Now()
+	w.event(fsnotify.Event{Name: a, Op: fsnotify.Create}, t0)
+	w.event(fsnotify.Event{Name: filepath.Join(filepath.Dir(w.src), "outside.fb2"), Op: fsnotify.Create}, t0)
+	w.tick(t0.Add(500 * time.Millisecond))
+	// file is still being written
+	w.event(fsnotify.Event{Name: a, Op: fsnotify.Write}, t0.Add(800*time.Millisecond))
+	w.tick(t0.Add(1500 * time.Millisecond))
+	expectIdle(t, started)
+
+	w.tick(t0.Add(1800 * time.Millisecond))
+	expectStarted(t, started, a)
+
+	// events are handled while conversion is running, next conversion waits for the current one
+	w.event(fsnotify.Event{Name: b, Op: fsnotify.Create}, t0.Add(2*time.Second))
+	w.tick(t0.Add(3 * time.Second))
+	if len(w.queue) != 1 || w.queue[0] != b {
+		t.Fatalf("expected %s to be queued, got %v", b, w.queue)
+	}
+	expectIdle(t, started)
+
+	release <- struct{}{}
+	<-w.done
+	w.finished()
+	expectStarted(t, started, b)
+	release <- struct{}{}
+	<-w.done
+	w.finished()
+
+	// removed before it was quiet long enough
+	w.event(fsnotify.Event{Name: a, Op: fsnotify.Write}, t0.Add(4*time.Second))
+	w.event(fsnotify.Event{Name: a, Op: fsnotify.Remove}, t0.Add(4*time.Second))
+	w.tick(t0.Add(10 * time.Second))
+	expectIdle(t, started)
+}
+
+func TestWatchReload(t *testing.T) {
+
+	w, started, release := newTestWatch(t, time.Second)
+
+	fname := filepath.Join(t.TempDir(), "fb2c.json")
+	if err := os.WriteFile(fname, []byte(`{"document":{"chapter_per_file":false}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w.fconfig = []string{fname}
+	w.cfgFiles[fname] = true
+
+	var used *state.LocalEnv
+	w.convert = func(path string, env *state.LocalEnv) {
+		used = env
+		started <- path
+		<-release
+	}
+
+	before := w.env
+	book := writeWatched(t, w, "book.fb2")
+	t0 := time.Now()
+	w.event(fsnotify.Event{Name: book, Op: fsnotify.Create}, t0)
+	w.tick(t0.Add(time.Second))
+	expectStarted(t, started, book)
+
+	w.event(fsnotify.Event{Name: fname, Op: fsnotify.Write}, t0.Add(time.Second))
+	w.tick(t0.Add(1500 * time.Millisecond))
+	if w.env != before {
+		t.Fatal("configuration was reloaded too early")
+	}
+	w.tick(t0.Add(2 * time.Second))
+	if w.env == before || w.env.Cfg.Doc.ChapterPerFile {
+		t.Fatal("configuration was not reloaded")
+	}
+
+	release <- struct{}{}
+	<-w.done
+	w.finished()
+	if used != before || !before.Cfg.Doc.ChapterPerFile {
+		t.Error("running conversion should keep its configuration")
+	}
+
+	// broken configuration keeps previous one
+	if err := os.WriteFile(fname, []byte(`{"document":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := w.env
+	w.event(fsnotify.Event{Name: fname, Op: fsnotify.Write}, t0.Add(3*time.Second))
+	w.tick(t0.Add(5 * time.Second))
+	if w.env != reloaded {
+		t.Error("broken configuration replaced working one")
+	}
+}
@@ -55,15 +55,39 @@ type Fb2Epub struct {
 
 // SMTPConfig keeps STK configuration.
 type SMTPConfig struct {
-	DeleteOnSuccess bool   `json:"delete_sent_book"`
-	Server          string `json:"smtp_server"`
-	Port            int    `json:"smtp_port"`
-	User            string `json:"smtp_user"`
-	Password        string `json:"smtp_password"`
-	From            string `json:"from_mail"`
-	To              string `json:"to_mail"`
+	DeleteOnSuccess bool        `json:"delete_sent_book"`
+	Server          string      `json:"smtp_server"`
+	Port            int         `json:"smtp_port"`
+	User            string      `json:"smtp_user"`
+	Password        string      `json:"smtp_password"`
+	TLS             string      `json:"smtp_tls"`
+	SkipVerify      bool        `json:"smtp_tls_skip_verify"`
+	From            string      `json:"from_mail"`
+	To              string      `json:"to_mail"`
+	Devices         []STKDevice `json:"devices"`
+	Subject         string      `json:"subject"`
+	Body            string      `json:"body"`
+	MaxSize         int         `json:"attachment_size_limit"`
+	Retries         int         `json:"retries"`
+	RetryDelay      int         `json:"retry_delay"`
+	DryRun          string      `json:"dry_run_dir"`
 }
 
+// STKDevice is Kindle device profile: its address and formats it should receive.
+type STKDevice struct {
+	Name    string   `json:"name"`
+	To      string   `json:"to_mail"`
+	Formats []string `json:"formats"`
+}
+
+// SMTP connection security modes.
+const (
+	SMTPTLSAuto     = "auto"     // TLS on port 465, otherwise STARTTLS when server supports it
+	SMTPTLSStartTLS = "starttls" // require STARTTLS
+	SMTPTLSImplicit = "tls"      // connect over TLS
+	SMTPTLSNone     = "none"     // plain text connection
+)
+
 // AuthorName is parsed author name from book metainfo.
 type AuthorName struct {
 	First  string `json:"first_name"`
@@ -85,6 +109,18 @@ func (a *AuthorName) String() string {
 	return res
 }
 
+// SortName returns author name in "last, first middle" form to be used for sorting.
+func (a *AuthorName) SortName() string {
+	rest := strings.TrimSpace(a.First + " " + a.Middle)
+	switch {
+	case len(a.Last) == 0:
+		return rest
+	case len(rest) == 0:
+		return a.Last
+	}
+	return a.Last + ", " + rest
+}
+
 // MetaInfo keeps book meta-info overwrites from configuration.
 type MetaInfo struct {
 	ID         string        `json:"id"`
@@ -107,11 +143,69 @@ type confMetaOverwrite struct {
 // IsValid checks if we have enough smtp parameters to attempt sending mail.
 // It does not attempt actual connection.
 func (c *SMTPConfig) IsValid() bool {
-	return len(c.Server) > 0 && govalidator.IsDNSName(c.Server) &&
+	switch c.TLS {
+	case SMTPTLSAuto, SMTPTLSStartTLS, SMTPTLSImplicit, SMTPTLSNone:
+	default:
+		return false
+	}
+	valid := func(list string) bool {
+		for _, a := range splitAddresses(list) {
+			if !govalidator.IsEmail(a) {
+				return false
+			}
+		}
+		return true
+	}
+	if !valid(c.To) {
+		return false
+	}
+	for _, d := range c.Devices {
+		if len(d.To) == 0 || !valid(d.To) {
+			return false
+		}
+	}
+	return len(c.Server) > 0 && govalidator.IsHost(c.Server) &&
 		c.Port > 0 && c.Port <= 65535 &&
-		len(c.User) > 0 &&
 		len(c.From) > 0 && govalidator.IsEmail(c.From) &&
-		len(c.To) > 0 && govalidator.IsEmail(c.To)
+		(len(c.To) > 0 || len(c.Devices) > 0)
+}
+
+// Recipients returns addresses book in specified format should be mailed to: all addresses from to_mail and
+// addresses of devices accepting this format.
+func (c *SMTPConfig) Recipients(format string) []string {
+	res := splitAddresses(c.To)
+	for _, d := range c.Devices {
+		accepts := len(d.Formats) == 0
+		for _, f := range d.Formats {
+			if strings.EqualFold(f, format) {
+				accepts = true
+				break
+			}
+		}
+		if !accepts {
+			continue
+		}
+	next:
+		for _, a := range splitAddresses(d.To) {
+			for _, r := range res {
+				if strings.EqualFold(r, a) {
+					continue next
+				}
+			}
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+func splitAddresses(list string) []string {
+	var res []string
+	for _, a := range strings.Split(list, ",") {
+		if a = strings.TrimSpace(a); len(a) > 0 {
+			res = append(res, a)
+		}
+	}
+	return res
 }
 
 // Doc format configuration for book processor.
@@ -130,12 +224,16 @@ type Doc struct {
 	Stylesheet            string   `json:"style"`
 	CharsPerPage          int      `json:"characters_per_page"`
 	PagesPerFile          int      `json:"pages_per_file"`
+	MaxFileSize           int      `json:"max_file_size"`
 	ChapterDividers       []string `json:"chapter_subtitle_dividers"`
 	Hyphenate             bool     `json:"insert_soft_hyphen"`
 	NoNBSP                bool     `json:"ignore_nonbreakable_space"`
 	UseBrokenImages       bool     `json:"use_broken_images"`
 	FileNameFormat        string   `json:"file_name_format"`
 	FileNameTransliterate bool     `json:"file_name_transliterate"`
+	FileNameCollision     string   `json:"file_name_collision"`
+	FileNameMaxBytes      int      `json:"file_name_max_bytes"`
+	FileNameFATSafe       bool     `json:"file_name_fat_safe"`
 	FixZip                bool     `json:"fix_zip_format"`
 	//
 	DropCaps struct {
@@ -154,12 +252,17 @@ type Doc struct {
 		Title    string `json:"title"`
 	} `json:"annotation"`
 	TOC struct {
-		Type              string `json:"type"`
-		Title             string `json:"page_title"`
-		Placement         string `json:"page_placement"`
-		MaxLevel          int    `json:"page_maxlevel"`
-		NoTitleChapters   bool   `json:"include_chapters_without_title"`
-		BookTitleFromMeta bool   `json:"book_title_from_meta"`
+		Type              string    `json:"type"`
+		Title             string    `json:"page_title"`
+		Placement         string    `json:"page_placement"`
+		MaxLevel          int       `json:"page_maxlevel"`
+		NoTitleChapters   bool      `json:"include_chapters_without_title"`
+		BookTitleFromMeta bool      `json:"book_title_from_meta"`
+		Subtitles         bool      `json:"include_subtitles"`
+		TitleFromText     int       `json:"title_from_text"`
+		NormalizeTitles   bool      `json:"normalize_titles"`
+		RomanToArabic     bool      `json:"roman_to_arabic"`
+		Rules             []TOCRule `json:"rules"`
 	} `json:"toc"`
 	Cover struct {
 		Convert   bool   `json:"always_convert"`
@@ -175,6 +278,34 @@ type Doc struct {
 		Create bool                         `json:"create"`
 		Images map[string]map[string]string `json:"images"`
 	} `json:"vignettes"`
+	Fonts struct {
+		Families    []FontFamily `json:"families"`
+		Subset      bool         `json:"subset"`
+		Obfuscation string       `json:"obfuscation"`
+	} `json:"fonts"`
+	Sentences struct {
+		Path          string              `json:"path"`
+		Abbreviations map[string][]string `json:"abbreviations"`
+	} `json:"sentences"`
+	Genres struct {
+		Subjects string            `json:"subjects"`
+		Language string            `json:"language"`
+		Path     string            `json:"path"`
+		Names    map[string]string `json:"names"`
+	} `json:"genres"`
+	Text struct {
+		LineWidth int    `json:"line_width"`
+		Encoding  string `json:"encoding"`
+	} `json:"text"`
+	HTML struct {
+		Layout string `json:"layout"`
+	} `json:"html"`
+	PDF struct {
+		PageSize   string  `json:"page_size"`
+		Margin     float64 `json:"margin"`
+		FontFamily string  `json:"font_family"`
+		FontSize   float64 `json:"font_size"`
+	} `json:"pdf"`
 	//
 	Transformations map[string]map[string]string `json:"transform"`
 	//
@@ -189,6 +320,28 @@ type Doc struct {
 	} `json:"kindlegen"`
 }
 
+// TOCRule assigns TOC level to entries with matching titles.
+type TOCRule struct {
+	Match string `json:"match"`
+	Level int    `json:"level"`
+}
+
+// FontFamily describes font files to be embedded when stylesheet uses font family.
+type FontFamily struct {
+	Name       string `json:"name"`
+	Regular    string `json:"regular"`
+	Bold       string `json:"bold"`
+	Italic     string `json:"italic"`
+	BoldItalic string `json:"bold_italic"`
+}
+
+// Profile is named device profile: output format and document settings overwriting main configuration ones.
+type Profile struct {
+	Format      string          `json:"format"`
+	Description string          `json:"description"`
+	Document    json.RawMessage `json:"document,omitempty"`
+}
+
 // names of supported vignettes
 const (
 	VigBeforeTitle = "before_title"
@@ -210,6 +363,7 @@ type Config struct {
 	Fb2Mobi       Fb2Mobi
 	Fb2Epub       Fb2Epub
 	Overwrites    map[string]MetaInfo
+	Profiles      map[string]Profile
 }
 
 var defaultConfig = []byte(`{
@@ -221,6 +375,8 @@ var defaultConfig = []byte(`{
     "series_number_positions": 2,
     "characters_per_page": 2300,
     "pages_per_file": 2147483647,
+    "file_name_collision": "error",
+    "file_name_max_bytes": 255,
     "fix_zip_format": true,
     "dropcaps": {
       "ignore_symbols": "'\"-.…0123456789‒–—«»“”\u003c\u003e"
@@ -262,6 +418,20 @@ var defaultConfig = []byte(`{
       "page_title": "Content",
       "page_placement": "after",
       "page_maxlevel": 2147483647
+    },
+    "genres": {
+      "subjects": "codes"
+    },
+    "text": {
+      "encoding": "utf-8"
+    },
+    "html": {
+      "layout": "single"
+    },
+    "pdf": {
+      "page_size": "a5",
+      "margin": 12,
+      "font_size": 11
     }
   },
   "logger": {
@@ -279,6 +449,58 @@ var defaultConfig = []byte(`{
   },
   "fb2epub": {
     "output_format": "epub"
+  },
+  "profiles": {
+    "kindle-paperwhite": {
+      "format": "azw3",
+      "description": "Amazon Kindle Paperwhite (5th generation and later)",
+      "document": {
+        "cover": {
+          "width": 1236,
+          "height": 1648
+        },
+        "notes": {
+          "mode": "float"
+        },
+        "kindlegen": {
+          "generate_apnx": "eink"
+        }
+      }
+    },
+    "kobo-libra": {
+      "format": "kepub",
+      "description": "Kobo Libra 2",
+      "document": {
+        "cover": {
+          "width": 1264,
+          "height": 1680
+        },
+        "notes": {
+          "mode": "float"
+        }
+      }
+    },
+    "pocketbook": {
+      "format": "epub",
+      "description": "PocketBook 6 inch devices (Touch HD 3, Era)",
+      "document": {
+        "cover": {
+          "width": 1072,
+          "height": 1448
+        },
+        "notes": {
+          "mode": "block"
+        }
+      }
+    }
+  },
+  "sendtokindle": {
+    "smtp_tls": "auto",
+    "subject": "Sent to Kindle: #file",
+    "body": "This email has been sent by fb2converter",
+    "attachment_size_limit": 50,
+    "retries": 3,
+    "retry_delay": 5
   }
 }`)
 
@@ -340,6 +562,22 @@ func BuildConfig(fnames ...string) (*Config, error) {
 	if err = c.Load(configSources...); err != nil {
 		return nil, fmt.Errorf("unable to parse configuration %v", fnames)
 	}
+	return newConfig(c, base)
+}
+
+// Overwrite returns new configuration with values from JSON data merged on top of the current one.
+func (conf *Config) Overwrite(data []byte) (*Config, error) {
+
+	c := config.NewConfig()
+
+	if err := c.Load(memory.NewSource(memory.WithJSON(conf.cfg.Bytes())), memory.NewSource(memory.WithJSON(data))); err != nil {
+		return nil, fmt.Errorf("unable to parse configuration overwrite: %w", err)
+	}
+	return newConfig(c, conf.Path)
+}
+
+// newConfig reads all configuration sections from loaded sources.
+func newConfig(c config.Config, base string) (*Config, error) {
 
 	conf := Config{cfg: c, Path: base, Overwrites: make(map[string]MetaInfo)}
 	if err := c.Get("logger", "console").Scan(&conf.ConsoleLogger); err != nil {
@@ -360,6 +598,9 @@ func BuildConfig(fnames ...string) (*Config, error) {
 	if err := c.Get("sendtokindle").Scan(&conf.SMTPConfig); err != nil {
 		return nil, fmt.Errorf("unable to read send to kindle cnfiguration: %w", err)
 	}
+	if err := c.Get("profiles").Scan(&conf.Profiles); err != nil {
+		return nil, fmt.Errorf("unable to read device profiles: %w", err)
+	}
 
 	var metas []confMetaOverwrite
 	if err := c.Get("overwrites").Scan(&metas); err != nil {
@@ -386,6 +627,35 @@ func BuildConfig(fnames ...string) (*Config, error) {
 	return &conf, nil
 }
 
+// ApplyProfile returns configuration with document settings of named device profile merged on top of the current one.
+func (conf *Config) ApplyProfile(name string) (*Config, *Profile, error) {
+
+	prof, ok := conf.Profiles[name]
+	if !ok {
+		for k, v := range conf.Profiles {
+			if strings.EqualFold(k, name) {
+				prof, ok = v, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown device profile %q", name)
+	}
+	if len(prof.Document) == 0 {
+		return conf, &prof, nil
+	}
+	data, err := json.Marshal(map[string]json.RawMessage{"document": prof.Document})
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := conf.Overwrite(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to apply device profile %q: %w", name, err)
+	}
+	return c, &prof, nil
+}
+
 // GetBytes returns configuration the way it was read from various sources, before unmarshaling.
 func (conf *Config) GetBytes() ([]byte, error) {
 	// do some pretty-printing
@@ -421,6 +691,77 @@ func (conf *Config) GetTransformation(name string) *Transformation {
 	return nil
 }
 
+// GetSentencesPath returns directory with user supplied sentences tokenizer data or empty string if none was configured.
+func (conf *Config) GetSentencesPath() string {
+
+	dir := conf.Doc.Sentences.Path
+	if len(dir) == 0 {
+		return ""
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(conf.Path, dir)
+	}
+	return dir
+}
+
+// GetDryRunDir returns directory mail is stored to instead of sending or empty string if none was configured.
+func (conf *Config) GetDryRunDir() string {
+
+	dir := conf.SMTPConfig.DryRun
+	if len(dir) == 0 {
+		return ""
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(conf.Path, dir)
+	}
+	return dir
+}
+
+// GetGenresPath returns location of user supplied genres table or empty string if none was configured.
+func (conf *Config) GetGenresPath() string {
+
+	fname := conf.Doc.Genres.Path
+	if len(fname) == 0 {
+		return ""
+	}
+	if !filepath.IsAbs(fname) {
+		fname = filepath.Join(conf.Path, fname)
+	}
+	return fname
+}
+
+// GetAbbreviations returns list of additional abbreviations for sentences tokenizer. Names are tried in order
+// and all matching lists are merged. Comparison is case insensitive.
+func (conf *Config) GetAbbreviations(names ...string) []string {
+
+	if len(conf.Doc.Sentences.Abbreviations) == 0 {
+		return nil
+	}
+
+	var (
+		res  []string
+		seen = make(map[string]bool)
+	)
+	for _, name := range names {
+		if len(name) == 0 {
+			continue
+		}
+		for k, v := range conf.Doc.Sentences.Abbreviations {
+			if !strings.EqualFold(k, name) || seen[k] {
+				continue
+			}
+			seen[k] = true
+			for _, a := range v {
+				// punkt keeps abbreviations lowercased and without final period
+				if a = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(a)), "."); len(a) > 0 {
+					res = append(res, a)
+				}
+			}
+		}
+	}
+	return res
+}
+
 // GetOverwrite returns pointer to information to be used instead of parsed data.
 func (conf *Config) GetOverwrite(name string) *MetaInfo {
 
@@ -485,10 +826,11 @@ func (conf *Config) GetActualBytes() ([]byte, error) {
 			Cl Logger `json:"console"`
 			Fl Logger `json:"file"`
 		} `json:"logger"`
-		D Doc        `json:"document"`
-		E SMTPConfig `json:"sendtokindle"`
-		F Fb2Mobi    `json:"fb2mobi"`
-		G Fb2Epub    `json:"fb2epub"`
+		D Doc                `json:"document"`
+		E SMTPConfig         `json:"sendtokindle"`
+		F Fb2Mobi            `json:"fb2mobi"`
+		G Fb2Epub            `json:"fb2epub"`
+		P map[string]Profile `json:"profiles,omitempty"`
 		H []struct {
 			Name string   `json:"name"`
 			Meta MetaInfo `json:"meta"`
@@ -500,6 +842,7 @@ func (conf *Config) GetActualBytes() ([]byte, error) {
 	a.E = conf.SMTPConfig
 	a.F = conf.Fb2Mobi
 	a.G = conf.Fb2Epub
+	a.P = conf.Profiles
 
 	for k, v := range conf.Overwrites {
 		s := struct {
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecipients(t *testing.T) {
+
+	c := &SMTPConfig{
+		To: "one@example.com, two@example.com",
+		Devices: []STKDevice{
+			{Name: "any", To: "three@example.com"},
+			{Name: "epub", To: "Two@example.com, four@example.com", Formats: []string{"EPUB", "azw3"}},
+			{Name: "mobi", To: "five@example.com", Formats: []string{"mobi"}},
+		},
+	}
+	for format, expected := range map[string]string{
+		"epub": "one@example.com,two@example.com,three@example.com,four@example.com",
+		"azw3": "one@example.com,two@example.com,three@example.com,four@example.com",
+		"mobi": "one@example.com,two@example.com,three@example.com,five@example.com",
+	} {
+		if got := strings.Join(c.Recipients(format), ","); got != expected {
+			t.Errorf("%s: expected %s, got %s", format, expected, got)
+		}
+	}
+}
+
+func TestGetDryRunDir(t *testing.T) {
+
+	conf := &Config{Path: filepath.FromSlash("/etc/fb2c")}
+	for dir, expected := range map[string]string{
+		"":                              "",
+		"mail":                          filepath.FromSlash("/etc/fb2c/mail"),
+		filepath.FromSlash("/tmp/mail"): filepath.FromSlash("/tmp/mail"),
+	} {
+		conf.SMTPConfig.DryRun = dir
+		if got := conf.GetDryRunDir(); got != expected {
+			t.Errorf("%q: expected %q, got %q", dir, expected, got)
+		}
+	}
+}
@@ -11,6 +11,7 @@ require (
 	github.com/fogleman/gg v1.3.0
 	github.com/fsnotify/fsnotify v1.6.0
 	github.com/ghodss/yaml v1.0.0
+	github.com/go-pdf/fpdf v0.6.0
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0
 	github.com/google/uuid v1.3.0
 	github.com/gosimple/slug v1.13.1
@@ -19,6 +20,7 @@ require (
 	github.com/hidez8891/zip v1.11.0
 	github.com/imdario/mergo v0.3.13
 	github.com/pkg/profile v1.7.0
+	github.com/ulikunitz/xz v0.5.11
 	github.com/urfave/cli/v2 v2.24.4
 	go.uber.org/zap v1.24.0
 	golang.org/x/crypto v0.6.0
@@ -0,0 +1,782 @@
+package importer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"fb2converter/etree"
+)
+
+var attr = etree.NewAttr
+
+// paraKind is the role of imported paragraph, mostly follows FB2 block elements.
+type paraKind int
+
+const (
+	paraText paraKind = iota
+	paraTitle
+	paraHeading
+	paraSubtitle
+	paraEpigraph
+	paraCite
+	paraAnnotation
+	paraPoemTitle
+	paraStanzaTitle
+	paraVerse
+	paraTextAuthor
+	paraEmptyLine
+	paraImage
+	paraCover
+	paraTable
+)
+
+// maxLevel is the deepest heading level word processors support.
+const maxLevel = 9
+
+// format is a set of inline formatting flags.
+type format uint8
+
+const (
+	fmtStrong format = 1 << iota
+	fmtEmphasis
+	fmtStrike
+	fmtCode
+	fmtSup
+	fmtSub
+)
+
+// formatTags lists FB2 inline elements in nesting order.
+var formatTags = []struct {
+	f   format
+	tag string
+}{
+	{fmtStrong, "strong"},
+	{fmtEmphasis, "emphasis"},
+	{fmtStrike, "strikethrough"},
+	{fmtCode, "code"},
+	{fmtSup, "sup"},
+	{fmtSub, "sub"},
+}
+
+// run is a piece of paragraph text with the same formatting. Run could instead carry footnote reference, inline image or
+// anchors.
+type run struct {
+	text   string
+	format format
+	link   string   // "#id" for links inside of the book
+	note   int      // footnote number
+	image  string   // binary id
+	ids    []string // anchors at this position
+}
+
+// para is imported paragraph, line breaks split its content into lines.
+type para struct {
+	kind  paraKind
+	level int // heading level
+	lines [][]*run
+	rows  [][]*cell // table
+}
+
+// cell is table cell.
+type cell struct {
+	header bool
+	align  string
+	runs   []*run
+}
+
+func newPara(kind paraKind, level int) *para {
+	return &para{kind: kind, level: level}
+}
+
+// add appends run to the last line, text of the runs with the same formatting is merged, white space is collapsed.
+func (p *para) add(r run) {
+	if len(p.lines) == 0 {
+		p.lines = append(p.lines, nil)
+	}
+	p.lines[len(p.lines)-1] = appendRun(p.lines[len(p.lines)-1], r)
+}
+
+// newLine starts new line of paragraph.
+func (p *para) newLine() {
+	if len(p.lines) == 0 {
+		p.lines = append(p.lines, nil)
+	}
+	p.lines = append(p.lines, nil)
+}
+
+var reSpaces = regexp.MustCompile(`\s+`)
+
+func appendRun(runs []*run, r run) []*run {
+	if len(r.text) > 0 {
+		r.text = reSpaces.ReplaceAllString(strings.ReplaceAll(r.text, "\u00ad", ""), " ")
+		// white space after line start or another space is not needed
+		space := true
+		for i := len(runs) - 1; i >= 0; i-- {
+			if runs[i].note > 0 || len(runs[i].image) > 0 {
+				space = false
+				break
+			}
+			if len(runs[i].text) > 0 {
+				space = strings.HasSuffix(runs[i].text, " ")
+				break
+			}
+		}
+		if space {
+			if r.text = strings.TrimLeft(r.text, " "); len(r.text) == 0 {
+				return runs
+			}
+		}
+		if len(runs) > 0 {
+			last := runs[len(runs)-1]
+			if last.note == 0 && len(last.image) == 0 && len(last.ids) == 0 && last.format == r.format && last.link == r.link {
+				last.text += r.text
+				return runs
+			}
+		}
+	}
+	return append(runs, &r)
+}
+
+// empty checks if paragraph has no visible content.
+func (p *para) empty() bool {
+	if len(p.rows) > 0 {
+		return false
+	}
+	for _, l := range p.lines {
+		if !emptyLine(l) {
+			return false
+		}
+	}
+	return true
+}
+
+func emptyLine(runs []*run) bool {
+	for _, r := range runs {
+		if r.note > 0 || len(r.image) > 0 || len(strings.TrimSpace(r.text)) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// images returns binary ids if paragraph consists of images only.
+func (p *para) images() []string {
+	var ids []string
+	for _, l := range p.lines {
+		for _, r := range l {
+			switch {
+			case len(r.image) > 0:
+				ids = append(ids, r.image)
+			case r.note > 0 || len(strings.TrimSpace(r.text)) > 0:
+				return nil
+			}
+		}
+	}
+	return ids
+}
+
+// ids returns all anchors of the paragraph.
+func (p *para) ids() []string {
+	var ids []string
+	for _, l := range p.lines {
+		for _, r := range l {
+			ids = append(ids, r.ids...)
+		}
+	}
+	return ids
+}
+
+// text returns plain text of the paragraph.
+func (p *para) text() string {
+	var lines []string
+	for _, l := range p.lines {
+		var b strings.Builder
+		for _, r := range l {
+			b.WriteString(r.text)
+		}
+		if s := strings.TrimSpace(b.String()); len(s) > 0 {
+			lines = append(lines, s)
+		}
+	}
+	return strings.Join(lines, " ")
+}
+
+// binary is embedded image.
+type binary struct {
+	id   string
+	ct   string
+	data []byte
+}
+
+// book accumulates imported document.
+type book struct {
+	title      string
+	authors    []string
+	genres     []string
+	annotation string
+	keywords   string
+	date       string
+	lang       string
+	id         string
+	series     string
+	number     string
+
+	paras    []*para
+	notes    [][]*para
+	binaries []*binary
+	images   map[string]string // source reference to binary id
+}
+
+func newBook() *book {
+	return &book{images: make(map[string]string)}
+}
+
+// addNote stores footnote content and returns its number.
+func (b *book) addNote(paras []*para) int {
+	b.notes = append(b.notes, paras)
+	return len(b.notes)
+}
+
+var imageExt = map[string]string{"image/jpeg": ".jpg", "image/png": ".png", "image/gif": ".gif"}
+
+// addImage stores image data under source reference and returns binary id, data which is not a picture FB2 readers
+// could show is ignored.
+func (b *book) addImage(ref string, data []byte) string {
+	if id, ok := b.images[ref]; ok {
+		return id
+	}
+	ct := http.DetectContentType(data)
+	ext, ok := imageExt[ct]
+	if !ok {
+		b.images[ref] = ""
+		return ""
+	}
+	id := fmt.Sprintf("img_%d%s", len(b.binaries)+1, ext)
+	b.binaries = append(b.binaries, &binary{id: id, ct: ct, data: data})
+	b.images[ref] = id
+	return id
+}
+
+// setProperty stores custom document property, names are the ones word processor documents are written with.
+func (b *book) setProperty(name, value string) {
+	value = strings.TrimSpace(value)
+	switch name {
+	case "Series":
+		b.series = value
+	case "Series Number":
+		b.number = value
+	case "Genres":
+		b.genres = nil
+		for _, g := range strings.Split(value, ",") {
+			if g = strings.TrimSpace(g); len(g) > 0 {
+				b.genres = append(b.genres, g)
+			}
+		}
+	case "Date":
+		b.date = value
+	case "Book ID":
+		b.id = value
+	}
+}
+
+// setAuthors splits list of authors.
+func (b *book) setAuthors(list string) {
+	b.authors = nil
+	for _, a := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ';' }) {
+		if a = strings.TrimSpace(a); len(a) > 0 {
+			b.authors = append(b.authors, a)
+		}
+	}
+}
+
+var reNameKeys = regexp.MustCompile(`#[fml]`)
+
+// splitName divides author name into first, middle and last names using order of the names in author format.
+func splitName(name, authorFormat string) map[string]string {
+	order := reNameKeys.FindAllString(authorFormat, -1)
+	if len(order) == 0 {
+		order = []string{"#f", "#m", "#l"}
+	}
+	words := strings.Fields(name)
+	if len(words) < len(order) {
+		// middle name is the first to go
+		for i, k := range order {
+			if k == "#m" {
+				order = append(order[:i:i], order[i+1:]...)
+				break
+			}
+		}
+	}
+	res := make(map[string]string)
+	if len(words) == 1 {
+		res["#l"] = words[0]
+		return res
+	}
+	for i, k := range order {
+		if i >= len(words) {
+			break
+		}
+		if i == len(order)-1 {
+			// extra words stay together
+			res[k] = strings.Join(words[i:], " ")
+			break
+		}
+		res[k] = words[i]
+	}
+	return res
+}
+
+// section is an open FB2 section.
+type section struct {
+	e     *etree.Element
+	level int
+	empty bool // only title so far
+}
+
+// builder turns imported book into FictionBook document.
+type builder struct {
+	b            *book
+	authorFormat string
+	body         *etree.Element
+	sections     []*section
+	cover        *etree.Element
+	alias        map[string]string // extra anchors of the same element
+	ids          map[string]bool
+	targets      map[string]bool // anchors links point to, the rest is not needed
+}
+
+// document produces FictionBook document from imported book.
+func (b *book) document(name, authorFormat string) *etree.Document {
+
+	bld := &builder{b: b, authorFormat: authorFormat, alias: make(map[string]string), ids: make(map[string]bool), targets: make(map[string]bool)}
+	for _, paras := range append([][]*para{b.paras}, b.notes...) {
+		for _, p := range paras {
+			for _, l := range p.lines {
+				for _, r := range l {
+					if strings.HasPrefix(r.link, "#") {
+						bld.targets[r.link[1:]] = true
+					}
+				}
+			}
+			for _, row := range p.rows {
+				for _, c := range row {
+					for _, r := range c.runs {
+						if strings.HasPrefix(r.link, "#") {
+							bld.targets[r.link[1:]] = true
+						}
+					}
+				}
+			}
+		}
+	}
+
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	fb := doc.CreateElement("FictionBook")
+	fb.CreateAttr("xmlns", "http://www.gribuser.ru/xml/fictionbook/2.0")
+	fb.CreateAttr("xmlns:l", "http://www.w3.org/1999/xlink")
+
+	desc := fb.AddNext("description")
+	bld.body = fb.AddNext("body")
+	bld.content(b.paras)
+	bld.dropEmpty(bld.body)
+	if len(b.notes) > 0 {
+		notes := fb.AddNext("body", attr("name", "notes"))
+		title := "Notes"
+		if strings.HasPrefix(b.lang, "ru") {
+			title = "Примечания"
+		}
+		notes.AddNext("title").AddNext("p").SetText(title)
+		for i, n := range b.notes {
+			s := notes.AddNext("section", attr("id", noteID(i+1)))
+			s.AddNext("title").AddNext("p").SetText(strconv.Itoa(i + 1))
+			bld.blocks(func(bool) *etree.Element { return s }, n)
+		}
+	}
+	for _, bin := range b.binaries {
+		fb.AddNext("binary", attr("id", bin.id), attr("content-type", bin.ct)).SetText(base64.StdEncoding.EncodeToString(bin.data))
+	}
+	bld.description(desc, name)
+	bld.resolveLinks(fb)
+	return doc
+}
+
+func noteID(n int) string {
+	return "n_" + strconv.Itoa(n)
+}
+
+// description fills book description.
+func (bld *builder) description(desc *etree.Element, name string) {
+
+	b := bld.b
+	ti := desc.AddNext("title-info")
+	for _, g := range b.genres {
+		ti.AddNext("genre").SetText(g)
+	}
+	for _, a := range b.authors {
+		names := splitName(a, bld.authorFormat)
+		author := ti.AddNext("author")
+		for _, k := range []struct{ key, tag string }{{"#f", "first-name"}, {"#m", "middle-name"}, {"#l", "last-name"}} {
+			if v, ok := names[k.key]; ok {
+				author.AddNext(k.tag).SetText(v)
+			}
+		}
+	}
+	title := b.title
+	if len(title) == 0 {
+		for _, p := range b.paras {
+			if p.kind == paraTitle {
+				title = p.text()
+				break
+			}
+		}
+	}
+	if len(title) == 0 {
+		title = name
+	}
+	ti.AddNext("book-title").SetText(title)
+	if len(b.annotation) > 0 {
+		annotation := ti.AddNext("annotation")
+		for _, l := range strings.Split(b.annotation, "\n") {
+			if l = strings.TrimSpace(l); len(l) > 0 {
+				annotation.AddNext("p").SetText(l)
+			}
+		}
+	}
+	if len(b.keywords) > 0 {
+		ti.AddNext("keywords").SetText(b.keywords)
+	}
+	if len(b.date) > 0 {
+		ti.AddNext("date").SetText(b.date)
+	}
+	if bld.cover != nil {
+		ti.AddChild(bld.cover)
+	}
+	if len(b.lang) > 0 {
+		ti.AddNext("lang").SetText(b.lang)
+	}
+	if len(b.series) > 0 {
+		ti.AddNext("sequence", attr("name", b.series), attr("number", b.number))
+	}
+
+	di := desc.AddNext("document-info")
+	di.AddNext("program-used").SetText("fb2converter")
+	now := time.Now()
+	di.AddNext("date", attr("value", now.Format("2006-01-02"))).SetText(now.Format("2006-01-02"))
+	if len(b.id) > 0 {
+		di.AddNext("id").SetText(b.id)
+	}
+	di.AddNext("version").SetText("1.0")
+}
+
+// container returns element block content goes to, section is created when body cannot have content directly.
+func (bld *builder) container(epigraph bool) *etree.Element {
+	if len(bld.sections) == 0 {
+		if epigraph && bld.body.SelectElement("section") == nil {
+			return bld.body
+		}
+		bld.sections = append(bld.sections, &section{e: bld.body.AddNext("section"), level: math.MaxInt})
+	}
+	s := bld.sections[len(bld.sections)-1]
+	s.empty = false
+	return s.e
+}
+
+// content places main body paragraphs into sections according to headings.
+func (bld *builder) content(paras []*para) {
+	for len(paras) > 0 {
+		p := paras[0]
+		switch {
+		case p.kind == paraTitle && len(bld.sections) == 0 && len(bld.body.ChildElements()) == 0:
+			bld.title(bld.body.AddNext("title"), p)
+			paras = paras[1:]
+		case (p.kind == paraTitle || p.kind == paraHeading) && p.empty():
+			paras = paras[1:]
+		case p.kind == paraTitle || p.kind == paraHeading:
+			level := p.level
+			if p.kind == paraTitle || level < 1 {
+				level = 1
+			}
+			if n := len(bld.sections); n > 0 && bld.sections[n-1].empty && bld.sections[n-1].level == level {
+				// subsequent headings of the same level make single title
+				s := bld.sections[n-1]
+				bld.title(s.e.SelectElement("title"), p)
+				bld.anchor(s.e, p.ids())
+				paras = paras[1:]
+				break
+			}
+			for len(bld.sections) > 0 && bld.sections[len(bld.sections)-1].level >= level {
+				bld.sections = bld.sections[:len(bld.sections)-1]
+			}
+			parent := bld.body
+			if len(bld.sections) > 0 {
+				parent = bld.sections[len(bld.sections)-1].e
+				bld.sections[len(bld.sections)-1].empty = false
+			}
+			s := &section{e: parent.AddNext("section"), level: level, empty: true}
+			bld.title(s.e.AddNext("title"), p)
+			bld.anchor(s.e, p.ids())
+			bld.sections = append(bld.sections, s)
+			paras = paras[1:]
+		default:
+			n := 1
+			for n < len(paras) && paras[n].kind != paraTitle && paras[n].kind != paraHeading {
+				n++
+			}
+			bld.blocks(bld.container, paras[:n])
+			paras = paras[n:]
+		}
+	}
+}
+
+// dropEmpty removes sections which got title only, such as headings of footnotes pages.
+func (bld *builder) dropEmpty(e *etree.Element) {
+	for _, s := range e.SelectElements("section") {
+		bld.dropEmpty(s)
+		children := s.ChildElements()
+		if len(children) == 0 || len(children) == 1 && children[0].Tag == "title" {
+			e.RemoveChild(s)
+		}
+	}
+}
+
+// title fills title element with paragraph lines.
+func (bld *builder) title(to *etree.Element, p *para) {
+	for _, l := range p.lines {
+		if emptyLine(l) {
+			continue
+		}
+		bld.inline(to.AddNext("p"), l)
+	}
+}
+
+// anchor sets id of the element, additional anchors are remembered to redirect links.
+func (bld *builder) anchor(e *etree.Element, ids []string) {
+	for _, id := range ids {
+		if bld.ids[id] || !bld.targets[id] {
+			continue
+		}
+		bld.ids[id] = true
+		if a := e.SelectAttr("id"); a != nil {
+			bld.alias[id] = a.Value
+			continue
+		}
+		e.CreateAttr("id", id)
+	}
+}
+
+// blocks adds non-heading paragraphs to container, grouping epigraphs, citations and poems.
+func (bld *builder) blocks(container func(epigraph bool) *etree.Element, paras []*para) {
+
+	for len(paras) > 0 {
+		p := paras[0]
+		switch p.kind {
+		case paraEpigraph, paraCite, paraAnnotation:
+			n := 1
+			for n < len(paras) && paras[n].kind == p.kind {
+				n++
+			}
+			for n < len(paras) && paras[n].kind == paraTextAuthor {
+				n++
+			}
+			tag := map[paraKind]string{paraEpigraph: "epigraph", paraCite: "cite", paraAnnotation: "annotation"}[p.kind]
+			e := container(p.kind == paraEpigraph).AddNext(tag)
+			for _, q := range paras[:n] {
+				inner := "p"
+				if q.kind == paraTextAuthor && p.kind != paraAnnotation {
+					inner = "text-author"
+				}
+				bld.lines(e, inner, q)
+			}
+			paras = paras[n:]
+		case paraPoemTitle, paraStanzaTitle, paraVerse:
+			paras = bld.poem(container(false), paras)
+		case paraSubtitle:
+			bld.lines(container(false), "subtitle", p)
+			paras = paras[1:]
+		case paraEmptyLine:
+			container(false).AddNext("empty-line")
+			paras = paras[1:]
+		case paraTable:
+			bld.table(container(false), p)
+			paras = paras[1:]
+		default:
+			if images := p.images(); len(images) > 0 {
+				if p.kind == paraCover && bld.cover == nil {
+					bld.cover = etree.NewElement("coverpage")
+					for _, id := range images {
+						bld.cover.AddNext("image", attr("l:href", "#"+id))
+					}
+				} else {
+					to := container(false)
+					for _, id := range images {
+						bld.anchor(to.AddNext("image", attr("l:href", "#"+id)), p.ids())
+					}
+				}
+			} else if !p.empty() {
+				bld.lines(container(false), "p", p)
+			}
+			paras = paras[1:]
+		}
+	}
+}
+
+// lines adds paragraph lines as separate elements, anchors go to the first one.
+func (bld *builder) lines(to *etree.Element, tag string, p *para) {
+	ids := p.ids()
+	for _, l := range p.lines {
+		if emptyLine(l) {
+			continue
+		}
+		e := to.AddNext(tag)
+		bld.anchor(e, ids)
+		ids = nil
+		bld.inline(e, l)
+	}
+	if len(ids) > 0 && to.Tag != "body" {
+		bld.anchor(to, ids)
+	}
+}
+
+// poem groups verses into poem and stanzas, returns paragraphs left.
+func (bld *builder) poem(to *etree.Element, paras []*para) []*para {
+
+	poem := to.AddNext("poem")
+	defer func() {
+		if poem.SelectElement("stanza") != nil {
+			return
+		}
+		// title without verses
+		to.RemoveChild(poem)
+		if t := poem.SelectElement("title"); t != nil {
+			for _, p := range t.SelectElements("p") {
+				p.Tag = "subtitle"
+				to.AddChild(p)
+			}
+		}
+	}()
+
+	var stanza *etree.Element
+	for i, p := range paras {
+		switch p.kind {
+		case paraPoemTitle:
+			if poem.SelectElement("stanza") != nil {
+				// next poem starts
+				return paras[i:]
+			}
+			t := poem.SelectElement("title")
+			if t == nil {
+				t = poem.AddNext("title")
+			}
+			bld.title(t, p)
+			bld.anchor(poem, p.ids())
+		case paraStanzaTitle:
+			stanza = poem.AddNext("stanza")
+			bld.title(stanza.AddNext("title"), p)
+			bld.anchor(stanza, p.ids())
+		case paraVerse:
+			if p.empty() {
+				stanza = nil
+				continue
+			}
+			if stanza == nil {
+				stanza = poem.AddNext("stanza")
+			}
+			bld.lines(stanza, "v", p)
+		case paraTextAuthor:
+			if poem.SelectElement("stanza") == nil {
+				return paras[i:]
+			}
+			bld.lines(poem, "text-author", p)
+		default:
+			return paras[i:]
+		}
+	}
+	return nil
+}
+
+// table adds table.
+func (bld *builder) table(to *etree.Element, p *para) {
+	table := to.AddNext("table")
+	for _, row := range p.rows {
+		tr := table.AddNext("tr")
+		for _, c := range row {
+			tag := "td"
+			if c.header {
+				tag = "th"
+			}
+			bld.inline(tr.AddNext(tag, attr("align", c.align)), c.runs)
+		}
+	}
+}
+
+// inline adds runs to element producing nested formatting elements, links and footnote references.
+func (bld *builder) inline(to *etree.Element, runs []*run) {
+
+	// trailing spaces are not needed
+	for i := len(runs) - 1; i >= 0; i-- {
+		if runs[i].note > 0 || len(runs[i].image) > 0 {
+			break
+		}
+		if t := strings.TrimRightFunc(runs[i].text, unicode.IsSpace); t != runs[i].text {
+			c := *runs[i]
+			c.text = t
+			runs = append(append(runs[:i:i], &c), runs[i+1:]...)
+		}
+		if len(runs[i].text) > 0 {
+			break
+		}
+	}
+
+	var (
+		link *etree.Element
+		href string
+	)
+	for _, r := range runs {
+		switch {
+		case r.note > 0:
+			link = nil
+			to.AddNext("a", attr("l:href", "#"+noteID(r.note)), attr("type", "note")).SetText("[" + strconv.Itoa(r.note) + "]")
+			continue
+		case len(r.image) > 0:
+			link = nil
+			to.AddNext("image", attr("l:href", "#"+r.image))
+			continue
+		case len(r.text) == 0:
+			continue
+		}
+		parent := to
+		if len(r.link) > 0 {
+			if link == nil || href != r.link {
+				link, href = to.AddNext("a", attr("l:href", r.link)), r.link
+			}
+			parent = link
+		} else {
+			link = nil
+		}
+		for _, t := range formatTags {
+			if r.format&t.f != 0 {
+				parent = parent.AddNext(t.tag)
+			}
+		}
+		parent.CreateCharData(r.text)
+	}
+}
+
+// resolveLinks redirects links to anchors which were merged with others.
+func (bld *builder) resolveLinks(fb *etree.Element) {
+	for _, a := range fb.FindElements("//a") {
+		if h := a.SelectAttr("href"); h != nil && strings.HasPrefix(h.Value, "#") {
+			if id, ok := bld.alias[h.Value[1:]]; ok {
+				h.Value = "#" + id
+			}
+		}
+	}
+}
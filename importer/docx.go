@@ -0,0 +1,494 @@
+package importer
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+)
+
+// pkg is zipped document package.
+type pkg map[string]*zip.File
+
+func openPackage(data []byte) (pkg, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open document package: %w", err)
+	}
+	files := make(pkg, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	return files, nil
+}
+
+// read returns content of the package part, nil if part does not exist.
+func (p pkg) read(name string) ([]byte, error) {
+	f, ok := p[name]
+	if !ok {
+		return nil, nil
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", name, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", name, err)
+	}
+	return data, nil
+}
+
+// xml parses package part, nil is returned if part does not exist.
+func (p pkg) xml(name string) (*etree.Document, error) {
+	data, err := p.read(name)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", name, err)
+	}
+	return doc, nil
+}
+
+// docxStyle is named style from styles part.
+type docxStyle struct {
+	name    string
+	basedOn string
+	level   int // outline level, 0 when absent
+}
+
+// docxReader converts WordprocessingML document.
+type docxReader struct {
+	b      *book
+	pkg    pkg
+	log    *zap.Logger
+	dir    string // directory of the main part
+	styles map[string]*docxStyle
+	notes  map[string]*etree.Element // footnotes and endnotes by kind and id
+	rels   map[string]*docxRels      // of the notes parts
+}
+
+// docxRels is relationships of the single document part.
+type docxRels struct {
+	dir     string
+	targets map[string]string
+	extern  map[string]bool
+}
+
+// path returns package part name of the relationship target.
+func (rels *docxRels) path(id string) string {
+	if t := rels.targets[id]; strings.HasPrefix(t, "/") {
+		return strings.TrimPrefix(t, "/")
+	}
+	return path.Join(rels.dir, rels.targets[id])
+}
+
+func readDOCX(data []byte, log *zap.Logger) (*book, error) {
+
+	p, err := openPackage(data)
+	if err != nil {
+		return nil, err
+	}
+	r := &docxReader{
+		b:      newBook(),
+		pkg:    p,
+		log:    log,
+		styles: make(map[string]*docxStyle),
+		notes:  make(map[string]*etree.Element),
+		rels:   make(map[string]*docxRels),
+	}
+
+	main := "word/document.xml"
+	if rels, err := r.relations(""); err == nil {
+		// main part could be named differently
+		for id, t := range rels.targets {
+			if strings.HasSuffix(id, "officeDocument") {
+				main = strings.TrimPrefix(t, "/")
+			}
+		}
+	}
+	doc, err := p.xml(main)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("not a word processing document, %s is absent", main)
+	}
+	r.dir = path.Dir(main)
+
+	if styles, err := p.xml(path.Join(r.dir, "styles.xml")); err != nil {
+		return nil, err
+	} else if styles != nil {
+		r.readStyles(styles)
+	}
+	for _, kind := range []string{"footnote", "endnote"} {
+		notes, err := p.xml(path.Join(r.dir, kind+"s.xml"))
+		if err != nil {
+			return nil, err
+		}
+		if notes == nil {
+			continue
+		}
+		for _, n := range notes.FindElements("//" + kind) {
+			if t := n.SelectAttrValue("type", ""); len(t) > 0 && t != "normal" {
+				continue
+			}
+			r.notes[kind+n.SelectAttrValue("id", "")] = n
+		}
+	}
+	if err := r.readProperties(); err != nil {
+		return nil, err
+	}
+
+	rels, err := r.relations(main)
+	if err != nil {
+		return nil, err
+	}
+	if body := doc.FindElement("//body"); body != nil {
+		r.blocks(body, rels, &r.b.paras)
+	}
+	return r.b, nil
+}
+
+// relations reads relationships of the package part, empty name is for package relationships.
+func (r *docxReader) relations(part string) (*docxRels, error) {
+	name := "_rels/.rels"
+	if len(part) > 0 {
+		name = path.Join(path.Dir(part), "_rels", path.Base(part)+".rels")
+	}
+	rels := &docxRels{dir: path.Dir(part), targets: make(map[string]string), extern: make(map[string]bool)}
+	doc, err := r.pkg.xml(name)
+	if err != nil || doc == nil {
+		return rels, err
+	}
+	for _, rel := range doc.FindElements("//Relationship") {
+		id, target := rel.SelectAttrValue("Id", ""), rel.SelectAttrValue("Target", "")
+		if len(part) == 0 {
+			// package relationships are looked up by type
+			id = rel.SelectAttrValue("Type", "")
+		}
+		rels.targets[id] = target
+		rels.extern[id] = rel.SelectAttrValue("TargetMode", "") == "External"
+	}
+	return rels, nil
+}
+
+func (r *docxReader) readStyles(doc *etree.Document) {
+	for _, s := range doc.FindElements("//style") {
+		st := &docxStyle{}
+		if n := s.SelectElement("name"); n != nil {
+			st.name = n.SelectAttrValue("val", "")
+		}
+		if b := s.SelectElement("basedOn"); b != nil {
+			st.basedOn = b.SelectAttrValue("val", "")
+		}
+		if l := s.FindElement("pPr/outlineLvl"); l != nil {
+			if n, err := strconv.Atoi(l.SelectAttrValue("val", "")); err == nil && n < maxLevel {
+				st.level = n + 1
+			}
+		}
+		r.styles[s.SelectAttrValue("styleId", "")] = st
+	}
+}
+
+// paragraphKind resolves paragraph style following inheritance.
+func (r *docxReader) paragraphKind(id string) (paraKind, int) {
+	for i := 0; i < 10 && len(id) > 0; i++ {
+		st, ok := r.styles[id]
+		if !ok {
+			// style definitions could be missing, identifiers are names without spaces
+			if kind, level, ok := styleKind(id); ok {
+				return kind, level
+			}
+			break
+		}
+		if kind, level, ok := styleKind(st.name); ok {
+			return kind, level
+		}
+		if st.level > 0 {
+			return paraHeading, st.level
+		}
+		id = st.basedOn
+	}
+	return paraText, 0
+}
+
+// characterFormat resolves character style following inheritance.
+func (r *docxReader) characterFormat(id string) format {
+	for i := 0; i < 10 && len(id) > 0; i++ {
+		st, ok := r.styles[id]
+		if !ok {
+			f, _ := styleFormat(id)
+			return f
+		}
+		if f, ok := styleFormat(st.name); ok {
+			return f
+		}
+		id = st.basedOn
+	}
+	return 0
+}
+
+func (r *docxReader) readProperties() error {
+
+	core, err := r.pkg.xml("docProps/core.xml")
+	if err != nil {
+		return err
+	}
+	if core != nil {
+		for _, e := range core.Root().ChildElements() {
+			v := strings.TrimSpace(e.Text())
+			switch e.Tag {
+			case "title":
+				r.b.title = v
+			case "creator":
+				r.b.setAuthors(v)
+			case "keywords":
+				r.b.keywords = v
+			case "description":
+				r.b.annotation = v
+			case "language":
+				r.b.lang = v
+			}
+		}
+	}
+	custom, err := r.pkg.xml("docProps/custom.xml")
+	if err != nil {
+		return err
+	}
+	if custom != nil {
+		for _, p := range custom.Root().SelectElements("property") {
+			var v string
+			for _, c := range p.ChildElements() {
+				v = c.Text()
+			}
+			r.b.setProperty(p.SelectAttrValue("name", ""), v)
+		}
+	}
+	return nil
+}
+
+// blocks converts block level content.
+func (r *docxReader) blocks(e *etree.Element, rels *docxRels, to *[]*para) {
+	for _, c := range e.ChildElements() {
+		switch c.Tag {
+		case "p":
+			r.paragraph(c, rels, to)
+		case "tbl":
+			r.table(c, rels, to)
+		case "sdt":
+			if content := c.SelectElement("sdtContent"); content != nil {
+				r.blocks(content, rels, to)
+			}
+		case "customXml", "ins", "smartTag":
+			r.blocks(c, rels, to)
+		}
+	}
+}
+
+func (r *docxReader) paragraph(e *etree.Element, rels *docxRels, to *[]*para) {
+
+	kind, level := paraText, 0
+	if ppr := e.SelectElement("pPr"); ppr != nil {
+		if s := ppr.SelectElement("pStyle"); s != nil {
+			kind, level = r.paragraphKind(s.SelectAttrValue("val", ""))
+		} else {
+			kind, level = r.paragraphKind(r.defaultStyle())
+		}
+		if l := ppr.SelectElement("outlineLvl"); l != nil {
+			if n, err := strconv.Atoi(l.SelectAttrValue("val", "")); err == nil && n < maxLevel {
+				kind, level = paraHeading, n+1
+			}
+		}
+	}
+	p := newPara(kind, level)
+	r.inline(e, rels, p, run{})
+	*to = append(*to, p)
+}
+
+// defaultStyle returns identifier of the default paragraph style.
+func (r *docxReader) defaultStyle() string {
+	if _, ok := r.styles["Normal"]; ok {
+		return "Normal"
+	}
+	return ""
+}
+
+// inline converts paragraph content, cur keeps formatting and link of the enclosing elements.
+func (r *docxReader) inline(e *etree.Element, rels *docxRels, p *para, cur run) {
+	for _, c := range e.ChildElements() {
+		switch c.Tag {
+		case "r":
+			r.run(c, rels, p, cur)
+		case "hyperlink":
+			link := cur
+			if a := c.SelectAttrValue("anchor", ""); len(a) > 0 {
+				link.link = "#" + a
+			} else if id := c.SelectAttrValue("r:id", ""); len(id) > 0 && rels.extern[id] {
+				link.link = rels.targets[id]
+			}
+			r.inline(c, rels, p, link)
+		case "bookmarkStart":
+			if name := c.SelectAttrValue("name", ""); len(name) > 0 && name != "_GoBack" {
+				p.add(run{ids: []string{name}})
+			}
+		case "fldSimple", "ins", "smartTag", "customXml", "sdt", "sdtContent":
+			r.inline(c, rels, p, cur)
+		}
+	}
+}
+
+func (r *docxReader) run(e *etree.Element, rels *docxRels, p *para, cur run) {
+
+	if rpr := e.SelectElement("rPr"); rpr != nil {
+		if s := rpr.SelectElement("rStyle"); s != nil {
+			cur.format |= r.characterFormat(s.SelectAttrValue("val", ""))
+		}
+		for _, c := range rpr.ChildElements() {
+			on := !isFalse(c.SelectAttrValue("val", ""))
+			switch c.Tag {
+			case "b":
+				cur.format = setFormat(cur.format, fmtStrong, on)
+			case "i":
+				cur.format = setFormat(cur.format, fmtEmphasis, on)
+			case "strike", "dstrike":
+				cur.format = setFormat(cur.format, fmtStrike, on)
+			case "vertAlign":
+				switch c.SelectAttrValue("val", "") {
+				case "superscript":
+					cur.format = setFormat(cur.format, fmtSup, true)
+				case "subscript":
+					cur.format = setFormat(cur.format, fmtSub, true)
+				}
+			}
+		}
+	}
+
+	for _, c := range e.ChildElements() {
+		switch c.Tag {
+		case "t":
+			t := cur
+			t.text = c.Text()
+			p.add(t)
+		case "tab", "noBreakHyphen":
+			t := cur
+			t.text = map[string]string{"tab": " ", "noBreakHyphen": "‑"}[c.Tag]
+			p.add(t)
+		case "br", "cr":
+			if c.SelectAttrValue("type", "") != "page" {
+				p.newLine()
+			}
+		case "footnoteReference", "endnoteReference":
+			kind := strings.TrimSuffix(c.Tag, "Reference")
+			if n, ok := r.notes[kind+c.SelectAttrValue("id", "")]; ok {
+				p.add(run{note: r.note(n, kind)})
+			}
+		case "drawing", "pict", "object":
+			for _, blip := range append(c.FindElements(".//blip"), c.FindElements(".//imagedata")...) {
+				id := blip.SelectAttrValue("embed", blip.SelectAttrValue("r:id", ""))
+				if len(id) == 0 || rels.extern[id] {
+					continue
+				}
+				if img := r.image(rels.path(id)); len(img) > 0 {
+					p.add(run{image: img})
+				}
+			}
+		}
+	}
+}
+
+func isFalse(v string) bool {
+	return v == "0" || v == "false" || v == "off" || v == "none"
+}
+
+func setFormat(f, flag format, on bool) format {
+	if on {
+		return f | flag
+	}
+	return f &^ flag
+}
+
+// note converts footnote content and returns its number.
+func (r *docxReader) note(e *etree.Element, kind string) int {
+	rels, ok := r.rels[kind]
+	if !ok {
+		var err error
+		if rels, err = r.relations(path.Join(r.dir, kind+"s.xml")); err != nil {
+			r.log.Warn("Unable to read notes relationships", zap.Error(err))
+		}
+		r.rels[kind] = rels
+	}
+	var paras []*para
+	r.blocks(e, rels, &paras)
+	for _, p := range paras {
+		// notes are paragraphs, their styles are of no interest
+		p.kind, p.level = paraText, 0
+	}
+	return r.b.addNote(paras)
+}
+
+// image stores picture from the package.
+func (r *docxReader) image(name string) string {
+	data, err := r.pkg.read(name)
+	if err != nil || data == nil {
+		r.log.Warn("Unable to read document image", zap.String("image", name), zap.Error(err))
+		return ""
+	}
+	id := r.b.addImage(name, data)
+	if len(id) == 0 {
+		r.log.Warn("Unsupported image format, skipping", zap.String("image", name))
+	}
+	return id
+}
+
+func (r *docxReader) table(e *etree.Element, rels *docxRels, to *[]*para) {
+	t := newPara(paraTable, 0)
+	for _, tr := range e.SelectElements("tr") {
+		var row []*cell
+		for _, tc := range tr.SelectElements("tc") {
+			var paras []*para
+			r.blocks(tc, rels, &paras)
+			c := &cell{header: tr.FindElement("trPr/tblHeader") != nil || strings.EqualFold(r.styleName(tc), "table heading")}
+			if jc := tc.FindElement("p/pPr/jc"); jc != nil {
+				c.align = map[string]string{"center": "center", "right": "right", "end": "right"}[jc.SelectAttrValue("val", "")]
+			}
+			for _, p := range paras {
+				for _, l := range p.lines {
+					if len(c.runs) > 0 {
+						c.runs = appendRun(c.runs, run{text: " "})
+					}
+					c.runs = append(c.runs, l...)
+				}
+			}
+			row = append(row, c)
+		}
+		if len(row) > 0 {
+			t.rows = append(t.rows, row)
+		}
+	}
+	if len(t.rows) > 0 {
+		*to = append(*to, t)
+	}
+}
+
+// styleName returns name of the first paragraph style in table cell.
+func (r *docxReader) styleName(tc *etree.Element) string {
+	s := tc.FindElement("p/pPr/pStyle")
+	if s == nil {
+		return ""
+	}
+	if st, ok := r.styles[s.SelectAttrValue("val", "")]; ok {
+		return st.name
+	}
+	return s.SelectAttrValue("val", "")
+}
@@ -0,0 +1,544 @@
+package importer
+
+import (
+	"encoding/base64"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+)
+
+// htmlReader converts HTML document. Besides usual markup it understands classes of the pages fb2converter produces, so
+// books could be edited as HTML.
+type htmlReader struct {
+	b     *book
+	dir   string
+	log   *zap.Logger
+	ids   map[string]*html.Node
+	notes map[*html.Node]int  // footnote references
+	skip  map[*html.Node]bool // footnotes content
+	// anchors waiting for the next paragraph
+	pending []string
+}
+
+func readHTML(r io.Reader, dir string, log *zap.Logger) (*book, error) {
+
+	cr, err := charset.NewReader(r, "")
+	if err != nil {
+		return nil, err
+	}
+	doc, err := html.Parse(cr)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &htmlReader{
+		b:     newBook(),
+		dir:   dir,
+		log:   log,
+		ids:   make(map[string]*html.Node),
+		notes: make(map[*html.Node]int),
+		skip:  make(map[*html.Node]bool),
+	}
+	var body *html.Node
+	walkHTML(doc, func(n *html.Node) bool {
+		switch n.DataAtom {
+		case atom.Html:
+			h.b.lang = htmlAttr(n, "lang")
+		case atom.Title:
+			h.b.title = strings.TrimSpace(htmlText(n))
+		case atom.Meta:
+			h.meta(n)
+		case atom.Body:
+			body = n
+		}
+		if id := htmlAttr(n, "id"); len(id) > 0 {
+			h.ids[id] = n
+		}
+		return true
+	})
+	if body == nil {
+		return h.b, nil
+	}
+	h.footnotes(body)
+	h.blocks(body, paraText, &h.b.paras)
+	return h.b, nil
+}
+
+// walkHTML visits nodes depth first, children are skipped when visitor returns false.
+func walkHTML(n *html.Node, visit func(n *html.Node) bool) {
+	if n.Type == html.ElementNode && !visit(n) {
+		return
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		walkHTML(c, visit)
+	}
+}
+
+func htmlAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func hasClass(n *html.Node, class string) bool {
+	for _, c := range strings.Fields(htmlAttr(n, "class")) {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+func classPrefix(n *html.Node, prefix string) bool {
+	for _, c := range strings.Fields(htmlAttr(n, "class")) {
+		if strings.HasPrefix(c, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRole checks ARIA role and EPUB semantics.
+func hasRole(n *html.Node, roles ...string) bool {
+	for _, r := range roles {
+		if htmlAttr(n, "role") == "doc-"+r {
+			return true
+		}
+		for _, t := range strings.Fields(htmlAttr(n, "epub:type")) {
+			if t == r {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func htmlText(n *html.Node) string {
+	var b strings.Builder
+	var text func(n *html.Node)
+	text = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			text(c)
+		}
+	}
+	text(n)
+	return b.String()
+}
+
+func (h *htmlReader) meta(n *html.Node) {
+	content := strings.TrimSpace(htmlAttr(n, "content"))
+	switch strings.ToLower(htmlAttr(n, "name")) {
+	case "author", "dc.creator":
+		h.b.setAuthors(content)
+	case "description", "dc.description":
+		h.b.annotation = content
+	case "keywords", "dc.subject":
+		h.b.keywords = content
+	case "dc.title":
+		h.b.title = content
+	case "dc.language":
+		h.b.lang = content
+	}
+}
+
+// footnotes finds footnote references and converts footnotes content, so it would not get into the main text.
+func (h *htmlReader) footnotes(body *html.Node) {
+	walkHTML(body, func(n *html.Node) bool {
+		if n.DataAtom != atom.A || !(hasClass(n, "anchor") || hasClass(n, "noteref") || hasClass(n, "footnote-ref") || hasRole(n, "noteref")) {
+			return true
+		}
+		id := fragment(htmlAttr(n, "href"))
+		target, ok := h.ids[id]
+		if !ok {
+			return false
+		}
+		var content []*html.Node
+		if target.FirstChild == nil {
+			// empty anchor, note is what follows up to the next anchor
+			for s := target.NextSibling; s != nil; s = s.NextSibling {
+				if s.Type == html.ElementNode && (len(htmlAttr(s, "id")) > 0 || hasClass(s, "section") || hasClass(s, "titleblock")) {
+					break
+				}
+				content = append(content, s)
+			}
+		} else {
+			content = append(content, target)
+		}
+		var paras []*para
+		for _, c := range content {
+			if !hasClass(c, "titlenotes") {
+				h.node(c, paraText, &paras)
+			}
+			h.skip[c] = true
+		}
+		for _, p := range paras {
+			p.kind, p.level = paraText, 0
+		}
+		h.skip[target] = true
+		h.notes[n] = h.b.addNote(paras)
+		return false
+	})
+}
+
+// fragment returns anchor the reference points to.
+func fragment(ref string) string {
+	if i := strings.IndexByte(ref, '#'); i >= 0 {
+		return ref[i+1:]
+	}
+	return ""
+}
+
+// blocks converts children of block element, inline content between blocks forms paragraphs.
+func (h *htmlReader) blocks(n *html.Node, kind paraKind, to *[]*para) {
+	var cur *para
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if h.skip[c] {
+			continue
+		}
+		if isInline(c) {
+			if cur == nil {
+				cur = h.newPara(kind, 0)
+			}
+			h.inline(c, cur, run{})
+			continue
+		}
+		if cur != nil {
+			h.add(to, cur)
+			cur = nil
+		}
+		h.node(c, kind, to)
+	}
+	if cur != nil {
+		h.add(to, cur)
+	}
+}
+
+func isInline(n *html.Node) bool {
+	switch n.Type {
+	case html.TextNode:
+		return true
+	case html.ElementNode:
+		switch n.DataAtom {
+		case atom.A, atom.Abbr, atom.B, atom.Bdi, atom.Bdo, atom.Big, atom.Br, atom.Cite, atom.Code, atom.Del, atom.Dfn,
+			atom.Em, atom.Font, atom.I, atom.Img, atom.Ins, atom.Kbd, atom.Mark, atom.Q, atom.S, atom.Samp, atom.Small,
+			atom.Span, atom.Strike, atom.Strong, atom.Sub, atom.Sup, atom.Time, atom.Tt, atom.U, atom.Var, atom.Wbr:
+			return !hasClass(n, "text-author")
+		}
+	}
+	return false
+}
+
+// newPara starts paragraph, waiting anchors go to its beginning.
+func (h *htmlReader) newPara(kind paraKind, level int) *para {
+	p := newPara(kind, level)
+	if len(h.pending) > 0 {
+		p.add(run{ids: h.pending})
+		h.pending = nil
+	}
+	return p
+}
+
+// add appends paragraph, paragraphs without content are dropped unless they have meaning.
+func (h *htmlReader) add(to *[]*para, p *para) {
+	if p.empty() && p.kind != paraEmptyLine && p.kind != paraVerse {
+		h.pending = append(h.pending, p.ids()...)
+		return
+	}
+	*to = append(*to, p)
+}
+
+// kindOf returns kind of the paragraphs inside container with class of generated pages or semantic element.
+func kindOf(n *html.Node, kind paraKind) paraKind {
+	switch {
+	case hasClass(n, "epigraph"):
+		return paraEpigraph
+	case hasClass(n, "cite") || n.DataAtom == atom.Blockquote:
+		return paraCite
+	case hasClass(n, "annotation"):
+		return paraAnnotation
+	case hasClass(n, "poem") || hasClass(n, "stanza"):
+		return paraVerse
+	case hasClass(n, "subtitle"):
+		return paraSubtitle
+	case hasClass(n, "text-author"):
+		return paraTextAuthor
+	case hasClass(n, "image") || n.DataAtom == atom.Figure:
+		if kind == paraCover {
+			return kind
+		}
+		return paraImage
+	case htmlAttr(n, "id") == "page_cover" || hasClass(n, "cover"):
+		return paraCover
+	}
+	return kind
+}
+
+// headingLevel recognizes headings and title blocks of generated pages.
+func headingLevel(n *html.Node) (int, bool) {
+	switch n.DataAtom {
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		return int(n.Data[1] - '0'), true
+	}
+	for _, c := range strings.Fields(htmlAttr(n, "class")) {
+		if len(c) == 2 && c[0] == 'h' && c[1] >= '0' && c[1] <= '9' {
+			return int(c[1] - '0'), true
+		}
+	}
+	return 0, false
+}
+
+// node converts single block element.
+func (h *htmlReader) node(n *html.Node, kind paraKind, to *[]*para) {
+
+	if n.Type != html.ElementNode || h.skip[n] {
+		return
+	}
+	switch n.DataAtom {
+	case atom.Script, atom.Style, atom.Nav, atom.Head, atom.Template, atom.Noscript:
+		return
+	}
+	if hasClass(n, "toc") || hasClass(n, "chapter_end") || classPrefix(n, "vignette") || hasClass(n, "footnotes") ||
+		hasRole(n, "endnotes", "footnotes", "toc") || htmlAttr(n, "id") == "page_toc" {
+		return
+	}
+	if id := htmlAttr(n, "id"); len(id) > 0 {
+		h.pending = append(h.pending, id)
+	}
+
+	if level, ok := headingLevel(n); ok {
+		hk := paraHeading
+		switch {
+		case kind == paraVerse:
+			hk = paraPoemTitle
+		case level == 0:
+			hk = paraTitle
+		}
+		p := h.newPara(hk, level)
+		if n.DataAtom == 0 || n.DataAtom == atom.Div {
+			// title block, lines are paragraphs
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				if len(p.lines) > 0 {
+					p.newLine()
+				}
+				h.inline(c, p, run{})
+			}
+		} else {
+			h.inline(n, p, run{})
+		}
+		h.add(to, p)
+		return
+	}
+
+	kind = kindOf(n, kind)
+	switch {
+	case n.DataAtom == atom.P || n.DataAtom == atom.Dt || n.DataAtom == atom.Dd || n.DataAtom == atom.Figcaption:
+		p := h.newPara(kind, 0)
+		h.inline(n, p, run{})
+		h.add(to, p)
+	case n.DataAtom == atom.Pre:
+		p := h.newPara(kind, 0)
+		for i, l := range strings.Split(strings.TrimRight(htmlText(n), "\n"), "\n") {
+			if i > 0 {
+				p.newLine()
+			}
+			// leading spaces are significant in preformatted text
+			p.add(run{text: strings.ReplaceAll(l, " ", "\u00a0"), format: fmtCode})
+		}
+		h.add(to, p)
+	case n.DataAtom == atom.Hr || hasClass(n, "emptyline"):
+		h.add(to, h.newPara(paraEmptyLine, 0))
+	case n.DataAtom == atom.Table:
+		h.table(n, to)
+	case n.DataAtom == atom.Svg:
+		p := h.newPara(kindOf(n, kind), 0)
+		h.inline(n, p, run{})
+		h.add(to, p)
+	case hasClass(n, "text-author") || hasClass(n, "subtitle"):
+		p := h.newPara(kind, 0)
+		h.inline(n, p, run{})
+		h.add(to, p)
+	default:
+		h.blocks(n, kind, to)
+		if hasClass(n, "stanza") {
+			// empty verse separates stanzas
+			*to = append(*to, newPara(paraVerse, 0))
+		}
+	}
+}
+
+// inline converts inline content, cur keeps formatting and link of the enclosing elements.
+func (h *htmlReader) inline(n *html.Node, p *para, cur run) {
+
+	if n.Type == html.TextNode {
+		t := cur
+		t.text = n.Data
+		p.add(t)
+		return
+	}
+	if n.Type != html.ElementNode || h.skip[n] {
+		return
+	}
+	if id := htmlAttr(n, "id"); len(id) > 0 && n.DataAtom != atom.P {
+		p.add(run{ids: []string{id}})
+	}
+	if note, ok := h.notes[n]; ok {
+		p.add(run{note: note})
+		return
+	}
+	switch n.DataAtom {
+	case atom.Script, atom.Style:
+		return
+	case atom.Br:
+		p.newLine()
+		return
+	case atom.Img:
+		if id := h.image(htmlAttr(n, "src")); len(id) > 0 {
+			p.add(run{image: id})
+		}
+		return
+	case atom.Image:
+		// svg image
+		ref := htmlAttr(n, "xlink:href")
+		if len(ref) == 0 {
+			ref = htmlAttr(n, "href")
+		}
+		if id := h.image(ref); len(id) > 0 {
+			p.add(run{image: id})
+		}
+		return
+	case atom.A:
+		if hasRole(n, "backlink") || hasClass(n, "footnote-back") {
+			return
+		}
+		ref := htmlAttr(n, "href")
+		if u, err := url.Parse(ref); err == nil && len(ref) > 0 {
+			if u.IsAbs() {
+				cur.link = ref
+			} else if len(u.Fragment) > 0 {
+				cur.link = "#" + u.Fragment
+			}
+		}
+	case atom.Em, atom.I, atom.Cite, atom.Dfn, atom.Var:
+		cur.format |= fmtEmphasis
+	case atom.Strong, atom.B:
+		cur.format |= fmtStrong
+	case atom.S, atom.Strike, atom.Del:
+		cur.format |= fmtStrike
+	case atom.Code, atom.Kbd, atom.Samp, atom.Tt:
+		cur.format |= fmtCode
+	case atom.Sup:
+		cur.format |= fmtSup
+	case atom.Sub:
+		cur.format |= fmtSub
+	case atom.Span:
+		switch {
+		case hasClass(n, "emphasis"):
+			cur.format |= fmtEmphasis
+		case hasClass(n, "strong"):
+			cur.format |= fmtStrong
+		case hasClass(n, "strike"):
+			cur.format |= fmtStrike
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		h.inline(c, p, cur)
+	}
+}
+
+// image stores picture from data URI or local file.
+func (h *htmlReader) image(ref string) string {
+
+	if len(ref) == 0 {
+		return ""
+	}
+	if id, ok := h.b.images[ref]; ok {
+		return id
+	}
+	var (
+		data []byte
+		err  error
+	)
+	switch {
+	case strings.HasPrefix(ref, "data:"):
+		i := strings.IndexByte(ref, ',')
+		if i < 0 || !strings.HasSuffix(ref[:i], ";base64") {
+			h.log.Warn("Unsupported image reference, skipping", zap.String("image", shorten(ref)))
+			return ""
+		}
+		data, err = base64.StdEncoding.DecodeString(ref[i+1:])
+	case strings.Contains(ref, ":") || len(h.dir) == 0:
+		h.log.Warn("Unable to access image, skipping", zap.String("image", ref))
+		return ""
+	default:
+		name := ref
+		if u, err := url.Parse(ref); err == nil {
+			name = u.Path
+		}
+		data, err = os.ReadFile(filepath.Join(h.dir, filepath.FromSlash(name)))
+	}
+	if err != nil {
+		h.log.Warn("Unable to read image, skipping", zap.String("image", shorten(ref)), zap.Error(err))
+		return ""
+	}
+	id := h.b.addImage(ref, data)
+	if len(id) == 0 {
+		h.log.Warn("Unsupported image format, skipping", zap.String("image", shorten(ref)))
+	}
+	return id
+}
+
+// shorten makes sure data URIs do not clutter the log.
+func shorten(ref string) string {
+	if len(ref) > 32 {
+		return ref[:32] + "..."
+	}
+	return ref
+}
+
+func (h *htmlReader) table(n *html.Node, to *[]*para) {
+	t := newPara(paraTable, 0)
+	walkHTML(n, func(c *html.Node) bool {
+		switch c.DataAtom {
+		case atom.Table:
+			return c == n
+		case atom.Tr:
+			var row []*cell
+			for td := c.FirstChild; td != nil; td = td.NextSibling {
+				if td.DataAtom != atom.Td && td.DataAtom != atom.Th {
+					continue
+				}
+				p := newPara(paraText, 0)
+				h.inline(td, p, run{})
+				cl := &cell{header: td.DataAtom == atom.Th, align: htmlAttr(td, "align")}
+				for _, l := range p.lines {
+					if len(cl.runs) > 0 {
+						cl.runs = appendRun(cl.runs, run{text: " "})
+					}
+					cl.runs = append(cl.runs, l...)
+				}
+				row = append(row, cl)
+			}
+			if len(row) > 0 {
+				t.rows = append(t.rows, row)
+			}
+			return false
+		}
+		return true
+	})
+	if len(t.rows) > 0 {
+		*to = append(*to, t)
+	}
+}
@@ -0,0 +1,133 @@
+// Package importer converts manuscripts written with word processors (DOCX, ODT) and clean HTML into FictionBook
+// documents, so they could be converted like any other FB2 book. Paragraph styles become sections, titles, epigraphs,
+// citations and poems, footnotes go to notes body, pictures to binaries and document properties to book description.
+package importer
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+)
+
+// Supported checks if document could be imported judging by its file name.
+func Supported(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".docx", ".odt", ".html", ".htm", ".xhtml":
+		return true
+	}
+	return false
+}
+
+// Import reads document and converts it into FB2. Format is selected by file name extension, relative references to
+// images in HTML documents are resolved against dir (when not empty). Authors in document properties are expected to be
+// written in authorFormat ("author_format" configuration option) order of names.
+func Import(r io.Reader, name, dir, authorFormat string, log *zap.Logger) (*etree.Document, error) {
+
+	var (
+		b   *book
+		err error
+	)
+	switch ext := strings.ToLower(filepath.Ext(name)); ext {
+	case ".docx", ".odt":
+		var data []byte
+		if data, err = io.ReadAll(r); err != nil {
+			return nil, fmt.Errorf("unable to read %s: %w", name, err)
+		}
+		if ext == ".docx" {
+			b, err = readDOCX(data, log)
+		} else {
+			b, err = readODT(data, log)
+		}
+	case ".html", ".htm", ".xhtml":
+		b, err = readHTML(r, dir, log)
+	default:
+		return nil, fmt.Errorf("unsupported document type: %s", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to import %s: %w", name, err)
+	}
+
+	// make sure imported document looks exactly like the parsed one
+	data, err := b.document(strings.TrimSuffix(filepath.Base(name), filepath.Ext(name)), authorFormat).WriteToBytes()
+	if err != nil {
+		return nil, fmt.Errorf("unable to import %s: %w", name, err)
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, fmt.Errorf("unable to import %s: %w", name, err)
+	}
+	return doc, nil
+}
+
+// styleKind recognizes named paragraph styles, both the ones FB2 documents are written with and common word processor
+// ones. Unknown styles are reported as not found.
+func styleKind(name string) (paraKind, int, bool) {
+	// names are compared without spaces, so style identifiers could be used when names are unknown
+	name = strings.ToLower(strings.ReplaceAll(name, " ", ""))
+	if strings.HasPrefix(name, "heading") {
+		level, err := strconv.Atoi(strings.TrimPrefix(name, "heading"))
+		if err == nil && level > 0 && level <= maxLevel {
+			return paraHeading, level, true
+		}
+		if name == "heading" {
+			return paraHeading, 1, true
+		}
+	}
+	switch name {
+	case "title":
+		return paraTitle, 0, true
+	case "subtitle":
+		return paraSubtitle, 0, true
+	case "epigraph":
+		return paraEpigraph, 0, true
+	case "cite", "quote", "quotations", "blocktext", "intensequote":
+		return paraCite, 0, true
+	case "annotation", "abstract":
+		return paraAnnotation, 0, true
+	case "poemtitle":
+		return paraPoemTitle, 0, true
+	case "stanzatitle":
+		return paraStanzaTitle, 0, true
+	case "verse", "poem":
+		return paraVerse, 0, true
+	case "textauthor", "signature":
+		return paraTextAuthor, 0, true
+	case "emptyline":
+		return paraEmptyLine, 0, true
+	case "image", "figure":
+		return paraImage, 0, true
+	case "cover":
+		return paraCover, 0, true
+	case "normal", "standard", "defaultparagraphstyle", "bodytext", "textbody", "firstparagraph",
+		"footnotetext", "footnote", "endnotetext", "endnote", "tableheading", "tablecontents":
+		return paraText, 0, true
+	}
+	return paraText, 0, false
+}
+
+// styleFormat recognizes named character styles, names are compared without spaces as well.
+func styleFormat(name string) (format, bool) {
+	switch strings.ToLower(strings.ReplaceAll(name, " ", "")) {
+	case "emphasis", "emphasischar":
+		return fmtEmphasis, true
+	case "strong", "strongemphasis":
+		return fmtStrong, true
+	case "strikethrough":
+		return fmtStrike, true
+	case "code", "sourcetext", "htmlcode", "verbatimchar":
+		return fmtCode, true
+	case "superscript":
+		return fmtSup, true
+	case "subscript":
+		return fmtSub, true
+	case "defaultparagraphfont", "hyperlink", "internetlink", "footnotereference", "footnoteanchor", "footnotesymbol":
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,159 @@
+package importer
+
+import (
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+)
+
+const testHTML = `<!DOCTYPE html>
+<html lang="en"><head><title>The Book</title><meta name="author" content="John Smith"></head>
+<body>
+<h1>Part One</h1>
+<h2 id="ch1">Chapter 1</h2>
+<p>Some <em>text</em> here<sup><a href="#fn1" class="footnote-ref" role="doc-noteref">1</a></sup>.</p>
+<blockquote><p>Quote</p></blockquote>
+<div class="poem"><div class="stanza"><p>line one</p><p>line two</p></div><div class="text-author">Poet</div></div>
+<h2>Chapter 2</h2>
+<p>See <a href="#ch1">chapter one</a>.</p>
+<section class="footnotes" role="doc-endnotes"><hr/><ol><li id="fn1"><p>The note. <a href="#fnref1" class="footnote-back" role="doc-backlink">↩</a></p></li></ol></section>
+</body></html>`
+
+func paths(doc *etree.Document) []string {
+	var res []string
+	var walk func(e *etree.Element, path string)
+	walk = func(e *etree.Element, path string) {
+		for _, c := range e.ChildElements() {
+			p := path + "/" + c.Tag
+			switch c.Tag {
+			case "p", "v", "text-author":
+				res = append(res, p+":"+strings.TrimSpace(c.Text()))
+			case "description", "binary":
+			default:
+				walk(c, p)
+			}
+		}
+	}
+	walk(doc.Root(), "")
+	return res
+}
+
+func TestImportHTML(t *testing.T) {
+
+	doc, err := Import(strings.NewReader(testHTML), "book.html", "", "#l{ #f}{ #m}", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"/body/section/title/p:Part One",
+		"/body/section/section/title/p:Chapter 1",
+		"/body/section/section/p:Some",
+		"/body/section/section/cite/p:Quote",
+		"/body/section/section/poem/stanza/v:line one",
+		"/body/section/section/poem/stanza/v:line two",
+		"/body/section/section/poem/text-author:Poet",
+		"/body/section/section/title/p:Chapter 2",
+		"/body/section/section/p:See",
+		"/body/title/p:Notes",
+		"/body/section/title/p:1",
+		"/body/section/p:The note.",
+	}
+	if got := paths(doc); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("structure: expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+	if e := doc.FindElement("//title-info/author/last-name"); e == nil || e.Text() != "John" {
+		t.Errorf("author names should follow author format")
+	}
+	if e := doc.FindElement("//title-info/book-title"); e == nil || e.Text() != "The Book" {
+		t.Errorf("book title was not imported")
+	}
+	if e := doc.FindElement("//section[@id='ch1']"); e == nil {
+		t.Errorf("link target was not kept")
+	}
+	if e := doc.FindElement("//a[@type='note']"); e == nil || e.SelectAttrValue("href", "") != "#n_1" {
+		t.Errorf("footnote reference was not imported")
+	}
+}
+
+func TestImportDOCX(t *testing.T) {
+
+	const (
+		ns       = `xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"`
+		document = `<w:document ` + ns + `><w:body>
+<w:p><w:pPr><w:pStyle w:val="Title"/></w:pPr><w:r><w:t>Book</w:t></w:r></w:p>
+<w:p><w:pPr><w:pStyle w:val="Heading1"/></w:pPr><w:r><w:t>Chapter</w:t></w:r></w:p>
+<w:p><w:pPr><w:pStyle w:val="Epigraph"/></w:pPr><w:r><w:t>Wise words</w:t></w:r></w:p>
+<w:p><w:pPr><w:pStyle w:val="MyQuote"/></w:pPr><w:r><w:t>Quoted</w:t></w:r></w:p>
+<w:p><w:r><w:t xml:space="preserve">Plain </w:t></w:r><w:r><w:rPr><w:b/></w:rPr><w:t>bold</w:t></w:r><w:r><w:footnoteReference w:id="2"/></w:r></w:p>
+</w:body></w:document>`
+		styles = `<w:styles ` + ns + `>
+<w:style w:type="paragraph" w:styleId="Heading1"><w:name w:val="heading 1"/></w:style>
+<w:style w:type="paragraph" w:styleId="MyQuote"><w:name w:val="My Quote"/><w:basedOn w:val="Quote"/></w:style>
+<w:style w:type="paragraph" w:styleId="Quote"><w:name w:val="Quote"/></w:style>
+</w:styles>`
+		footnotes = `<w:footnotes ` + ns + `><w:footnote w:type="separator" w:id="0"><w:p/></w:footnote>
+<w:footnote w:id="2"><w:p><w:r><w:footnoteRef/></w:r><w:r><w:t xml:space="preserve"> Footnote</w:t></w:r></w:p></w:footnote></w:footnotes>`
+	)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string]string{"word/document.xml": document, "word/styles.xml": styles, "word/footnotes.xml": footnotes} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := Import(&buf, "book.docx", "", "", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"/body/title/p:Book",
+		"/body/section/title/p:Chapter",
+		"/body/section/epigraph/p:Wise words",
+		"/body/section/cite/p:Quoted",
+		"/body/section/p:Plain",
+		"/body/title/p:Notes",
+		"/body/section/title/p:1",
+		"/body/section/p:Footnote",
+	}
+	if got := paths(doc); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("structure: expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+	if e := doc.FindElement("//body/section/p/strong"); e == nil || e.Text() != "bold" {
+		t.Errorf("direct formatting was not imported")
+	}
+	if e := doc.FindElement("//title-info/book-title"); e == nil || e.Text() != "Book" {
+		t.Errorf("book title should come from the title paragraph")
+	}
+}
+
+func TestSplitName(t *testing.T) {
+	for _, c := range []struct {
+		name, format string
+		expected     map[string]string
+	}{
+		{"John Smith", "", map[string]string{"#f": "John", "#l": "Smith"}},
+		{"Толстой Лев Николаевич", "#l{ #f}{ #m}", map[string]string{"#l": "Толстой", "#f": "Лев", "#m": "Николаевич"}},
+		{"Толстой Лев", "#l{ #f}{ #m}", map[string]string{"#l": "Толстой", "#f": "Лев"}},
+		{"Homer", "", map[string]string{"#l": "Homer"}},
+		{"Jean Paul Sartre", "#f #l", map[string]string{"#f": "Jean", "#l": "Paul Sartre"}},
+	} {
+		if got := splitName(c.name, c.format); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("splitName(%q, %q): expected %v, got %v", c.name, c.format, c.expected, got)
+		}
+	}
+}
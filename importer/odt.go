@@ -0,0 +1,356 @@
+package importer
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+)
+
+// odtStyle is either named or automatic style.
+type odtStyle struct {
+	name   string // display name
+	parent string
+	level  int    // default outline level
+	on     format // formatting set by text properties
+	off    format // formatting explicitly removed by text properties
+	align  string
+}
+
+// odtReader converts OpenDocument text.
+type odtReader struct {
+	b      *book
+	pkg    pkg
+	log    *zap.Logger
+	styles map[string]*odtStyle // by family and name
+}
+
+func readODT(data []byte, log *zap.Logger) (*book, error) {
+
+	p, err := openPackage(data)
+	if err != nil {
+		return nil, err
+	}
+	r := &odtReader{b: newBook(), pkg: p, log: log, styles: make(map[string]*odtStyle)}
+
+	content, err := p.xml("content.xml")
+	if err != nil {
+		return nil, err
+	}
+	if content == nil {
+		return nil, fmt.Errorf("not an OpenDocument, content.xml is absent")
+	}
+	styles, err := p.xml("styles.xml")
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range []*etree.Document{styles, content} {
+		if doc != nil {
+			r.readStyles(doc)
+		}
+	}
+	meta, err := p.xml("meta.xml")
+	if err != nil {
+		return nil, err
+	}
+	if meta != nil {
+		r.readMeta(meta)
+	}
+	if text := content.FindElement("//body/text"); text != nil {
+		r.blocks(text, &r.b.paras)
+	}
+	return r.b, nil
+}
+
+var reEscaped = regexp.MustCompile(`_([0-9a-fA-F]{2})_`)
+
+// odtDisplayName restores style name when display name is absent: spaces and other characters are escaped as "_XX_".
+func odtDisplayName(name string) string {
+	return reEscaped.ReplaceAllStringFunc(name, func(s string) string {
+		c, _ := strconv.ParseUint(s[1:3], 16, 8)
+		return string(rune(c))
+	})
+}
+
+func (r *odtReader) readStyles(doc *etree.Document) {
+	for _, s := range doc.FindElements("//style") {
+		if s.Space != "style" {
+			continue
+		}
+		name := s.SelectAttrValue("style:name", "")
+		st := &odtStyle{
+			name:   s.SelectAttrValue("style:display-name", odtDisplayName(name)),
+			parent: s.SelectAttrValue("style:parent-style-name", ""),
+		}
+		if l, err := strconv.Atoi(s.SelectAttrValue("style:default-outline-level", "")); err == nil && l > 0 {
+			st.level = l
+		}
+		if tp := s.SelectElement("text-properties"); tp != nil {
+			set := func(f format, on bool) {
+				if on {
+					st.on |= f
+				} else {
+					st.off |= f
+				}
+			}
+			if w := tp.SelectAttrValue("fo:font-weight", ""); len(w) > 0 {
+				n, _ := strconv.Atoi(w)
+				set(fmtStrong, w == "bold" || n >= 600)
+			}
+			if v := tp.SelectAttrValue("fo:font-style", ""); len(v) > 0 {
+				set(fmtEmphasis, v == "italic" || v == "oblique")
+			}
+			if v := tp.SelectAttrValue("style:text-line-through-style", ""); len(v) > 0 {
+				set(fmtStrike, v != "none")
+			}
+			if v := tp.SelectAttrValue("style:text-position", ""); len(v) > 0 {
+				switch {
+				case strings.HasPrefix(v, "super"):
+					set(fmtSup, true)
+				case strings.HasPrefix(v, "sub") || strings.HasPrefix(v, "-"):
+					set(fmtSub, true)
+				case !strings.HasPrefix(v, "0"):
+					set(fmtSup, true)
+				}
+			}
+		}
+		if pp := s.SelectElement("paragraph-properties"); pp != nil {
+			st.align = map[string]string{"center": "center", "end": "right", "right": "right"}[pp.SelectAttrValue("fo:text-align", "")]
+		}
+		r.styles[s.SelectAttrValue("style:family", "")+":"+name] = st
+	}
+}
+
+// paragraphKind resolves paragraph style following inheritance.
+func (r *odtReader) paragraphKind(name string) (paraKind, int) {
+	for i := 0; i < 10 && len(name) > 0; i++ {
+		st, ok := r.styles["paragraph:"+name]
+		if !ok {
+			if kind, level, ok := styleKind(odtDisplayName(name)); ok {
+				return kind, level
+			}
+			break
+		}
+		if kind, level, ok := styleKind(st.name); ok {
+			return kind, level
+		}
+		if st.level > 0 {
+			return paraHeading, st.level
+		}
+		name = st.parent
+	}
+	return paraText, 0
+}
+
+// characterFormat resolves text style following inheritance, properties of the derived styles take precedence.
+func (r *odtReader) characterFormat(name string) format {
+	var on, off format
+	for i := 0; i < 10 && len(name) > 0; i++ {
+		st, ok := r.styles["text:"+name]
+		if !ok {
+			f, _ := styleFormat(odtDisplayName(name))
+			return on | f&^off
+		}
+		on |= st.on &^ off
+		off |= st.off &^ on
+		if f, ok := styleFormat(st.name); ok {
+			return on | f&^off
+		}
+		name = st.parent
+	}
+	return on
+}
+
+// align returns alignment set by paragraph style, named styles alignment is not a property of the cell.
+func (r *odtReader) align(name string) string {
+	if st, ok := r.styles["paragraph:"+name]; ok {
+		return st.align
+	}
+	return ""
+}
+
+func (r *odtReader) readMeta(doc *etree.Document) {
+	meta := doc.FindElement("//meta")
+	if meta == nil {
+		return
+	}
+	var keywords []string
+	for _, e := range meta.ChildElements() {
+		v := strings.TrimSpace(e.Text())
+		switch e.Space + ":" + e.Tag {
+		case "dc:title":
+			r.b.title = v
+		case "dc:creator", "meta:initial-creator":
+			if len(r.b.authors) == 0 {
+				r.b.setAuthors(v)
+			}
+		case "dc:description":
+			r.b.annotation = v
+		case "dc:language":
+			r.b.lang = v
+		case "meta:keyword":
+			keywords = append(keywords, v)
+		case "meta:user-defined":
+			r.b.setProperty(e.SelectAttrValue("meta:name", ""), v)
+		}
+	}
+	r.b.keywords = strings.Join(keywords, ", ")
+}
+
+// blocks converts block level content.
+func (r *odtReader) blocks(e *etree.Element, to *[]*para) {
+	for _, c := range e.ChildElements() {
+		switch c.Space + ":" + c.Tag {
+		case "text:p":
+			kind, level := r.paragraphKind(c.SelectAttrValue("text:style-name", ""))
+			r.paragraph(c, kind, level, to)
+		case "text:h":
+			kind, level := r.paragraphKind(c.SelectAttrValue("text:style-name", ""))
+			if kind != paraTitle {
+				kind, level = paraHeading, 1
+				if l, err := strconv.Atoi(c.SelectAttrValue("text:outline-level", "")); err == nil && l > 0 {
+					level = l
+				}
+			}
+			r.paragraph(c, kind, level, to)
+		case "text:list", "text:list-item", "text:list-header", "text:section":
+			r.blocks(c, to)
+		case "table:table":
+			r.table(c, to)
+		}
+	}
+}
+
+func (r *odtReader) paragraph(e *etree.Element, kind paraKind, level int, to *[]*para) {
+	p := newPara(kind, level)
+	r.inline(e, p, run{})
+	*to = append(*to, p)
+}
+
+// inline converts paragraph content, cur keeps formatting and link of the enclosing elements.
+func (r *odtReader) inline(e *etree.Element, p *para, cur run) {
+	for _, t := range e.Child {
+		switch c := t.(type) {
+		case *etree.CharData:
+			t := cur
+			t.text = c.Data
+			p.add(t)
+		case *etree.Element:
+			switch c.Space + ":" + c.Tag {
+			case "text:span":
+				span := cur
+				span.format |= r.characterFormat(c.SelectAttrValue("text:style-name", ""))
+				r.inline(c, p, span)
+			case "text:a":
+				link := cur
+				link.link = c.SelectAttrValue("xlink:href", "")
+				if i := strings.IndexByte(link.link, '|'); strings.HasPrefix(link.link, "#") && i > 0 {
+					// references to headings and other objects
+					link.link = link.link[:i]
+				}
+				r.inline(c, p, link)
+			case "text:note":
+				if body := c.SelectElement("note-body"); body != nil {
+					var paras []*para
+					r.blocks(body, &paras)
+					for _, np := range paras {
+						np.kind, np.level = paraText, 0
+					}
+					p.add(run{note: r.b.addNote(paras)})
+				}
+			case "text:line-break":
+				p.newLine()
+			case "text:tab", "text:s":
+				t := cur
+				t.text = " "
+				p.add(t)
+			case "text:bookmark", "text:bookmark-start":
+				if name := c.SelectAttrValue("text:name", ""); len(name) > 0 {
+					p.add(run{ids: []string{name}})
+				}
+			case "draw:frame":
+				for _, img := range c.SelectElements("image") {
+					if id := r.image(img.SelectAttrValue("xlink:href", "")); len(id) > 0 {
+						p.add(run{image: id})
+						break
+					}
+				}
+			case "text:soft-page-break", "text:note-citation", "text:bookmark-end", "office:annotation":
+			default:
+				r.inline(c, p, cur)
+			}
+			if tail := c.Tail(); len(tail) > 0 {
+				t := cur
+				t.text = tail
+				p.add(t)
+			}
+		}
+	}
+}
+
+// image stores picture from the package.
+func (r *odtReader) image(name string) string {
+	if len(name) == 0 || strings.Contains(name, ":") {
+		return ""
+	}
+	name = strings.TrimPrefix(name, "./")
+	data, err := r.pkg.read(name)
+	if err != nil || data == nil {
+		r.log.Warn("Unable to read document image", zap.String("image", name), zap.Error(err))
+		return ""
+	}
+	id := r.b.addImage(name, data)
+	if len(id) == 0 {
+		r.log.Warn("Unsupported image format, skipping", zap.String("image", name))
+	}
+	return id
+}
+
+func (r *odtReader) table(e *etree.Element, to *[]*para) {
+	t := newPara(paraTable, 0)
+	var rows func(e *etree.Element, header bool)
+	rows = func(e *etree.Element, header bool) {
+		for _, c := range e.ChildElements() {
+			switch c.Tag {
+			case "table-header-rows":
+				rows(c, true)
+			case "table-rows", "table-row-group":
+				rows(c, header)
+			case "table-row":
+				var row []*cell
+				for _, tc := range c.SelectElements("table-cell") {
+					var paras []*para
+					r.blocks(tc, &paras)
+					cl := &cell{header: header}
+					if p := tc.SelectElement("p"); p != nil {
+						style := p.SelectAttrValue("text:style-name", "")
+						cl.align = r.align(style)
+						if st, ok := r.styles["paragraph:"+style]; ok && strings.EqualFold(st.name, "table heading") || style == "Table_20_Heading" {
+							cl.header = true
+						}
+					}
+					for _, p := range paras {
+						for _, l := range p.lines {
+							if len(cl.runs) > 0 {
+								cl.runs = appendRun(cl.runs, run{text: " "})
+							}
+							cl.runs = append(cl.runs, l...)
+						}
+					}
+					row = append(row, cl)
+				}
+				if len(row) > 0 {
+					t.rows = append(t.rows, row)
+				}
+			}
+		}
+	}
+	rows(e, false)
+	if len(t.rows) > 0 {
+		*to = append(*to, t)
+	}
+}
@@ -20,6 +20,7 @@ type tocEntry struct {
 	level    htmlHeader
 	bodyName string
 	main     bool
+	subtitle bool // chapter divider, always child of the preceding entry
 }
 
 // Notes collected during parsing.
@@ -47,6 +48,8 @@ type Book struct {
 	Lang       language.Tag
 	Cover      string
 	Genres     []string
+	GenreNames []string // human readable genre names, same order as Genres
+	GenreGroup string   // name of the first genre group
 	Authors    []*config.AuthorName
 	SeqName    string
 	SeqNum     int
@@ -86,6 +89,52 @@ func NewBook(u uuid.UUID, name string) *Book {
 	}
 }
 
+// clone makes a copy of the book which could be further processed independently. Generated content documents, images
+// and data files are copied, collected notes, TOC entries and parsing helpers are shared as they are not changed after
+// content is processed.
+func (b *Book) clone() *Book {
+
+	copyFiles := func(in []*dataFile) []*dataFile {
+		out := make([]*dataFile, 0, len(in))
+		for _, f := range in {
+			c := *f
+			if f.doc != nil {
+				c.doc = f.doc.Copy()
+			}
+			out = append(out, &c)
+		}
+		return out
+	}
+	copyImages := func(in []*binImage) []*binImage {
+		out := make([]*binImage, 0, len(in))
+		for _, img := range in {
+			c := *img
+			out = append(out, &c)
+		}
+		return out
+	}
+
+	c := *b
+	c.TOC = append([]*tocEntry(nil), b.TOC...)
+	c.Files = copyFiles(b.Files)
+	c.Data = copyFiles(b.Data)
+	c.Meta = copyFiles(b.Meta)
+	c.Images = copyImages(b.Images)
+	c.Vignettes = copyImages(b.Vignettes)
+	c.Pages = make(map[string]int, len(b.Pages))
+	for k, v := range b.Pages {
+		c.Pages[k] = v
+	}
+	c.LinksLocations = make(map[string]string, len(b.LinksLocations))
+	for k, v := range b.LinksLocations {
+		c.LinksLocations[k] = v
+	}
+	ctx := *b.context
+	c.context = &ctx
+	c.contextStack = append([]*context(nil), b.contextStack...)
+	return &c
+}
+
 // BookAuthors returns authors as a single string.
 func (b *Book) BookAuthors(format string, short bool) string {
 	if len(b.Authors) == 0 {
@@ -104,6 +153,15 @@ func (b *Book) BookAuthors(format string, short bool) string {
 	return strings.Join(res, ", ")
 }
 
+// AuthorsSort returns authors names suitable for sorting as a single string.
+func (b *Book) AuthorsSort() string {
+	res := make([]string, 0, len(b.Authors))
+	for _, an := range b.Authors {
+		res = append(res, an.SortName())
+	}
+	return strings.Join(res, " & ")
+}
+
 // flushMeta saves all container meta files.
 func (b *Book) flushMeta(path string) error {
 	for _, f := range b.Meta {
@@ -0,0 +1,246 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+	"fb2converter/processor/internal/mobi"
+)
+
+// BookInfo is book meta information used for cataloging.
+type BookInfo struct {
+	ID         string   `json:"id"`
+	ASIN       string   `json:"asin,omitempty"`
+	Title      string   `json:"title"`
+	Lang       string   `json:"language"`
+	Authors    []string `json:"authors,omitempty"`
+	Genres     []string `json:"genres,omitempty"`
+	SeqName    string   `json:"sequence,omitempty"`
+	SeqNum     int      `json:"sequence_number,omitempty"`
+	Date       string   `json:"date,omitempty"`
+	Annotation string   `json:"annotation,omitempty"`
+	Cover      bool     `json:"cover"`
+	// cover image data if any
+	CoverData []byte `json:"-"`
+}
+
+// BookInfo returns book meta information, to be used after book description was processed.
+func (p *Processor) BookInfo() *BookInfo {
+
+	b := p.Book
+	info := &BookInfo{
+		ID:         b.ID.String(),
+		ASIN:       b.ASIN,
+		Title:      b.Title,
+		Lang:       b.Lang.String(),
+		Genres:     b.Genres,
+		SeqName:    b.SeqName,
+		SeqNum:     b.SeqNum,
+		Date:       b.Date,
+		Annotation: b.Annotation,
+	}
+	for _, a := range b.Authors {
+		info.Authors = append(info.Authors, strings.TrimSpace(a.String()))
+	}
+	if len(b.Cover) > 0 {
+		for _, e := range p.doc.FindElements("./FictionBook/binary") {
+			if getAttrValue(e, "id") != b.Cover {
+				continue
+			}
+			if data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(e.Text()), "")); err == nil {
+				info.CoverData = data
+			} else {
+				p.env.Log.Debug("Unable to decode cover image", zap.String("id", b.Cover), zap.Error(err))
+			}
+			break
+		}
+	}
+	info.Cover = len(info.CoverData) > 0
+	return info
+}
+
+// ReadEpubInfo reads meta information from OPF of epub file.
+func ReadEpubInfo(fname string) (*BookInfo, error) {
+
+	zr, err := zip.OpenReader(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	readDoc := func(name string) (*etree.Document, error) {
+		f, err := zr.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		doc := etree.NewDocument()
+		if _, err := doc.ReadFrom(f); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	}
+
+	container, err := readDoc(path.Join(DirMata, "container.xml"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read container: %w", err)
+	}
+	var opfName string
+	for _, e := range container.FindElements("//rootfile") {
+		if opfName = getAttrValue(e, "full-path"); len(opfName) > 0 {
+			break
+		}
+	}
+	if len(opfName) == 0 {
+		return nil, errors.New("unable to find OPF in container")
+	}
+	opf, err := readDoc(opfName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read OPF: %w", err)
+	}
+
+	metadata := opf.FindElement("//metadata")
+	if metadata == nil {
+		return nil, errors.New("OPF has no metadata")
+	}
+
+	info := &BookInfo{}
+	var coverID string
+	for _, e := range metadata.ChildElements() {
+		text := strings.TrimSpace(e.Text())
+		switch e.Tag {
+		case "identifier":
+			if len(info.ID) == 0 || getAttrValue(e, "id") == getAttrValue(opf.Root(), "unique-identifier") {
+				info.ID = strings.TrimPrefix(text, "urn:uuid:")
+			}
+		case "title":
+			if len(info.Title) == 0 {
+				info.Title = text
+			}
+		case "language":
+			if len(info.Lang) == 0 {
+				info.Lang = text
+			}
+		case "creator":
+			if role := getAttrValue(e, "role"); (len(role) == 0 || role == "aut") && len(text) > 0 {
+				info.Authors = append(info.Authors, text)
+			}
+		case "subject":
+			if len(text) > 0 {
+				info.Genres = append(info.Genres, text)
+			}
+		case "description":
+			info.Annotation = text
+		case "date":
+			info.Date = text
+		case "meta":
+			content := getAttrValue(e, "content")
+			switch getAttrValue(e, "name") {
+			case "cover":
+				coverID = content
+			case "calibre:series":
+				info.SeqName = content
+			case "calibre:series_index":
+				if f, err := strconv.ParseFloat(content, 64); err == nil {
+					info.SeqNum = int(f)
+				}
+			}
+		}
+	}
+
+	var coverHref string
+	for _, e := range opf.FindElements("//manifest/item") {
+		if (len(coverID) > 0 && getAttrValue(e, "id") == coverID) || strings.Contains(getAttrValue(e, "properties"), "cover-image") {
+			coverHref = getAttrValue(e, "href")
+			break
+		}
+	}
+	if len(coverHref) > 0 {
+		if u, err := url.PathUnescape(coverHref); err == nil {
+			coverHref = u
+		}
+		if f, err := zr.Open(path.Join(path.Dir(opfName), coverHref)); err == nil {
+			info.CoverData, _ = io.ReadAll(f)
+			f.Close()
+		}
+	}
+	info.Cover = len(info.CoverData) > 0
+	return info, nil
+}
+
+// ReadMobiInfo reads meta information from EXTH records of mobi or azw3 file. Cover is not extracted, use ProduceThumbnail.
+func ReadMobiInfo(fname string) (info *BookInfo, err error) {
+
+	defer func() {
+		// file could be damaged or not really a mobi
+		if r := recover(); r != nil {
+			info, err = nil, fmt.Errorf("unable to parse %s: %v\n%s", fname, r, debug.Stack())
+		}
+	}()
+
+	m, err := mobi.ReadMeta(fname)
+	if err != nil {
+		return nil, err
+	}
+	return &BookInfo{
+		ASIN:       m.ASIN,
+		Title:      m.Title,
+		Lang:       m.Language,
+		Authors:    m.Authors,
+		Genres:     m.Subjects,
+		Date:       m.Date,
+		Annotation: m.Description,
+	}, nil
+}
+
+// ReadThumbnail returns JPEG thumbnail for the book cover: extracted from mobi and azw3 files or made from cover image
+// data. Returns nil if book has no cover.
+func ReadThumbnail(fname string, info *BookInfo, w, h int, log *zap.Logger) ([]byte, error) {
+
+	ext := strings.ToLower(filepath.Ext(fname))
+	if ext == ".mobi" || ext == ".azw3" {
+		dir, err := os.MkdirTemp("", "fb2c-thumb-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+
+		if created, err := ProduceThumbnail(fname, dir, w, h, false, log); err != nil || !created {
+			return nil, err
+		}
+		names, err := filepath.Glob(filepath.Join(dir, "thumbnail_*.jpg"))
+		if err != nil || len(names) == 0 {
+			return nil, err
+		}
+		return os.ReadFile(names[0])
+	}
+
+	if info == nil || len(info.CoverData) == 0 {
+		return nil, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(info.CoverData))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode cover image: %w", err)
+	}
+	buf := new(bytes.Buffer)
+	if err := imaging.Encode(buf, imaging.Thumbnail(img, w, h, imaging.Lanczos), imaging.JPEG, imaging.JPEGQuality(75)); err != nil {
+		return nil, fmt.Errorf("unable to encode thumbnail: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -12,6 +12,7 @@ type context struct {
 	findex            int
 	fname             string
 	pageLength        int
+	fileSize          int // approximate size of content already placed into current file
 	out               *etree.Document
 	bodyName          string
 	firstBodyTitle    bool        // first title in a body needs special processing
@@ -19,15 +20,14 @@ type context struct {
 	specialParagraph  bool        // special paragraph processing, no drop caps
 	sectionWithTitle  stackedBool // indicates that current section has title
 	sectionTextLength stackedInt  // has current section text length - paragraphs only
-	paragraph         int         // used for Kobo spans
-	sentence          int         // used for Kobo spans
 	inParagraph       bool
 	inHeader          bool
 	inSubHeader       bool
 	header            htmlHeader
 	tocIndex          int
-	currentNotes      []*note // for inline and block notes
-	debug             bool    // internal use
+	currentNotes      []*note                           // for inline and block notes
+	moved             map[*etree.Element]*etree.Element // when content is split elements continue in the next file
+	debug             bool                              // internal use
 }
 
 // newContext creates new empty parsing context.
@@ -59,7 +59,7 @@ func (ctx *context) createXHTML(name string, attrs ...*etree.Attr) (*etree.Eleme
 	}
 	ctx.fname = fname + ".xhtml"
 	ctx.pageLength = 0
-	ctx.paragraph = 0
+	ctx.fileSize = 0
 
 	// set up XML
 	ctx.out = etree.NewDocument()
@@ -84,11 +84,29 @@ func (ctx *context) createXHTML(name string, attrs ...*etree.Attr) (*etree.Eleme
 	return html.AddNext("body"), f
 }
 
+// relocate records that element continues in the next file.
+func (ctx *context) relocate(from, to *etree.Element) {
+	if ctx.moved == nil {
+		ctx.moved = make(map[*etree.Element]*etree.Element)
+	}
+	ctx.moved[from] = to
+}
+
+// relocated returns element where content of the original element is continued.
+func (ctx *context) relocated(e *etree.Element) *etree.Element {
+	for {
+		next, ok := ctx.moved[e]
+		if !ok {
+			return e
+		}
+		e = next
+	}
+}
+
 func (ctx *context) createNCX(name, id string) (*etree.Element, *dataFile) {
 
 	ctx.fname = name + ".ncx"
 	ctx.pageLength = 0
-	ctx.paragraph = 0
 
 	// set up XML
 	ctx.out = etree.NewDocument()
@@ -120,7 +138,6 @@ func (ctx *context) createPM(name string) (*etree.Element, *dataFile) {
 
 	ctx.fname = name + ".xml"
 	ctx.pageLength = 0
-	ctx.paragraph = 0
 
 	// set up XML
 	ctx.out = etree.NewDocument()
@@ -144,7 +161,6 @@ func (ctx *context) createOPF(name string) (*etree.Element, *dataFile) {
 
 	ctx.fname = name + ".opf"
 	ctx.pageLength = 0
-	ctx.paragraph = 0
 
 	// set up XML
 	ctx.out = etree.NewDocument()
@@ -173,7 +189,6 @@ func (ctx *context) createOCF(name string) (*etree.Element, *dataFile) {
 
 	ctx.fname = name + ".xml"
 	ctx.pageLength = 0
-	ctx.paragraph = 0
 
 	// set up XML
 	ctx.out = etree.NewDocument()
@@ -0,0 +1,657 @@
+package processor
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"fb2converter/etree"
+)
+
+const (
+	docxNsMain    = "http://schemas.openxmlformats.org/wordprocessingml/2006/main"
+	docxNsRels    = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+	docxNsPkgRels = "http://schemas.openxmlformats.org/package/2006/relationships"
+	docxNsDrawing = "http://schemas.openxmlformats.org/drawingml/2006/wordprocessingDrawing"
+	docxNsGraphic = "http://schemas.openxmlformats.org/drawingml/2006/main"
+	docxNsPicture = "http://schemas.openxmlformats.org/drawingml/2006/picture"
+
+	docxRelBase     = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/"
+	docxContentBase = "application/vnd.openxmlformats-officedocument.wordprocessingml."
+
+	docxEMU = 12700 // English Metric Units per point
+)
+
+// docxPart is a document part with its relationships.
+type docxPart struct {
+	rels *etree.Element
+	next int
+}
+
+func newDocxPart() *docxPart {
+	rels := etree.NewElement("Relationships")
+	rels.CreateAttr("xmlns", docxNsPkgRels)
+	return &docxPart{rels: rels}
+}
+
+// relation adds relationship and returns its id.
+func (dp *docxPart) relation(kind, target string, external bool) string {
+	dp.next++
+	id := "rId" + strconv.Itoa(dp.next)
+	mode := ""
+	if external {
+		mode = "External"
+	}
+	dp.rels.AddNext("Relationship", attr("Id", id), attr("Type", docxRelBase+kind), attr("Target", target), attr("TargetMode", mode))
+	return id
+}
+
+func (dp *docxPart) bytes() ([]byte, error) {
+	doc := newXMLPart()
+	doc.SetRoot(dp.rels)
+	return xmlPart(doc)
+}
+
+// docxWriter serializes office document to WordprocessingML.
+type docxWriter struct {
+	d         *officeDocument
+	document  *docxPart
+	footnotes *docxPart
+	notes     *etree.Element
+	noteID    int
+	markIDs   map[string]int
+	drawingID int
+	images    map[*officePicture]string
+}
+
+// FinalizeDOCX produces docx file out of processed book content.
+func (p *Processor) FinalizeDOCX(fname string) error {
+	return p.officeOutput(fname, func(d *officeDocument) (map[string][]byte, []string, error) {
+		w := &docxWriter{
+			d:         d,
+			document:  newDocxPart(),
+			footnotes: newDocxPart(),
+			markIDs:   make(map[string]int),
+			images:    make(map[*officePicture]string),
+		}
+		return w.write()
+	})
+}
+
+func (w *docxWriter) write() (map[string][]byte, []string, error) {
+
+	parts := make(map[string][]byte)
+	order := []string{"[Content_Types].xml", "_rels/.rels", "docProps/core.xml", "docProps/custom.xml",
+		"word/_rels/document.xml.rels", "word/document.xml", "word/styles.xml", "word/settings.xml",
+		"word/_rels/footnotes.xml.rels", "word/footnotes.xml"}
+
+	add := func(name string, doc *etree.Document) error {
+		data, err := xmlPart(doc)
+		if err != nil {
+			return fmt.Errorf("unable to prepare %s: %w", name, err)
+		}
+		parts[name] = data
+		return nil
+	}
+
+	w.document.relation("styles", "styles.xml", false)
+	w.document.relation("settings", "settings.xml", false)
+	w.document.relation("footnotes", "footnotes.xml", false)
+
+	// footnotes part starts with separators
+	notes := newXMLPart()
+	w.notes = notes.CreateElement("w:footnotes")
+	w.notes.CreateAttr("xmlns:w", docxNsMain)
+	w.notes.CreateAttr("xmlns:r", docxNsRels)
+	w.notes.CreateAttr("xmlns:wp", docxNsDrawing)
+	w.notes.AddNext("w:footnote", attr("w:type", "separator"), attr("w:id", "-1")).
+		AddNext("w:p").AddNext("w:r").AddNext("w:separator")
+	w.notes.AddNext("w:footnote", attr("w:type", "continuationSeparator"), attr("w:id", "0")).
+		AddNext("w:p").AddNext("w:r").AddNext("w:continuationSeparator")
+
+	doc := newXMLPart()
+	root := doc.CreateElement("w:document")
+	root.CreateAttr("xmlns:w", docxNsMain)
+	root.CreateAttr("xmlns:r", docxNsRels)
+	root.CreateAttr("xmlns:wp", docxNsDrawing)
+	body := root.AddNext("w:body")
+	w.blocks(body, w.d.content, w.document)
+	sect := body.AddNext("w:sectPr")
+	sect.AddNext("w:pgSz", attr("w:w", "11906"), attr("w:h", "16838"))
+	sect.AddNext("w:pgMar", attr("w:top", "1134"), attr("w:right", "1134"), attr("w:bottom", "1134"), attr("w:left", "1134"),
+		attr("w:header", "709"), attr("w:footer", "709"), attr("w:gutter", "0"))
+
+	if err := add("word/document.xml", doc); err != nil {
+		return nil, nil, err
+	}
+	if err := add("word/footnotes.xml", notes); err != nil {
+		return nil, nil, err
+	}
+	if err := add("word/styles.xml", w.styles()); err != nil {
+		return nil, nil, err
+	}
+	if err := add("word/settings.xml", w.settings()); err != nil {
+		return nil, nil, err
+	}
+	if err := add("docProps/core.xml", w.core()); err != nil {
+		return nil, nil, err
+	}
+	if err := add("docProps/custom.xml", w.custom()); err != nil {
+		return nil, nil, err
+	}
+	for name, part := range map[string]*docxPart{"word/_rels/document.xml.rels": w.document, "word/_rels/footnotes.xml.rels": w.footnotes} {
+		data, err := part.bytes()
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to prepare %s: %w", name, err)
+		}
+		parts[name] = data
+	}
+
+	pkg := newDocxPart()
+	pkg.relation("officeDocument", "word/document.xml", false)
+	pkg.rels.AddNext("Relationship", attr("Id", "rIdCore"),
+		attr("Type", "http://schemas.openxmlformats.org/package/2006/relationships/metadata/core-properties"), attr("Target", "docProps/core.xml"))
+	pkg.relation("custom-properties", "docProps/custom.xml", false)
+	data, err := pkg.bytes()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to prepare package relationships: %w", err)
+	}
+	parts["_rels/.rels"] = data
+
+	// images are referenced from the parts above
+	for _, pic := range w.d.pictures {
+		if _, ok := w.images[pic]; !ok {
+			continue
+		}
+		name := "word/media/" + pic.name
+		parts[name] = pic.data
+		order = append(order, name)
+	}
+
+	if err := add("[Content_Types].xml", w.contentTypes()); err != nil {
+		return nil, nil, err
+	}
+	return parts, order, nil
+}
+
+func (w *docxWriter) contentTypes() *etree.Document {
+
+	doc := newXMLPart()
+	types := doc.CreateElement("Types")
+	types.CreateAttr("xmlns", "http://schemas.openxmlformats.org/package/2006/content-types")
+	types.AddSame("Default", attr("Extension", "rels"), attr("ContentType", "application/vnd.openxmlformats-package.relationships+xml")).
+		AddSame("Default", attr("Extension", "xml"), attr("ContentType", "application/xml"))
+	exts := make(map[string]bool)
+	for _, pic := range w.d.pictures {
+		ext := strings.TrimPrefix(pic.ct, "image/")
+		if _, ok := w.images[pic]; ok && !exts[ext] {
+			exts[ext] = true
+			types.AddNext("Default", attr("Extension", ext), attr("ContentType", pic.ct))
+		}
+	}
+	for _, o := range [][2]string{
+		{"/word/document.xml", docxContentBase + "document.main+xml"},
+		{"/word/styles.xml", docxContentBase + "styles+xml"},
+		{"/word/settings.xml", docxContentBase + "settings+xml"},
+		{"/word/footnotes.xml", docxContentBase + "footnotes+xml"},
+		{"/docProps/core.xml", "application/vnd.openxmlformats-package.core-properties+xml"},
+		{"/docProps/custom.xml", "application/vnd.openxmlformats-officedocument.custom-properties+xml"},
+	} {
+		types.AddNext("Override", attr("PartName", o[0]), attr("ContentType", o[1]))
+	}
+	return doc
+}
+
+// docxStyleID returns style identifier for style name.
+func docxStyleID(name string) string {
+	return strings.ReplaceAll(name, " ", "")
+}
+
+// docxStyleName returns name of the style as known to word processors, some built-in styles have lower case names.
+func docxStyleName(name string) string {
+	if name == officeFootnote || strings.HasPrefix(name, officeHeading+" ") {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// docxBookmark converts element id into bookmark name: starting with letter, without special characters.
+func docxBookmark(id string) string {
+	name := []rune(id)
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 || !(name[0] >= 'a' && name[0] <= 'z' || name[0] >= 'A' && name[0] <= 'Z') {
+		name = append([]rune("b_"), name...)
+	}
+	if len(name) > 40 {
+		name = name[:40]
+	}
+	return string(name)
+}
+
+// twips returns measurement in twentieths of a point.
+func twips(pt float64) string {
+	return strconv.Itoa(int(math.Round(pt * 20)))
+}
+
+func (w *docxWriter) blocks(to *etree.Element, blocks []officeBlock, part *docxPart) {
+	for _, b := range blocks {
+		switch v := b.(type) {
+		case *officePara:
+			w.paragraph(to, v, part, nil)
+		case *officeTable:
+			w.table(to, v, part)
+		}
+	}
+}
+
+// paragraph writes paragraph, prefix is used to put footnote reference mark at the beginning of the footnote.
+func (w *docxWriter) paragraph(to *etree.Element, para *officePara, part *docxPart, prefix func(p *etree.Element)) {
+
+	p := to.AddNext("w:p")
+	ppr := p.AddNext("w:pPr")
+	ppr.AddNext("w:pStyle", attr("w:val", docxStyleID(para.style)))
+	if para.brk {
+		ppr.AddNext("w:pageBreakBefore")
+	}
+	switch para.align {
+	case "left", "right", "center":
+		ppr.AddNext("w:jc", attr("w:val", para.align))
+	case "justify":
+		ppr.AddNext("w:jc", attr("w:val", "both"))
+	}
+	if prefix != nil {
+		prefix(p)
+	}
+
+	var (
+		link    *etree.Element
+		current string
+	)
+	for _, r := range para.runs {
+		for _, m := range r.marks {
+			name := docxBookmark(m)
+			if _, ok := w.markIDs[name]; ok {
+				continue
+			}
+			id := strconv.Itoa(len(w.markIDs))
+			w.markIDs[name] = len(w.markIDs)
+			p.AddNext("w:bookmarkStart", attr("w:id", id), attr("w:name", name))
+			p.AddNext("w:bookmarkEnd", attr("w:id", id))
+		}
+		if len(r.text) == 0 && r.picture == nil && r.note == nil && !r.br {
+			continue
+		}
+
+		// consecutive runs with the same link share hyperlink element
+		target := ""
+		if len(r.link) > 0 {
+			target = "url:" + r.link
+		} else if len(r.dest) > 0 {
+			target = "dest:" + r.dest
+		}
+		if target != current {
+			link, current = nil, target
+			switch {
+			case len(r.link) > 0:
+				link = p.AddNext("w:hyperlink", attr("r:id", part.relation("hyperlink", r.link, true)))
+			case len(r.dest) > 0:
+				link = p.AddNext("w:hyperlink", attr("w:anchor", docxBookmark(r.dest)))
+			}
+		}
+		parent := p
+		if link != nil {
+			parent = link
+		}
+		w.run(parent, r, part)
+	}
+}
+
+// run writes text run. First character style is referenced, the rest is expressed with direct formatting.
+func (w *docxWriter) run(to *etree.Element, r *officeRun, part *docxPart) {
+
+	wr := to.AddNext("w:r")
+	rpr := wr.AddNext("w:rPr")
+	styles := r.styles
+	switch {
+	case r.note != nil:
+		styles = append([]string{"Footnote Reference"}, styles...)
+	case len(r.link) > 0 || len(r.dest) > 0:
+		styles = append([]string{officeLink}, styles...)
+	}
+	if len(styles) > 0 {
+		rpr.AddNext("w:rStyle", attr("w:val", docxStyleID(styles[0])))
+		var direct officeStyle
+		for _, s := range styles[1:] {
+			switch s {
+			case officeEmphasis:
+				direct.italic = true
+			case officeStrong:
+				direct.bold = true
+			case officeStrike:
+				direct.strike = true
+			case officeCode:
+				direct.mono = true
+			case officeSuper:
+				direct.vert = "super"
+			case officeSub:
+				direct.vert = "sub"
+			}
+		}
+		docxRunProperties(rpr, &direct, 0)
+	}
+	if len(rpr.Child) == 0 {
+		wr.RemoveChild(rpr)
+	}
+
+	switch {
+	case r.br:
+		wr.AddNext("w:br")
+	case r.picture != nil:
+		w.drawing(wr, r.picture, part)
+	case r.note != nil:
+		w.footnote(wr, r.note)
+	default:
+		wr.AddNext("w:t", attr("xml:space", "preserve")).SetText(r.text)
+	}
+}
+
+// footnote writes footnote content and reference to it.
+func (w *docxWriter) footnote(to *etree.Element, blocks []officeBlock) {
+
+	w.noteID++
+	id := strconv.Itoa(w.noteID)
+	to.AddNext("w:footnoteReference", attr("w:id", id))
+
+	note := w.notes.AddNext("w:footnote", attr("w:id", id))
+	ref := func(p *etree.Element) {
+		p.AddNext("w:r").AddNext("w:rPr").AddNext("w:rStyle", attr("w:val", "FootnoteReference")).Parent().Parent().AddNext("w:footnoteRef")
+		p.AddNext("w:r").AddNext("w:t", attr("xml:space", "preserve")).SetText(" ")
+	}
+	for i, b := range blocks {
+		switch v := b.(type) {
+		case *officePara:
+			if i == 0 {
+				w.paragraph(note, v, w.footnotes, ref)
+			} else {
+				w.paragraph(note, v, w.footnotes, nil)
+			}
+		case *officeTable:
+			if i == 0 {
+				w.paragraph(note, &officePara{style: officeFootnote}, w.footnotes, ref)
+			}
+			w.table(note, v, w.footnotes)
+		}
+	}
+}
+
+// drawing writes inline picture.
+func (w *docxWriter) drawing(to *etree.Element, pic *officePicture, part *docxPart) {
+
+	if _, ok := w.images[pic]; !ok {
+		w.images[pic] = "media/" + pic.name
+	}
+	rid := part.relation("image", w.images[pic], false)
+
+	w.drawingID++
+	id := strconv.Itoa(w.drawingID)
+	cx, cy := strconv.Itoa(int(pic.width*docxEMU)), strconv.Itoa(int(pic.height*docxEMU))
+
+	inline := to.AddNext("w:drawing").AddNext("wp:inline", attr("distT", "0"), attr("distB", "0"), attr("distL", "0"), attr("distR", "0"))
+	inline.AddNext("wp:extent", attr("cx", cx), attr("cy", cy))
+	inline.AddNext("wp:docPr", attr("id", id), attr("name", "Picture "+id))
+	inline.AddNext("wp:cNvGraphicFramePr").
+		AddNext("a:graphicFrameLocks", attr("xmlns:a", docxNsGraphic), attr("noChangeAspect", "1"))
+	pp := inline.AddNext("a:graphic", attr("xmlns:a", docxNsGraphic)).
+		AddNext("a:graphicData", attr("uri", docxNsPicture)).
+		AddNext("pic:pic", attr("xmlns:pic", docxNsPicture))
+	pp.AddNext("pic:nvPicPr").
+		AddSame("pic:cNvPr", attr("id", "0"), attr("name", pic.name)).
+		AddSame("pic:cNvPicPr")
+	pp.AddNext("pic:blipFill").
+		AddSame("a:blip", attr("r:embed", rid)).
+		AddNext("a:stretch").AddNext("a:fillRect")
+	sp := pp.AddNext("pic:spPr")
+	sp.AddNext("a:xfrm").
+		AddSame("a:off", attr("x", "0"), attr("y", "0")).
+		AddSame("a:ext", attr("cx", cx), attr("cy", cy))
+	sp.AddNext("a:prstGeom", attr("prst", "rect")).AddNext("a:avLst")
+}
+
+func (w *docxWriter) table(to *etree.Element, t *officeTable, part *docxPart) {
+
+	tbl := to.AddNext("w:tbl")
+	tbl.AddNext("w:tblPr").
+		AddSame("w:tblStyle", attr("w:val", "TableGrid")).
+		AddSame("w:tblW", attr("w:w", "5000"), attr("w:type", "pct"))
+	grid := tbl.AddNext("w:tblGrid")
+	width := strconv.Itoa(9638 / t.cols)
+	for i := 0; i < t.cols; i++ {
+		grid.AddNext("w:gridCol", attr("w:w", width))
+	}
+	for _, row := range t.rows {
+		tr := tbl.AddNext("w:tr")
+		for _, cell := range row {
+			tc := tr.AddNext("w:tc")
+			tc.AddNext("w:tcPr").AddNext("w:tcW", attr("w:w", width), attr("w:type", "dxa"))
+			w.blocks(tc, cell.blocks, part)
+			if len(cell.blocks) == 0 {
+				// cell must end with paragraph
+				w.paragraph(tc, &officePara{style: officeTableContents}, part, nil)
+			} else if _, ok := cell.blocks[len(cell.blocks)-1].(*officeTable); ok {
+				w.paragraph(tc, &officePara{style: officeTableContents}, part, nil)
+			}
+		}
+	}
+}
+
+// docxRunProperties adds character formatting, base is document font size in points.
+func docxRunProperties(rpr *etree.Element, s *officeStyle, base float64) {
+	if s.mono {
+		rpr.AddNext("w:rFonts", attr("w:ascii", "Courier New"), attr("w:hAnsi", "Courier New"), attr("w:cs", "Courier New"))
+	}
+	if s.bold {
+		rpr.AddNext("w:b")
+	}
+	if s.italic {
+		rpr.AddNext("w:i")
+	}
+	if s.strike {
+		rpr.AddNext("w:strike")
+	}
+	if len(s.color) > 0 {
+		rpr.AddNext("w:color", attr("w:val", s.color))
+	}
+	if s.size > 0 && base > 0 {
+		rpr.AddNext("w:sz", attr("w:val", strconv.Itoa(int(math.Round(base*s.size*2)))))
+	}
+	if s.underline {
+		rpr.AddNext("w:u", attr("w:val", "single"))
+	}
+	switch s.vert {
+	case "super":
+		rpr.AddNext("w:vertAlign", attr("w:val", "superscript"))
+	case "sub":
+		rpr.AddNext("w:vertAlign", attr("w:val", "subscript"))
+	}
+}
+
+func (w *docxWriter) styles() *etree.Document {
+
+	const base = 11.0
+
+	doc := newXMLPart()
+	root := doc.CreateElement("w:styles")
+	root.CreateAttr("xmlns:w", docxNsMain)
+
+	defaults := root.AddNext("w:docDefaults")
+	rpr := defaults.AddNext("w:rPrDefault").AddNext("w:rPr")
+	rpr.AddNext("w:rFonts", attr("w:ascii", "Times New Roman"), attr("w:hAnsi", "Times New Roman"), attr("w:cs", "Times New Roman"))
+	rpr.AddNext("w:sz", attr("w:val", strconv.Itoa(base*2)))
+	rpr.AddNext("w:lang", attr("w:val", w.d.p.Book.Lang.String()))
+	defaults.AddNext("w:pPrDefault").AddNext("w:pPr").AddNext("w:spacing", attr("w:after", "0"), attr("w:line", "264"), attr("w:lineRule", "auto"))
+
+	root.AddNext("w:style", attr("w:type", "paragraph"), attr("w:default", "1"), attr("w:styleId", "Normal")).
+		AddNext("w:name", attr("w:val", "Normal"))
+	root.AddNext("w:style", attr("w:type", "character"), attr("w:default", "1"), attr("w:styleId", "DefaultParagraphFont")).
+		AddNext("w:name", attr("w:val", "Default Paragraph Font"))
+
+	for _, s := range officeStyles() {
+		kind := "paragraph"
+		if s.character {
+			kind = "character"
+		}
+		st := root.AddNext("w:style", attr("w:type", kind), attr("w:customStyle", customFlag(s.name)), attr("w:styleId", docxStyleID(s.name)))
+		st.AddNext("w:name", attr("w:val", docxStyleName(s.name)))
+		if s.character {
+			st.AddNext("w:basedOn", attr("w:val", "DefaultParagraphFont"))
+		} else {
+			st.AddNext("w:basedOn", attr("w:val", "Normal"))
+			if s.name != officeText && s.level == 0 {
+				st.AddNext("w:next", attr("w:val", docxStyleID(officeText)))
+			}
+		}
+		st.AddNext("w:qFormat")
+		if !s.character {
+			ppr := st.AddNext("w:pPr")
+			if s.keep {
+				ppr.AddNext("w:keepNext")
+			}
+			if s.before > 0 || s.after > 0 {
+				ppr.AddNext("w:spacing", attr("w:before", twips(s.before)), attr("w:after", twips(s.after)))
+			}
+			if s.left > 0 || s.right > 0 || s.indent > 0 {
+				ppr.AddNext("w:ind", attr("w:left", twips(s.left)), attr("w:right", twips(s.right)), attr("w:firstLine", twips(s.indent)))
+			}
+			switch s.align {
+			case "justify":
+				ppr.AddNext("w:jc", attr("w:val", "both"))
+			case "center", "right":
+				ppr.AddNext("w:jc", attr("w:val", s.align))
+			}
+			if s.level > 0 {
+				ppr.AddNext("w:outlineLvl", attr("w:val", strconv.Itoa(s.level-1)))
+			}
+			if len(ppr.Child) == 0 {
+				st.RemoveChild(ppr)
+			}
+		}
+		rpr := st.AddNext("w:rPr")
+		docxRunProperties(rpr, s, base)
+		if len(rpr.Child) == 0 {
+			st.RemoveChild(rpr)
+		}
+	}
+
+	st := root.AddNext("w:style", attr("w:type", "character"), attr("w:styleId", "FootnoteReference"))
+	st.AddNext("w:name", attr("w:val", "footnote reference"))
+	st.AddNext("w:basedOn", attr("w:val", "DefaultParagraphFont"))
+	st.AddNext("w:rPr").AddNext("w:vertAlign", attr("w:val", "superscript"))
+
+	st = root.AddNext("w:style", attr("w:type", "table"), attr("w:styleId", "TableGrid"))
+	st.AddNext("w:name", attr("w:val", "Table Grid"))
+	borders := st.AddNext("w:tblPr").AddNext("w:tblBorders")
+	for _, side := range []string{"w:top", "w:left", "w:bottom", "w:right", "w:insideH", "w:insideV"} {
+		borders.AddNext(side, attr("w:val", "single"), attr("w:sz", "4"), attr("w:space", "0"), attr("w:color", "auto"))
+	}
+	return doc
+}
+
+// customFlag marks styles which are not built into word processors.
+func customFlag(name string) string {
+	switch {
+	case name == officeText, name == officeTitle, name == officeSubtitle, name == officeFootnote, name == officeEmphasis,
+		name == officeStrong, name == officeLink, strings.HasPrefix(name, officeHeading+" "):
+		return ""
+	}
+	return "1"
+}
+
+func (w *docxWriter) settings() *etree.Document {
+	doc := newXMLPart()
+	root := doc.CreateElement("w:settings")
+	root.CreateAttr("xmlns:w", docxNsMain)
+	root.AddNext("w:footnotePr").
+		AddSame("w:footnote", attr("w:id", "-1")).
+		AddSame("w:footnote", attr("w:id", "0"))
+	root.AddNext("w:compat").AddNext("w:compatSetting",
+		attr("w:name", "compatibilityMode"), attr("w:uri", "http://schemas.microsoft.com/office/word"), attr("w:val", "15"))
+	return doc
+}
+
+// core writes book description into document properties.
+func (w *docxWriter) core() *etree.Document {
+
+	b := w.d.p.Book
+
+	doc := newXMLPart()
+	root := doc.CreateElement("cp:coreProperties")
+	root.CreateAttr("xmlns:cp", "http://schemas.openxmlformats.org/package/2006/metadata/core-properties")
+	root.CreateAttr("xmlns:dc", "http://purl.org/dc/elements/1.1/")
+	root.CreateAttr("xmlns:dcterms", "http://purl.org/dc/terms/")
+	root.CreateAttr("xmlns:xsi", "http://www.w3.org/2001/XMLSchema-instance")
+
+	root.AddNext("dc:title").SetText(b.Title)
+	if authors := w.d.authors(); len(authors) > 0 {
+		root.AddNext("dc:creator").SetText(authors)
+	}
+	if len(b.SeqName) > 0 {
+		root.AddNext("dc:subject").SetText(b.SeqName)
+	}
+	if len(b.GenreNames) > 0 {
+		root.AddNext("cp:keywords").SetText(strings.Join(b.GenreNames, ", "))
+	}
+	if len(b.Annotation) > 0 {
+		root.AddNext("dc:description").SetText(b.Annotation)
+	}
+	if len(b.GenreGroup) > 0 {
+		root.AddNext("cp:category").SetText(b.GenreGroup)
+	}
+	root.AddNext("dc:identifier").SetText(b.ID.String())
+	root.AddNext("dc:language").SetText(b.Lang.String())
+	root.AddNext("dcterms:created", attr("xsi:type", "dcterms:W3CDTF")).SetText(time.Now().UTC().Format(time.RFC3339))
+	return doc
+}
+
+// custom keeps book description which has no place among core properties.
+func (w *docxWriter) custom() *etree.Document {
+
+	doc := newXMLPart()
+	root := doc.CreateElement("Properties")
+	root.CreateAttr("xmlns", "http://schemas.openxmlformats.org/officeDocument/2006/custom-properties")
+	root.CreateAttr("xmlns:vt", "http://schemas.openxmlformats.org/officeDocument/2006/docPropsVTypes")
+	pid := 1
+	for _, prop := range officeProperties(w.d.p.Book) {
+		pid++
+		root.AddNext("property", attr("fmtid", "{D5CDD505-2E9C-101B-9397-08002B2CF9AE}"), attr("pid", strconv.Itoa(pid)), attr("name", prop[0])).
+			AddNext("vt:lpwstr").SetText(prop[1])
+	}
+	return doc
+}
+
+// officeProperties lists book description kept as custom document properties.
+func officeProperties(b *Book) [][2]string {
+	var props [][2]string
+	if len(b.SeqName) > 0 {
+		props = append(props, [2]string{"Series", b.SeqName})
+		if b.SeqNum > 0 {
+			props = append(props, [2]string{"Series Number", strconv.Itoa(b.SeqNum)})
+		}
+	}
+	if len(b.Genres) > 0 {
+		props = append(props, [2]string{"Genres", strings.Join(b.Genres, ", ")})
+	}
+	if len(b.Date) > 0 {
+		props = append(props, [2]string{"Date", b.Date})
+	}
+	if len(b.ASIN) > 0 {
+		props = append(props, [2]string{"ASIN", b.ASIN})
+	}
+	props = append(props, [2]string{"Book ID", b.ID.String()})
+	return props
+}
@@ -13,6 +13,12 @@ const (
 	OKepub                                // kepub
 	OAzw3                                 // azw3
 	OMobi                                 // mobi
+	OTxt                                  // txt
+	OMd                                   // md
+	OHtml                                 // html
+	OPdf                                  // pdf
+	ODocx                                 // docx
+	OOdt                                  // odt
 	UnsupportedOutputFmt                  //
 )
 
@@ -162,3 +168,113 @@ func ParseCoverProcessingString(format string) CoverProcessing {
 	}
 	return UnsupportedCoverProcessing
 }
+
+// FontObfuscation specifies how embedded fonts are protected - EPUB only
+type FontObfuscation int
+
+// Supported obfuscation algorithms
+const (
+	FontObfuscationNone        FontObfuscation = iota // none
+	FontObfuscationIDPF                               // idpf
+	FontObfuscationAdobe                              // adobe
+	UnsupportedFontObfuscation                        //
+)
+
+// ParseFontObfuscationString converts string to enum value. Case insensitive.
+func ParseFontObfuscationString(format string) FontObfuscation {
+
+	for i := FontObfuscationNone; i < UnsupportedFontObfuscation; i++ {
+		if strings.EqualFold(i.String(), format) {
+			return i
+		}
+	}
+	return UnsupportedFontObfuscation
+}
+
+// GenreSubjects specifies how book genres are presented in book meta information
+type GenreSubjects int
+
+// Supported genre presentations
+const (
+	GenreNames               GenreSubjects = iota // names
+	GenreCodes                                    // codes
+	GenreBoth                                     // both
+	UnsupportedGenreSubjects                      //
+)
+
+// ParseGenreSubjectsString converts string to enum value. Case insensitive.
+func ParseGenreSubjectsString(format string) GenreSubjects {
+
+	for i := GenreNames; i < UnsupportedGenreSubjects; i++ {
+		if strings.EqualFold(i.String(), format) {
+			return i
+		}
+	}
+	return UnsupportedGenreSubjects
+}
+
+// FileNameCollision specifies what to do when output file already exists
+type FileNameCollision int
+
+// Supported collision resolutions
+const (
+	CollisionError               FileNameCollision = iota // error
+	CollisionCounter                                      // counter
+	CollisionID                                           // id
+	CollisionSkip                                         // skip
+	UnsupportedFileNameCollision                          //
+)
+
+// ParseFileNameCollisionString converts string to enum value. Case insensitive.
+func ParseFileNameCollisionString(format string) FileNameCollision {
+
+	for i := CollisionError; i < UnsupportedFileNameCollision; i++ {
+		if strings.EqualFold(i.String(), format) {
+			return i
+		}
+	}
+	return UnsupportedFileNameCollision
+}
+
+// HTMLLayout specifies how html output is organized
+type HTMLLayout int
+
+// Supported html layouts
+const (
+	HTMLSingle            HTMLLayout = iota // single
+	HTMLSite                                // site
+	UnsupportedHTMLLayout                   //
+)
+
+// ParseHTMLLayoutString converts string to enum value. Case insensitive.
+func ParseHTMLLayoutString(format string) HTMLLayout {
+
+	for i := HTMLSingle; i < UnsupportedHTMLLayout; i++ {
+		if strings.EqualFold(i.String(), format) {
+			return i
+		}
+	}
+	return UnsupportedHTMLLayout
+}
+
+// PageSize specifies pdf page dimensions
+type PageSize int
+
+// Supported page sizes
+const (
+	PageA5              PageSize = iota // a5
+	PageA6                              // a6
+	Page6in                             // 6in
+	UnsupportedPageSize                 //
+)
+
+// ParsePageSizeString converts string to enum value. Case insensitive.
+func ParsePageSizeString(format string) PageSize {
+
+	for i := PageA5; i < UnsupportedPageSize; i++ {
+		if strings.EqualFold(i.String(), format) {
+			return i
+		}
+	}
+	return UnsupportedPageSize
+}
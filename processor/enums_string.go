@@ -1,4 +1,4 @@
-// Code generated by "stringer -linecomment -type OutputFmt,NotesFmt,TOCPlacement,TOCType,APNXGeneration,StampPlacement,CoverProcessing -output processor/enums_string.go processor/enums.go"; DO NOT EDIT.
+// Code generated by "stringer -linecomment -type OutputFmt,NotesFmt,TOCPlacement,TOCType,APNXGeneration,StampPlacement,CoverProcessing,FontObfuscation,GenreSubjects,FileNameCollision,HTMLLayout,PageSize -output processor/enums_string.go processor/enums.go"; DO NOT EDIT.
 
 package processor
 
@@ -12,12 +12,18 @@ func _() {
 	_ = x[OKepub-1]
 	_ = x[OAzw3-2]
 	_ = x[OMobi-3]
-	_ = x[UnsupportedOutputFmt-4]
+	_ = x[OTxt-4]
+	_ = x[OMd-5]
+	_ = x[OHtml-6]
+	_ = x[OPdf-7]
+	_ = x[ODocx-8]
+	_ = x[OOdt-9]
+	_ = x[UnsupportedOutputFmt-10]
 }
 
-const _OutputFmt_name = "epubkepubazw3mobi"
+const _OutputFmt_name = "epubkepubazw3mobitxtmdhtmlpdfdocxodt"
 
-var _OutputFmt_index = [...]uint8{0, 4, 9, 13, 17, 17}
+var _OutputFmt_index = [...]uint8{0, 4, 9, 13, 17, 20, 22, 26, 29, 33, 36, 36}
 
 func (i OutputFmt) String() string {
 	if i < 0 || i >= OutputFmt(len(_OutputFmt_index)-1) {
@@ -149,3 +155,106 @@ func (i CoverProcessing) String() string {
 	}
 	return _CoverProcessing_name[_CoverProcessing_index[i]:_CoverProcessing_index[i+1]]
 }
+
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[FontObfuscationNone-0]
+	_ = x[FontObfuscationIDPF-1]
+	_ = x[FontObfuscationAdobe-2]
+	_ = x[UnsupportedFontObfuscation-3]
+}
+
+const _FontObfuscation_name = "noneidpfadobe"
+
+var _FontObfuscation_index = [...]uint8{0, 4, 8, 13, 13}
+
+func (i FontObfuscation) String() string {
+	if i < 0 || i >= FontObfuscation(len(_FontObfuscation_index)-1) {
+		return "FontObfuscation(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _FontObfuscation_name[_FontObfuscation_index[i]:_FontObfuscation_index[i+1]]
+}
+
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[GenreNames-0]
+	_ = x[GenreCodes-1]
+	_ = x[GenreBoth-2]
+	_ = x[UnsupportedGenreSubjects-3]
+}
+
+const _GenreSubjects_name = "namescodesboth"
+
+var _GenreSubjects_index = [...]uint8{0, 5, 10, 14, 14}
+
+func (i GenreSubjects) String() string {
+	if i < 0 || i >= GenreSubjects(len(_GenreSubjects_index)-1) {
+		return "GenreSubjects(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _GenreSubjects_name[_GenreSubjects_index[i]:_GenreSubjects_index[i+1]]
+}
+
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[CollisionError-0]
+	_ = x[CollisionCounter-1]
+	_ = x[CollisionID-2]
+	_ = x[CollisionSkip-3]
+	_ = x[UnsupportedFileNameCollision-4]
+}
+
+const _FileNameCollision_name = "errorcounteridskip"
+
+var _FileNameCollision_index = [...]uint8{0, 5, 12, 14, 18, 18}
+
+func (i FileNameCollision) String() string {
+	if i < 0 || i >= FileNameCollision(len(_FileNameCollision_index)-1) {
+		return "FileNameCollision(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _FileNameCollision_name[_FileNameCollision_index[i]:_FileNameCollision_index[i+1]]
+}
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[HTMLSingle-0]
+	_ = x[HTMLSite-1]
+	_ = x[UnsupportedHTMLLayout-2]
+}
+
+const _HTMLLayout_name = "singlesite"
+
+var _HTMLLayout_index = [...]uint8{0, 6, 10, 10}
+
+func (i HTMLLayout) String() string {
+	if i < 0 || i >= HTMLLayout(len(_HTMLLayout_index)-1) {
+		return "HTMLLayout(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _HTMLLayout_name[_HTMLLayout_index[i]:_HTMLLayout_index[i+1]]
+}
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[PageA5-0]
+	_ = x[PageA6-1]
+	_ = x[Page6in-2]
+	_ = x[UnsupportedPageSize-3]
+}
+
+const _PageSize_name = "a5a66in"
+
+var _PageSize_index = [...]uint8{0, 2, 4, 7, 7}
+
+func (i PageSize) String() string {
+	if i < 0 || i >= PageSize(len(_PageSize_index)-1) {
+		return "PageSize(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _PageSize_name[_PageSize_index[i]:_PageSize_index[i+1]]
+}
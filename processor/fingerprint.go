@@ -0,0 +1,226 @@
+package processor
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"fb2converter/etree"
+)
+
+// MinHash parameters.
+const (
+	shingleWords  = 4   // words in text shingle
+	SignatureSize = 128 // number of hash functions in text signature
+)
+
+// Fingerprint describes book to recognize different versions of the same book (corrected copies, editions, files
+// from different libraries): meta information, MinHash signature of the main text and properties used to select the
+// best version.
+type Fingerprint struct {
+	Title   string
+	Authors []string
+	Lang    string
+	// document-info, version is dotted number
+	Version string
+	Date    string
+	// number of binaries (images) in book
+	Images int
+	// number of words in main text
+	Words int
+	// MinHash of main text word shingles, empty when book has no text
+	Signature []uint32
+}
+
+var (
+	reVersion = regexp.MustCompile(`\d+(?:[.,]\d+)*`)
+	reISODate = regexp.MustCompile(`\d{4}(?:-\d{2}(?:-\d{2})?)?`)
+)
+
+// seeds of hash functions, fixed so signatures of different runs could be compared
+var signatureSeeds = func() []uint64 {
+	seeds := make([]uint64, SignatureSize)
+	x := uint64(0x2545F4914F6CDD1D)
+	for i := range seeds {
+		x = mix64(x)
+		seeds[i] = x
+	}
+	return seeds
+}()
+
+// mix64 is splitmix64 finalizer.
+func mix64(x uint64) uint64 {
+	x += 0x9E3779B97F4A7C15
+	x = (x ^ (x >> 30)) * 0xBF58476D1CE4E5B9
+	x = (x ^ (x >> 27)) * 0x94D049BB133111EB
+	return x ^ (x >> 31)
+}
+
+// NewFingerprint calculates fingerprint of parsed FB2 document. Text of notes and comments bodies is not used.
+func NewFingerprint(doc *etree.Document) *Fingerprint {
+
+	fp := &Fingerprint{}
+	if info := doc.FindElement("./FictionBook/description/title-info"); info != nil {
+		if e := info.SelectElement("book-title"); e != nil {
+			fp.Title = strings.Join(strings.Fields(e.Text()), " ")
+		}
+		for _, a := range info.SelectElements("author") {
+			var names []string
+			for _, tag := range []string{"first-name", "middle-name", "last-name"} {
+				if e := a.SelectElement(tag); e != nil && len(strings.TrimSpace(e.Text())) > 0 {
+					names = append(names, strings.TrimSpace(e.Text()))
+				}
+			}
+			if len(names) == 0 {
+				if e := a.SelectElement("nickname"); e != nil && len(strings.TrimSpace(e.Text())) > 0 {
+					names = append(names, strings.TrimSpace(e.Text()))
+				}
+			}
+			if len(names) > 0 {
+				fp.Authors = append(fp.Authors, strings.Join(names, " "))
+			}
+		}
+		if e := info.SelectElement("lang"); e != nil {
+			fp.Lang = strings.ToLower(strings.TrimSpace(e.Text()))
+		}
+	}
+	if info := doc.FindElement("./FictionBook/description/document-info"); info != nil {
+		if e := info.SelectElement("version"); e != nil {
+			if v := reVersion.FindString(e.Text()); len(v) > 0 {
+				fp.Version = strings.ReplaceAll(v, ",", ".")
+			}
+		}
+		if e := info.SelectElement("date"); e != nil {
+			fp.Date = reISODate.FindString(getAttrValue(e, "value"))
+			if len(fp.Date) == 0 {
+				fp.Date = reISODate.FindString(e.Text())
+			}
+		}
+	}
+	fp.Images = len(doc.FindElements("./FictionBook/binary"))
+
+	var words []string
+	for _, body := range doc.FindElements("./FictionBook/body") {
+		if len(getAttrValue(body, "name")) > 0 {
+			// notes and comments
+			continue
+		}
+		words = appendWords(words, body)
+	}
+	fp.Words = len(words)
+	fp.Signature = signature(words)
+	return fp
+}
+
+// appendWords collects normalized words of paragraphs and verses.
+func appendWords(words []string, e *etree.Element) []string {
+	for _, c := range e.ChildElements() {
+		switch c.Tag {
+		case "p", "v", "subtitle", "text-author":
+			words = append(words, normalizedWords(extractText(c, true))...)
+		case "binary", "image":
+		default:
+			words = appendWords(words, c)
+		}
+	}
+	return words
+}
+
+// normalizedWords splits text into lowercase words ignoring punctuation, so typographic corrections do not matter.
+func normalizedWords(s string) []string {
+	return strings.FieldsFunc(strings.ReplaceAll(strings.ToLower(s), "ё", "е"), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// signature calculates MinHash of word shingles.
+func signature(words []string) []uint32 {
+
+	if len(words) == 0 {
+		return nil
+	}
+	sig := make([]uint32, SignatureSize)
+	for i := range sig {
+		sig[i] = ^uint32(0)
+	}
+	n := len(words) - shingleWords + 1
+	if n < 1 {
+		n = 1
+	}
+	h := fnv.New64a()
+	for i := 0; i < n; i++ {
+		h.Reset()
+		for j := i; j < i+shingleWords && j < len(words); j++ {
+			h.Write([]byte(words[j]))
+			h.Write([]byte{' '})
+		}
+		x := h.Sum64()
+		for k, seed := range signatureSeeds {
+			if v := uint32(mix64(x^seed) >> 32); v < sig[k] {
+				sig[k] = v
+			}
+		}
+	}
+	return sig
+}
+
+// Similarity estimates share of common text shingles of two books (Jaccard index), books without text are never similar.
+func (fp *Fingerprint) Similarity(other *Fingerprint) float64 {
+
+	if len(fp.Signature) == 0 || len(fp.Signature) != len(other.Signature) {
+		return 0
+	}
+	var same int
+	for i, v := range fp.Signature {
+		if v == other.Signature[i] {
+			same++
+		}
+	}
+	return float64(same) / float64(len(fp.Signature))
+}
+
+// Key returns normalized title and sorted authors last names, books with the same key are likely to be versions of the
+// same book. Key is empty for books without title.
+func (fp *Fingerprint) Key() string {
+
+	title := strings.Join(normalizedWords(fp.Title), " ")
+	if len(title) == 0 {
+		return ""
+	}
+	authors := make([]string, 0, len(fp.Authors))
+	for _, a := range fp.Authors {
+		// first and middle names are often abbreviated or absent
+		if names := normalizedWords(a); len(names) > 0 {
+			authors = append(authors, names[len(names)-1])
+		}
+	}
+	sort.Strings(authors)
+	return title + "|" + strings.Join(authors, ",")
+}
+
+// Bands splits signature into n bands and returns hash of every band, books sharing any band hash are candidates for
+// comparison (locality sensitive hashing).
+func (fp *Fingerprint) Bands(n int) []uint64 {
+
+	if len(fp.Signature) == 0 || n <= 0 || len(fp.Signature)%n != 0 {
+		return nil
+	}
+	rows := len(fp.Signature) / n
+	res := make([]uint64, 0, n)
+	h := fnv.New64a()
+	buf := make([]byte, 4)
+	for b := 0; b < n; b++ {
+		h.Reset()
+		buf[0] = byte(b)
+		h.Write(buf[:1])
+		for _, v := range fp.Signature[b*rows : (b+1)*rows] {
+			binary.LittleEndian.PutUint32(buf, v)
+			h.Write(buf)
+		}
+		res = append(res, h.Sum64())
+	}
+	return res
+}
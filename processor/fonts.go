@@ -0,0 +1,251 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+	"fb2converter/processor/internal/fonts"
+)
+
+var (
+	fontFamilyPattern = regexp.MustCompile(`(?i)font-family\s*:\s*([^;}]+)`)
+	fontFacePattern   = regexp.MustCompile(`(?i)@font-face\s*{[^}]*}`)
+)
+
+// isFontFile checks if data file is font we embedded.
+func isFontFile(d *dataFile) bool {
+	return d.ct == "application/x-font-ttf" || d.ct == "application/opentype"
+}
+
+// embedFont adds font file to the book, returns path to be used in stylesheet. The same font referenced several times is
+// embedded once, different fonts with the same file name get unique names.
+func (p *Processor) embedFont(id, fname string, data []byte) (string, bool) {
+
+	d := &dataFile{data: data, fname: filepath.Base(fname), relpath: filepath.Join(DirContent, DirFonts)}
+	switch {
+	case isTTFFontFile(fname, data):
+		d.ct = "application/x-font-ttf"
+	case isOTFFontFile(fname, data):
+		d.ct = "application/opentype"
+	default:
+		return "", false
+	}
+
+	var taken bool
+	for _, f := range p.Book.Data {
+		if !isFontFile(f) {
+			continue
+		}
+		if bytes.Equal(f.data, data) {
+			// already embedded
+			return path.Join(DirFonts, f.fname), true
+		}
+		taken = taken || f.fname == d.fname
+	}
+	if taken {
+		ext := filepath.Ext(d.fname)
+		d.fname = strings.TrimSuffix(d.fname, ext) + "_" + id + ext
+	}
+	d.id = id
+	p.Book.Data = append(p.Book.Data, d)
+	return path.Join(DirFonts, d.fname), true
+}
+
+// stylesheetFamilies returns names of all font families used in stylesheet and those already having @font-face rules.
+func stylesheetFamilies(css []byte) (used, declared map[string]bool) {
+
+	used, declared = make(map[string]bool), make(map[string]bool)
+	names := func(in []byte, to map[string]bool) {
+		for _, m := range fontFamilyPattern.FindAllSubmatch(in, -1) {
+			for _, name := range strings.Split(string(m[1]), ",") {
+				name = strings.ToLower(strings.Trim(strings.TrimSpace(name), `"'`))
+				if len(name) > 0 {
+					to[name] = true
+				}
+			}
+		}
+	}
+	names(fontFacePattern.ReplaceAll(css, nil), used)
+	for _, face := range fontFacePattern.FindAll(css, -1) {
+		names(face, declared)
+	}
+	return
+}
+
+// addFontFaces embeds fonts for configured font families referenced by stylesheet and generates @font-face rules for
+// them.
+func (p *Processor) addFontFaces(css []byte) []byte {
+
+	if len(p.env.Cfg.Doc.Fonts.Families) == 0 {
+		return css
+	}
+
+	used, declared := stylesheetFamilies(css)
+
+	var rules strings.Builder
+	for i, family := range p.env.Cfg.Doc.Fonts.Families {
+		name := strings.ToLower(family.Name)
+		if len(name) == 0 || !used[name] || declared[name] {
+			continue
+		}
+		for j, face := range []struct {
+			fname, style, weight string
+		}{
+			{family.Regular, "normal", "normal"},
+			{family.Bold, "normal", "bold"},
+			{family.Italic, "italic", "normal"},
+			{family.BoldItalic, "italic", "bold"},
+		} {
+			if len(face.fname) == 0 {
+				continue
+			}
+			fname := face.fname
+			if !filepath.IsAbs(fname) {
+				fname = filepath.Join(p.env.Cfg.Path, fname)
+			}
+			data, err := os.ReadFile(fname)
+			if err != nil {
+				p.env.Log.Warn("Font file not found. Skipping...", zap.String("family", family.Name), zap.String("file", face.fname), zap.Error(err))
+				continue
+			}
+			href, ok := p.embedFont(fmt.Sprintf("family%d_font%d", i+1, j+1), fname, data)
+			if !ok {
+				p.env.Log.Warn("Font file format unrecognized (possibly wrong file extension). Skipping...", zap.String("family", family.Name), zap.String("file", face.fname))
+				continue
+			}
+			fmt.Fprintf(&rules, "@font-face {\n  font-family: \"%s\";\n  font-style: %s;\n  font-weight: %s;\n  src: url(\"%s\");\n}\n\n",
+				family.Name, face.style, face.weight, href)
+		}
+	}
+	if rules.Len() == 0 {
+		return css
+	}
+	return append([]byte(rules.String()), css...)
+}
+
+// usedCharacters collects all characters present in the book content.
+func (p *Processor) usedCharacters() map[rune]bool {
+
+	chars := make(map[rune]bool)
+	add := func(s string) {
+		for _, r := range s {
+			chars[r] = true
+			// text-transform could change case
+			chars[unicode.ToUpper(r)] = true
+			chars[unicode.ToLower(r)] = true
+		}
+	}
+	// always keep printable ASCII and characters which could be inserted by reader
+	for r := rune(0x20); r < 0x7F; r++ {
+		chars[r] = true
+	}
+	add("\u00a0\u00ad\u2010\u2026")
+
+	var walk func(e *etree.Element)
+	walk = func(e *etree.Element) {
+		for _, t := range e.Child {
+			switch v := t.(type) {
+			case *etree.CharData:
+				add(v.Data)
+			case *etree.Element:
+				walk(v)
+			}
+		}
+	}
+	for _, f := range p.Book.Files {
+		if f.doc != nil && f.ct == "application/xhtml+xml" {
+			walk(&f.doc.Element)
+		}
+	}
+	for _, d := range p.Book.Data {
+		if d.ct == "text/css" {
+			// generated content
+			add(string(d.data))
+		}
+	}
+	return chars
+}
+
+// processFonts subsets and obfuscates embedded fonts according to configuration.
+func (p *Processor) processFonts() error {
+
+	var embedded []*dataFile
+	for _, d := range p.Book.Data {
+		if isFontFile(d) {
+			embedded = append(embedded, d)
+		}
+	}
+	if len(embedded) == 0 || (!p.env.Cfg.Doc.Fonts.Subset && p.fontObfuscate == FontObfuscationNone) {
+		return nil
+	}
+
+	p.env.Log.Debug("Processing fonts - start")
+	defer func(start time.Time) {
+		p.env.Log.Debug("Processing fonts - done", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	if p.env.Cfg.Doc.Fonts.Subset {
+		chars := p.usedCharacters()
+		for _, d := range embedded {
+			data, err := fonts.Subset(d.data, chars)
+			if err != nil {
+				p.env.Log.Warn("Unable to subset font, embedding as is", zap.String("font", d.fname), zap.Error(err))
+				continue
+			}
+			p.env.Log.Debug("Font subset", zap.String("font", d.fname), zap.Int("size", len(d.data)), zap.Int("subset", len(data)))
+			d.data = data
+		}
+	}
+
+	if p.fontObfuscate == FontObfuscationNone {
+		return nil
+	}
+
+	uid := fmt.Sprintf("urn:uuid:%s", p.Book.ID)
+	algorithm := fonts.AlgorithmIDPF
+	if p.fontObfuscate == FontObfuscationAdobe {
+		algorithm = fonts.AlgorithmAdobe
+	}
+
+	doc := etree.NewDocument()
+	doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	enc := doc.Element.AddNext("encryption",
+		attr("xmlns", `urn:oasis:names:tc:opendocument:xmlns:container`),
+		attr("xmlns:enc", `http://www.w3.org/2001/04/xmlenc#`))
+
+	for _, d := range embedded {
+		if p.fontObfuscate == FontObfuscationAdobe {
+			data, err := fonts.ObfuscateAdobe(d.data, uid)
+			if err != nil {
+				return err
+			}
+			d.data = data
+		} else {
+			d.data = fonts.ObfuscateIDPF(d.data, uid)
+		}
+		ed := enc.AddNext("enc:EncryptedData")
+		ed.AddNext("enc:EncryptionMethod", attr("Algorithm", algorithm))
+		ed.AddNext("enc:CipherData").AddNext("enc:CipherReference", attr("URI", filepath.ToSlash(filepath.Join(d.relpath, d.fname))))
+	}
+
+	p.Book.Meta = append(p.Book.Meta, &dataFile{
+		id:        "encryption",
+		fname:     "encryption.xml",
+		relpath:   DirMata,
+		transient: dataNotForSpline | dataNotForManifest,
+		ct:        "text/xml",
+		doc:       doc,
+	})
+	return nil
+}
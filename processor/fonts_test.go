@@ -0,0 +1,88 @@
+package processor
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fb2converter/config"
+)
+
+func TestFontFaces(t *testing.T) {
+
+	p := newTestProcessor(t, testBook, OEpub, false, func(cfg *config.Config) {
+		cfg.Doc.Fonts.Obfuscation = "idpf"
+		cfg.Doc.Fonts.Families = []config.FontFamily{
+			// different fonts with the same file name, regular face is referenced twice
+			{Name: "Test Serif", Regular: "regular/serif.ttf", Bold: "bold/serif.ttf", Italic: "copy/serif.ttf"},
+			{Name: "Declared", Regular: "regular/serif.ttf"},
+			{Name: "Unused", Regular: "regular/serif.ttf"},
+		}
+	})
+	regular := append([]byte{0, 1, 0, 0, 0}, bytes.Repeat([]byte{'r'}, 2000)...)
+	bold := append([]byte{0, 1, 0, 0, 0}, bytes.Repeat([]byte{'b'}, 2000)...)
+	for name, data := range map[string][]byte{"regular/serif.ttf": regular, "bold/serif.ttf": bold, "copy/serif.ttf": regular} {
+		fname := filepath.Join(p.env.Cfg.Path, name)
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fname, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	css := `@font-face { font-family: Declared; src: url("declared.ttf"); } body { font-family: "Test Serif", Declared, serif; }`
+	out := string(p.addFontFaces([]byte(css)))
+	for _, expected := range []string{
+		"font-weight: normal;\n  src: url(\"fonts/serif.ttf\");",
+		"font-weight: bold;\n  src: url(\"fonts/serif_family1_font2.ttf\");",
+		"font-style: italic;\n  font-weight: normal;\n  src: url(\"fonts/serif.ttf\");",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("%q not found in stylesheet:\n%s", expected, out)
+		}
+	}
+	if n := strings.Count(out, "@font-face"); n != 4 {
+		t.Errorf("expected 3 generated and 1 declared @font-face rules, got %d:\n%s", n, out)
+	}
+
+	var fonts []*dataFile
+	for _, d := range p.Book.Data {
+		if isFontFile(d) {
+			fonts = append(fonts, d)
+		}
+	}
+	if len(fonts) != 2 || !bytes.Equal(fonts[0].data, regular) || !bytes.Equal(fonts[1].data, bold) {
+		t.Fatalf("expected regular and bold fonts embedded, got %v", fonts)
+	}
+
+	if err := p.processFonts(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(fonts[0].data[:1040], regular[:1040]) || !bytes.Equal(fonts[0].data[1040:], regular[1040:]) {
+		t.Error("font was not obfuscated")
+	}
+	var enc *dataFile
+	for _, d := range p.Book.Meta {
+		if d.fname == "encryption.xml" {
+			enc = d
+		}
+	}
+	if enc == nil {
+		t.Fatal("encryption.xml was not generated")
+	}
+	var uris []string
+	for _, e := range enc.doc.FindElements("//enc:EncryptedData") {
+		if m := e.FindElement("./enc:EncryptionMethod"); m == nil || getAttrValue(m, "Algorithm") != "http://www.idpf.org/2008/embedding" {
+			t.Errorf("unexpected encryption method %v", m)
+		}
+		if r := e.FindElement("./enc:CipherData/enc:CipherReference"); r != nil {
+			uris = append(uris, getAttrValue(r, "URI"))
+		}
+	}
+	if expected := "OEBPS/fonts/serif.ttf,OEBPS/fonts/serif_family1_font2.ttf"; strings.Join(uris, ",") != expected {
+		t.Errorf("expected cipher references %s, got %v", expected, uris)
+	}
+}
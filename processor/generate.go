@@ -1,6 +1,7 @@
 package processor
 
 import (
+	"encoding/json"
 	"fmt"
 	"math"
 	"mime"
@@ -45,6 +46,13 @@ func (p *Processor) generateTOCPage() error {
 		p.Book.Files = append(p.Book.Files, f)
 	}
 
+	p.addTOC(to)
+	return nil
+}
+
+// addTOC adds table of contents built from collected TOC entries to the page body.
+func (p *Processor) addTOC(to *etree.Element) {
+
 	toc := to.AddNext("div", attr("class", "toc"))
 	toc.AddNext("div", attr("id", "toc"), attr("class", "h1")).SetText(p.env.Cfg.Doc.TOC.Title)
 
@@ -80,7 +88,6 @@ func (p *Processor) generateTOCPage() error {
 			}
 		}
 	}
-	return nil
 }
 
 // generateCover creates proper cover page for the book.
@@ -335,29 +342,20 @@ func (p *Processor) prepareStylesheet() error {
 			return name
 		}
 
-		d := &dataFile{data: data}
-		switch {
-		case isTTFFontFile(fname, data):
-			d.id = fmt.Sprintf("font%d", index+1)
-			d.fname = filepath.Base(fname)
-			d.relpath = filepath.Join(DirContent, DirFonts)
-			d.ct = "application/x-font-ttf"
-		case isOTFFontFile(fname, data):
-			d.id = fmt.Sprintf("font%d", index+1)
-			d.fname = filepath.Base(fname)
-			d.relpath = filepath.Join(DirContent, DirFonts)
-			d.ct = "application/opentype"
-		default:
-			if strings.EqualFold(filepath.Ext(fname), ".ttf") || strings.EqualFold(filepath.Ext(fname), ".otf") {
-				p.env.Log.Warn("Stylesheet font resource file format unrecognized (possibly wrong file extension). Skipping...", zap.String("url", name))
-				return name
-			}
-			d.id = fmt.Sprintf("css_data%d", index+1)
-			d.fname = "css_" + filepath.Base(fname)
-			d.relpath = filepath.Join(DirContent, DirImages)
-			d.ct = mime.TypeByExtension(filepath.Ext(fname))
+		if href, ok := p.embedFont(fmt.Sprintf("font%d", index+1), fname, data); ok {
+			return href
+		}
+		if strings.EqualFold(filepath.Ext(fname), ".ttf") || strings.EqualFold(filepath.Ext(fname), ".otf") {
+			p.env.Log.Warn("Stylesheet font resource file format unrecognized (possibly wrong file extension). Skipping...", zap.String("url", name))
+			return name
+		}
+		d := &dataFile{
+			id:      fmt.Sprintf("css_data%d", index+1),
+			fname:   "css_" + filepath.Base(fname),
+			relpath: filepath.Join(DirContent, DirImages),
+			ct:      mime.TypeByExtension(filepath.Ext(fname)),
+			data:    data,
 		}
-
 		p.Book.Data = append(p.Book.Data, d)
 		return path.Join(DirFonts, d.fname)
 	}
@@ -389,6 +387,7 @@ func (p *Processor) prepareStylesheet() error {
 	if len(result) > 0 {
 		d.data = []byte(result)
 	}
+	d.data = p.addFontFaces(d.data)
 	return nil
 }
 
@@ -459,17 +458,19 @@ func (p *Processor) generateOPF() error {
 	meta.AddNext("dc:language").SetText(p.Book.Lang.String())
 	meta.AddNext("dc:identifier", attr("id", "BookId"), attr("opf:scheme", "uuid")).SetText(fmt.Sprintf("urn:uuid:%s", p.Book.ID))
 
+	links := make(map[string]string, len(p.Book.Authors))
 	for _, an := range p.Book.Authors {
-		a := ReplaceKeywords(p.env.Cfg.Doc.AuthorFormatMeta, CreateAuthorKeywordsMap(an))
+		a, sort := ReplaceKeywords(p.env.Cfg.Doc.AuthorFormatMeta, CreateAuthorKeywordsMap(an)), an.SortName()
 		if p.env.Cfg.Doc.TransliterateMeta {
-			a = slug.Make(a)
+			a, sort = slug.Make(a), slug.Make(sort)
 		}
-		meta.AddNext("dc:creator", attr("opf:role", "aut")).SetText(a)
+		meta.AddNext("dc:creator", attr("opf:role", "aut"), attr("opf:file-as", sort)).SetText(a)
+		links[a] = ""
 	}
 
 	meta.AddNext("dc:publisher")
 
-	for _, g := range p.Book.Genres {
+	for _, g := range p.bookSubjects() {
 		meta.AddNext("dc:subject").SetText(g)
 	}
 
@@ -488,6 +489,12 @@ func (p *Processor) generateOPF() error {
 			meta.AddNext("meta", attr("name", "calibre:series_index"), attr("content", strconv.Itoa(p.Book.SeqNum)))
 		}
 	}
+	meta.AddNext("meta", attr("name", "calibre:title_sort"), attr("content", TitleSort(p.Book.Title, p.Book.Lang)))
+	if len(links) > 0 {
+		if data, err := json.Marshal(links); err == nil {
+			meta.AddNext("meta", attr("name", "calibre:author_link_map"), attr("content", string(data)))
+		}
+	}
 
 	// Manifest generation
 
@@ -606,27 +613,3 @@ func (p *Processor) generateMeta() error {
 
 	return nil
 }
-
-// KepubifyXHTML inserts Kobo specific formatting into results.
-func (p *Processor) KepubifyXHTML() error {
-
-	if p.format != OKepub {
-		return nil
-	}
-
-	for _, f := range p.Book.Files {
-		if f.ct == "application/xhtml+xml" && filepath.Ext(f.fname) == ".xhtml" && f.doc != nil {
-			if body := f.doc.FindElement("./html/body"); body != nil {
-				to := etree.NewElement("div")
-				to.CreateAttr("id", "book-columns")
-				inner := to.AddNext("div", attr("id", "book-inner"))
-				children := body.ChildElements()
-				for i := 0; i < len(children); i++ {
-					inner.AddChild(body.RemoveChild(children[i]))
-				}
-				body.AddChild(to)
-			}
-		}
-	}
-	return nil
-}
@@ -0,0 +1,167 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/static"
+)
+
+// genreGroup describes part of FB2 genres hierarchy as it is kept in genres table. Names are keyed by language code.
+type genreGroup struct {
+	Names  map[string]string `json:"names"`
+	Genres []struct {
+		Code  string            `json:"code"`
+		Names map[string]string `json:"names"`
+	} `json:"genres"`
+}
+
+type genreInfo struct {
+	names map[string]string
+	group map[string]string
+}
+
+type genreTable map[string]*genreInfo
+
+var (
+	genresLock   sync.Mutex
+	genresTables = make(map[string]genreTable) // table file name -> table, built-in table has empty name
+)
+
+// parse adds genres from JSON table to the map, genres from later tables replace earlier ones.
+func (t genreTable) parse(data []byte) error {
+
+	var groups []genreGroup
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return err
+	}
+	for _, g := range groups {
+		for _, e := range g.Genres {
+			if code := strings.ToLower(strings.TrimSpace(e.Code)); len(code) > 0 {
+				t[code] = &genreInfo{names: e.Names, group: g.Names}
+			}
+		}
+	}
+	return nil
+}
+
+// getGenres returns built-in genres table merged with user supplied one (if any). Tables are loaded once.
+func getGenres(fname string) (genreTable, error) {
+
+	genresLock.Lock()
+	defer genresLock.Unlock()
+
+	if t, ok := genresTables[fname]; ok {
+		return t, nil
+	}
+
+	data, err := static.Asset("resources/genres.json")
+	if err != nil {
+		return nil, fmt.Errorf("unable to load built-in genres: %w", err)
+	}
+	t := make(genreTable)
+	if err := t.parse(data); err != nil {
+		return nil, fmt.Errorf("unable to parse built-in genres: %w", err)
+	}
+	if len(fname) > 0 {
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read genres from %s: %w", fname, err)
+		}
+		if err := t.parse(data); err != nil {
+			return nil, fmt.Errorf("unable to parse genres from %s: %w", fname, err)
+		}
+	}
+	genresTables[fname] = t
+	return t, nil
+}
+
+// localName selects name in requested language, falling back to English.
+func localName(names map[string]string, lang string) string {
+	if n, ok := names[lang]; ok && len(n) > 0 {
+		return n
+	}
+	return names["en"]
+}
+
+// resolveGenres translates book genre codes into human readable names. Unknown codes are used as names.
+func (p *Processor) resolveGenres() {
+
+	p.Book.GenreNames, p.Book.GenreGroup = nil, ""
+	if len(p.Book.Genres) == 0 {
+		return
+	}
+
+	t, err := getGenres(p.env.Cfg.GetGenresPath())
+	if err != nil {
+		p.env.Log.Warn("Unable to load genres table, using genre codes", zap.Error(err))
+	}
+
+	lang := strings.ToLower(p.env.Cfg.Doc.Genres.Language)
+	if len(lang) == 0 {
+		b, _ := p.Book.Lang.Base()
+		lang = b.String()
+	}
+
+	for i, code := range p.Book.Genres {
+		name, group := genreName(t, code, lang, p.env.Cfg.Doc.Genres.Names)
+		if i == 0 {
+			p.Book.GenreGroup = group
+		}
+		p.Book.GenreNames = append(p.Book.GenreNames, name)
+	}
+}
+
+// genreName looks up genre name and name of its group in the table, configured names take precedence. Unknown code
+// is used as a name.
+func genreName(t genreTable, code, lang string, names map[string]string) (string, string) {
+	var name, group string
+	if g, ok := t[strings.ToLower(code)]; ok {
+		name, group = localName(g.names, lang), localName(g.group, lang)
+	}
+	for c, n := range names {
+		if strings.EqualFold(c, code) && len(n) > 0 {
+			name = n
+		}
+	}
+	if len(name) == 0 {
+		name = code
+	}
+	return name, group
+}
+
+// GenreName returns human readable name of genre code when there is no book to take language from (catalogs, lists).
+// Configured genres language is used, English by default. Unknown codes are returned as is.
+func GenreName(code string, cfg *config.Config) string {
+	// when table could not be loaded only configured names are used, loading error is reported on conversion
+	t, _ := getGenres(cfg.GetGenresPath())
+	lang := strings.ToLower(cfg.Doc.Genres.Language)
+	if len(lang) == 0 {
+		lang = "en"
+	}
+	name, _ := genreName(t, code, lang, cfg.Doc.Genres.Names)
+	return name
+}
+
+// bookSubjects returns list of book subjects to be put into meta information.
+func (p *Processor) bookSubjects() []string {
+
+	var res []string
+	if p.genreSubjects != GenreNames {
+		for _, g := range p.Book.Genres {
+			res = AppendIfMissing(res, g)
+		}
+	}
+	if p.genreSubjects != GenreCodes {
+		for _, g := range p.Book.GenreNames {
+			res = AppendIfMissing(res, g)
+		}
+	}
+	return res
+}
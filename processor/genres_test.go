@@ -0,0 +1,64 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+
+	"fb2converter/config"
+)
+
+func TestGenres(t *testing.T) {
+
+	table, err := getGenres("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		code, lang, name, group string
+	}{
+		{"sf_fantasy", "en", "Fantasy", "Science Fiction & Fantasy"},
+		{"sf_fantasy", "ru", "Фэнтези", "Фантастика"},
+		{"prose_classic", "de", "Classical Prose", "Prose"},
+	} {
+		g, ok := table[c.code]
+		if !ok {
+			t.Errorf("genre %s is missing", c.code)
+			continue
+		}
+		if n := localName(g.names, c.lang); n != c.name {
+			t.Errorf("%s (%s): expected name %q, got %q", c.code, c.lang, c.name, n)
+		}
+		if n := localName(g.group, c.lang); n != c.group {
+			t.Errorf("%s (%s): expected group %q, got %q", c.code, c.lang, c.group, n)
+		}
+	}
+}
+
+func TestBookSubjects(t *testing.T) {
+
+	const book = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+<description><title-info><genre>SF_Fantasy</genre><genre>prose_classic</genre><book-title>Test</book-title><lang>en</lang></title-info></description>
+<body><section><p>Text.</p></section></body>
+</FictionBook>`
+
+	for _, c := range []struct {
+		subjects string
+		expected string
+	}{
+		{"", "SF_Fantasy,prose_classic"},
+		{"names", "Fantasy,Classics"},
+		{"both", "SF_Fantasy,prose_classic,Fantasy,Classics"},
+	} {
+		p := newTestProcessor(t, book, OEpub, false, func(cfg *config.Config) {
+			cfg.Doc.Genres.Subjects = c.subjects
+			cfg.Doc.Genres.Names = map[string]string{"Prose_Classic": "Classics"}
+		})
+		if err := p.ProcessDescription(); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(p.bookSubjects(), ","); got != c.expected {
+			t.Errorf("subjects %q: expected %s, got %s", c.subjects, c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package processor
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+)
+
+// htmlVoidElements could not have content and are written without closing tag.
+var htmlVoidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "source": true, "track": true, "wbr": true,
+}
+
+// cssURLPattern matches resource references in stylesheet.
+var cssURLPattern = regexp.MustCompile(`url\(\s*["']?([^"'\)\s]+)["']?\s*\)`)
+
+// FinalizeHTML produces single html file or html site directory out of previously saved temporary files.
+func (p *Processor) FinalizeHTML(fname string) error {
+
+	if _, err := os.Stat(fname); err == nil {
+		if !p.overwrite {
+			return fmt.Errorf("output file already exists: %s", fname)
+		}
+		p.env.Log.Warn("Overwriting existing file", zap.String("file", fname))
+		if err = os.RemoveAll(fname); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if p.htmlLayout == HTMLSite {
+		return p.writeHTMLSite(fname)
+	}
+	if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+		return fmt.Errorf("unable to create output directory: %w", err)
+	}
+	return p.writeHTMLFile(fname)
+}
+
+// htmlPages returns content files in reading order.
+func (p *Processor) htmlPages() []*dataFile {
+
+	var pages []*dataFile
+	for _, f := range p.Book.Files {
+		if f == nil || f.doc == nil || f.ct != "application/xhtml+xml" {
+			continue
+		}
+		if f.doc.FindElement("./html/body") == nil {
+			continue
+		}
+		pages = append(pages, f)
+	}
+	return pages
+}
+
+// newHTMLDocument creates html page, returns document and its head.
+func (p *Processor) newHTMLDocument() (*etree.Document, *etree.Element) {
+
+	doc := etree.NewDocument()
+	doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
+	doc.CreateDirective("DOCTYPE html")
+
+	html := doc.Element.AddNext("html", attr("lang", p.Book.Lang.String()))
+	head := html.AddNext("head").
+		AddSame("meta", attr("charset", "utf-8")).
+		AddSame("meta", attr("name", "viewport"), attr("content", "width=device-width, initial-scale=1"))
+	head.AddNext("title").SetText(p.Book.Title)
+	if authors := p.Book.BookAuthors(p.env.Cfg.Doc.AuthorFormat, false); len(authors) > 0 {
+		head.AddNext("meta", attr("name", "author"), attr("content", authors))
+	}
+	return doc, head
+}
+
+// htmlPageID returns anchor used for the content file in single html file.
+func htmlPageID(fname string) string {
+	return "page_" + strings.TrimSuffix(fname, ".xhtml")
+}
+
+// prepareHTML adjusts copied page content: changes references to other pages and images and makes sure empty elements
+// are closed properly for html parsers.
+func prepareHTML(e *etree.Element, href func(string) string, src func(string) string) {
+
+	for i := range e.Attr {
+		a := &e.Attr[i]
+		switch {
+		case e.Tag == "a" && a.Space == "" && a.Key == "href":
+			a.Value = href(a.Value)
+		case e.Tag == "img" && a.Space == "" && a.Key == "src":
+			a.Value = src(a.Value)
+		case e.Tag == "image" && a.Key == "href":
+			a.Value = src(a.Value)
+		}
+	}
+	for _, c := range e.ChildElements() {
+		prepareHTML(c, href, src)
+	}
+	if len(e.Child) == 0 && !htmlVoidElements[e.Tag] {
+		e.CreateCharData("")
+	}
+}
+
+// isLocalRef checks if reference points inside the book.
+func isLocalRef(ref string) bool {
+	return !strings.Contains(ref, ":")
+}
+
+// readContent returns data of the saved content file, name is relative to content directory.
+func (p *Processor) readContent(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(p.tmpDir, DirContent, filepath.FromSlash(path.Clean(name))))
+}
+
+// dataURI embeds saved content file into reference.
+func (p *Processor) dataURI(name string, cache map[string]string) string {
+
+	if !isLocalRef(name) {
+		return name
+	}
+	if uri, ok := cache[name]; ok {
+		return uri
+	}
+	data, err := p.readContent(name)
+	if err != nil {
+		p.env.Log.Warn("Unable to embed resource, keeping reference", zap.String("ref", name), zap.Error(err))
+		return name
+	}
+	ct := mime.TypeByExtension(path.Ext(name))
+	if len(ct) == 0 {
+		ct = http.DetectContentType(data)
+	}
+	uri := "data:" + ct + ";base64," + base64.StdEncoding.EncodeToString(data)
+	cache[name] = uri
+	return uri
+}
+
+// writeHTMLFile puts all content pages into single html file with stylesheet and images embedded.
+func (p *Processor) writeHTMLFile(fname string) error {
+
+	doc, head := p.newHTMLDocument()
+
+	cache := make(map[string]string)
+	css, err := p.readContent("stylesheet.css")
+	if err != nil {
+		return fmt.Errorf("unable to read stylesheet: %w", err)
+	}
+	css = cssURLPattern.ReplaceAllFunc(css, func(m []byte) []byte {
+		return []byte(`url("` + p.dataURI(string(cssURLPattern.FindSubmatch(m)[1]), cache) + `")`)
+	})
+	if strings.ContainsAny(string(css), "<>&") {
+		// style content would be escaped, so it is referenced instead
+		head.AddNext("link", attr("rel", "stylesheet"), attr("type", "text/css"),
+			attr("href", "data:text/css;base64,"+base64.StdEncoding.EncodeToString(css)))
+	} else {
+		head.AddNext("style").SetText(string(css))
+	}
+
+	href := func(ref string) string {
+		if !isLocalRef(ref) {
+			return ref
+		}
+		file, frag, _ := strings.Cut(ref, "#")
+		if len(frag) > 0 {
+			return "#" + frag
+		}
+		if strings.HasSuffix(file, ".xhtml") {
+			return "#" + htmlPageID(file)
+		}
+		return ref
+	}
+	src := func(ref string) string {
+		return p.dataURI(ref, cache)
+	}
+
+	body := head.Parent().AddNext("body")
+	for _, f := range p.htmlPages() {
+		page := f.doc.FindElement("./html/body").Copy()
+		page.Tag = "section"
+		page.CreateAttr("id", htmlPageID(f.fname))
+		page.CreateAttr("class", "page")
+		prepareHTML(page, href, src)
+		body.AddChild(page)
+	}
+
+	if err := doc.WriteToFile(fname); err != nil {
+		return fmt.Errorf("unable to write html file %s: %w", fname, err)
+	}
+	return nil
+}
+
+// writeHTMLSite produces directory with index page and page for every content file, images, fonts and stylesheet are
+// kept as separate files.
+func (p *Processor) writeHTMLSite(dir string) error {
+
+	content := filepath.Join(p.tmpDir, DirContent)
+	err := filepath.Walk(content, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(content, name)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dir, rel), 0700)
+		}
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".xhtml", ".ncx", ".opf", ".smil":
+			return nil
+		}
+		return copyFile(name, filepath.Join(dir, rel))
+	})
+	if err != nil {
+		return fmt.Errorf("unable to copy html site resources: %w", err)
+	}
+
+	href := func(ref string) string {
+		if !isLocalRef(ref) {
+			return ref
+		}
+		file, frag, found := strings.Cut(ref, "#")
+		if strings.HasSuffix(file, ".xhtml") {
+			file = strings.TrimSuffix(file, ".xhtml") + ".html"
+		}
+		if found {
+			return file + "#" + frag
+		}
+		return file
+	}
+	src := func(ref string) string { return ref }
+
+	pages := p.htmlPages()
+
+	// spine pages are connected with navigation links
+	var spine []*dataFile
+	for _, f := range pages {
+		if f.transient&dataNotForSpline == 0 {
+			spine = append(spine, f)
+		}
+	}
+	prev, next := make(map[*dataFile]string), make(map[*dataFile]string)
+	for i, f := range spine {
+		if i > 0 {
+			prev[f] = href(spine[i-1].fname)
+		}
+		if i < len(spine)-1 {
+			next[f] = href(spine[i+1].fname)
+		}
+	}
+
+	navigation := func(to *etree.Element, prev, next string) {
+		nav := to.AddNext("nav", attr("class", "navigation"))
+		if len(prev) > 0 {
+			nav.AddNext("a", attr("href", prev), attr("rel", "prev")).SetText("←")
+			nav.CreateCharData(" ")
+		}
+		nav.AddNext("a", attr("href", "index.html"), attr("rel", "contents")).SetText(p.env.Cfg.Doc.TOC.Title)
+		if len(next) > 0 {
+			nav.CreateCharData(" ")
+			nav.AddNext("a", attr("href", next), attr("rel", "next")).SetText("→")
+		}
+	}
+
+	writePage := func(name string, body *etree.Element, doc *etree.Document, head *etree.Element) error {
+		head.AddNext("link", attr("rel", "stylesheet"), attr("type", "text/css"), attr("href", "stylesheet.css"))
+		prepareHTML(body, href, src)
+		head.Parent().AddChild(body)
+		if err := doc.WriteToFile(filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("unable to write html page %s: %w", name, err)
+		}
+		return nil
+	}
+
+	// index page with book title and table of contents
+	doc, head := p.newHTMLDocument()
+	body := etree.NewElement("body")
+	title := body.AddNext("div", attr("class", "titleblock"))
+	if authors := p.Book.BookAuthors(p.env.Cfg.Doc.AuthorFormat, false); len(authors) > 0 {
+		title.AddNext("div", attr("class", "h2")).SetText(authors)
+	}
+	title.AddNext("div", attr("class", "h1")).SetText(p.Book.Title)
+	if len(p.Book.TOC) > 0 {
+		p.addTOC(body)
+	}
+	if len(spine) > 0 {
+		body.AddNext("nav", attr("class", "navigation")).
+			AddNext("a", attr("href", href(spine[0].fname)), attr("rel", "next")).SetText("→")
+	}
+	if err := writePage("index.html", body, doc, head); err != nil {
+		return err
+	}
+
+	for _, f := range pages {
+		doc, head := p.newHTMLDocument()
+		body := etree.NewElement("body")
+		navigation(body, prev[f], next[f])
+		for _, c := range f.doc.FindElement("./html/body").Child {
+			switch v := c.(type) {
+			case *etree.Element:
+				body.AddChild(v.Copy())
+			case *etree.CharData:
+				body.CreateCharData(v.Data)
+			}
+		}
+		navigation(body, prev[f], next[f])
+		if err := writePage(href(f.fname), body, doc, head); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies regular file.
+func copyFile(from, to string) error {
+
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
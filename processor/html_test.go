@@ -0,0 +1,35 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+
+	"fb2converter/etree"
+)
+
+func TestPrepareHTML(t *testing.T) {
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(`<body><div class="section" id="s1"/><p>Text<br/><a href="index2.xhtml#n1">1</a> <a href="https://example.com/">link</a></p><img src="images/bin0.png"/></body>`); err != nil {
+		t.Fatal(err)
+	}
+	body := doc.Root()
+	prepareHTML(body,
+		func(ref string) string {
+			if !isLocalRef(ref) {
+				return ref
+			}
+			return strings.Replace(ref, ".xhtml", ".html", 1)
+		},
+		func(ref string) string { return "data:" + ref },
+	)
+
+	out, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<body><div class="section" id="s1"></div><p>Text<br/><a href="index2.html#n1">1</a> <a href="https://example.com/">link</a></p><img src="data:images/bin0.png"/></body>`
+	if out != expected {
+		t.Errorf("unexpected html:\n%s\nexpected:\n%s", out, expected)
+	}
+}
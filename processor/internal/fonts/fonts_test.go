@@ -0,0 +1,215 @@
+package fonts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testFont builds minimal TrueType font with glyphs for 'A', 'B' (composite using 'A') and 'C'.
+func testFont() []byte {
+
+	be := binary.BigEndian
+
+	simple := func(fill byte) []byte {
+		g := bytes.Repeat([]byte{fill}, 20)
+		be.PutUint16(g, 1) // one contour
+		return g
+	}
+	composite := make([]byte, 16)
+	be.PutUint16(composite, 0xFFFF) // -1 contours
+	be.PutUint16(composite[10:], 0) // flags: byte arguments, last component
+	be.PutUint16(composite[12:], 1) // glyph 'A'
+
+	glyphs := [][]byte{simple(0x11), simple(0x22), composite, simple(0x33)}
+	var glyf []byte
+	loca := make([]byte, (len(glyphs)+1)*2)
+	for i, g := range glyphs {
+		be.PutUint16(loca[i*2:], uint16(len(glyf)/2))
+		glyf = append(glyf, g...)
+	}
+	be.PutUint16(loca[len(glyphs)*2:], uint16(len(glyf)/2))
+
+	head := make([]byte, 54)
+	be.PutUint32(head, 0x00010000)
+	maxp := make([]byte, 6)
+	be.PutUint32(maxp, 0x00005000)
+	be.PutUint16(maxp[4:], uint16(len(glyphs)))
+
+	// format 4 subtable: 'A'-'C' mapped to glyphs 1-3
+	sub := make([]byte, 14+2*2*4+2)
+	be.PutUint16(sub, 4)
+	be.PutUint16(sub[2:], uint16(len(sub)))
+	be.PutUint16(sub[6:], 4)
+	be.PutUint16(sub[14:], 'C')
+	be.PutUint16(sub[16:], 0xFFFF)
+	be.PutUint16(sub[20:], 'A')
+	be.PutUint16(sub[22:], 0xFFFF)
+	be.PutUint16(sub[24:], uint16(0x10000-0x40))
+	be.PutUint16(sub[26:], 1)
+	cmap := make([]byte, 12)
+	be.PutUint16(cmap[2:], 1)
+	be.PutUint16(cmap[4:], 3)
+	be.PutUint16(cmap[6:], 1)
+	be.PutUint32(cmap[8:], 12)
+	cmap = append(cmap, sub...)
+
+	f := &sfnt{version: versionTrueType, tables: map[string][]byte{
+		"head": head, "maxp": maxp, "cmap": cmap, "loca": loca, "glyf": glyf,
+		"GSUB": {0, 1, 0, 0},
+	}}
+	return f.bytes()
+}
+
+func TestSubsetGlyf(t *testing.T) {
+
+	out, err := Subset(testFont(), map[rune]bool{'B': true})
+	if err != nil {
+		t.Fatalf("unable to subset: %v", err)
+	}
+	if sum := checkSum(out); sum != checkSumMagic {
+		t.Errorf("wrong font checksum %x", sum)
+	}
+
+	f, err := parse(out)
+	if err != nil {
+		t.Fatalf("unable to parse subset: %v", err)
+	}
+	if _, ok := f.tables["GSUB"]; ok {
+		t.Error("GSUB table was not removed")
+	}
+	if binary.BigEndian.Uint16(f.tables["head"][headIndexToLocFormat:]) != 1 {
+		t.Fatal("loca format is not long")
+	}
+	loca := f.tables["loca"]
+	for g, want := range []int{20, 20, 16, 0} {
+		if l := int(binary.BigEndian.Uint32(loca[(g+1)*4:]) - binary.BigEndian.Uint32(loca[g*4:])); l != want {
+			t.Errorf("glyph %d: expected length %d, got %d", g, want, l)
+		}
+	}
+}
+
+func TestObfuscation(t *testing.T) {
+
+	data := bytes.Repeat([]byte{0xA5}, 2000)
+	uid := "urn:uuid:1b3c5e7a-1111-2222-3333-444455556666"
+
+	idpf := ObfuscateIDPF(data, uid)
+	if bytes.Equal(idpf[:1040], data[:1040]) || !bytes.Equal(idpf[1040:], data[1040:]) {
+		t.Error("IDPF: wrong part of data obfuscated")
+	}
+	if !bytes.Equal(ObfuscateIDPF(idpf, " "+uid+"\n"), data) {
+		t.Error("IDPF: unable to restore data")
+	}
+
+	adobe, err := ObfuscateAdobe(data, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(adobe[:1024], data[:1024]) || !bytes.Equal(adobe[1024:], data[1024:]) {
+		t.Error("Adobe: wrong part of data obfuscated")
+	}
+	if restored, _ := ObfuscateAdobe(adobe, uid); !bytes.Equal(restored, data) {
+		t.Error("Adobe: unable to restore data")
+	}
+	if _, err := ObfuscateAdobe(data, "isbn:12345"); err == nil {
+		t.Error("Adobe: non UUID identifier accepted")
+	}
+}
+
+// testCFFFont replaces outlines of testFont with CFF table: charstrings are followed by charset, so subsetting has to
+// relocate offsets in top dict.
+func testCFFFont() []byte {
+
+	private := []byte{139, 20} // defaultWidthX 0
+	glyphs := [][]byte{
+		bytes.Repeat([]byte{0x11}, 10),
+		bytes.Repeat([]byte{0x22}, 10),
+		bytes.Repeat([]byte{0x33}, 10),
+		bytes.Repeat([]byte{0x44}, 10),
+	}
+	charset := []byte{0, 0, 1, 0, 2, 0, 3}
+
+	top := func(charsetOfs, csOfs, privateOfs int) []byte {
+		var dict []byte
+		dict = append(append(dict, cffInt32(charsetOfs).raw...), cffCharset)
+		dict = append(append(dict, cffInt32(csOfs).raw...), cffCharStrings)
+		dict = append(append(append(dict, cffInt32(len(private)).raw...), cffInt32(privateOfs).raw...), cffPrivate)
+		return writeCFFIndex([][]byte{dict})
+	}
+	head := append([]byte{1, 0, 4, 4}, writeCFFIndex([][]byte{[]byte("Test")})...)
+	privateOfs := len(head) + len(top(0, 0, 0)) + 4 // empty strings and global subrs
+	csOfs := privateOfs + len(private)
+	cs := writeCFFIndex(glyphs)
+
+	cff := append(head, top(csOfs+len(cs), csOfs, privateOfs)...)
+	cff = append(cff, 0, 0, 0, 0)
+	cff = append(cff, private...)
+	cff = append(cff, cs...)
+	cff = append(cff, charset...)
+
+	f, err := parse(testFont())
+	if err != nil {
+		panic(err)
+	}
+	f.version = versionCFF
+	delete(f.tables, "glyf")
+	delete(f.tables, "loca")
+	f.tables["CFF "] = cff
+	return f.bytes()
+}
+
+func TestSubsetCFF(t *testing.T) {
+
+	out, err := Subset(testCFFFont(), map[rune]bool{'B': true})
+	if err != nil {
+		t.Fatalf("unable to subset: %v", err)
+	}
+	if sum := checkSum(out); sum != checkSumMagic {
+		t.Errorf("wrong font checksum %x", sum)
+	}
+	f, err := parse(out)
+	if err != nil {
+		t.Fatalf("unable to parse subset: %v", err)
+	}
+	cff := f.tables["CFF "]
+
+	_, topStart, err := cffIndex(cff, int(cff[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tops, _, err := cffIndex(cff, topStart)
+	if err != nil || len(tops) != 1 {
+		t.Fatalf("unable to read top dict: %v", err)
+	}
+	top, err := parseCFFDict(tops[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsets := make(map[int][]cffOperand)
+	for _, e := range top {
+		offsets[e.op] = e.operands
+	}
+
+	glyphs, _, err := cffIndex(cff, offsets[cffCharStrings][0].val)
+	if err != nil {
+		t.Fatalf("unable to read charstrings: %v", err)
+	}
+	// .notdef and 'B' are kept, everything else is replaced with endchar
+	for g, want := range [][]byte{
+		bytes.Repeat([]byte{0x11}, 10),
+		{cffEndChar},
+		bytes.Repeat([]byte{0x33}, 10),
+		{cffEndChar},
+	} {
+		if g >= len(glyphs) || !bytes.Equal(glyphs[g], want) {
+			t.Errorf("glyph %d: unexpected charstring %v", g, glyphs[g])
+		}
+	}
+	if ofs := offsets[cffCharset][0].val; !bytes.Equal(cff[ofs:ofs+7], []byte{0, 0, 1, 0, 2, 0, 3}) {
+		t.Errorf("charset offset was not relocated: %v", cff[ofs:])
+	}
+	if size, ofs := offsets[cffPrivate][0].val, offsets[cffPrivate][1].val; !bytes.Equal(cff[ofs:ofs+size], []byte{139, 20}) {
+		t.Errorf("private dict offset was not relocated: %v", cff[ofs:])
+	}
+}
@@ -0,0 +1,48 @@
+package fonts
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Algorithm URIs to be used in encryption.xml
+const (
+	AlgorithmIDPF  = "http://www.idpf.org/2008/embedding"
+	AlgorithmAdobe = "http://ns.adobe.com/pdf/enc#RC"
+)
+
+// ObfuscateIDPF implements EPUB OCF font obfuscation: first 1040 bytes are XOR-ed with SHA-1 of package unique
+// identifier. Applying it twice restores original data.
+func ObfuscateIDPF(data []byte, uid string) []byte {
+
+	uid = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, uid)
+	key := sha1.Sum([]byte(uid))
+
+	return xor(data, key[:], 1040)
+}
+
+// ObfuscateAdobe implements Adobe font mangling: first 1024 bytes are XOR-ed with 16 bytes of book UUID.
+func ObfuscateAdobe(data []byte, uid string) ([]byte, error) {
+
+	key, err := hex.DecodeString(strings.ReplaceAll(strings.TrimPrefix(strings.TrimSpace(uid), "urn:uuid:"), "-", ""))
+	if err != nil || len(key) != 16 {
+		return nil, errors.New("adobe font obfuscation requires UUID as book identifier")
+	}
+	return xor(data, key, 1024), nil
+}
+
+func xor(data, key []byte, n int) []byte {
+	out := append([]byte(nil), data...)
+	for i := 0; i < n && i < len(out); i++ {
+		out[i] ^= key[i%len(key)]
+	}
+	return out
+}
@@ -0,0 +1,243 @@
+// Package fonts implements minimal TrueType/OpenType handling necessary to embed fonts into books.
+package fonts
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	versionTrueType = 0x00010000
+	versionApple    = 0x74727565 // 'true'
+	versionCFF      = 0x4f54544f // 'OTTO'
+
+	// head table offsets
+	headCheckSumAdjustment = 8
+	headIndexToLocFormat   = 50
+
+	// maxp table offsets
+	maxpNumGlyphs = 4
+
+	checkSumMagic = 0xB1B0AFBA
+)
+
+var errNotSupported = errors.New("font format is not supported")
+
+// sfnt is parsed font container - set of tables.
+type sfnt struct {
+	version uint32
+	tables  map[string][]byte
+}
+
+func parse(data []byte) (*sfnt, error) {
+
+	if len(data) < 12 {
+		return nil, errors.New("font file is too short")
+	}
+	f := &sfnt{version: binary.BigEndian.Uint32(data), tables: make(map[string][]byte)}
+	switch f.version {
+	case versionTrueType, versionApple, versionCFF:
+	default:
+		return nil, errNotSupported
+	}
+
+	num := int(binary.BigEndian.Uint16(data[4:]))
+	if len(data) < 12+num*16 {
+		return nil, errors.New("font table directory is truncated")
+	}
+	for i := 0; i < num; i++ {
+		rec := data[12+i*16:]
+		tag := string(rec[:4])
+		off, l := int(binary.BigEndian.Uint32(rec[8:])), int(binary.BigEndian.Uint32(rec[12:]))
+		if off < 0 || l < 0 || off+l > len(data) {
+			return nil, fmt.Errorf("font table %q is out of bounds", tag)
+		}
+		f.tables[tag] = data[off : off+l]
+	}
+	for _, tag := range []string{"head", "maxp", "cmap"} {
+		if _, ok := f.tables[tag]; !ok {
+			return nil, fmt.Errorf("font has no %q table", tag)
+		}
+	}
+	if len(f.tables["head"]) < 54 || len(f.tables["maxp"]) < 6 {
+		return nil, errors.New("font has malformed header tables")
+	}
+	return f, nil
+}
+
+func (f *sfnt) numGlyphs() int {
+	return int(binary.BigEndian.Uint16(f.tables["maxp"][maxpNumGlyphs:]))
+}
+
+func checkSum(data []byte) uint32 {
+	var sum uint32
+	for i := 0; i < len(data); i += 4 {
+		var b [4]byte
+		copy(b[:], data[i:])
+		sum += binary.BigEndian.Uint32(b[:])
+	}
+	return sum
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// bytes serializes font with properly recalculated table directory and checksums.
+func (f *sfnt) bytes() []byte {
+
+	tags := make([]string, 0, len(f.tables))
+	for tag := range f.tables {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	// head is always modified, make sure we are not touching original data
+	head := append([]byte(nil), f.tables["head"]...)
+	binary.BigEndian.PutUint32(head[headCheckSumAdjustment:], 0)
+	f.tables["head"] = head
+
+	num := len(tags)
+	size := 12 + num*16
+	for _, tag := range tags {
+		size += pad4(len(f.tables[tag]))
+	}
+	out := make([]byte, size)
+
+	sel := 0
+	for 1<<(sel+1) <= num {
+		sel++
+	}
+	binary.BigEndian.PutUint32(out, f.version)
+	binary.BigEndian.PutUint16(out[4:], uint16(num))
+	binary.BigEndian.PutUint16(out[6:], uint16((1<<sel)*16))
+	binary.BigEndian.PutUint16(out[8:], uint16(sel))
+	binary.BigEndian.PutUint16(out[10:], uint16(num*16-(1<<sel)*16))
+
+	off := 12 + num*16
+	var headOff int
+	for i, tag := range tags {
+		data := f.tables[tag]
+		rec := out[12+i*16:]
+		copy(rec, tag)
+		binary.BigEndian.PutUint32(rec[4:], checkSum(data))
+		binary.BigEndian.PutUint32(rec[8:], uint32(off))
+		binary.BigEndian.PutUint32(rec[12:], uint32(len(data)))
+		copy(out[off:], data)
+		if tag == "head" {
+			headOff = off
+		}
+		off += pad4(len(data))
+	}
+	binary.BigEndian.PutUint32(out[headOff+headCheckSumAdjustment:], checkSumMagic-checkSum(out))
+	return out
+}
+
+// cmapLookup returns function mapping characters to glyph indexes using best unicode subtable of cmap.
+func cmapLookup(cmap []byte) (func(rune) int, error) {
+
+	if len(cmap) < 4 {
+		return nil, errors.New("cmap table is too short")
+	}
+
+	var best, bestRank int
+	num := int(binary.BigEndian.Uint16(cmap[2:]))
+	for i := 0; i < num && 4+i*8+8 <= len(cmap); i++ {
+		rec := cmap[4+i*8:]
+		platform, encoding := binary.BigEndian.Uint16(rec), binary.BigEndian.Uint16(rec[2:])
+		off := int(binary.BigEndian.Uint32(rec[4:]))
+		if off+2 > len(cmap) {
+			continue
+		}
+		format := binary.BigEndian.Uint16(cmap[off:])
+		rank := 0
+		switch {
+		case format == 12 && (platform == 0 || (platform == 3 && encoding == 10)):
+			rank = 3
+		case format == 4 && (platform == 0 || (platform == 3 && encoding == 1)):
+			rank = 2
+		case format == 4 && platform == 3 && encoding == 0:
+			rank = 1
+		}
+		if rank > bestRank {
+			best, bestRank = off, rank
+		}
+	}
+
+	switch {
+	case bestRank == 0:
+		return nil, errors.New("font has no supported unicode cmap")
+	case bestRank == 3:
+		return cmapFormat12(cmap[best:])
+	default:
+		return cmapFormat4(cmap[best:])
+	}
+}
+
+func cmapFormat4(t []byte) (func(rune) int, error) {
+
+	if len(t) < 14 {
+		return nil, errors.New("cmap subtable is too short")
+	}
+	segs := int(binary.BigEndian.Uint16(t[6:])) / 2
+	ends, starts, deltas, ranges := 14, 16+segs*2, 16+segs*4, 16+segs*6
+	if len(t) < ranges+segs*2 {
+		return nil, errors.New("cmap subtable is truncated")
+	}
+	u16 := func(off int) int {
+		if off+2 > len(t) {
+			return 0
+		}
+		return int(binary.BigEndian.Uint16(t[off:]))
+	}
+
+	return func(r rune) int {
+		c := int(r)
+		if c > 0xFFFF {
+			return 0
+		}
+		for i := 0; i < segs; i++ {
+			if u16(ends+i*2) < c {
+				continue
+			}
+			start := u16(starts + i*2)
+			if start > c {
+				return 0
+			}
+			delta, ro := u16(deltas+i*2), u16(ranges+i*2)
+			if ro == 0 {
+				return (c + delta) & 0xFFFF
+			}
+			if g := u16(ranges + i*2 + ro + (c-start)*2); g != 0 {
+				return (g + delta) & 0xFFFF
+			}
+			return 0
+		}
+		return 0
+	}, nil
+}
+
+func cmapFormat12(t []byte) (func(rune) int, error) {
+
+	if len(t) < 16 {
+		return nil, errors.New("cmap subtable is too short")
+	}
+	num := int(binary.BigEndian.Uint32(t[12:]))
+	if len(t) < 16+num*12 {
+		return nil, errors.New("cmap subtable is truncated")
+	}
+
+	return func(r rune) int {
+		c := uint32(r)
+		for i := 0; i < num; i++ {
+			g := t[16+i*12:]
+			start, end := binary.BigEndian.Uint32(g), binary.BigEndian.Uint32(g[4:])
+			if c >= start && c <= end {
+				return int(binary.BigEndian.Uint32(g[8:]) + c - start)
+			}
+		}
+		return 0
+	}, nil
+}
@@ -0,0 +1,445 @@
+package fonts
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// tables which become invalid or dangerous after glyphs removal
+var droppedTables = []string{
+	"DSIG", // signature no longer matches
+	"GSUB", // substitutions may reference removed glyphs
+	"morx", // same for AAT
+	"mort",
+}
+
+// Subset removes outlines of all glyphs not necessary to render specified characters. Glyph indexes are preserved, so
+// all other tables stay valid. Glyph substitutions (ligatures, alternates) are dropped. CID-keyed CFF fonts are not
+// supported.
+func Subset(data []byte, chars map[rune]bool) ([]byte, error) {
+
+	f, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	lookup, err := cmapLookup(f.tables["cmap"])
+	if err != nil {
+		return nil, err
+	}
+
+	num := f.numGlyphs()
+	keep := make([]bool, num)
+	if num > 0 {
+		keep[0] = true // .notdef
+	}
+	for c := range chars {
+		g := lookup(c)
+		if g == 0 && c < 0x100 {
+			// symbol fonts
+			g = lookup(0xF000 + c)
+		}
+		if g > 0 && g < num {
+			keep[g] = true
+		}
+	}
+
+	switch {
+	case f.tables["glyf"] != nil && f.tables["loca"] != nil:
+		err = subsetGlyf(f, keep)
+	case f.tables["CFF "] != nil:
+		err = subsetCFF(f, keep)
+	default:
+		err = errNotSupported
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tag := range droppedTables {
+		delete(f.tables, tag)
+	}
+	return f.bytes(), nil
+}
+
+// composite glyph flags
+const (
+	argsAreWords   = 0x0001
+	haveScale      = 0x0008
+	moreComponents = 0x0020
+	haveXYScale    = 0x0040
+	have2x2        = 0x0080
+)
+
+func subsetGlyf(f *sfnt, keep []bool) error {
+
+	glyf, loca := f.tables["glyf"], f.tables["loca"]
+	num := len(keep)
+
+	long := binary.BigEndian.Uint16(f.tables["head"][headIndexToLocFormat:]) != 0
+	offsets := make([]int, num+1)
+	for i := range offsets {
+		switch {
+		case long && (i+1)*4 <= len(loca):
+			offsets[i] = int(binary.BigEndian.Uint32(loca[i*4:]))
+		case !long && (i+1)*2 <= len(loca):
+			offsets[i] = int(binary.BigEndian.Uint16(loca[i*2:])) * 2
+		default:
+			return errors.New("font loca table is truncated")
+		}
+	}
+	glyph := func(g int) []byte {
+		b, e := offsets[g], offsets[g+1]
+		if b >= e || e > len(glyf) {
+			return nil
+		}
+		return glyf[b:e]
+	}
+
+	// add components of composite glyphs
+	queue := make([]int, 0, num)
+	for g, k := range keep {
+		if k {
+			queue = append(queue, g)
+		}
+	}
+	for len(queue) > 0 {
+		g := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+
+		data := glyph(g)
+		if len(data) < 10 || int16(binary.BigEndian.Uint16(data)) >= 0 {
+			continue
+		}
+		for pos := 10; pos+4 <= len(data); {
+			flags := binary.BigEndian.Uint16(data[pos:])
+			c := int(binary.BigEndian.Uint16(data[pos+2:]))
+			if c < num && !keep[c] {
+				keep[c] = true
+				queue = append(queue, c)
+			}
+			pos += 4
+			if flags&argsAreWords != 0 {
+				pos += 4
+			} else {
+				pos += 2
+			}
+			switch {
+			case flags&haveScale != 0:
+				pos += 2
+			case flags&haveXYScale != 0:
+				pos += 4
+			case flags&have2x2 != 0:
+				pos += 8
+			}
+			if flags&moreComponents == 0 {
+				break
+			}
+		}
+	}
+
+	var newGlyf []byte
+	newLoca := make([]byte, (num+1)*4)
+	for g := 0; g < num; g++ {
+		binary.BigEndian.PutUint32(newLoca[g*4:], uint32(len(newGlyf)))
+		if keep[g] {
+			newGlyf = append(newGlyf, glyph(g)...)
+			for len(newGlyf)%4 != 0 {
+				newGlyf = append(newGlyf, 0)
+			}
+		}
+	}
+	binary.BigEndian.PutUint32(newLoca[num*4:], uint32(len(newGlyf)))
+
+	head := append([]byte(nil), f.tables["head"]...)
+	binary.BigEndian.PutUint16(head[headIndexToLocFormat:], 1)
+	f.tables["head"], f.tables["glyf"], f.tables["loca"] = head, newGlyf, newLoca
+	return nil
+}
+
+// CFF operators referencing offsets from the beginning of CFF data
+const (
+	cffCharset     = 15
+	cffEncoding    = 16
+	cffCharStrings = 17
+	cffPrivate     = 18
+	cffROS         = 1230
+	cffFDArray     = 1236
+	cffFDSelect    = 1237
+
+	cffEndChar = 14
+)
+
+type cffOperand struct {
+	raw []byte
+	val int
+	num bool // integer value
+}
+
+type cffEntry struct {
+	op       int
+	operands []cffOperand
+}
+
+// cffIndex returns items of CFF INDEX structure starting at pos and position right after it.
+func cffIndex(data []byte, pos int) ([][]byte, int, error) {
+
+	if pos+2 > len(data) {
+		return nil, 0, errors.New("CFF index is out of bounds")
+	}
+	count := int(binary.BigEndian.Uint16(data[pos:]))
+	if count == 0 {
+		return nil, pos + 2, nil
+	}
+	if pos+3 > len(data) {
+		return nil, 0, errors.New("CFF index is out of bounds")
+	}
+	offSize := int(data[pos+2])
+	if offSize < 1 || offSize > 4 || pos+3+(count+1)*offSize > len(data) {
+		return nil, 0, errors.New("CFF index is malformed")
+	}
+	offset := func(i int) int {
+		var v int
+		for _, b := range data[pos+3+i*offSize : pos+3+(i+1)*offSize] {
+			v = v<<8 | int(b)
+		}
+		return v
+	}
+	base := pos + 3 + (count+1)*offSize - 1
+	items := make([][]byte, count)
+	for i := range items {
+		b, e := base+offset(i), base+offset(i+1)
+		if b > e || e > len(data) {
+			return nil, 0, errors.New("CFF index item is out of bounds")
+		}
+		items[i] = data[b:e]
+	}
+	return items, base + offset(count), nil
+}
+
+func writeCFFIndex(items [][]byte) []byte {
+
+	if len(items) == 0 {
+		return []byte{0, 0}
+	}
+	total := 1
+	for _, it := range items {
+		total += len(it)
+	}
+	offSize := 1
+	for total >= 1<<(8*offSize) {
+		offSize++
+	}
+
+	out := make([]byte, 3, 3+(len(items)+1)*offSize+total)
+	binary.BigEndian.PutUint16(out, uint16(len(items)))
+	out[2] = byte(offSize)
+	put := func(v int) {
+		for i := offSize - 1; i >= 0; i-- {
+			out = append(out, byte(v>>(8*i)))
+		}
+	}
+	off := 1
+	put(off)
+	for _, it := range items {
+		off += len(it)
+		put(off)
+	}
+	for _, it := range items {
+		out = append(out, it...)
+	}
+	return out
+}
+
+func parseCFFDict(data []byte) ([]cffEntry, error) {
+
+	var (
+		res      []cffEntry
+		operands []cffOperand
+	)
+	for i := 0; i < len(data); {
+		b := int(data[i])
+		switch {
+		case b <= 21:
+			op := b
+			i++
+			if b == 12 {
+				if i >= len(data) {
+					return nil, errors.New("CFF dict is truncated")
+				}
+				op = 1200 + int(data[i])
+				i++
+			}
+			res = append(res, cffEntry{op: op, operands: operands})
+			operands = nil
+			continue
+		case b == 28:
+			if i+3 > len(data) {
+				return nil, errors.New("CFF dict is truncated")
+			}
+			operands = append(operands, cffOperand{raw: data[i : i+3], val: int(int16(binary.BigEndian.Uint16(data[i+1:]))), num: true})
+			i += 3
+		case b == 29:
+			if i+5 > len(data) {
+				return nil, errors.New("CFF dict is truncated")
+			}
+			operands = append(operands, cffOperand{raw: data[i : i+5], val: int(int32(binary.BigEndian.Uint32(data[i+1:]))), num: true})
+			i += 5
+		case b == 30:
+			j := i + 1
+			for ; j < len(data); j++ {
+				if data[j]&0x0F == 0x0F || data[j]&0xF0 == 0xF0 {
+					break
+				}
+			}
+			if j >= len(data) {
+				return nil, errors.New("CFF dict is truncated")
+			}
+			operands = append(operands, cffOperand{raw: data[i : j+1]})
+			i = j + 1
+		case b >= 32 && b <= 246:
+			operands = append(operands, cffOperand{raw: data[i : i+1], val: b - 139, num: true})
+			i++
+		case b >= 247 && b <= 254:
+			if i+2 > len(data) {
+				return nil, errors.New("CFF dict is truncated")
+			}
+			v := (b-247)*256 + int(data[i+1]) + 108
+			if b >= 251 {
+				v = -(b-251)*256 - int(data[i+1]) - 108
+			}
+			operands = append(operands, cffOperand{raw: data[i : i+2], val: v, num: true})
+			i += 2
+		default:
+			return nil, fmt.Errorf("CFF dict has unexpected byte %d", b)
+		}
+	}
+	return res, nil
+}
+
+func writeCFFDict(entries []cffEntry) []byte {
+	var out []byte
+	for _, e := range entries {
+		for _, o := range e.operands {
+			out = append(out, o.raw...)
+		}
+		if e.op >= 1200 {
+			out = append(out, 12, byte(e.op-1200))
+		} else {
+			out = append(out, byte(e.op))
+		}
+	}
+	return out
+}
+
+func cffInt32(v int) cffOperand {
+	raw := make([]byte, 5)
+	raw[0] = 29
+	binary.BigEndian.PutUint32(raw[1:], uint32(int32(v)))
+	return cffOperand{raw: raw, val: v, num: true}
+}
+
+func subsetCFF(f *sfnt, keep []bool) error {
+
+	data := f.tables["CFF "]
+	if len(data) < 4 {
+		return errors.New("CFF table is too short")
+	}
+	hdrSize := int(data[2])
+
+	_, topStart, err := cffIndex(data, hdrSize)
+	if err != nil {
+		return err
+	}
+	tops, stringsStart, err := cffIndex(data, topStart)
+	if err != nil {
+		return err
+	}
+	if len(tops) != 1 {
+		return errNotSupported
+	}
+	_, gsubrStart, err := cffIndex(data, stringsStart)
+	if err != nil {
+		return err
+	}
+	_, restStart, err := cffIndex(data, gsubrStart)
+	if err != nil {
+		return err
+	}
+
+	top, err := parseCFFDict(tops[0])
+	if err != nil {
+		return err
+	}
+	cs := -1
+	for _, e := range top {
+		switch e.op {
+		case cffROS, cffFDArray, cffFDSelect:
+			return errNotSupported
+		case cffCharStrings:
+			if len(e.operands) == 1 && e.operands[0].num {
+				cs = e.operands[0].val
+			}
+		}
+	}
+	if cs < restStart {
+		return errors.New("CFF has no charstrings")
+	}
+	glyphs, csEnd, err := cffIndex(data, cs)
+	if err != nil {
+		return err
+	}
+
+	subset := make([][]byte, len(glyphs))
+	for g, gd := range glyphs {
+		if g < len(keep) && keep[g] {
+			subset[g] = gd
+		} else {
+			subset[g] = []byte{cffEndChar}
+		}
+	}
+	newCS := writeCFFIndex(subset)
+
+	// re-encode all offsets with fixed size so new top dict size does not depend on their values
+	relocate := func(delta int) []byte {
+		move := func(o int) int {
+			switch {
+			case o >= csEnd:
+				return o + delta + len(newCS) - (csEnd - cs)
+			default:
+				return o + delta
+			}
+		}
+		entries := make([]cffEntry, len(top))
+		for i, e := range top {
+			entries[i] = cffEntry{op: e.op, operands: append([]cffOperand(nil), e.operands...)}
+			ops := entries[i].operands
+			switch e.op {
+			case cffCharset, cffEncoding:
+				// 0, 1 and 2 are predefined tables
+				if len(ops) == 1 && ops[0].num && ops[0].val > 2 {
+					ops[0] = cffInt32(move(ops[0].val))
+				}
+			case cffCharStrings:
+				ops[0] = cffInt32(move(ops[0].val))
+			case cffPrivate:
+				if len(ops) == 2 && ops[1].num {
+					ops[1] = cffInt32(move(ops[1].val))
+				}
+			}
+		}
+		return writeCFFIndex([][]byte{writeCFFDict(entries)})
+	}
+	delta := len(relocate(0)) - (stringsStart - topStart)
+	newTop := relocate(delta)
+
+	out := make([]byte, 0, len(data)+delta+len(newCS)-(csEnd-cs))
+	out = append(out, data[:topStart]...)
+	out = append(out, newTop...)
+	out = append(out, data[stringsStart:cs]...)
+	out = append(out, newCS...)
+	out = append(out, data[csEnd:]...)
+	f.tables["CFF "] = out
+	return nil
+}
@@ -0,0 +1,273 @@
+package mobi
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// rec0 offset of full book name length, name offset is titleOffset
+	titleLength = 88
+
+	// exth records with book meta information
+	exthAuthor       = 100
+	exthDescription  = 103
+	exthSubject      = 105
+	exthPubDate      = 106
+	exthUpdatedTitle = 503
+	exthLanguage     = 524
+
+	// exth records used for sorting (title and creator pronunciation)
+	exthTitleSort  = 508
+	exthAuthorSort = 517
+)
+
+// SortMeta - book meta information used by Kindle for sorting. Kindle has no EXTH records for series, so series is
+// not stored here and does not change the sort order.
+type SortMeta struct {
+	TitleSort  string
+	AuthorSort string
+}
+
+// addExth replaces sorting records in rec0.
+func (m *SortMeta) addExth(rec0 []byte) []byte {
+
+	if m == nil {
+		return rec0
+	}
+	for _, r := range []struct {
+		num   int
+		value string
+	}{
+		{exthTitleSort, m.TitleSort},
+		{exthAuthorSort, m.AuthorSort},
+	} {
+		if len(r.value) == 0 {
+			continue
+		}
+		rec0 = addExth(delExth(rec0, r.num), r.num, []byte(r.value))
+	}
+	return rec0
+}
+
+// Meta - mobi book meta information.
+type Meta struct {
+	Title       string
+	Authors     []string
+	Subjects    []string
+	Language    string
+	Description string
+	Date        string
+	ASIN        string
+	CDEType     string
+	CDEKey      string
+	Encrypted   bool
+}
+
+// ThumbnailName returns name of the thumbnail file Kindle looks for or empty string if book has no ASIN.
+func (m *Meta) ThumbnailName() string {
+	return thumbnailName([]byte(m.ASIN), []byte(m.CDEKey), []byte(m.CDEType))
+}
+
+// Displayable reports if Kindle will show thumbnail for the book.
+func (m *Meta) Displayable() bool {
+	return thumbnailMetaOK([]byte(m.ASIN), []byte(m.CDEKey), []byte(m.CDEType))
+}
+
+// ReadMeta reads meta information from mobi file. When book has KF8 part its meta information is preferred.
+func ReadMeta(fname string) (*Meta, error) {
+
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	rec0, kfrec0 := readSection(data, 0), readKF8Rec0(data)
+	asin, cdetype, cdekey := mergeThumbnailMeta(rec0, kfrec0)
+	encrypted := getUInt16(rec0, cryptoType) != 0
+	if len(kfrec0) > 0 {
+		rec0 = kfrec0
+	}
+
+	first := func(id int) string {
+		if v := readExth(rec0, id); len(v) > 0 {
+			return strings.TrimSpace(string(v[0]))
+		}
+		return ""
+	}
+	all := func(id int) []string {
+		var res []string
+		for _, v := range readExth(rec0, id) {
+			if s := strings.TrimSpace(string(v)); len(s) > 0 {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+
+	m := &Meta{
+		Title:       first(exthUpdatedTitle),
+		Authors:     all(exthAuthor),
+		Subjects:    all(exthSubject),
+		Language:    first(exthLanguage),
+		Description: first(exthDescription),
+		Date:        first(exthPubDate),
+		ASIN:        strings.TrimSpace(string(asin)),
+		CDEType:     strings.TrimSpace(string(cdetype)),
+		CDEKey:      strings.TrimSpace(string(cdekey)),
+		Encrypted:   encrypted,
+	}
+	if len(m.Title) == 0 {
+		if ofs, l := getInt32(rec0, titleOffset), getInt32(rec0, titleLength); ofs > 0 && l > 0 && ofs+l <= len(rec0) {
+			m.Title = strings.TrimSpace(string(rec0[ofs : ofs+l]))
+		}
+	}
+	return m, nil
+}
+
+// readKF8Rec0 returns record 0 of KF8 part of combo book or nil.
+func readKF8Rec0(data []byte) []byte {
+
+	kf8off := readExth(readSection(data, 0), exthKF8Offset)
+	if len(kf8off) == 0 {
+		return nil
+	}
+	// only pay attention to first KF8 offfset - there should only be one
+	if kf8 := getInt32(kf8off[0], 0); kf8 >= 0 {
+		return readSection(data, kf8)
+	}
+	return nil
+}
+
+// readThumbnailMeta returns book identification used by Kindle to find thumbnail.
+func readThumbnailMeta(rec0 []byte) (asin, cdetype, cdekey []byte) {
+
+	if v := readExth(rec0, exthASIN); len(v) > 0 {
+		asin = v[0]
+	}
+	if v := readExth(rec0, exthCDEType); len(v) > 0 {
+		cdetype = v[0]
+	}
+	if v := readExth(rec0, exthCDEContentKey); len(v) > 0 {
+		cdekey = v[0]
+	}
+	return
+}
+
+// mergeThumbnailMeta returns book identification always preferring data from KF8 part.
+func mergeThumbnailMeta(rec0, kfrec0 []byte) (asin, cdetype, cdekey []byte) {
+
+	asin, cdetype, cdekey = readThumbnailMeta(rec0)
+	if len(kfrec0) == 0 {
+		return
+	}
+	kasin, kcdetype, kcdekey := readThumbnailMeta(kfrec0)
+	if len(kasin) > 0 {
+		asin = kasin
+	}
+	if len(kcdetype) > 0 {
+		cdetype = kcdetype
+	}
+	if len(kcdekey) > 0 {
+		cdekey = kcdekey
+	}
+	return
+}
+
+// thumbnailName returns name of the thumbnail file for the book, content key takes precedence over ASIN.
+func thumbnailName(asin, cdekey, cdetype []byte) string {
+
+	id := asin
+	if len(cdekey) > 0 {
+		id = cdekey
+	}
+	if len(id) == 0 {
+		return ""
+	}
+	return "thumbnail_" + string(id) + "_" + string(cdetype) + "_portrait.jpg"
+}
+
+// thumbnailMetaOK checks book identification: Kindle only shows thumbnails for sideloaded books marked as EBOK which
+// have ASIN matching content key.
+func thumbnailMetaOK(asin, cdekey, cdetype []byte) bool {
+	if string(cdetype) != "EBOK" || len(asin) == 0 {
+		return false
+	}
+	return len(cdekey) == 0 || string(cdekey) == string(asin)
+}
+
+// fixThumbnailExth replaces book identification records in rec0.
+func fixThumbnailExth(rec0, id []byte) []byte {
+	for _, r := range []struct {
+		num   int
+		value []byte
+	}{
+		{exthCDEType, []byte("EBOK")},
+		{exthASIN, id},
+		{exthCDEContentKey, id},
+	} {
+		for len(readExth(rec0, r.num)) > 0 {
+			rec0 = delExth(rec0, r.num)
+		}
+		rec0 = addExth(rec0, r.num, r.value)
+	}
+	return rec0
+}
+
+// FixThumbnailMeta makes sure Kindle will show thumbnail for the book: it marks book as EBOK and sets both ASIN and
+// content key to the same value (existing content key or ASIN are kept, new one is generated from book content). Book
+// file is replaced only when changes are necessary, encrypted books are never touched. Returns true if book was changed.
+func FixThumbnailMeta(fname string) (bool, error) {
+
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return false, err
+	}
+
+	rec0, kfrec0 := readSection(data, 0), readKF8Rec0(data)
+	if getUInt16(rec0, cryptoType) != 0 {
+		return false, fmt.Errorf("encrypted book")
+	}
+	asin, cdetype, cdekey := mergeThumbnailMeta(rec0, kfrec0)
+	if thumbnailMetaOK(asin, cdekey, cdetype) {
+		return false, nil
+	}
+
+	id := cdekey
+	if len(id) == 0 {
+		id = asin
+	}
+	if len(id) == 0 {
+		// 48 bits make 10 characters, same as real ASIN
+		sum := md5.Sum(data)
+		id = convertToRadix32(hex.EncodeToString(sum[:6]), 10)
+	}
+
+	if len(kfrec0) > 0 {
+		kf8 := getInt32(readExth(rec0, exthKF8Offset)[0], 0)
+		data = writeSection(data, kf8, fixThumbnailExth(kfrec0, id))
+	}
+	data = writeSection(data, 0, fixThumbnailExth(rec0, id))
+
+	// do not leave partially written book on device
+	tmp, err := os.CreateTemp(filepath.Dir(fname), filepath.Base(fname)+".*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp.Name(), fname); err != nil {
+		return false, err
+	}
+	return true, nil
+}
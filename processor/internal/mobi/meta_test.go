@@ -0,0 +1,124 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// minimalRec0 returns record 0 with mobi header followed by empty EXTH header and title.
+func minimalRec0() []byte {
+
+	const headerLen = 232
+	ebase := mobiHeaderBase + headerLen
+	rec0 := make([]byte, ebase+12)
+	binary.BigEndian.PutUint32(rec0[mobiHeaderLength:], headerLen)
+	copy(rec0[ebase:], "EXTH")
+	binary.BigEndian.PutUint32(rec0[ebase+4:], 12)
+	binary.BigEndian.PutUint32(rec0[titleOffset:], uint32(len(rec0)))
+	return append(rec0, "Title"...)
+}
+
+func TestSortMeta(t *testing.T) {
+
+	rec0 := minimalRec0()
+
+	m := &SortMeta{TitleSort: "Book, The", AuthorSort: "Last, First"}
+	// applying twice must not duplicate records
+	rec0 = m.addExth(m.addExth(rec0))
+
+	if v := readExth(rec0, exthTitleSort); len(v) != 1 || string(v[0]) != "Book, The" {
+		t.Errorf("unexpected title sort %q", v)
+	}
+	if v := readExth(rec0, exthAuthorSort); len(v) != 1 || string(v[0]) != "Last, First" {
+		t.Errorf("unexpected author sort %q", v)
+	}
+	if ofs := getInt32(rec0, titleOffset); string(rec0[ofs:]) != "Title" {
+		t.Errorf("title offset was not updated, got %q", rec0[ofs:])
+	}
+}
+
+func TestThumbnailMeta(t *testing.T) {
+
+	rec0 := addExth(addExth(minimalRec0(), exthCDEType, []byte("PDOC")), exthASIN, []byte("B000000001"))
+	rec0 = addExth(rec0, exthASIN, []byte("B000000002"))
+
+	asin, cdetype, cdekey := readThumbnailMeta(rec0)
+	if thumbnailMetaOK(asin, cdekey, cdetype) {
+		t.Error("personal document must not be displayable")
+	}
+	if name := thumbnailName(asin, cdekey, cdetype); name != "thumbnail_B000000002_PDOC_portrait.jpg" {
+		t.Errorf("unexpected thumbnail name %q", name)
+	}
+
+	rec0 = fixThumbnailExth(rec0, asin)
+	asin, cdetype, cdekey = readThumbnailMeta(rec0)
+	if !thumbnailMetaOK(asin, cdekey, cdetype) {
+		t.Errorf("book is not displayable after fix: %q %q %q", asin, cdetype, cdekey)
+	}
+	if v := readExth(rec0, exthASIN); len(v) != 1 {
+		t.Errorf("duplicate ASIN records were not removed: %q", v)
+	}
+	if ofs := getInt32(rec0, titleOffset); string(rec0[ofs:]) != "Title" {
+		t.Errorf("title offset was not updated, got %q", rec0[ofs:])
+	}
+}
+
+// makePDB returns book file with requested records.
+func makePDB(records ...[]byte) []byte {
+
+	var buf bytes.Buffer
+	buf.Write(make([]byte, numberOfPdbRecords))
+	binary.Write(&buf, binary.BigEndian, uint16(len(records)))
+	ofs := firstPdbRecord + 8*len(records)
+	for i, r := range records {
+		binary.Write(&buf, binary.BigEndian, uint32(ofs))
+		binary.Write(&buf, binary.BigEndian, uint32(2*i))
+		ofs += len(r)
+	}
+	for _, r := range records {
+		buf.Write(r)
+	}
+	return buf.Bytes()
+}
+
+func TestFixThumbnailMeta(t *testing.T) {
+
+	fname := filepath.Join(t.TempDir(), "book.mobi")
+	rec0 := addExth(minimalRec0(), exthCDEType, []byte("PDOC"))
+	if err := os.WriteFile(fname, makePDB(rec0, []byte("text")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []bool{true, false} {
+		fixed, err := FixThumbnailMeta(fname)
+		if err != nil {
+			t.Fatalf("pass %d: %v", i, err)
+		}
+		if fixed != expected {
+			t.Errorf("pass %d: expected fixed %v, got %v", i, expected, fixed)
+		}
+	}
+
+	m, err := ReadMeta(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Displayable() || len(m.ASIN) != 10 || m.ASIN != m.CDEKey {
+		t.Errorf("unexpected meta after fix: %+v", m)
+	}
+	data, _ := os.ReadFile(fname)
+	if s := readSection(data, 1); string(s) != "text" {
+		t.Errorf("book content damaged: %q", s)
+	}
+
+	binary.BigEndian.PutUint16(rec0[cryptoType:], 1)
+	if err := os.WriteFile(fname, makePDB(rec0, []byte("text")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if fixed, err := FixThumbnailMeta(fname); fixed || err == nil {
+		t.Error("encrypted book must not be changed")
+	}
+}
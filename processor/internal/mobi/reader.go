@@ -24,6 +24,7 @@ type Reader struct {
 	cdetype   []byte
 	cdekey    []byte
 	thumbnail []byte
+	encrypted bool
 }
 
 // NewReader returns pointer to Reader with parsed mobi file.
@@ -48,16 +49,13 @@ func (r *Reader) SaveResult(dir string) (bool, error) {
 		return false, nil
 	}
 
-	asin := string(r.asin)
-	if len(r.cdekey) > 0 {
-		asin = string(r.cdekey)
-	}
-	if len(asin) == 0 {
+	name := r.ThumbnailName()
+	if len(name) == 0 {
 		r.log.Debug("Nothing to save - document has no ASIN", zap.String("file", r.fname))
 		return false, nil
 	}
 
-	fname := filepath.Join(dir, "thumbnail_"+asin+"_"+string(r.cdetype)+"_portrait.jpg")
+	fname := filepath.Join(dir, name)
 	if _, err := os.Stat(fname); err == nil {
 		r.log.Debug("Overwriting existing thumbnail", zap.String("file", r.fname), zap.String("thumb", fname))
 	}
@@ -66,33 +64,39 @@ func (r *Reader) SaveResult(dir string) (bool, error) {
 		return false, err
 	}
 
-	r.log.Debug("Thumbnail created", zap.String("ASIN", asin), zap.String("file", r.fname), zap.String("thumb", fname))
+	r.log.Debug("Thumbnail created", zap.String("file", r.fname), zap.String("thumb", fname))
 	return true, nil
 }
 
+// ThumbnailName returns name of the thumbnail file Kindle looks for or empty string if book has no ASIN.
+func (r *Reader) ThumbnailName() string {
+	return thumbnailName(r.asin, r.cdekey, r.cdetype)
+}
+
+// Displayable reports if Kindle will show thumbnail for the book: sideloaded book must be marked as EBOK and have
+// ASIN, which matches content key when both are present.
+func (r *Reader) Displayable() bool {
+	return thumbnailMetaOK(r.asin, r.cdekey, r.cdetype)
+}
+
+// Encrypted reports if book is protected by DRM, such books are never changed.
+func (r *Reader) Encrypted() bool {
+	return r.encrypted
+}
+
 func (r *Reader) produceThumbnail(data []byte) {
 
 	rec0 := readSection(data, 0)
 
+	// identification is always available, even for encrypted books
+	r.asin, r.cdetype, r.cdekey = mergeThumbnailMeta(rec0, readKF8Rec0(data))
+
 	if getUInt16(rec0, cryptoType) != 0 {
 		r.log.Debug("Encrypted book", zap.String("file", r.fname))
+		r.encrypted = true
 		return
 	}
 
-	var (
-		kf8    int
-		kfrec0 []byte
-	)
-
-	kf8off := readExth(rec0, exthKF8Offset)
-	if len(kf8off) > 0 {
-		// only pay attention to first KF8 offfset - there should only be one
-		if kf8 = getInt32(kf8off[0], 0); kf8 >= 0 {
-			kfrec0 = readSection(data, kf8)
-		}
-	}
-	combo := len(kfrec0) > 0 && kf8 >= 0
-
 	// save ACR
 	const alphabet = `- ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789`
 	r.acr = bytes.Map(func(sym rune) rune {
@@ -105,19 +109,6 @@ func (r *Reader) produceThumbnail(data []byte) {
 		return '_'
 	}, data[0:32])
 
-	exth := readExth(rec0, exthASIN)
-	if len(exth) > 0 {
-		r.asin = exth[0]
-	}
-	exth = readExth(rec0, exthCDEType)
-	if len(exth) > 0 {
-		r.cdetype = exth[0]
-	}
-	exth = readExth(rec0, exthCDEContentKey)
-	if len(exth) > 0 {
-		r.cdekey = exth[0]
-	}
-
 	firstimage := getInt32(rec0, firstRescRecord)
 	exthCover := readExth(rec0, exthCoverOffset)
 	coverIndex := -1
@@ -178,19 +169,4 @@ func (r *Reader) produceThumbnail(data []byte) {
 		}
 	}
 
-	if combo {
-		// always prefer data from KF8
-		exth = readExth(kfrec0, exthASIN)
-		if len(exth) > 0 {
-			r.asin = exth[0]
-		}
-		exth = readExth(kfrec0, exthCDEType)
-		if len(exth) > 0 {
-			r.cdetype = exth[0]
-		}
-		exth = readExth(kfrec0, exthCDEContentKey)
-		if len(exth) > 0 {
-			r.cdekey = exth[0]
-		}
-	}
 }
@@ -25,6 +25,7 @@ import (
 type Splitter struct {
 	log   *zap.Logger
 	combo bool
+	meta  *SortMeta
 	//
 	contentGUID string
 	acr         []byte
@@ -35,8 +36,9 @@ type Splitter struct {
 	result      []byte
 }
 
-// NewSplitter returns pointer to Slitter with parsed mobi file.
-func NewSplitter(fname string, u uuid.UUID, asin string, combo, nonPersonal, forceASIN bool, log *zap.Logger) (*Splitter, error) {
+// NewSplitter returns pointer to Slitter with parsed mobi file. When meta is not nil sorting records are added to
+// resulting book.
+func NewSplitter(fname string, u uuid.UUID, asin string, combo, nonPersonal, forceASIN bool, meta *SortMeta, log *zap.Logger) (*Splitter, error) {
 
 	data, err := os.ReadFile(fname)
 	if err != nil {
@@ -46,6 +48,7 @@ func NewSplitter(fname string, u uuid.UUID, asin string, combo, nonPersonal, for
 	s := &Splitter{
 		log:         log,
 		combo:       combo,
+		meta:        meta,
 		contentGUID: strings.Replace(u.String(), "-", "", -1)[:8],
 	}
 
@@ -165,7 +168,7 @@ func (s *Splitter) produceCombo(data []byte, u []byte, nonPersonal bool) {
 			rec0 = addExth(rec0, exthASIN, s.asin)
 		}
 	}
-	result = writeSection(result, 0, rec0)
+	result = writeSection(result, 0, s.meta.addExth(rec0))
 
 	// Only keep the correct Start Reading offset, KG 2.5 carries over the one from the mobi7 part, which then
 	// points at garbage in the mobi8 part, and confuses FW 3.4
@@ -245,7 +248,7 @@ func (s *Splitter) produceCombo(data []byte, u []byte, nonPersonal bool) {
 	} else {
 		s.cdetype = []byte("PDOC")
 	}
-	s.result = writeSection(result, kf8, kfrec0)
+	s.result = writeSection(result, kf8, s.meta.addExth(kfrec0))
 
 	s.processPageData(pdata)
 }
@@ -436,7 +439,7 @@ func (s *Splitter) produceKF8(data []byte, u []byte, nonPersonal, forceASIN bool
 			kfrec0 = addExth(kfrec0, exthASIN, s.cdekey)
 		}
 	}
-	s.result = writeSection(result, 0, kfrec0)
+	s.result = writeSection(result, 0, s.meta.addExth(kfrec0))
 
 	s.processPageData(pdata)
 }
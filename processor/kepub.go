@@ -0,0 +1,148 @@
+package processor
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"fb2converter/etree"
+)
+
+// Kobo style hooks are inserted directly into content documents, so they are present even when custom stylesheet is
+// used and there is no need for kobo.js.
+const koboStyleHacks = `div#book-inner { margin-top: 0; margin-bottom: 0;}`
+
+var (
+	// sentence is terminated by punctuation, possibly followed by closing quotes or brackets, and white space
+	koboSentencePattern = regexp.MustCompile(`(?s).*?[.!?…]+['"”’»)\]]*\s+`)
+	// text following these elements starts new Kobo paragraph
+	koboParagraphs = map[string]bool{
+		"p": true, "ol": true, "ul": true, "table": true,
+		"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	}
+	// content of these elements is left as is
+	koboSkip = map[string]bool{"svg": true, "math": true, "script": true, "style": true}
+)
+
+// KepubifyXHTML inserts Kobo specific formatting into results.
+func (p *Processor) KepubifyXHTML() error {
+
+	if p.format != OKepub {
+		return nil
+	}
+
+	for _, f := range p.Book.Files {
+		if f.ct == "application/xhtml+xml" && filepath.Ext(f.fname) == ".xhtml" && f.doc != nil {
+			if head := f.doc.FindElement("./html/head"); head != nil {
+				head.AddNext("style", attr("type", "text/css"), attr("class", "kobostylehacks")).SetText(koboStyleHacks)
+			}
+			if body := f.doc.FindElement("./html/body"); body != nil {
+				p.insertKoboSpans(body, &koboCounter{newParagraph: true})
+				to := etree.NewElement("div")
+				to.CreateAttr("id", "book-columns")
+				inner := to.AddNext("div", attr("id", "book-inner"))
+				children := body.ChildElements()
+				for i := 0; i < len(children); i++ {
+					inner.AddChild(body.RemoveChild(children[i]))
+				}
+				body.AddChild(to)
+			}
+		}
+	}
+	return nil
+}
+
+// koboCounter keeps paragraph and sentence numbers for Kobo spans, numbering starts anew in every content file.
+type koboCounter struct {
+	paragraph    int
+	sentence     int
+	newParagraph bool
+}
+
+// next returns id for the next Kobo span.
+func (c *koboCounter) next() string {
+	if c.newParagraph {
+		c.paragraph++
+		c.sentence = 0
+		c.newParagraph = false
+	}
+	c.sentence++
+	return fmt.Sprintf("kobo.%d.%d", c.paragraph, c.sentence)
+}
+
+// insertKoboSpans wraps every sentence of the text in the element and its descendants (including tails) into Kobo span
+// with "kobo.<paragraph>.<sentence>" id and gives every image span of its own. Device uses spans for reading
+// statistics, highlights and bookmarks.
+func (p *Processor) insertKoboSpans(e *etree.Element, cnt *koboCounter) {
+
+	children := e.Child
+	e.Child = nil
+	for _, t := range children {
+		switch v := t.(type) {
+		case *etree.CharData:
+			p.addKoboText(e, v.Data, cnt)
+		case *etree.Element:
+			// tail belongs to the parent
+			tail := v.TailData
+			v.TailData = ""
+			switch {
+			case koboSkip[v.Tag] || (v.Tag == "span" && getAttrValue(v, "class") == "koboSpan"):
+				e.AddChild(v)
+			case v.Tag == "img":
+				cnt.newParagraph = true
+				e.AddNext("span", attr("class", "koboSpan"), attr("id", cnt.next())).AddChild(v)
+				cnt.newParagraph = true
+			default:
+				if koboParagraphs[v.Tag] {
+					cnt.newParagraph = true
+				}
+				e.AddChild(v)
+				p.insertKoboSpans(v, cnt)
+			}
+			p.addKoboText(e, tail, cnt)
+		default:
+			e.AddChild(t)
+		}
+	}
+}
+
+// addKoboText adds text to the element splitting it into Kobo spans.
+func (p *Processor) addKoboText(e *etree.Element, text string, cnt *koboCounter) {
+
+	if len(text) == 0 {
+		return
+	}
+	if len(strings.TrimSpace(text)) == 0 {
+		e.CreateCharData(text)
+		return
+	}
+	for _, sentence := range p.koboSentences(text) {
+		if len(strings.TrimSpace(sentence)) == 0 {
+			e.CreateCharData(sentence)
+			continue
+		}
+		e.AddNext("span", attr("class", "koboSpan"), attr("id", cnt.next())).SetText(sentence)
+	}
+}
+
+// koboSentences splits text into sentences preserving all characters. Sentences tokenizer is used when available.
+func (p *Processor) koboSentences(text string) []string {
+
+	if p.Book.tokenizer != nil && p.Book.tokenizer.t != nil {
+		if res := splitSentences(p.Book.tokenizer, text); strings.Join(res, "") == text {
+			return res
+		}
+	}
+
+	var res []string
+	last := 0
+	for _, loc := range koboSentencePattern.FindAllStringIndex(text, -1) {
+		res = append(res, text[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	if last < len(text) {
+		res = append(res, text[last:])
+	}
+	return res
+}
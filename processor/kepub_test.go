@@ -0,0 +1,79 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+
+	"fb2converter/etree"
+)
+
+// Expected span layout: paragraph number changes with every paragraph level element and image, sentence number with
+// every sentence.
+var casesKoboSpans = []struct {
+	name string
+	in   string
+	ids  []string
+}{
+	{
+		name: "headings and nested inline markup",
+		in:   `<body><div class="h1"><p class="title">Chapter 1</p></div><p>First sentence. Second one! <em>Third?</em> tail</p><p>Next.</p></body>`,
+		ids:  []string{"kobo.1.1", "kobo.2.1", "kobo.2.2", "kobo.2.3", "kobo.2.4", "kobo.3.1"},
+	},
+	{
+		name: "lists and tables",
+		in:   `<body><ul><li>One.</li><li>Two.</li></ul><table><tr><td>A</td><td>B</td></tr></table></body>`,
+		ids:  []string{"kobo.1.1", "kobo.1.2", "kobo.2.1", "kobo.2.2"},
+	},
+	{
+		name: "images",
+		in:   `<body><p>Before <img src="a.png"/> after.</p><div class="image"><img src="b.png"/></div><p>Text.</p></body>`,
+		ids:  []string{"kobo.1.1", "kobo.2.1", "kobo.3.1", "kobo.4.1", "kobo.5.1"},
+	},
+	{
+		name: "notes",
+		in:   `<body><div class="floatnote" id="n1"><p>Note text. More «quoted.» Last</p></div></body>`,
+		ids:  []string{"kobo.1.1", "kobo.1.2", "kobo.1.3"},
+	},
+	{
+		name: "skipped content",
+		in:   `<body><svg><text>x</text></svg><p><span class="koboSpan" id="kobo.9.9">kept</span> </p></body>`,
+		ids:  []string{"kobo.9.9"},
+	},
+}
+
+func TestKoboSpans(t *testing.T) {
+
+	p := &Processor{Book: &Book{}}
+	for _, c := range casesKoboSpans {
+		doc := etree.NewDocument()
+		if err := doc.ReadFromString(c.in); err != nil {
+			t.Fatal(err)
+		}
+		text := getFullTextFragment(doc.Root())
+
+		p.insertKoboSpans(doc.Root(), &koboCounter{newParagraph: true})
+
+		var (
+			ids  []string
+			walk func(e *etree.Element)
+		)
+		walk = func(e *etree.Element) {
+			if e.Tag == "span" && getAttrValue(e, "class") == "koboSpan" {
+				ids = append(ids, getAttrValue(e, "id"))
+			}
+			for _, c := range e.ChildElements() {
+				walk(c)
+			}
+		}
+		walk(doc.Root())
+		if strings.Join(ids, " ") != strings.Join(c.ids, " ") {
+			t.Errorf("%s: expected spans %v, got %v", c.name, c.ids, ids)
+		}
+		if res := getFullTextFragment(doc.Root()); res != text {
+			t.Errorf("%s: text changed from [%s] to [%s]", c.name, text, res)
+		}
+		if len(doc.FindElements("//span[@class='koboSpan']/img")) != strings.Count(c.in, "<img") {
+			t.Errorf("%s: not all images are wrapped", c.name)
+		}
+	}
+}
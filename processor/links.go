@@ -0,0 +1,210 @@
+package processor
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+)
+
+// linksReport accumulates results of internal links processing.
+type linksReport struct {
+	resolved   int
+	backlinks  int
+	duplicates []string
+	repaired   []string
+	removed    []string
+}
+
+// String formats report to be put into debug archive.
+func (r *linksReport) String() string {
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Resolved links: %d\nBack links: %d\n", r.resolved, r.backlinks)
+	for _, s := range []struct {
+		title string
+		lines []string
+	}{
+		{"Duplicate ids", r.duplicates},
+		{"Repaired links", r.repaired},
+		{"Removed links", r.removed},
+	} {
+		fmt.Fprintf(&b, "\n%s: %d\n", s.title, len(s.lines))
+		for _, l := range s.lines {
+			b.WriteString("\t" + l + "\n")
+		}
+	}
+	return b.String()
+}
+
+// linksIndex knows where every id in generated content is.
+type linksIndex struct {
+	files  map[string]bool     // content file names
+	ids    map[string]string   // id -> file name
+	folded map[string][]string // lower cased id -> ids
+	titles map[string]string   // lower cased TOC title -> reference
+}
+
+// processLinks goes over generated documents and makes sure hanging anchors are properly anchored. Links with targets
+// which could not be found are repaired when possible, hopeless ones are replaced by their content.
+func (p *Processor) processLinks() error {
+
+	p.env.Log.Debug("Processing links - start")
+
+	var rpt linksReport
+	defer func(start time.Time) {
+		p.env.Log.Debug("Processing links - done",
+			zap.Duration("elapsed", time.Since(start)),
+			zap.Int("resolved", rpt.resolved),
+			zap.Int("back links", rpt.backlinks),
+			zap.Int("duplicate ids", len(rpt.duplicates)),
+			zap.Int("repaired", len(rpt.repaired)),
+			zap.Int("removed", len(rpt.removed)),
+		)
+	}(time.Now())
+
+	idx := p.indexLinks(&rpt)
+
+	for _, f := range p.Book.Files {
+		if f.doc == nil {
+			continue
+		}
+		for _, a := range f.doc.FindElements("//a[@href]") {
+			href := getAttrValue(a, "href")
+			file, id, ok := strings.Cut(href, "#")
+			if !ok || strings.Contains(file, ":") || (len(file) > 0 && file != "nowhere" && !idx.files[file]) {
+				// external link or link to the whole file
+				continue
+			}
+			if target, ok := idx.ids[id]; ok {
+				a.CreateAttr("href", target+"#"+id)
+				if len(file) > 0 && file != target {
+					rpt.repaired = append(rpt.repaired, fmt.Sprintf("%s: %s -> %s#%s (target moved)", f.fname, href, target, id))
+				}
+				rpt.resolved++
+				if strings.HasPrefix(id, "back_") {
+					rpt.backlinks++
+				}
+				continue
+			}
+			if target, ok := p.Book.LinksLocations[id]; ok && len(file) == 0 {
+				a.CreateAttr("href", target+href)
+				rpt.resolved++
+				continue
+			}
+			if ref, how := idx.repair(id); len(ref) > 0 {
+				p.env.Log.Warn("Broken link repaired", zap.String("file", f.fname), zap.String("href", href), zap.String("target", ref), zap.String("match", how))
+				rpt.repaired = append(rpt.repaired, fmt.Sprintf("%s: %s -> %s (%s)", f.fname, href, ref, how))
+				a.CreateAttr("href", ref)
+				continue
+			}
+			text := strings.TrimSpace(strings.TrimSuffix(extractText(a, false), a.Tail()))
+			p.env.Log.Warn("Unable to find link target, removing link", zap.String("file", f.fname), zap.String("href", href), zap.String("text", text))
+			rpt.removed = append(rpt.removed, fmt.Sprintf("%s: %s [%s]", f.fname, href, text))
+			flattenElement(a)
+		}
+	}
+
+	if p.env.Rpt != nil {
+		if err := os.WriteFile(filepath.Join(p.tmpDir, "links.txt"), []byte(rpt.String()), 0644); err != nil {
+			return fmt.Errorf("unable to write links report: %w", err)
+		}
+	}
+	return nil
+}
+
+// indexLinks collects ids from generated content. First occurrence of id wins, duplicates are renamed to keep XHTML
+// valid.
+func (p *Processor) indexLinks(rpt *linksReport) *linksIndex {
+
+	idx := &linksIndex{
+		files:  make(map[string]bool),
+		ids:    make(map[string]string),
+		folded: make(map[string][]string),
+		titles: make(map[string]string),
+	}
+	for _, f := range p.Book.Files {
+		idx.files[f.fname] = true
+		if f.doc == nil {
+			continue
+		}
+		for _, e := range f.doc.FindElements("//*[@id]") {
+			id := getAttrValue(e, "id")
+			if len(id) == 0 {
+				continue
+			}
+			if first, ok := idx.ids[id]; ok {
+				newid := id
+				for i := 2; ; i++ {
+					if newid = fmt.Sprintf("%s_%d", id, i); len(idx.ids[newid]) == 0 {
+						break
+					}
+				}
+				e.CreateAttr("id", newid)
+				p.env.Log.Warn("Duplicate id, renaming", zap.String("id", id), zap.String("file", f.fname), zap.String("first", first), zap.String("new id", newid))
+				rpt.duplicates = append(rpt.duplicates, fmt.Sprintf("%s: also in %s, renamed to %s", id, f.fname, newid))
+				id = newid
+			}
+			idx.ids[id] = f.fname
+			folded := strings.ToLower(id)
+			idx.folded[folded] = append(idx.folded[folded], id)
+		}
+	}
+	for _, t := range p.Book.TOC {
+		if title := strings.ToLower(strings.Join(strings.Fields(t.title), " ")); len(title) > 0 {
+			if _, ok := idx.titles[title]; !ok {
+				idx.titles[title] = t.ref
+			}
+		}
+	}
+	return idx
+}
+
+// repair attempts to find intended target of the broken link. It returns new href and description of the way target
+// was found.
+func (idx *linksIndex) repair(id string) (string, string) {
+
+	// "#" prefix quirks, white space and escaping
+	cleaned := strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(id), "#"))
+	if s, err := url.PathUnescape(cleaned); err == nil {
+		cleaned = strings.TrimSpace(s)
+	}
+	if len(cleaned) == 0 {
+		return "", ""
+	}
+	sanitized, _ := SanitizeName(cleaned)
+	for _, s := range []string{cleaned, sanitized} {
+		if file, ok := idx.ids[s]; ok {
+			return file + "#" + s, "malformed id"
+		}
+	}
+	if ids := idx.folded[strings.ToLower(cleaned)]; len(ids) == 1 {
+		return idx.ids[ids[0]] + "#" + ids[0], "case mismatch"
+	}
+	if ref, ok := idx.titles[strings.ToLower(strings.Join(strings.Fields(cleaned), " "))]; ok {
+		return ref, "section title"
+	}
+	return "", ""
+}
+
+// flattenElement replaces element with its content.
+func flattenElement(e *etree.Element) {
+
+	parent := e.Parent()
+	if parent == nil {
+		return
+	}
+	for _, t := range append([]etree.Token(nil), e.Child...) {
+		parent.InsertChild(e, t)
+	}
+	if tail := e.Tail(); len(tail) > 0 {
+		parent.InsertChild(e, etree.NewCharData(tail))
+	}
+	parent.RemoveChild(e)
+}
@@ -0,0 +1,129 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+
+	"fb2converter/config"
+	"fb2converter/etree"
+)
+
+// linksBook has duplicate ids, link without target and note referenced from the body which follows notes, so its back
+// link is not known when notes are generated.
+const linksBook = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description><title-info><book-title>Links</book-title><lang>en</lang></title-info></description>
+<body>
+<section id="dup"><title><p>First</p></title><p>Text, see <a l:href="#dup">first</a> and <a l:href="#missing">nothing <emphasis>at all</emphasis></a> here.</p></section>
+<section id="dup"><title><p>Second</p></title><p id="dup">More text.</p></section>
+</body>
+<body name="notes"><title><p>Notes</p></title><section id="n1"><title><p>1</p></title><p>Note.</p></section></body>
+<body name="appendix"><section><p>Appendix<a l:href="#n1" type="note">[1]</a>.</p></section></body>
+</FictionBook>`
+
+func TestProcessLinks(t *testing.T) {
+
+	p := newTestProcessor(t, linksBook, OEpub, false, func(cfg *config.Config) {
+		cfg.Doc.Notes.Mode = NFloat.String()
+	})
+	if err := p.Process(); err != nil {
+		t.Fatalf("unable to process: %v", err)
+	}
+
+	files := make(map[string]string) // id -> file
+	var links []*etree.Element
+	for _, f := range p.Book.Files {
+		if f.doc == nil || !strings.HasSuffix(f.fname, ".xhtml") {
+			continue
+		}
+		for _, e := range f.doc.FindElements("//*[@id]") {
+			id := getAttrValue(e, "id")
+			if prev, ok := files[id]; ok {
+				t.Errorf("duplicate id %q in %s and %s", id, prev, f.fname)
+			}
+			files[id] = f.fname
+		}
+		links = append(links, f.doc.FindElements("//a[@href]")...)
+	}
+	for _, id := range []string{"dup", "dup_2", "dup_3"} {
+		if _, ok := files[id]; !ok {
+			t.Errorf("id %q not found, duplicates were not renamed", id)
+		}
+	}
+
+	var first, back bool
+	for _, a := range links {
+		href := getAttrValue(a, "href")
+		file, id, _ := strings.Cut(href, "#")
+		switch {
+		case strings.Contains(href, "missing") || strings.HasPrefix(href, "nowhere"):
+			t.Errorf("unresolved link %q", href)
+		case a.Text() == "first":
+			first = true
+			if file != files["dup"] || id != "dup" {
+				t.Errorf("link to the first of duplicate ids points to %q", href)
+			}
+		case id == "back_n1":
+			back = true
+			if file != files["back_n1"] {
+				t.Errorf("note back link points to %q, anchor is in %s", href, files["back_n1"])
+			}
+		}
+	}
+	if !first || !back {
+		t.Errorf("links were lost: first %v, back %v", first, back)
+	}
+
+	// link without target is replaced by its content
+	var flattened bool
+	for _, f := range p.Book.Files {
+		if f.doc == nil || f.fname != files["dup"] {
+			continue
+		}
+		for _, e := range f.doc.FindElements("//p") {
+			if strings.HasSuffix(getXMLFragmentFromElement(e, true), `</a> and nothing <span class="emphasis">at all</span> here.</p>`) {
+				flattened = true
+			}
+		}
+	}
+	if !flattened {
+		t.Errorf("text of the link without target was lost")
+	}
+}
+
+func TestFlattenElement(t *testing.T) {
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(`<p>Before <a href="#x">link <em>text</em></a> after <a href="#y"/>end</p>`); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range doc.FindElements("//a") {
+		flattenElement(a)
+	}
+	if s, _ := doc.WriteToString(); s != `<p>Before link <em>text</em> after end</p>` {
+		t.Errorf("unexpected result %s", s)
+	}
+}
+
+func TestLinksRepair(t *testing.T) {
+
+	idx := &linksIndex{
+		ids:    map[string]string{"far": "index3.xhtml", "Note_1": "notes.xhtml", "a": "index1.xhtml", "A": "index2.xhtml"},
+		folded: map[string][]string{"far": {"far"}, "note_1": {"Note_1"}, "a": {"a", "A"}},
+		titles: map[string]string{"second chapter": "index3.xhtml#tocref3"},
+	}
+	for _, c := range []struct {
+		id, ref, how string
+	}{
+		{"#far", "index3.xhtml#far", "malformed id"},
+		{" far%20", "index3.xhtml#far", "malformed id"},
+		{"NOTE_1", "notes.xhtml#Note_1", "case mismatch"},
+		{"Second   Chapter", "index3.xhtml#tocref3", "section title"},
+		{"b", "", ""},
+		{"", "", ""},
+	} {
+		if ref, how := idx.repair(c.id); ref != c.ref || how != c.how {
+			t.Errorf("%q: expected %q (%s), got %q (%s)", c.id, c.ref, c.how, ref, how)
+		}
+	}
+}
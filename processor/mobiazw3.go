@@ -54,7 +54,7 @@ func (p *Processor) FinalizeMOBI(fname string) error {
 			u = p.Book.ID
 			a = p.Book.ASIN
 		}
-		splitter, err := mobi.NewSplitter(tmp, u, a, true, p.env.Cfg.Doc.Kindlegen.RemovePersonal, false, p.env.Log)
+		splitter, err := mobi.NewSplitter(tmp, u, a, true, p.env.Cfg.Doc.Kindlegen.RemovePersonal, false, p.sortMeta(), p.env.Log)
 		if err != nil {
 			return fmt.Errorf("unable to parse intermediate content file: %w", err)
 		}
@@ -108,7 +108,7 @@ func (p *Processor) FinalizeAZW3(fname string) error {
 			u = p.Book.ID
 			a = p.Book.ASIN
 		}
-		splitter, err := mobi.NewSplitter(tmp, u, a, false, p.env.Cfg.Doc.Kindlegen.RemovePersonal, p.env.Cfg.Doc.Kindlegen.ForceASIN, p.env.Log)
+		splitter, err := mobi.NewSplitter(tmp, u, a, false, p.env.Cfg.Doc.Kindlegen.RemovePersonal, p.env.Cfg.Doc.Kindlegen.ForceASIN, p.sortMeta(), p.env.Log)
 		if err != nil {
 			return fmt.Errorf("unable to parse intermediate content file: %w", err)
 		}
@@ -124,6 +124,17 @@ func (p *Processor) FinalizeAZW3(fname string) error {
 	return nil
 }
 
+// sortMeta prepares book information used by Kindle for sorting.
+func (p *Processor) sortMeta() *mobi.SortMeta {
+	if p.Book == nil {
+		return nil
+	}
+	return &mobi.SortMeta{
+		TitleSort:  TitleSort(p.Book.Title, p.Book.Lang),
+		AuthorSort: p.Book.AuthorsSort(),
+	}
+}
+
 // generateIntermediateContent produces temporary mobi file, presently by running kindlegen and returns its full path.
 func (p *Processor) generateIntermediateContent(fname string) (string, error) {
 
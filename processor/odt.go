@@ -0,0 +1,416 @@
+package processor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"fb2converter/etree"
+)
+
+const odtMimetype = "application/vnd.oasis.opendocument.text"
+
+// odtNamespaces are declared on root elements of all document parts.
+var odtNamespaces = [][2]string{
+	{"office", "urn:oasis:names:tc:opendocument:xmlns:office:1.0"},
+	{"style", "urn:oasis:names:tc:opendocument:xmlns:style:1.0"},
+	{"text", "urn:oasis:names:tc:opendocument:xmlns:text:1.0"},
+	{"table", "urn:oasis:names:tc:opendocument:xmlns:table:1.0"},
+	{"draw", "urn:oasis:names:tc:opendocument:xmlns:drawing:1.0"},
+	{"fo", "urn:oasis:names:tc:opendocument:xmlns:xsl-fo-compatible:1.0"},
+	{"xlink", "http://www.w3.org/1999/xlink"},
+	{"dc", "http://purl.org/dc/elements/1.1/"},
+	{"meta", "urn:oasis:names:tc:opendocument:xmlns:meta:1.0"},
+	{"svg", "urn:oasis:names:tc:opendocument:xmlns:svg-compatible:1.0"},
+}
+
+// odtWriter serializes office document to OpenDocument text.
+type odtWriter struct {
+	d      *officeDocument
+	auto   *etree.Element
+	styles map[string]string // automatic paragraph styles by parent style and properties
+	marks  map[string]bool
+	noteID int
+	frames int
+	tables int
+	images map[*officePicture]bool
+}
+
+// FinalizeODT produces odt file out of processed book content.
+func (p *Processor) FinalizeODT(fname string) error {
+	return p.officeOutput(fname, func(d *officeDocument) (map[string][]byte, []string, error) {
+		w := &odtWriter{
+			d:      d,
+			styles: make(map[string]string),
+			marks:  make(map[string]bool),
+			images: make(map[*officePicture]bool),
+		}
+		return w.write()
+	})
+}
+
+func newODTPart(root string) (*etree.Document, *etree.Element) {
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	e := doc.CreateElement(root)
+	for _, ns := range odtNamespaces {
+		e.CreateAttr("xmlns:"+ns[0], ns[1])
+	}
+	e.CreateAttr("office:version", "1.3")
+	return doc, e
+}
+
+// odtStyleName returns internal name of the style.
+func odtStyleName(name string) string {
+	return strings.ReplaceAll(odtDisplayName(name), " ", "_20_")
+}
+
+// odtDisplayName returns style name as known to word processors, some built-in styles are named differently.
+func odtDisplayName(name string) string {
+	switch name {
+	case officeText:
+		return "Text body"
+	case officeFootnote:
+		return "Footnote"
+	case officeLink:
+		return "Internet link"
+	}
+	return name
+}
+
+func (w *odtWriter) write() (map[string][]byte, []string, error) {
+
+	parts := map[string][]byte{"mimetype": []byte(odtMimetype)}
+	order := []string{"mimetype", "META-INF/manifest.xml", "meta.xml", "styles.xml", "content.xml"}
+
+	add := func(name string, doc *etree.Document) error {
+		data, err := xmlPart(doc)
+		if err != nil {
+			return fmt.Errorf("unable to prepare %s: %w", name, err)
+		}
+		parts[name] = data
+		return nil
+	}
+
+	doc, root := newODTPart("office:document-content")
+	w.auto = root.AddNext("office:automatic-styles")
+	w.auto.AddNext("style:style", attr("style:name", "Cell"), attr("style:family", "table-cell")).
+		AddNext("style:table-cell-properties", attr("fo:border", "0.5pt solid #000000"), attr("fo:padding", "2pt"))
+	text := root.AddNext("office:body").AddNext("office:text")
+	w.blocks(text, w.d.content)
+
+	if err := add("content.xml", doc); err != nil {
+		return nil, nil, err
+	}
+	if err := add("styles.xml", w.namedStyles()); err != nil {
+		return nil, nil, err
+	}
+	if err := add("meta.xml", w.meta()); err != nil {
+		return nil, nil, err
+	}
+
+	manifest := newXMLPart()
+	m := manifest.CreateElement("manifest:manifest")
+	m.CreateAttr("xmlns:manifest", "urn:oasis:names:tc:opendocument:xmlns:manifest:1.0")
+	m.CreateAttr("manifest:version", "1.3")
+	m.AddSame("manifest:file-entry", attr("manifest:full-path", "/"), attr("manifest:version", "1.3"), attr("manifest:media-type", odtMimetype)).
+		AddSame("manifest:file-entry", attr("manifest:full-path", "content.xml"), attr("manifest:media-type", "text/xml")).
+		AddSame("manifest:file-entry", attr("manifest:full-path", "styles.xml"), attr("manifest:media-type", "text/xml")).
+		AddSame("manifest:file-entry", attr("manifest:full-path", "meta.xml"), attr("manifest:media-type", "text/xml"))
+	for _, pic := range w.d.pictures {
+		if !w.images[pic] {
+			continue
+		}
+		name := "Pictures/" + pic.name
+		m.AddNext("manifest:file-entry", attr("manifest:full-path", name), attr("manifest:media-type", pic.ct))
+		parts[name] = pic.data
+		order = append(order, name)
+	}
+	if err := add("META-INF/manifest.xml", manifest); err != nil {
+		return nil, nil, err
+	}
+	return parts, order, nil
+}
+
+func (w *odtWriter) blocks(to *etree.Element, blocks []officeBlock) {
+	for _, b := range blocks {
+		switch v := b.(type) {
+		case *officePara:
+			w.paragraph(to, v)
+		case *officeTable:
+			w.table(to, v)
+		}
+	}
+}
+
+// paragraphStyle returns named style or automatic style derived from it when paragraph has direct formatting.
+func (w *odtWriter) paragraphStyle(para *officePara) string {
+
+	name := odtStyleName(para.style)
+	if !para.brk && len(para.align) == 0 {
+		return name
+	}
+	key := fmt.Sprintf("%s/%t/%s", name, para.brk, para.align)
+	if auto, ok := w.styles[key]; ok {
+		return auto
+	}
+	auto := "P" + strconv.Itoa(len(w.styles)+1)
+	w.styles[key] = auto
+	props := w.auto.AddNext("style:style", attr("style:name", auto), attr("style:family", "paragraph"), attr("style:parent-style-name", name)).
+		AddNext("style:paragraph-properties")
+	if para.brk {
+		props.CreateAttr("fo:break-before", "page")
+	}
+	if len(para.align) > 0 {
+		props.CreateAttr("fo:text-align", odtAlign(para.align))
+	}
+	return auto
+}
+
+func odtAlign(align string) string {
+	switch align {
+	case "left":
+		return "start"
+	case "right":
+		return "end"
+	}
+	return align
+}
+
+func (w *odtWriter) paragraph(to *etree.Element, para *officePara) {
+
+	var p *etree.Element
+	if para.level > 0 {
+		p = to.AddNext("text:h", attr("text:style-name", w.paragraphStyle(para)), attr("text:outline-level", strconv.Itoa(para.level)))
+	} else {
+		p = to.AddNext("text:p", attr("text:style-name", w.paragraphStyle(para)))
+	}
+
+	var (
+		link    *etree.Element
+		current string
+	)
+	for _, r := range para.runs {
+		for _, m := range r.marks {
+			if !w.marks[m] {
+				w.marks[m] = true
+				p.AddNext("text:bookmark", attr("text:name", m))
+			}
+		}
+		if len(r.text) == 0 && r.picture == nil && r.note == nil && !r.br {
+			continue
+		}
+
+		// consecutive runs with the same link share link element
+		target := r.link
+		if len(target) == 0 && len(r.dest) > 0 {
+			target = "#" + r.dest
+		}
+		if target != current {
+			link, current = nil, target
+			if len(target) > 0 {
+				link = p.AddNext("text:a", attr("xlink:type", "simple"), attr("xlink:href", target),
+					attr("text:style-name", odtStyleName(officeLink)))
+			}
+		}
+		parent := p
+		if link != nil {
+			parent = link
+		}
+		for _, s := range r.styles {
+			parent = parent.AddNext("text:span", attr("text:style-name", odtStyleName(s)))
+		}
+
+		switch {
+		case r.br:
+			parent.AddNext("text:line-break")
+		case r.picture != nil:
+			w.frame(parent, r.picture)
+		case r.note != nil:
+			w.footnote(parent, r.note)
+		default:
+			parent.CreateCharData(r.text)
+		}
+	}
+}
+
+// footnote writes note with its content in place.
+func (w *odtWriter) footnote(to *etree.Element, blocks []officeBlock) {
+	w.noteID++
+	note := to.AddNext("text:note", attr("text:id", "ftn"+strconv.Itoa(w.noteID)), attr("text:note-class", "footnote"))
+	note.AddNext("text:note-citation").SetText(strconv.Itoa(w.noteID))
+	w.blocks(note.AddNext("text:note-body"), blocks)
+}
+
+// frame writes picture anchored as character.
+func (w *odtWriter) frame(to *etree.Element, pic *officePicture) {
+	w.images[pic] = true
+	w.frames++
+	to.AddNext("draw:frame", attr("draw:name", "Image"+strconv.Itoa(w.frames)), attr("text:anchor-type", "as-char"),
+		attr("svg:width", fmt.Sprintf("%.2fpt", pic.width)), attr("svg:height", fmt.Sprintf("%.2fpt", pic.height)),
+		attr("draw:z-index", "0")).
+		AddNext("draw:image", attr("xlink:href", "Pictures/"+pic.name), attr("xlink:type", "simple"),
+			attr("xlink:show", "embed"), attr("xlink:actuate", "onLoad"))
+}
+
+func (w *odtWriter) table(to *etree.Element, t *officeTable) {
+
+	w.tables++
+	tbl := to.AddNext("table:table", attr("table:name", "Table"+strconv.Itoa(w.tables)))
+	tbl.AddNext("table:table-column", attr("table:number-columns-repeated", strconv.Itoa(t.cols)))
+	for _, row := range t.rows {
+		tr := tbl.AddNext("table:table-row")
+		for _, cell := range row {
+			tc := tr.AddNext("table:table-cell", attr("table:style-name", "Cell"), attr("office:value-type", "string"))
+			w.blocks(tc, cell.blocks)
+			if len(cell.blocks) == 0 {
+				w.paragraph(tc, &officePara{style: officeTableContents})
+			}
+		}
+	}
+}
+
+// odtTextProperties adds character formatting, font size is relative to the parent style.
+func odtTextProperties(to *etree.Element, s *officeStyle) {
+	props := to.AddNext("style:text-properties")
+	if s.bold {
+		props.CreateAttr("fo:font-weight", "bold")
+	}
+	if s.italic {
+		props.CreateAttr("fo:font-style", "italic")
+	}
+	if s.strike {
+		props.CreateAttr("style:text-line-through-style", "solid")
+	}
+	if s.underline {
+		props.CreateAttr("style:text-underline-style", "solid")
+		props.CreateAttr("style:text-underline-width", "auto")
+		props.CreateAttr("style:text-underline-color", "font-color")
+	}
+	if s.mono {
+		props.CreateAttr("style:font-name", "Courier New")
+	}
+	if len(s.color) > 0 {
+		props.CreateAttr("fo:color", "#"+s.color)
+	}
+	if s.size > 0 {
+		props.CreateAttr("fo:font-size", fmt.Sprintf("%.0f%%", s.size*100))
+	}
+	switch s.vert {
+	case "super":
+		props.CreateAttr("style:text-position", "super 58%")
+	case "sub":
+		props.CreateAttr("style:text-position", "sub 58%")
+	}
+	if len(props.Attr) == 0 {
+		to.RemoveChild(props)
+	}
+}
+
+func (w *odtWriter) namedStyles() *etree.Document {
+
+	doc, root := newODTPart("office:document-styles")
+
+	fonts := root.AddNext("office:font-face-decls")
+	fonts.AddNext("style:font-face", attr("style:name", "Times New Roman"), attr("svg:font-family", "'Times New Roman'"),
+		attr("style:font-family-generic", "roman"))
+	fonts.AddNext("style:font-face", attr("style:name", "Courier New"), attr("svg:font-family", "'Courier New'"),
+		attr("style:font-family-generic", "modern"), attr("style:font-pitch", "fixed"))
+
+	styles := root.AddNext("office:styles")
+	def := styles.AddNext("style:default-style", attr("style:family", "paragraph"))
+	def.AddNext("style:paragraph-properties", attr("fo:line-height", "110%"))
+	tp := def.AddNext("style:text-properties", attr("style:font-name", "Times New Roman"), attr("fo:font-size", "11pt"))
+	if lang, country, found := strings.Cut(w.d.p.Book.Lang.String(), "-"); lang != "und" {
+		tp.CreateAttr("fo:language", lang)
+		if found {
+			tp.CreateAttr("fo:country", country)
+		}
+	}
+	styles.AddNext("style:style", attr("style:name", "Standard"), attr("style:family", "paragraph"), attr("style:class", "text"))
+
+	for _, s := range officeStyles() {
+		st := styles.AddNext("style:style", attr("style:name", odtStyleName(s.name)), attr("style:display-name", odtDisplayName(s.name)))
+		if s.character {
+			st.CreateAttr("style:family", "text")
+			odtTextProperties(st, s)
+			continue
+		}
+		st.CreateAttr("style:family", "paragraph")
+		st.CreateAttr("style:parent-style-name", "Standard")
+		if s.name != officeText && s.level == 0 {
+			st.CreateAttr("style:next-style-name", odtStyleName(officeText))
+		}
+		if s.level > 0 {
+			st.CreateAttr("style:default-outline-level", strconv.Itoa(s.level))
+		}
+		props := st.AddNext("style:paragraph-properties")
+		if s.left > 0 {
+			props.CreateAttr("fo:margin-left", fmt.Sprintf("%gpt", s.left))
+		}
+		if s.right > 0 {
+			props.CreateAttr("fo:margin-right", fmt.Sprintf("%gpt", s.right))
+		}
+		if s.indent > 0 {
+			props.CreateAttr("fo:text-indent", fmt.Sprintf("%gpt", s.indent))
+		}
+		if s.before > 0 {
+			props.CreateAttr("fo:margin-top", fmt.Sprintf("%gpt", s.before))
+		}
+		if s.after > 0 {
+			props.CreateAttr("fo:margin-bottom", fmt.Sprintf("%gpt", s.after))
+		}
+		if len(s.align) > 0 {
+			props.CreateAttr("fo:text-align", odtAlign(s.align))
+		}
+		if s.keep {
+			props.CreateAttr("fo:keep-with-next", "always")
+		}
+		if len(props.Attr) == 0 {
+			st.RemoveChild(props)
+		}
+		odtTextProperties(st, s)
+	}
+
+	styles.AddNext("text:notes-configuration", attr("text:note-class", "footnote"), attr("style:num-format", "1"),
+		attr("text:start-value", "0"), attr("text:footnotes-position", "page"), attr("text:start-numbering-at", "document"))
+
+	auto := root.AddNext("office:automatic-styles")
+	auto.AddNext("style:page-layout", attr("style:name", "pm1")).
+		AddNext("style:page-layout-properties", attr("fo:page-width", "21cm"), attr("fo:page-height", "29.7cm"),
+			attr("fo:margin-top", "2cm"), attr("fo:margin-bottom", "2cm"), attr("fo:margin-left", "2cm"), attr("fo:margin-right", "2cm"))
+	root.AddNext("office:master-styles").
+		AddNext("style:master-page", attr("style:name", "Standard"), attr("style:page-layout-name", "pm1"))
+	return doc
+}
+
+// meta writes book description into document properties.
+func (w *odtWriter) meta() *etree.Document {
+
+	b := w.d.p.Book
+
+	doc, root := newODTPart("office:document-meta")
+	meta := root.AddNext("office:meta")
+	meta.AddNext("meta:generator").SetText("fb2converter")
+	meta.AddNext("dc:title").SetText(b.Title)
+	if authors := w.d.authors(); len(authors) > 0 {
+		meta.AddNext("meta:initial-creator").SetText(authors)
+		meta.AddNext("dc:creator").SetText(authors)
+	}
+	if len(b.SeqName) > 0 {
+		meta.AddNext("dc:subject").SetText(b.SeqName)
+	}
+	if len(b.Annotation) > 0 {
+		meta.AddNext("dc:description").SetText(b.Annotation)
+	}
+	for _, g := range b.GenreNames {
+		meta.AddNext("meta:keyword").SetText(g)
+	}
+	meta.AddNext("dc:language").SetText(b.Lang.String())
+	meta.AddNext("meta:creation-date").SetText(time.Now().UTC().Format("2006-01-02T15:04:05"))
+	for _, prop := range officeProperties(b) {
+		meta.AddNext("meta:user-defined", attr("meta:name", prop[0])).SetText(prop[1])
+	}
+	return doc
+}
@@ -0,0 +1,734 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+)
+
+// Named styles of word processor documents. Editors are expected to keep them, so edited document could be imported back.
+const (
+	officeText          = "Body Text"
+	officeTitle         = "Title"
+	officeHeading       = "Heading" // followed by level
+	officeSubtitle      = "Subtitle"
+	officeEpigraph      = "Epigraph"
+	officeCite          = "Cite"
+	officeAnnotation    = "Annotation"
+	officePoemTitle     = "Poem Title"
+	officeStanzaTitle   = "Stanza Title"
+	officeVerse         = "Verse"
+	officeTextAuthor    = "Text Author"
+	officeEmptyLine     = "Empty Line"
+	officeImage         = "Image"
+	officeCover         = "Cover"
+	officeTableHeading  = "Table Heading"
+	officeTableContents = "Table Contents"
+	officeFootnote      = "Footnote Text"
+	// character styles
+	officeEmphasis = "Emphasis"
+	officeStrong   = "Strong"
+	officeStrike   = "Strikethrough"
+	officeCode     = "Code"
+	officeSuper    = "Superscript"
+	officeSub      = "Subscript"
+	officeLink     = "Hyperlink"
+)
+
+// officeMaxLevel is the deepest heading level supported by word processors.
+const officeMaxLevel = 9
+
+// officeStyle describes formatting of named style, sizes are in points, font size is relative to the document one.
+type officeStyle struct {
+	name      string
+	character bool
+	bold      bool
+	italic    bool
+	strike    bool
+	underline bool
+	mono      bool
+	vert      string // "super" or "sub"
+	color     string
+	size      float64
+	align     string // "left", "center", "right" or "justify"
+	left      float64
+	right     float64
+	indent    float64
+	before    float64
+	after     float64
+	keep      bool // keep with next paragraph
+	level     int  // outline level
+}
+
+// officeStyles returns all named styles of the document.
+func officeStyles() []*officeStyle {
+	styles := []*officeStyle{
+		{name: officeText, align: "justify", indent: 18},
+		{name: officeTitle, bold: true, size: 1.6, align: "center", before: 12, after: 12, keep: true},
+		{name: officeSubtitle, bold: true, align: "center", before: 6, after: 6, keep: true},
+		{name: officeEpigraph, italic: true, size: 0.9, left: 170, after: 2},
+		{name: officeCite, size: 0.9, left: 28, right: 28, align: "justify", after: 2},
+		{name: officeAnnotation, italic: true, size: 0.9, left: 28, right: 28, align: "justify", after: 2},
+		{name: officePoemTitle, bold: true, left: 56, before: 6, after: 6, keep: true},
+		{name: officeStanzaTitle, bold: true, left: 56, before: 6, after: 3, keep: true},
+		{name: officeVerse, left: 56},
+		{name: officeTextAuthor, italic: true, align: "right", after: 6},
+		{name: officeEmptyLine},
+		{name: officeImage, align: "center", before: 6, after: 6},
+		{name: officeCover, align: "center"},
+		{name: officeTableHeading, bold: true, align: "center"},
+		{name: officeTableContents},
+		{name: officeFootnote, size: 0.85},
+		{name: officeEmphasis, character: true, italic: true},
+		{name: officeStrong, character: true, bold: true},
+		{name: officeStrike, character: true, strike: true},
+		{name: officeCode, character: true, mono: true},
+		{name: officeSuper, character: true, vert: "super"},
+		{name: officeSub, character: true, vert: "sub"},
+		{name: officeLink, character: true, underline: true, color: "0563C1"},
+	}
+	sizes := []float64{1.4, 1.25, 1.15}
+	for level := 1; level <= officeMaxLevel; level++ {
+		size := 1.05
+		if level <= len(sizes) {
+			size = sizes[level-1]
+		}
+		styles = append(styles, &officeStyle{
+			name: officeHeadingStyle(level), bold: true, size: size, align: "center", before: 12, after: 12, keep: true, level: level,
+		})
+	}
+	return styles
+}
+
+// officeHeadingStyle returns style name for heading level.
+func officeHeadingStyle(level int) string {
+	return officeHeading + " " + strconv.Itoa(level)
+}
+
+// officeBlock is either *officePara or *officeTable.
+type officeBlock interface{}
+
+// officePara is a paragraph with named style.
+type officePara struct {
+	style string
+	level int    // outline level of headings
+	brk   bool   // starts new page
+	align string // overrides style alignment
+	runs  []*officeRun
+}
+
+// officeRun is a piece of paragraph with the same formatting. Runs with image, note or line break have no text.
+type officeRun struct {
+	text    string
+	styles  []string // character styles, outer first
+	link    string   // external link
+	dest    string   // internal link target
+	marks   []string // bookmarks defined at this position
+	picture *officePicture
+	note    []officeBlock // footnote content
+	br      bool
+}
+
+type officeTable struct {
+	rows [][]*officeCell
+	cols int
+}
+
+type officeCell struct {
+	header bool
+	blocks []officeBlock
+}
+
+// officePicture is an image stored in the document package, sizes are in points.
+type officePicture struct {
+	name   string
+	ct     string
+	data   []byte
+	width  float64
+	height float64
+}
+
+// officeDocument is book content prepared for word processor formats.
+type officeDocument struct {
+	p        *Processor
+	content  []officeBlock
+	pictures []*officePicture
+	// pictures by source file, nil if image could not be used
+	sources  map[string]*officePicture
+	anchored map[*etree.Element]*etree.Element
+	// bookmarks waiting for the next paragraph
+	marks  []string
+	inNote bool
+}
+
+// officeOutput creates word processor document out of processed book content.
+func (p *Processor) officeOutput(fname string, write func(d *officeDocument) (map[string][]byte, []string, error)) error {
+
+	if _, err := os.Stat(fname); err == nil {
+		if !p.overwrite {
+			return fmt.Errorf("output file already exists: %s", fname)
+		}
+		p.env.Log.Warn("Overwriting existing file", zap.String("file", fname))
+		if err = os.Remove(fname); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	} else if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+		return fmt.Errorf("unable to create output directory: %w", err)
+	}
+
+	d := &officeDocument{
+		p:        p,
+		sources:  make(map[string]*officePicture),
+		anchored: make(map[*etree.Element]*etree.Element),
+	}
+	d.build()
+
+	parts, order, err := write(d)
+	if err != nil {
+		return err
+	}
+	return writeOfficePackage(fname, parts, order)
+}
+
+// writeOfficePackage stores document parts in zip archive. Parts are written in specified order, first one is not
+// compressed (OpenDocument requires it for mimetype).
+func writeOfficePackage(fname string, parts map[string][]byte, order []string) error {
+
+	f, err := os.Create(fname)
+	if err != nil {
+		return fmt.Errorf("unable to create document (%s): %w", fname, err)
+	}
+	defer f.Close()
+
+	arc := zip.NewWriter(f)
+	t := time.Now()
+	for i, name := range order {
+		h := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: t}
+		if i == 0 {
+			h.Method = zip.Store
+		}
+		w, err := arc.CreateHeader(h)
+		if err != nil {
+			return fmt.Errorf("unable to add %s to document: %w", name, err)
+		}
+		if _, err := w.Write(parts[name]); err != nil {
+			return fmt.Errorf("unable to add %s to document: %w", name, err)
+		}
+	}
+	if err := arc.Close(); err != nil {
+		return fmt.Errorf("unable to write document (%s): %w", fname, err)
+	}
+	return f.Close()
+}
+
+// xmlPart serializes document part.
+func xmlPart(doc *etree.Document) ([]byte, error) {
+	doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
+	return doc.WriteToBytes()
+}
+
+// newXMLPart creates document part with xml declaration.
+func newXMLPart() *etree.Document {
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8" standalone="yes"`)
+	return doc
+}
+
+// build converts content files into paragraphs and tables. Notes become footnotes, so notes bodies and table of
+// contents page are left out.
+func (d *officeDocument) build() {
+
+	d.cover()
+	for _, f := range d.p.Book.Files {
+		if f == nil || f.doc == nil || f.id == "cover-page" || f.id == "toc" {
+			continue
+		}
+		body := f.doc.FindElement("./html/body")
+		if body == nil || d.notesBody(body) {
+			continue
+		}
+		for a, n := range matchNotes(body) {
+			d.anchored[a] = n
+		}
+		d.marks = append(d.marks, strings.TrimSuffix(f.fname, ".xhtml"))
+		d.blocks(body, &d.content, officeText)
+	}
+}
+
+// notesBody checks if content file holds notes.
+func (d *officeDocument) notesBody(body *etree.Element) bool {
+	if body.FindElement(".//p[@class='floatnote']") != nil {
+		return true
+	}
+	for _, e := range body.FindElements(".//*[@id]") {
+		if _, ok := d.p.Book.Notes[getAttrValue(e, "id")]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// cover puts cover image at the beginning of the document.
+func (d *officeDocument) cover() {
+
+	if len(d.p.Book.Cover) == 0 {
+		return
+	}
+	for _, b := range d.p.Book.Images {
+		if b.id == d.p.Book.Cover {
+			d.picture(path.Join(DirImages, b.fname), &d.content, officeCover)
+			return
+		}
+	}
+}
+
+func (d *officeDocument) blocks(e *etree.Element, to *[]officeBlock, style string) {
+	for _, c := range e.ChildElements() {
+		d.block(c, to, style)
+	}
+}
+
+func (d *officeDocument) block(c *etree.Element, to *[]officeBlock, style string) {
+
+	if id := getAttrValue(c, "id"); len(id) > 0 && !d.inNote {
+		d.marks = append(d.marks, id)
+	}
+
+	class := getAttrValue(c, "class")
+	switch {
+	case class == "titleblock", class == "titleblock_nobreak":
+		d.heading(c, to, "", class == "titleblock")
+	case class == "titlenotes":
+		// replaced by footnote numbers
+	case class == "epigraph":
+		d.blocks(c, to, officeEpigraph)
+	case class == "cite":
+		d.blocks(c, to, officeCite)
+	case class == "annotation":
+		d.blocks(c, to, officeAnnotation)
+	case class == "poem":
+		var stanzas int
+		for _, v := range c.ChildElements() {
+			switch getAttrValue(v, "class") {
+			case "titleblock", "titleblock_nobreak":
+				d.heading(v, to, officePoemTitle, false)
+			case "stanza":
+				if stanzas > 0 {
+					// empty verse separates stanzas
+					d.add(to, &officePara{style: officeVerse}, true)
+				}
+				d.block(v, to, officeVerse)
+				stanzas++
+			default:
+				d.block(v, to, officeVerse)
+			}
+		}
+	case class == "stanza":
+		for _, v := range c.ChildElements() {
+			switch getAttrValue(v, "class") {
+			case "titleblock", "titleblock_nobreak":
+				d.heading(v, to, officeStanzaTitle, false)
+			default:
+				d.block(v, to, officeVerse)
+			}
+		}
+	case class == "text-author":
+		d.paragraph(c, to, officeTextAuthor)
+	case class == "emptyline":
+		d.add(to, &officePara{style: officeEmptyLine}, true)
+	case class == "image":
+		for _, img := range c.FindElements(".//img") {
+			d.picture(getAttrValue(img, "src"), to, officeImage)
+		}
+	case strings.HasPrefix(class, "vignette"):
+		// decorations are not part of the text
+	case class == "inlinenote", class == "blocknote":
+		// become footnotes
+	case c.Tag == "table":
+		d.table(c, to)
+	case c.Tag == "p" && class == "subtitle":
+		d.paragraph(c, to, officeSubtitle)
+	case c.Tag == "p":
+		d.paragraph(c, to, style)
+	case hasBlocks(c):
+		d.blocks(c, to, style)
+	default:
+		d.paragraph(c, to, style)
+	}
+}
+
+// heading adds title lines as single paragraph. Section titles get heading style by their level.
+func (d *officeDocument) heading(c *etree.Element, to *[]officeBlock, style string, brk bool) {
+
+	for _, h := range c.ChildElements() {
+		class := getAttrValue(h, "class")
+		if strings.HasPrefix(class, "vignette") {
+			continue
+		}
+		if id := getAttrValue(h, "id"); len(id) > 0 && !d.inNote {
+			d.marks = append(d.marks, id)
+		}
+		para := &officePara{style: style}
+		if len(style) == 0 {
+			para.style = officeTitle
+			if n, err := strconv.Atoi(strings.TrimPrefix(class, "h")); err == nil && strings.HasPrefix(class, "h") && n > 0 {
+				if n > officeMaxLevel {
+					n = officeMaxLevel
+				}
+				para.style, para.level = officeHeadingStyle(n), n
+			}
+			para.brk = brk && len(*to) > 0
+		}
+		lines := h.ChildElements()
+		if len(lines) == 0 || !hasBlocks(h) {
+			lines = []*etree.Element{h}
+		}
+		for i, l := range lines {
+			if i > 0 {
+				para.runs = append(para.runs, &officeRun{br: true})
+			}
+			d.inline(l, &para.runs, officeRun{})
+		}
+		d.add(to, para, false)
+	}
+}
+
+// paragraph collects inline content of the element.
+func (d *officeDocument) paragraph(e *etree.Element, to *[]officeBlock, style string) {
+	para := &officePara{style: style}
+	if align := getAttrValue(e, "align"); len(align) > 0 {
+		para.align = align
+	}
+	d.inline(e, &para.runs, officeRun{})
+	d.add(to, para, false)
+}
+
+// add normalizes spaces and adds paragraph with pending bookmarks. Paragraphs without content are skipped unless forced.
+func (d *officeDocument) add(to *[]officeBlock, para *officePara, force bool) {
+
+	// collapse spaces, trim them at the paragraph and line boundaries
+	var (
+		runs  []*officeRun
+		space = true
+	)
+	for _, r := range para.runs {
+		if r.br {
+			trimRuns(runs)
+			space = true
+		}
+		if len(r.text) > 0 {
+			var sb strings.Builder
+			for _, c := range r.text {
+				if c == ' ' {
+					if space {
+						continue
+					}
+					space = true
+				} else {
+					space = false
+				}
+				sb.WriteRune(c)
+			}
+			r.text = sb.String()
+			if len(r.text) == 0 && len(r.marks) == 0 {
+				continue
+			}
+		}
+		if r.picture != nil || r.note != nil {
+			space = false
+		}
+		runs = append(runs, r)
+	}
+	trimRuns(runs)
+
+	var content bool
+	for _, r := range runs {
+		if len(r.text) > 0 || r.picture != nil || r.note != nil {
+			content = true
+			break
+		}
+	}
+	if !content && !force {
+		// bookmarks move to the next paragraph
+		for _, r := range runs {
+			if !d.inNote {
+				d.marks = append(d.marks, r.marks...)
+			}
+		}
+		return
+	}
+	para.runs = runs
+	if len(d.marks) > 0 && !d.inNote {
+		para.runs = append([]*officeRun{{marks: d.marks}}, para.runs...)
+		d.marks = nil
+	}
+	*to = append(*to, para)
+}
+
+// trimRuns removes trailing spaces of the text.
+func trimRuns(runs []*officeRun) {
+	for i := len(runs) - 1; i >= 0; i-- {
+		r := runs[i]
+		if r.br || r.picture != nil || r.note != nil {
+			return
+		}
+		r.text = strings.TrimRight(r.text, " ")
+		if len(r.text) > 0 {
+			return
+		}
+	}
+}
+
+// inline collects runs from the element content.
+func (d *officeDocument) inline(e *etree.Element, to *[]*officeRun, cur officeRun) {
+	for _, t := range e.Child {
+		switch v := t.(type) {
+		case *etree.CharData:
+			d.chars(v.Data, to, cur)
+		case *etree.Element:
+			d.element(v, to, cur)
+			d.chars(v.Tail(), to, cur)
+		}
+	}
+}
+
+func (d *officeDocument) chars(text string, to *[]*officeRun, cur officeRun) {
+	text = strings.NewReplacer("\n", " ", "\r", " ", "\t", " ", strSOFTHYPHEN, "").Replace(text)
+	if len(text) == 0 {
+		return
+	}
+	cur.text = text
+	*to = append(*to, &cur)
+}
+
+func (d *officeDocument) element(e *etree.Element, to *[]*officeRun, cur officeRun) {
+
+	if id := getAttrValue(e, "id"); len(id) > 0 && !d.inNote {
+		*to = append(*to, &officeRun{marks: []string{id}})
+	}
+
+	class := getAttrValue(e, "class")
+	switch {
+	case e.Tag == "br":
+		*to = append(*to, &officeRun{br: true})
+		return
+	case e.Tag == "img":
+		if d.inNote {
+			return
+		}
+		if pic := d.image(getAttrValue(e, "src")); pic != nil {
+			*to = append(*to, &officeRun{picture: pic})
+		}
+		return
+	case class == "inlinenote", class == "notenum":
+		return
+	case class == "inlineanchor", class == "blockanchor":
+		if n, ok := d.anchored[e]; ok {
+			d.footnote(to, func(blocks *[]officeBlock) {
+				d.paragraph(n, blocks, officeFootnote)
+			})
+			return
+		}
+	case e.Tag == "a":
+		href := getAttrValue(e, "href")
+		u, err := url.Parse(href)
+		if err != nil || len(href) == 0 {
+			break
+		}
+		if len(u.Scheme) > 0 {
+			cur.link = href
+			break
+		}
+		if n, ok := d.p.Book.Notes[u.Fragment]; ok && n.parsed != nil {
+			d.footnote(to, func(blocks *[]officeBlock) {
+				d.blocks(n.parsed, blocks, officeFootnote)
+			})
+			return
+		}
+		if len(u.Fragment) > 0 {
+			cur.dest = u.Fragment
+		} else if f := strings.TrimSuffix(u.Path, ".xhtml"); len(f) > 0 {
+			cur.dest = f
+		}
+	case e.Tag == "sup":
+		cur.styles = withStyle(cur.styles, officeSuper)
+	case e.Tag == "sub":
+		cur.styles = withStyle(cur.styles, officeSub)
+	case class == "emphasis", e.Tag == "em", e.Tag == "i":
+		cur.styles = withStyle(cur.styles, officeEmphasis)
+	case class == "strong", e.Tag == "b":
+		cur.styles = withStyle(cur.styles, officeStrong)
+	case class == "strike", e.Tag == "del", e.Tag == "s":
+		cur.styles = withStyle(cur.styles, officeStrike)
+	case e.Tag == "code":
+		cur.styles = withStyle(cur.styles, officeCode)
+	}
+	d.inline(e, to, cur)
+}
+
+// withStyle returns copy of character styles with added one.
+func withStyle(styles []string, style string) []string {
+	for _, s := range styles {
+		if s == style {
+			return styles
+		}
+	}
+	return append(append(make([]string, 0, len(styles)+1), styles...), style)
+}
+
+// footnote adds note reference with note content. Notes inside notes are dropped.
+func (d *officeDocument) footnote(to *[]*officeRun, content func(blocks *[]officeBlock)) {
+	if d.inNote {
+		return
+	}
+	d.inNote = true
+	var blocks []officeBlock
+	content(&blocks)
+	d.inNote = false
+	if len(blocks) == 0 {
+		blocks = append(blocks, &officePara{style: officeFootnote})
+	}
+	*to = append(*to, &officeRun{note: blocks})
+}
+
+// picture adds paragraph with block image.
+func (d *officeDocument) picture(src string, to *[]officeBlock, style string) {
+	if d.inNote {
+		return
+	}
+	if pic := d.image(src); pic != nil {
+		d.add(to, &officePara{style: style, runs: []*officeRun{{picture: pic}}}, false)
+	}
+}
+
+// image registers image to be stored in the document. Formats not understood by word processors are converted to PNG.
+func (d *officeDocument) image(src string) *officePicture {
+
+	if len(src) == 0 {
+		return nil
+	}
+	if pic, ok := d.sources[src]; ok {
+		return pic
+	}
+	d.sources[src] = nil
+
+	if strings.EqualFold(path.Ext(src), ".svg") {
+		d.p.env.Log.Warn("SVG images are not supported by word processors, skipping", zap.String("src", src))
+		return nil
+	}
+	data, err := d.p.readContent(src)
+	if err != nil {
+		d.p.env.Log.Warn("Unable to read image, skipping", zap.String("src", src), zap.Error(err))
+		return nil
+	}
+	ct := http.DetectContentType(data)
+	switch ct {
+	case "image/jpeg", "image/png", "image/gif":
+	default:
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			d.p.env.Log.Warn("Unable to decode image, skipping", zap.String("src", src), zap.Error(err))
+			return nil
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, imaging.Clone(img)); err != nil {
+			d.p.env.Log.Warn("Unable to convert image, skipping", zap.String("src", src), zap.Error(err))
+			return nil
+		}
+		data, ct = buf.Bytes(), "image/png"
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width == 0 || cfg.Height == 0 {
+		d.p.env.Log.Warn("Unable to get image dimensions, skipping", zap.String("src", src), zap.Error(err))
+		return nil
+	}
+
+	// image pixels are treated as 96 dpi and are scaled down to fit the page
+	const maxWidth, maxHeight = 6 * 72, 8 * 72
+	w, h := float64(cfg.Width)*0.75, float64(cfg.Height)*0.75
+	if scale := maxWidth / w; scale < 1 {
+		w, h = w*scale, h*scale
+	}
+	if scale := maxHeight / h; scale < 1 {
+		w, h = w*scale, h*scale
+	}
+
+	pic := &officePicture{
+		name:   fmt.Sprintf("image%d.%s", len(d.pictures)+1, strings.TrimPrefix(ct, "image/")),
+		ct:     ct,
+		data:   data,
+		width:  w,
+		height: h,
+	}
+	d.pictures = append(d.pictures, pic)
+	d.sources[src] = pic
+	return pic
+}
+
+// table collects table rows, shorter rows are padded with empty cells.
+func (d *officeDocument) table(c *etree.Element, to *[]officeBlock) {
+
+	t := &officeTable{}
+	for _, tr := range c.FindElements(".//tr") {
+		var row []*officeCell
+		for _, td := range tr.ChildElements() {
+			if td.Tag != "td" && td.Tag != "th" {
+				continue
+			}
+			cell := &officeCell{header: td.Tag == "th"}
+			style := officeTableContents
+			if cell.header {
+				style = officeTableHeading
+			}
+			if hasBlocks(td) {
+				d.blocks(td, &cell.blocks, style)
+			} else {
+				d.paragraph(td, &cell.blocks, style)
+			}
+			row = append(row, cell)
+		}
+		if len(row) == 0 {
+			continue
+		}
+		if len(row) > t.cols {
+			t.cols = len(row)
+		}
+		t.rows = append(t.rows, row)
+	}
+	if t.cols == 0 {
+		return
+	}
+	for i, row := range t.rows {
+		for len(row) < t.cols {
+			row = append(row, &officeCell{})
+		}
+		t.rows[i] = row
+	}
+	if len(d.marks) > 0 && !d.inNote {
+		// bookmarks could not be placed on table itself
+		d.add(to, &officePara{style: officeText}, true)
+	}
+	*to = append(*to, t)
+}
+
+// authors returns book authors for document properties.
+func (d *officeDocument) authors() string {
+	return d.p.Book.BookAuthors(d.p.env.Cfg.Doc.AuthorFormat, false)
+}
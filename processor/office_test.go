@@ -0,0 +1,60 @@
+package processor
+
+import (
+	"reflect"
+	"testing"
+
+	"fb2converter/etree"
+)
+
+func TestOfficeBlocks(t *testing.T) {
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(`<body><div class="section" id="s1"/><p>  Some <span class="emphasis">text <span class="strong">here</span></span>   end </p><div class="poem"><div class="stanza"><p>a</p></div><div class="stanza"><p>b</p></div></div></body>`); err != nil {
+		t.Fatal(err)
+	}
+	d := &officeDocument{anchored: make(map[*etree.Element]*etree.Element)}
+	var blocks []officeBlock
+	d.blocks(doc.Root(), &blocks, officeText)
+
+	var styles []string
+	for _, b := range blocks {
+		styles = append(styles, b.(*officePara).style)
+	}
+	if expected := []string{officeText, officeVerse, officeVerse, officeVerse}; !reflect.DeepEqual(styles, expected) {
+		t.Fatalf("styles: expected %v, got %v", expected, styles)
+	}
+
+	runs := blocks[0].(*officePara).runs
+	if !reflect.DeepEqual(runs[0].marks, []string{"s1"}) {
+		t.Errorf("bookmarks: expected [s1], got %v", runs[0].marks)
+	}
+	var texts []string
+	for _, r := range runs[1:] {
+		texts = append(texts, r.text)
+	}
+	if expected := []string{"Some ", "text ", "here", " end"}; !reflect.DeepEqual(texts, expected) {
+		t.Errorf("text: expected %q, got %q", expected, texts)
+	}
+	if expected := []string{officeEmphasis, officeStrong}; !reflect.DeepEqual(runs[3].styles, expected) {
+		t.Errorf("character styles: expected %v, got %v", expected, runs[3].styles)
+	}
+	if len(blocks[2].(*officePara).runs) != 0 {
+		t.Errorf("stanzas should be separated by empty verse")
+	}
+}
+
+func TestDocxBookmark(t *testing.T) {
+	for id, expected := range map[string]string{
+		"ch1":   "ch1",
+		"n-1.2": "n_1_2",
+		"1st":   "b_1st",
+		"_toc":  "b__toc",
+		"глава": "b______",
+		"a23456789012345678901234567890123456789012": "a234567890123456789012345678901234567890",
+	} {
+		if got := docxBookmark(id); got != expected {
+			t.Errorf("docxBookmark(%q): expected %q, got %q", id, expected, got)
+		}
+	}
+}
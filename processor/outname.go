@@ -0,0 +1,172 @@
+package processor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gosimple/slug"
+
+	"fb2converter/config"
+)
+
+// maxCollisions limits number of attempts to find free output name with counter.
+const maxCollisions = 1000
+
+// fatReserved lists device names which could not be used as file names on FAT file systems (with any extension).
+var fatReserved = []string{
+	"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
+}
+
+// fatSafeName removes characters not allowed in FAT/exFAT file names, drops trailing dots and spaces and changes
+// reserved device names.
+func fatSafeName(in string) string {
+
+	out := strings.TrimRight(strings.Map(func(sym rune) rune {
+		if sym < 0x20 || sym == 0x7F || strings.ContainsRune(`"*/:<>?\|`, sym) {
+			return -1
+		}
+		return sym
+	}, in), ". ")
+
+	stem := out
+	if i := strings.IndexByte(stem, '.'); i >= 0 {
+		stem = stem[:i]
+	}
+	for _, r := range fatReserved {
+		if strings.EqualFold(strings.TrimSpace(stem), r) {
+			out = "_" + out
+			break
+		}
+	}
+	if len(out) == 0 {
+		out = "_bad_file_name_"
+	}
+	return out
+}
+
+// truncateName cuts name to at most max bytes on UTF-8 character boundary. Trailing spaces and dots left by cut are
+// removed. Names are never truncated to nothing.
+func truncateName(name string, max int) string {
+
+	if max < 1 {
+		max = 1
+	}
+	if len(name) <= max {
+		return name
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	if out := strings.TrimRight(name[:cut], ". "); len(out) > 0 {
+		return out
+	}
+	_, size := utf8.DecodeRuneInString(name)
+	return name[:size]
+}
+
+// outputExt returns output file extension for current format. Html site is a directory without extension.
+func (p *Processor) outputExt() string {
+	if p.format == OHtml && p.htmlLayout == HTMLSite {
+		return ""
+	}
+	ext := "." + p.format.String()
+	if p.format == OKepub {
+		ext += "." + OEpub.String()
+	}
+	return ext
+}
+
+// cleanName turns single path element into proper file name according to configuration. Reserve is number of bytes
+// which will be added to the name later (extension).
+func (p *Processor) cleanName(name string, reserve int) string {
+
+	if p.env.Cfg.Doc.FileNameTransliterate {
+		name = slug.Make(name)
+	}
+	name = config.CleanFileName(name)
+	if p.env.Cfg.Doc.FileNameFATSafe {
+		name = fatSafeName(name)
+	}
+	if max := p.env.Cfg.Doc.FileNameMaxBytes; max > 0 {
+		name = truncateName(name, max-reserve)
+	}
+	return name
+}
+
+// insertSuffix adds suffix to the output file name before its extension, name is truncated if necessary.
+func (p *Processor) insertSuffix(fname, suffix string) string {
+
+	dir, name := filepath.Split(fname)
+	ext := p.outputExt()
+	name = strings.TrimSuffix(name, ext)
+	if max := p.env.Cfg.Doc.FileNameMaxBytes; max > 0 {
+		name = truncateName(name, max-len(suffix)-len(ext))
+	}
+	return filepath.Join(dir, name+suffix+ext)
+}
+
+// resolveOutputName applies configured collision handling to the output file name. Function exists reports if name is
+// already taken. Empty name is returned when book should be skipped.
+func (p *Processor) resolveOutputName(fname string, exists func(string) bool) (string, error) {
+
+	if p.overwrite || !exists(fname) {
+		return fname, nil
+	}
+
+	switch p.collision {
+	case CollisionSkip:
+		return "", nil
+	case CollisionID:
+		if name := p.insertSuffix(fname, "_"+p.Book.ID.String()[:8]); !exists(name) {
+			return name, nil
+		}
+		fallthrough
+	case CollisionCounter:
+		for i := 2; i < maxCollisions; i++ {
+			if name := p.insertSuffix(fname, fmt.Sprintf(" (%d)", i)); !exists(name) {
+				return name, nil
+			}
+		}
+	}
+	return fname, fmt.Errorf("output file already exists: %s", fname)
+}
+
+// OutputName returns name of the file Save would produce for specified format and destination, nothing is written.
+// Book description has to be processed first. Names in planned are considered taken, resulting name is added there.
+// Empty name means book would be skipped.
+func (p *Processor) OutputName(format OutputFmt, dst string, planned map[string]bool) (string, error) {
+
+	f := *p
+	f.format, f.dst = format, dst
+
+	fname, err := f.resolveOutputName(f.prepareOutputName(), func(name string) bool {
+		return planned[name] || fileExists(name)
+	})
+	if len(fname) > 0 {
+		planned[fname] = true
+	}
+	return fname, err
+}
+
+// Reserve makes Save treat names in taken as existing files and add names of produced files there. It is useful when
+// results do not stay in destination directory.
+func (p *Processor) Reserve(taken map[string]bool) {
+	p.reserved = taken
+}
+
+// FileNameKeyword returns value of file name format keyword (ex: "#author", "#series") for the book. Book description
+// has to be processed first.
+func (p *Processor) FileNameKeyword(keyword string) string {
+	return CreateFileNameKeywordsMap(p.Book, p.env.Cfg.Doc.AuthorFormatFileName, p.env.Cfg.Doc.SeqNumPos)[keyword]
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
@@ -0,0 +1,51 @@
+package processor
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateName(t *testing.T) {
+
+	for _, tc := range []struct {
+		in  string
+		max int
+		out string
+	}{
+		{"short", 255, "short"},
+		{"Война и мир", 7, "Вой"},
+		{"Война и мир", 12, "Война"},
+		{"Война и мир", 13, "Война и"},
+		{"Война... и мир", 13, "Война"},
+		{"Война", 1, "В"},
+		{"...", 2, "."},
+	} {
+		out := truncateName(tc.in, tc.max)
+		if out != tc.out {
+			t.Errorf("truncateName(%q, %d) = %q, expected %q", tc.in, tc.max, out, tc.out)
+		}
+		if !utf8.ValidString(out) {
+			t.Errorf("truncateName(%q, %d) produced invalid UTF-8", tc.in, tc.max)
+		}
+	}
+}
+
+func TestFATSafeName(t *testing.T) {
+
+	for _, tc := range []struct {
+		in  string
+		out string
+	}{
+		{"Толстой: Война и мир?", "Толстой Война и мир"},
+		{`a<b>c"d|e*f\g`, "abcdefg"},
+		{"name. . ", "name"},
+		{"con", "_con"},
+		{"COM1.tar", "_COM1.tar"},
+		{"CONSOLE", "CONSOLE"},
+		{"???", "_bad_file_name_"},
+	} {
+		if out := fatSafeName(tc.in); out != tc.out {
+			t.Errorf("fatSafeName(%q) = %q, expected %q", tc.in, out, tc.out)
+		}
+	}
+}
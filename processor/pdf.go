@@ -0,0 +1,1189 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/go-pdf/fpdf"
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+	"fb2converter/static"
+)
+
+// pdfPageSizes lists supported page dimensions in millimeters.
+var pdfPageSizes = map[PageSize][2]float64{
+	PageA5:  {148, 210},
+	PageA6:  {105, 148},
+	Page6in: {90, 122},
+}
+
+const (
+	pdfFamily  = "text"
+	pdfLeading = 1.25 // line height relative to font size
+	pdfNoteMul = 0.8  // footnotes font size relative to text
+	pdfMM      = 72 / 25.4
+)
+
+// pdfBox is the smallest piece of text drawn with the same attributes. Words consist of one or more boxes.
+type pdfBox struct {
+	text  string
+	style string
+	size  float64
+	rise  float64
+	width float64
+	link  string   // external link
+	dest  string   // id of internal link target
+	ids   []string // link targets defined at this position
+	note  []string // footnote paragraphs, marker is box text
+	shy   bool     // word could be hyphenated after this box
+}
+
+// pdfPara is a block of text to be broken into lines.
+type pdfPara struct {
+	words  [][]*pdfBox
+	align  string // "J", "L", "C" or "R"
+	size   float64
+	indent float64 // first line
+	left   float64
+	right  float64
+	before float64
+	after  float64
+	keep   bool // keep with following lines (headings)
+}
+
+// pdfLine is a single laid out line, box positions are relative to the line start.
+type pdfLine struct {
+	boxes  []*pdfBox
+	xs     []float64
+	height float64
+	ascent float64
+}
+
+// pdfRenderer typesets processed XHTML content.
+type pdfRenderer struct {
+	p      *Processor
+	pdf    *fpdf.Fpdf
+	width  float64
+	height float64
+	margin float64
+	size   float64
+	// vertical position on the current page
+	y     float64
+	empty bool
+	// footnote lines waiting for the bottom of the current page
+	notes []*pdfLine
+	// link targets and outline
+	links    map[string]int
+	toc      map[string]*tocEntry
+	level    int
+	pending  []string
+	anchored map[*etree.Element][]string
+	float    bool
+	images   map[string]*fpdf.ImageInfoType
+	spaces   map[string]float64
+	defined  map[int]bool
+	cover    int
+}
+
+// FinalizePDF typesets book content into pdf file using previously saved images.
+func (p *Processor) FinalizePDF(fname string) error {
+
+	if _, err := os.Stat(fname); err == nil {
+		if !p.overwrite {
+			return fmt.Errorf("output file already exists: %s", fname)
+		}
+		p.env.Log.Warn("Overwriting existing file", zap.String("file", fname))
+		if err = os.Remove(fname); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	} else if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+		return fmt.Errorf("unable to create output directory: %w", err)
+	}
+
+	p.env.Log.Debug("Typesetting pdf - start")
+	defer func(start time.Time) {
+		p.env.Log.Debug("Typesetting pdf - done", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	r, err := p.newPDFRenderer()
+	if err != nil {
+		return err
+	}
+	r.render()
+	if err := r.pdf.Error(); err != nil {
+		return fmt.Errorf("unable to typeset pdf: %w", err)
+	}
+
+	out, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	if err := r.pdf.Output(out); err != nil {
+		out.Close()
+		return fmt.Errorf("unable to write pdf file %s: %w", fname, err)
+	}
+	return out.Close()
+}
+
+// newPDFRenderer prepares document with configured page size and fonts.
+func (p *Processor) newPDFRenderer() (*pdfRenderer, error) {
+
+	cfg := &p.env.Cfg.Doc.PDF
+
+	size := ParsePageSizeString(cfg.PageSize)
+	if size == UnsupportedPageSize {
+		p.env.Log.Warn("Unknown pdf page size requested, using default", zap.String("size", cfg.PageSize))
+		size = PageA5
+	}
+	dim := pdfPageSizes[size]
+
+	r := &pdfRenderer{
+		p:        p,
+		width:    dim[0] * pdfMM,
+		height:   dim[1] * pdfMM,
+		margin:   cfg.Margin * pdfMM,
+		size:     cfg.FontSize,
+		links:    make(map[string]int),
+		toc:      make(map[string]*tocEntry),
+		level:    -1,
+		anchored: make(map[*etree.Element][]string),
+		float:    p.notesMode == NFloat || p.notesMode == NFloatOld || p.notesMode == NFloatNew,
+		images:   make(map[string]*fpdf.ImageInfoType),
+		spaces:   make(map[string]float64),
+		defined:  make(map[int]bool),
+		empty:    true,
+	}
+	if r.size <= 0 {
+		r.size = 11
+	}
+	if r.margin < 0 || 2*r.margin > r.width/2 {
+		p.env.Log.Warn("Bad pdf page margin requested, using default", zap.Float64("margin", cfg.Margin))
+		r.margin = 12 * pdfMM
+	}
+
+	r.pdf = fpdf.NewCustom(&fpdf.InitType{UnitStr: "pt", Size: fpdf.SizeType{Wd: r.width, Ht: r.height}})
+	r.pdf.SetAutoPageBreak(false, 0)
+	r.pdf.SetMargins(r.margin, r.margin, r.margin)
+	r.pdf.SetTitle(p.Book.Title, true)
+	r.pdf.SetAuthor(p.Book.BookAuthors(p.env.Cfg.Doc.AuthorFormat, false), true)
+	r.pdf.SetSubject(p.Book.Annotation, true)
+	r.pdf.SetKeywords(strings.Join(p.Book.GenreNames, ", "), true)
+	r.pdf.SetCreator("fb2converter", true)
+
+	faces, err := p.pdfFonts()
+	if err != nil {
+		return nil, err
+	}
+	for style, data := range faces {
+		r.pdf.AddUTF8FontFromBytes(pdfFamily, style, data)
+	}
+	r.pdf.SetFont(pdfFamily, "", r.size)
+	if err := r.pdf.Error(); err != nil {
+		return nil, fmt.Errorf("unable to load pdf fonts: %w", err)
+	}
+
+	for _, te := range p.Book.TOC {
+		if i := strings.LastIndex(te.ref, "#"); i >= 0 {
+			r.toc[te.ref[i+1:]] = te
+		}
+	}
+	return r, nil
+}
+
+// pdfFonts returns font faces by fpdf style. Faces missing from configured family are replaced with regular one.
+func (p *Processor) pdfFonts() (map[string][]byte, error) {
+
+	faces := make(map[string][]byte)
+	if name := p.env.Cfg.Doc.PDF.FontFamily; len(name) > 0 {
+		var found bool
+		for _, family := range p.env.Cfg.Doc.Fonts.Families {
+			if !strings.EqualFold(family.Name, name) {
+				continue
+			}
+			found = true
+			for style, fname := range map[string]string{"": family.Regular, "B": family.Bold, "I": family.Italic, "BI": family.BoldItalic} {
+				if len(fname) == 0 {
+					continue
+				}
+				if !filepath.IsAbs(fname) {
+					fname = filepath.Join(p.env.Cfg.Path, fname)
+				}
+				data, err := os.ReadFile(fname)
+				if err != nil {
+					p.env.Log.Warn("Font file not found. Skipping...", zap.String("family", family.Name), zap.String("file", fname), zap.Error(err))
+					continue
+				}
+				faces[style] = data
+			}
+			break
+		}
+		if !found {
+			p.env.Log.Warn("Font family for pdf is not configured, using default", zap.String("family", name))
+		}
+	}
+	if _, ok := faces[""]; !ok {
+		data, err := static.Asset(path.Join(DirResources, "LinLibertine_RBah.ttf"))
+		if err != nil {
+			return nil, fmt.Errorf("unable to get default font: %w", err)
+		}
+		faces[""] = data
+	}
+	for _, style := range []string{"B", "I", "BI"} {
+		if _, ok := faces[style]; !ok {
+			faces[style] = faces[""]
+		}
+	}
+	return faces, nil
+}
+
+// render lays out all pages.
+func (r *pdfRenderer) render() {
+
+	r.coverPage()
+	notes := r.p.floatNotesFiles()
+	for _, f := range r.p.Book.Files {
+		if f == nil || f.doc == nil || f.id == "cover-page" {
+			continue
+		}
+		if notes[f.id] {
+			// notes are placed at the bottom of pages
+			continue
+		}
+		body := f.doc.FindElement("./html/body")
+		if body == nil {
+			continue
+		}
+		for a, n := range matchNotes(body) {
+			r.anchored[a] = []string{normalizeSpaces(plainText(n))}
+		}
+		r.pending = append(r.pending, strings.TrimSuffix(f.fname, ".xhtml"))
+		r.blocks(body, &pdfPara{})
+	}
+
+	if r.pdf.PageNo() == 0 {
+		r.newPage()
+	}
+	r.finishPage()
+	for len(r.notes) > 0 {
+		// notes which did not fit
+		r.pdf.AddPage()
+		r.y, r.empty = r.margin, true
+		r.finishPage()
+	}
+
+	// links to targets which were not typeset
+	for _, l := range r.links {
+		if !r.defined[l] {
+			r.pdf.SetLink(l, 0, 1)
+		}
+	}
+}
+
+// coverPage puts cover image on its own page.
+func (r *pdfRenderer) coverPage() {
+
+	if len(r.p.Book.Cover) == 0 {
+		return
+	}
+	for _, b := range r.p.Book.Images {
+		if b.id != r.p.Book.Cover {
+			continue
+		}
+		info := r.image(path.Join(DirImages, b.fname))
+		if info == nil {
+			return
+		}
+		r.pdf.AddPage()
+		w, h := info.Width(), info.Height()
+		scale := r.width / w
+		if r.height/h < scale {
+			scale = r.height / h
+		}
+		r.pdf.ImageOptions(path.Join(DirImages, b.fname), (r.width-w*scale)/2, (r.height-h*scale)/2, w*scale, h*scale, false, fpdf.ImageOptions{}, 0, "")
+		r.cover = r.pdf.PageNo()
+		r.newPage()
+		return
+	}
+}
+
+// newPage finishes current page and starts new one.
+func (r *pdfRenderer) newPage() {
+	if r.pdf.PageNo() > 0 {
+		r.finishPage()
+	}
+	r.pdf.AddPage()
+	r.y, r.empty = r.margin, true
+}
+
+// finishPage draws footnotes which fit on the page and page number.
+func (r *pdfRenderer) finishPage() {
+
+	if r.pdf.PageNo() == r.cover || (r.empty && len(r.notes) == 0) {
+		return
+	}
+
+	if len(r.notes) > 0 {
+		var (
+			gap   = r.size * pdfNoteMul
+			avail = r.bottom() - r.y - gap
+			h     float64
+			n     int
+		)
+		for n < len(r.notes) && (h+r.notes[n].height <= avail || (n == 0 && r.empty)) {
+			h += r.notes[n].height
+			n++
+		}
+		if n > 0 {
+			y := r.bottom() - h
+			r.pdf.SetLineWidth(0.5)
+			r.pdf.Line(r.margin, y-gap/2, r.margin+(r.width-2*r.margin)/3, y-gap/2)
+			for _, l := range r.notes[:n] {
+				r.drawLine(l, r.margin, y)
+				y += l.height
+			}
+			r.notes = r.notes[n:]
+		}
+	}
+
+	r.pdf.SetFont(pdfFamily, "", r.size*pdfNoteMul)
+	num := strconv.Itoa(r.pdf.PageNo())
+	r.pdf.Text((r.width-r.pdf.GetStringWidth(num))/2, r.height-r.margin/2, num)
+	r.empty = true
+}
+
+// bottom returns vertical position where page text area ends.
+func (r *pdfRenderer) bottom() float64 {
+	return r.height - r.margin
+}
+
+// notesHeight returns vertical space taken by footnotes waiting for the current page.
+func (r *pdfRenderer) notesHeight(lines []*pdfLine) float64 {
+	var h float64
+	for _, l := range lines {
+		h += l.height
+	}
+	if h > 0 {
+		h += r.size * pdfNoteMul
+	}
+	return h
+}
+
+// matchNotes pairs inline and block note anchors with their bodies, which follow them in the same order.
+func matchNotes(body *etree.Element) map[*etree.Element]*etree.Element {
+
+	var anchors, bodies []*etree.Element
+	var walk func(e *etree.Element)
+	walk = func(e *etree.Element) {
+		for _, c := range e.ChildElements() {
+			switch class := getAttrValue(c, "class"); class {
+			case "inlineanchor", "blockanchor":
+				anchors = append(anchors, c)
+			case "inlinenote":
+				bodies = append(bodies, c)
+			case "blocknote":
+				bodies = append(bodies, c.ChildElements()...)
+			default:
+				walk(c)
+			}
+		}
+	}
+	walk(body)
+	matched := make(map[*etree.Element]*etree.Element)
+	for i, a := range anchors {
+		if i < len(bodies) {
+			matched[a] = bodies[i]
+		}
+	}
+	return matched
+}
+
+// plainText returns element text without note numbers and soft hyphens.
+func plainText(e *etree.Element) string {
+	var sb strings.Builder
+	for _, t := range e.Child {
+		switch v := t.(type) {
+		case *etree.CharData:
+			sb.WriteString(v.Data)
+		case *etree.Element:
+			if getAttrValue(v, "class") != "notenum" {
+				sb.WriteString(plainText(v))
+			}
+			sb.WriteString(v.Tail())
+		}
+	}
+	return strings.ReplaceAll(sb.String(), strSOFTHYPHEN, "")
+}
+
+// blocks typesets block level children of the element using style of the enclosing block.
+func (r *pdfRenderer) blocks(e *etree.Element, style *pdfPara) {
+	for _, c := range e.ChildElements() {
+		r.block(c, style)
+	}
+}
+
+// hasBlocks checks if element contains block level elements.
+func hasBlocks(e *etree.Element) bool {
+	for _, c := range e.ChildElements() {
+		switch c.Tag {
+		case "div", "p", "table", "aside", "section", "h1", "h2", "h3", "h4", "h5", "h6", "blockquote", "ul", "ol":
+			return true
+		}
+	}
+	return false
+}
+
+func (r *pdfRenderer) block(c *etree.Element, style *pdfPara) {
+
+	if id := getAttrValue(c, "id"); len(id) > 0 {
+		r.pending = append(r.pending, id)
+	}
+
+	class := getAttrValue(c, "class")
+	s := *style
+	s.before, s.after, s.keep = 0, 0, false
+	switch {
+	case class == "titleblock", class == "titleblock_nobreak", class == "titlenotes":
+		r.heading(c, class, &s)
+	case class == "epigraph":
+		s.left += (r.width - 2*r.margin) / 3
+		s.size = r.size * 0.9
+		r.space(r.size * 0.5)
+		r.blocks(c, &s)
+		r.space(r.size * 0.5)
+	case class == "cite", class == "annotation":
+		s.left += r.size * 1.5
+		s.right += r.size * 1.5
+		s.size = r.size * 0.9
+		r.space(r.size * 0.5)
+		r.blocks(c, &s)
+		r.space(r.size * 0.5)
+	case class == "poem":
+		s.left += r.size * 2
+		r.space(r.size * 0.5)
+		r.blocks(c, &s)
+		r.space(r.size * 0.5)
+	case class == "stanza":
+		s.align, s.indent = "L", 0
+		for _, v := range c.ChildElements() {
+			if v.Tag == "p" && len(getAttrValue(v, "class")) == 0 {
+				r.paragraph(v, &s, "")
+			} else {
+				r.block(v, &s)
+			}
+		}
+		r.space(r.size * 0.5)
+	case class == "text-author":
+		s.align = "R"
+		r.paragraph(c, &s, "I")
+	case class == "emptyline":
+		r.space(r.size * pdfLeading)
+	case class == "image", strings.HasPrefix(class, "vignette"):
+		for _, img := range c.FindElements(".//img") {
+			r.picture(getAttrValue(img, "src"), strings.HasPrefix(class, "vignette"))
+		}
+	case class == "blocknote":
+		// notes are at the bottom of pages
+	case class == "section", class == "chapter_end":
+		r.blocks(c, &s)
+	case strings.HasPrefix(class, "indent") && len(class) > 6:
+		// table of contents
+		if n, err := strconv.Atoi(class[6:]); err == nil {
+			s.left += float64(n) * r.size
+		}
+		s.align, s.indent = "L", 0
+		r.paragraph(c, &s, "")
+	case c.Tag == "table":
+		r.table(c, &s)
+	case c.Tag == "p" && class == "subtitle":
+		s.align, s.indent, s.before, s.after, s.keep = "C", 0, r.size*0.5, r.size*0.5, true
+		r.paragraph(c, &s, "B")
+	case c.Tag == "p":
+		if len(s.align) == 0 {
+			s.align, s.indent = "J", r.size*1.5
+		}
+		r.paragraph(c, &s, "")
+	case hasBlocks(c):
+		r.blocks(c, &s)
+	default:
+		r.paragraph(c, &s, "")
+	}
+}
+
+// heading typesets title block, starting new page when necessary.
+func (r *pdfRenderer) heading(c *etree.Element, class string, style *pdfPara) {
+
+	if class == "titleblock" && !r.empty {
+		r.newPage()
+	}
+	for _, d := range c.ChildElements() {
+		dc := getAttrValue(d, "class")
+		if strings.HasPrefix(dc, "vignette") {
+			r.block(d, style)
+			continue
+		}
+		if id := getAttrValue(d, "id"); len(id) > 0 {
+			r.pending = append(r.pending, id)
+		}
+		mul := 1.0
+		if n, err := strconv.Atoi(strings.TrimPrefix(dc, "h")); err == nil && strings.HasPrefix(dc, "h") {
+			switch n {
+			case 0:
+				mul = 1.6
+			case 1:
+				mul = 1.4
+			case 2:
+				mul = 1.25
+			case 3:
+				mul = 1.15
+			default:
+				mul = 1.05
+			}
+		}
+		s := *style
+		s.align, s.indent, s.size, s.keep = "C", 0, r.size*mul, true
+		s.before, s.after = 0, 0
+		lines := d.ChildElements()
+		if len(lines) == 0 || !hasBlocks(d) {
+			lines = []*etree.Element{d}
+		}
+		for i, l := range lines {
+			if i == 0 {
+				s.before = r.size
+			}
+			if i == len(lines)-1 {
+				s.after = r.size
+			}
+			r.paragraph(l, &s, "B")
+			s.before, s.after = 0, 0
+		}
+	}
+}
+
+// space adds vertical gap unless page was just started.
+func (r *pdfRenderer) space(h float64) {
+	if r.empty {
+		return
+	}
+	if r.y+h > r.bottom()-r.notesHeight(r.notes) {
+		r.newPage()
+		return
+	}
+	r.y += h
+}
+
+// paragraph collects inline content of the element and typesets it.
+func (r *pdfRenderer) paragraph(e *etree.Element, style *pdfPara, font string) {
+
+	s := *style
+	if s.size == 0 {
+		s.size = r.size
+	}
+	if len(s.align) == 0 {
+		s.align = "L"
+	}
+	var boxes []*pdfBox
+	r.inline(e, &boxes, &pdfBox{style: font, size: s.size})
+	s.words = r.words(boxes)
+	if len(s.words) == 0 {
+		if len(strings.TrimSpace(plainText(e))) == 0 {
+			// empty paragraph keeps its place
+			r.space(s.size * pdfLeading)
+		}
+		return
+	}
+	if len(r.pending) > 0 {
+		s.words[0][0].ids = append(r.pending, s.words[0][0].ids...)
+		r.pending = nil
+	}
+	r.place(&s)
+}
+
+// inline collects text boxes from the element content.
+func (r *pdfRenderer) inline(e *etree.Element, to *[]*pdfBox, cur *pdfBox) {
+	for _, t := range e.Child {
+		switch v := t.(type) {
+		case *etree.CharData:
+			r.chars(v.Data, to, cur)
+		case *etree.Element:
+			r.element(v, to, cur)
+			r.chars(v.Tail(), to, cur)
+		}
+	}
+}
+
+func (r *pdfRenderer) chars(text string, to *[]*pdfBox, cur *pdfBox) {
+	if len(text) == 0 {
+		return
+	}
+	b := *cur
+	b.text = strings.NewReplacer("\n", " ", "\r", " ", "\t", " ").Replace(text)
+	b.ids, b.note = nil, nil
+	*to = append(*to, &b)
+}
+
+func (r *pdfRenderer) element(e *etree.Element, to *[]*pdfBox, cur *pdfBox) {
+
+	if id := getAttrValue(e, "id"); len(id) > 0 {
+		*to = append(*to, &pdfBox{style: cur.style, size: cur.size, ids: []string{id}})
+	}
+
+	b := *cur
+	class := getAttrValue(e, "class")
+	switch {
+	case e.Tag == "br":
+		r.chars(" ", to, cur)
+		return
+	case e.Tag == "img", class == "inlinenote", class == "notenum":
+		return
+	case class == "inlineanchor", class == "blockanchor":
+		note, ok := r.anchored[e]
+		if !ok {
+			break
+		}
+		r.marker(strings.TrimSpace(plainText(e)), note, to, cur)
+		return
+	case e.Tag == "a":
+		href := getAttrValue(e, "href")
+		u, err := url.Parse(href)
+		if err != nil || len(href) == 0 {
+			break
+		}
+		if len(u.Scheme) > 0 {
+			b.link = href
+			break
+		}
+		if n, ok := r.p.Book.Notes[u.Fragment]; ok && r.float {
+			r.marker(strings.TrimSpace(plainText(e)), strings.Split(strings.TrimSpace(n.body), "\n"), to, cur)
+			return
+		}
+		if len(u.Fragment) > 0 {
+			b.dest = u.Fragment
+		} else if f := strings.TrimSuffix(u.Path, ".xhtml"); len(f) > 0 {
+			b.dest = f
+		}
+	case e.Tag == "sup":
+		b.size, b.rise = cur.size*0.7, cur.rise+cur.size*0.35
+	case e.Tag == "sub":
+		b.size, b.rise = cur.size*0.7, cur.rise-cur.size*0.15
+	case class == "emphasis", e.Tag == "em", e.Tag == "i":
+		if !strings.Contains(b.style, "I") {
+			b.style += "I"
+		}
+	case class == "strong", e.Tag == "b":
+		if !strings.Contains(b.style, "B") {
+			b.style = "B" + b.style
+		}
+	}
+	r.inline(e, to, &b)
+}
+
+// marker adds footnote reference.
+func (r *pdfRenderer) marker(text string, note []string, to *[]*pdfBox, cur *pdfBox) {
+	if len(text) == 0 {
+		text = "*"
+	}
+	*to = append(*to, &pdfBox{
+		text:  strings.Trim(text, "[]{}"),
+		style: cur.style,
+		size:  cur.size * 0.7,
+		rise:  cur.rise + cur.size*0.35,
+		note:  note,
+	})
+}
+
+// words splits boxes on spaces and soft hyphens, measuring them.
+func (r *pdfRenderer) words(boxes []*pdfBox) [][]*pdfBox {
+
+	var (
+		words [][]*pdfBox
+		word  []*pdfBox
+	)
+	add := func(b *pdfBox, text string, shy bool) {
+		n := *b
+		n.text, n.shy = text, shy
+		if len(text) > 0 {
+			r.pdf.SetFont(pdfFamily, n.style, n.size)
+			n.width = r.pdf.GetStringWidth(text)
+		}
+		word = append(word, &n)
+	}
+	for _, b := range boxes {
+		if len(b.text) == 0 {
+			// link target or note marker without text
+			add(b, "", false)
+			continue
+		}
+		for i, part := range strings.Split(b.text, " ") {
+			if i > 0 && len(word) > 0 {
+				words = append(words, word)
+				word = nil
+			}
+			syllables := strings.Split(part, strSOFTHYPHEN)
+			for j, syl := range syllables {
+				if len(syl) > 0 {
+					add(b, syl, j < len(syllables)-1)
+				}
+			}
+		}
+	}
+	if len(word) > 0 {
+		words = append(words, word)
+	}
+
+	// words made only of link targets are joined to neighbours
+	var res [][]*pdfBox
+	var ids []*pdfBox
+	for _, w := range words {
+		empty := true
+		for _, b := range w {
+			if len(b.text) > 0 {
+				empty = false
+				break
+			}
+		}
+		if empty {
+			ids = append(ids, w...)
+			continue
+		}
+		res = append(res, append(ids, w...))
+		ids = nil
+	}
+	if len(ids) > 0 && len(res) > 0 {
+		res[len(res)-1] = append(res[len(res)-1], ids...)
+	}
+	return res
+}
+
+// space returns width of space for the box.
+func (r *pdfRenderer) spaceWidth(b *pdfBox) float64 {
+	key := b.style + strconv.FormatFloat(b.size, 'f', 2, 64)
+	if w, ok := r.spaces[key]; ok {
+		return w
+	}
+	r.pdf.SetFont(pdfFamily, b.style, b.size)
+	w := r.pdf.GetStringWidth(" ")
+	r.spaces[key] = w
+	return w
+}
+
+// hyphen returns box with hyphen ending broken word.
+func (r *pdfRenderer) hyphen(b *pdfBox) *pdfBox {
+	h := &pdfBox{text: "-", style: b.style, size: b.size, rise: b.rise, link: b.link, dest: b.dest}
+	r.pdf.SetFont(pdfFamily, h.style, h.size)
+	h.width = r.pdf.GetStringWidth(h.text)
+	return h
+}
+
+func wordWidth(w []*pdfBox) float64 {
+	var res float64
+	for _, b := range w {
+		res += b.width
+	}
+	return res
+}
+
+// breakLines breaks paragraph into lines using soft hyphens when word does not fit.
+func (r *pdfRenderer) breakLines(s *pdfPara) [][][]*pdfBox {
+
+	var (
+		lines [][][]*pdfBox
+		line  [][]*pdfBox
+		used  float64
+		full  = r.width - 2*r.margin - s.left - s.right
+	)
+	avail := func() float64 {
+		if len(lines) == 0 {
+			return full - s.indent
+		}
+		return full
+	}
+	finish := func() {
+		lines = append(lines, line)
+		line, used = nil, 0
+	}
+
+	words := append([][]*pdfBox(nil), s.words...)
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		ww := wordWidth(w)
+		var sp float64
+		if len(line) > 0 {
+			sp = r.spaceWidth(w[0])
+		}
+		if used+sp+ww <= avail() {
+			line = append(line, w)
+			used += sp + ww
+			continue
+		}
+		// try to hyphenate
+		var (
+			cut   = -1
+			width float64
+		)
+		for j, b := range w {
+			width += b.width
+			if b.shy && used+sp+width+r.hyphen(b).width <= avail() {
+				cut = j
+			}
+		}
+		if cut >= 0 {
+			head := append(append([]*pdfBox{}, w[:cut+1]...), r.hyphen(w[cut]))
+			line = append(line, head)
+			finish()
+			words[i] = w[cut+1:]
+			i--
+			continue
+		}
+		if len(line) == 0 {
+			// word longer than line
+			line = append(line, w)
+			finish()
+			continue
+		}
+		finish()
+		i--
+	}
+	if len(line) > 0 {
+		finish()
+	}
+	return lines
+}
+
+// layout breaks paragraph into lines positioning boxes relative to the text area.
+func (r *pdfRenderer) layout(s *pdfPara) []*pdfLine {
+
+	var (
+		res   []*pdfLine
+		lines = r.breakLines(s)
+		full  = r.width - 2*r.margin - s.left - s.right
+	)
+	for i, words := range lines {
+		l := &pdfLine{height: s.size * pdfLeading, ascent: s.size * 0.9}
+		x, avail := s.left, full
+		if i == 0 {
+			x += s.indent
+			avail -= s.indent
+		}
+		var natural, gaps float64
+		for j, w := range words {
+			if j > 0 {
+				natural += r.spaceWidth(w[0])
+				gaps++
+			}
+			natural += wordWidth(w)
+		}
+		extra := 0.0
+		switch s.align {
+		case "C":
+			x += (avail - natural) / 2
+		case "R":
+			x += avail - natural
+		case "J":
+			if i < len(lines)-1 && gaps > 0 && natural < avail {
+				extra = (avail - natural) / gaps
+			}
+		}
+		for j, w := range words {
+			if j > 0 {
+				x += r.spaceWidth(w[0]) + extra
+			}
+			for _, b := range w {
+				l.boxes = append(l.boxes, b)
+				l.xs = append(l.xs, x)
+				x += b.width
+				if b.size*pdfLeading > l.height {
+					l.height, l.ascent = b.size*pdfLeading, b.size*0.9
+				}
+			}
+		}
+		res = append(res, l)
+	}
+	return res
+}
+
+// place puts paragraph lines on pages.
+func (r *pdfRenderer) place(s *pdfPara) {
+
+	lines := r.layout(s)
+	if !r.empty {
+		r.y += s.before
+	}
+	if s.keep && !r.empty {
+		// heading should not be the last thing on the page
+		if r.y+s.size*pdfLeading*float64(len(lines)+2) > r.bottom()-r.notesHeight(r.notes) {
+			r.newPage()
+		}
+	}
+	for _, l := range lines {
+		r.put(l)
+	}
+	r.y += s.after
+}
+
+// put draws line on the current page or starts new one, footnotes referenced in the line go to the page bottom.
+func (r *pdfRenderer) put(l *pdfLine) {
+
+	var notes []*pdfLine
+	for _, b := range l.boxes {
+		for i, text := range b.note {
+			s := &pdfPara{align: "J", size: r.size * pdfNoteMul}
+			var boxes []*pdfBox
+			if i == 0 {
+				boxes = append(boxes, &pdfBox{text: b.text + " ", style: "B", size: s.size})
+			}
+			boxes = append(boxes, &pdfBox{text: text, size: s.size})
+			if s.words = r.words(boxes); len(s.words) > 0 {
+				notes = append(notes, r.layout(s)...)
+			}
+		}
+	}
+
+	if r.pdf.PageNo() == 0 || (!r.empty && r.y+l.height+r.notesHeight(append(r.notes[:len(r.notes):len(r.notes)], notes...)) > r.bottom()) {
+		r.newPage()
+	}
+	r.drawLine(l, r.margin, r.y)
+	r.y += l.height
+	r.notes = append(r.notes, notes...)
+	r.empty = false
+}
+
+// drawLine outputs line boxes at the specified position.
+func (r *pdfRenderer) drawLine(l *pdfLine, x, y float64) {
+
+	base := y + l.ascent
+	for i, b := range l.boxes {
+		bx := x + l.xs[i]
+		for _, id := range b.ids {
+			r.target(id, y)
+		}
+		if len(b.text) == 0 {
+			continue
+		}
+		r.pdf.SetFont(pdfFamily, b.style, b.size)
+		r.pdf.Text(bx, base-b.rise, b.text)
+		switch {
+		case len(b.link) > 0:
+			r.pdf.LinkString(bx, base-b.rise-b.size*0.8, b.width, b.size, b.link)
+		case len(b.dest) > 0:
+			r.pdf.Link(bx, base-b.rise-b.size*0.8, b.width, b.size, r.link(b.dest))
+		}
+	}
+}
+
+// link returns internal link for the target id.
+func (r *pdfRenderer) link(id string) int {
+	if l, ok := r.links[id]; ok {
+		return l
+	}
+	l := r.pdf.AddLink()
+	r.links[id] = l
+	return l
+}
+
+// target defines link target and outline entry at the position on the current page.
+func (r *pdfRenderer) target(id string, y float64) {
+	l := r.link(id)
+	if !r.defined[l] {
+		r.pdf.SetLink(l, y, -1)
+		r.defined[l] = true
+	}
+	r.bookmark(id, y)
+}
+
+// bookmark adds outline entry when id belongs to table of contents.
+func (r *pdfRenderer) bookmark(id string, y float64) {
+
+	te, ok := r.toc[id]
+	if !ok {
+		return
+	}
+	delete(r.toc, id)
+
+	level := te.level.Int()
+	if len(te.bodyName) > 0 || te.main || level < 0 {
+		level = 0
+	}
+	if level > r.level+1 {
+		level = r.level + 1
+	}
+	r.level = level
+	r.pdf.Bookmark(strings.TrimSpace(AllLines(te.title)), level, y)
+}
+
+// image registers picture from saved content with pdf document.
+func (r *pdfRenderer) image(src string) *fpdf.ImageInfoType {
+
+	if info, ok := r.images[src]; ok {
+		return info
+	}
+	r.images[src] = nil
+
+	data, err := r.p.readContent(src)
+	if err != nil {
+		r.p.env.Log.Warn("Unable to read image, skipping", zap.String("src", src), zap.Error(err))
+		return nil
+	}
+	var kind string
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		kind = "JPG"
+	case "image/png":
+		kind = "PNG"
+	case "image/gif":
+		kind = "GIF"
+	}
+	if len(kind) > 0 {
+		info := r.pdf.RegisterImageOptionsReader(src, fpdf.ImageOptions{ImageType: kind}, bytes.NewReader(data))
+		if r.pdf.Ok() {
+			r.images[src] = info
+			return info
+		}
+		// unsupported variant of the format (interlacing, 16 bits per channel)
+		r.pdf.ClearError()
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		r.p.env.Log.Warn("Unable to decode image for pdf, skipping", zap.String("src", src), zap.Error(err))
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, imaging.Clone(img)); err != nil {
+		r.p.env.Log.Warn("Unable to convert image for pdf, skipping", zap.String("src", src), zap.Error(err))
+		return nil
+	}
+	info := r.pdf.RegisterImageOptionsReader(src, fpdf.ImageOptions{ImageType: "PNG"}, &buf)
+	if !r.pdf.Ok() {
+		r.p.env.Log.Warn("Unable to add image to pdf, skipping", zap.String("src", src), zap.Error(r.pdf.Error()))
+		r.pdf.ClearError()
+		return nil
+	}
+	r.images[src] = info
+	return info
+}
+
+// picture puts block image scaled to fit text area, vignettes are kept small.
+func (r *pdfRenderer) picture(src string, vignette bool) {
+
+	if len(src) == 0 || strings.EqualFold(path.Ext(src), ".svg") {
+		return
+	}
+	info := r.image(src)
+	if info == nil {
+		return
+	}
+
+	maxw, maxh := r.width-2*r.margin, r.bottom()-r.margin-r.size*pdfLeading
+	if vignette {
+		maxw /= 2
+		maxh = r.size * 3
+	}
+	w, h := info.Width(), info.Height()
+	if scale := maxw / w; scale < 1 {
+		w, h = w*scale, h*scale
+	}
+	if scale := maxh / h; scale < 1 {
+		w, h = w*scale, h*scale
+	}
+
+	if r.pdf.PageNo() == 0 || (!r.empty && r.y+h > r.bottom()-r.notesHeight(r.notes)) {
+		r.newPage()
+	}
+	for _, id := range r.pending {
+		r.target(id, r.y)
+	}
+	r.pending = nil
+	r.pdf.ImageOptions(src, (r.width-w)/2, r.y, w, h, false, fpdf.ImageOptions{}, 0, "")
+	r.y += h + r.size*0.5
+	r.empty = false
+}
+
+// table typesets table as grid of cells with equal widths.
+func (r *pdfRenderer) table(c *etree.Element, style *pdfPara) {
+
+	var rows [][]*etree.Element
+	cols := 0
+	for _, tr := range c.FindElements(".//tr") {
+		var row []*etree.Element
+		for _, td := range tr.ChildElements() {
+			if td.Tag == "td" || td.Tag == "th" {
+				row = append(row, td)
+			}
+		}
+		if len(row) > cols {
+			cols = len(row)
+		}
+		if len(row) > 0 {
+			rows = append(rows, row)
+		}
+	}
+	if cols == 0 {
+		return
+	}
+
+	const pad = 3.0
+	var (
+		left  = r.margin + style.left
+		width = (r.width - 2*r.margin - style.left - style.right) / float64(cols)
+		size  = r.size * 0.9
+	)
+	r.space(r.size * 0.5)
+	for _, row := range rows {
+		var (
+			cells  [][]*pdfLine
+			height float64
+		)
+		for _, td := range row {
+			font := ""
+			if td.Tag == "th" {
+				font = "B"
+			}
+			var boxes []*pdfBox
+			r.inline(td, &boxes, &pdfBox{style: font, size: size})
+			s := &pdfPara{align: "L", size: size, right: r.width - 2*r.margin - width + 2*pad}
+			s.words = r.words(boxes)
+			lines := r.layout(s)
+			h := 2 * pad
+			for _, l := range lines {
+				h += l.height
+			}
+			cells = append(cells, lines)
+			if h > height {
+				height = h
+			}
+		}
+		if r.pdf.PageNo() == 0 || (!r.empty && r.y+height > r.bottom()-r.notesHeight(r.notes)) {
+			r.newPage()
+		}
+		r.pdf.SetLineWidth(0.5)
+		for i := 0; i < cols; i++ {
+			x := left + float64(i)*width
+			r.pdf.Rect(x, r.y, width, height, "D")
+			if i >= len(cells) {
+				continue
+			}
+			y := r.y + pad
+			for _, l := range cells[i] {
+				r.drawLine(l, x+pad, y)
+				y += l.height
+			}
+		}
+		r.y += height
+		r.empty = false
+	}
+	r.space(r.size * 0.5)
+}
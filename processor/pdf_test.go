@@ -0,0 +1,194 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"fb2converter/config"
+)
+
+// pdfBook returns book with several chapters long enough to take few pages and notes of two bodies.
+func pdfBook() string {
+
+	var buf strings.Builder
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description><title-info><book-title>Typeset</book-title><lang>en</lang></title-info></description>
+<body>`)
+	for s := 1; s <= 3; s++ {
+		fmt.Fprintf(&buf, `<section><title><p>Chapter %d</p></title>`, s)
+		for i := 1; i <= 20; i++ {
+			switch {
+			case s == 2 && i == 10:
+				buf.WriteString(`<p>Referenced<a l:href="#n1" type="note">[1]</a> paragraph.</p>`)
+			case s == 3 && i == 20:
+				buf.WriteString(`<p>Commented<a l:href="#c1" type="note">[1]</a> paragraph.</p>`)
+			default:
+				fmt.Fprintf(&buf, `<p>Paragraph %d of chapter %d with some text to fill the page.</p>`, i, s)
+			}
+		}
+		buf.WriteString(`</section>`)
+	}
+	buf.WriteString(`</body>
+<body name="notes"><title><p>Notes</p></title><section id="n1"><title><p>1</p></title><p>Footnoted.</p></section></body>
+<body name="comments"><title><p>Comments</p></title><section id="c1"><title><p>1</p></title><subtitle>Annotated.</subtitle></section></body>
+</FictionBook>`)
+	return buf.String()
+}
+
+// pdfWord is a piece of text drawn on the page, y is measured from the page bottom.
+type pdfWord struct {
+	text string
+	y    float64
+}
+
+var (
+	rePDFText    = regexp.MustCompile(`BT ([\d.]+) ([\d.]+) Td \(((?:\\.|[^\\)])*)\) Tj ET`)
+	rePDFOutline = regexp.MustCompile(`<</Title \(((?:\\.|[^\\)])*)\)\n/Parent \d+ 0 R\n(?:/Prev \d+ 0 R\n)?(?:/Next \d+ 0 R\n)?(?:/First \d+ 0 R\n/Last \d+ 0 R\n)?/Dest \[(\d+) 0 R`)
+)
+
+// pdfString decodes UTF-16 literal string written by fpdf.
+func pdfString(s string) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			if s[i] == 'r' {
+				b = append(b, '\r')
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	b = bytes.TrimPrefix(b, []byte{0xFE, 0xFF})
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		u = append(u, uint16(b[i])<<8|uint16(b[i+1]))
+	}
+	return strings.TrimPrefix(string(utf16.Decode(u)), "\uFEFF")
+}
+
+// typesetPDF renders processed book without compression and returns words drawn on every page and outline titles
+// with numbers of pages they point to.
+func typesetPDF(t *testing.T, p *Processor) ([][]pdfWord, []string) {
+	t.Helper()
+
+	r, err := p.newPDFRenderer()
+	if err != nil {
+		t.Fatalf("unable to create renderer: %v", err)
+	}
+	r.pdf.SetCompression(false)
+	r.render()
+	var buf bytes.Buffer
+	if err := r.pdf.Output(&buf); err != nil {
+		t.Fatalf("unable to typeset: %v", err)
+	}
+
+	// every page object is followed by its content stream
+	parts := strings.Split(buf.String(), "<</Type /Page\n")
+	if len(parts)-1 != r.pdf.PageNo() {
+		t.Fatalf("expected %d pages, found %d", r.pdf.PageNo(), len(parts)-1)
+	}
+	pages := make([][]pdfWord, 0, len(parts)-1)
+	objects := make(map[string]int) // page object number -> page number
+	for i, part := range parts[1:] {
+		head := strings.TrimSuffix(parts[i], " 0 obj\n")
+		objects[head[strings.LastIndex(head, "\n")+1:]] = i + 1
+		var words []pdfWord
+		for _, m := range rePDFText.FindAllStringSubmatch(part, -1) {
+			y, _ := strconv.ParseFloat(m[2], 64)
+			words = append(words, pdfWord{text: strings.TrimSpace(pdfString(m[3])), y: y})
+		}
+		pages = append(pages, words)
+	}
+	var outline []string
+	for _, m := range rePDFOutline.FindAllStringSubmatch(buf.String(), -1) {
+		outline = append(outline, fmt.Sprintf("%s:%d", pdfString(m[1]), objects[m[2]]))
+	}
+	return pages, outline
+}
+
+// findWord returns page number and vertical position of the word, page number is 0 when word was not drawn.
+func findWord(pages [][]pdfWord, text string) (int, float64) {
+	for i, words := range pages {
+		for _, w := range words {
+			if w.text == text {
+				return i + 1, w.y
+			}
+		}
+	}
+	return 0, 0
+}
+
+func TestPDF(t *testing.T) {
+
+	for _, mode := range []NotesFmt{NFloat, NFloatOld, NFloatNew} {
+		p := newTestProcessor(t, pdfBook(), OPdf, false, func(cfg *config.Config) {
+			cfg.Doc.Notes.Mode = mode.String()
+		})
+		if err := p.Process(); err != nil {
+			t.Fatalf("%s: unable to process: %v", mode, err)
+		}
+		pages, outline := typesetPDF(t, p)
+		cfg := &p.env.Cfg.Doc.PDF
+
+		if len(pages) < 4 {
+			t.Errorf("%s: expected book to take several pages, got %d", mode, len(pages))
+		}
+		// title page, then chapters following each other, notes bodies do not have their own entries
+		if len(outline) != 4 || outline[0] != "Typeset:1" {
+			t.Fatalf("%s: unexpected outline %q", mode, outline)
+		}
+		prev := 1
+		for i, entry := range outline[1:] {
+			title, num, _ := strings.Cut(entry, ":")
+			page, _ := strconv.Atoi(num)
+			if title != fmt.Sprintf("Chapter %d", i+1) || page <= prev {
+				t.Errorf("%s: unexpected outline entry %s after page %d", mode, entry, prev)
+			}
+			prev = page
+		}
+
+		// notes are typeset once, at the bottom of the page with reference - below text and above page number
+		for _, note := range [][2]string{{"Referenced", "Footnoted."}, {"Commented", "Annotated."}} {
+			ref, _ := findWord(pages, note[0])
+			page, y := findWord(pages, note[1])
+			if ref == 0 || page != ref {
+				t.Errorf("%s: note %q is on page %d, referenced on page %d", mode, note[1], page, ref)
+				continue
+			}
+			var count int
+			for _, words := range pages {
+				for _, w := range words {
+					if w.text == note[1] {
+						count++
+					}
+				}
+			}
+			if count != 1 {
+				t.Errorf("%s: note %q is typeset %d times", mode, note[1], count)
+			}
+			var numbered bool
+			for _, w := range pages[page-1] {
+				switch {
+				case w.y > y || w.text == note[1] || (w.y == y && w.text == "1"):
+				case w.y < y && w.text == strconv.Itoa(page):
+					numbered = true
+				default:
+					t.Errorf("%s: text %q is below note %q", mode, w.text, note[1])
+				}
+			}
+			if !numbered {
+				t.Errorf("%s: note %q is below page number", mode, note[1])
+			}
+			if bottom := cfg.Margin*pdfMM + cfg.FontSize; y > bottom {
+				t.Errorf("%s: note %q is not at the page bottom, %.2f above %.2f", mode, note[1], y, bottom)
+			}
+		}
+	}
+}
@@ -18,12 +18,10 @@ import (
 
 	"github.com/asaskevich/govalidator"
 	"github.com/google/uuid"
-	"github.com/gosimple/slug"
 	"go.uber.org/zap"
 	"golang.org/x/net/html/charset"
 	"golang.org/x/text/language"
 	"golang.org/x/text/language/display"
-	"gopkg.in/gomail.v2"
 
 	"fb2converter/config"
 	"fb2converter/etree"
@@ -73,8 +71,18 @@ type Processor struct {
 	kindlePageMap  APNXGeneration
 	stampPlacement StampPlacement
 	coverResize    CoverProcessing
+	fontObfuscate  FontObfuscation
+	genreSubjects  GenreSubjects
+	collision      FileNameCollision
+	htmlLayout     HTMLLayout
+	reserved       map[string]bool
+	tocRules       []tocRule
+	// rendered plain text or Markdown
+	text []byte
 	// working directory
 	tmpDir string
+	// format independent processing was done
+	prepared bool
 	// input document
 	doc *etree.Document
 	// parsing state and conversion results
@@ -88,10 +96,34 @@ type Processor struct {
 	kindlegenPath   string
 }
 
+// ParseFB2 reads FB2 document, so it could be converted several times without re-parsing.
+func ParseFB2(r io.Reader, unknownEncoding bool) (*etree.Document, error) {
+
+	doc := etree.NewDocument()
+	if unknownEncoding {
+		// input file had no BOM mark - most likely was not Unicode
+		doc.ReadSettings = etree.ReadSettings{
+			CharsetReader: charset.NewReaderLabel,
+		}
+	}
+	if _, err := doc.ReadFrom(r); err != nil {
+		return nil, fmt.Errorf("unable to parse FB2: %w", err)
+	}
+	return doc, nil
+}
+
 // NewFB2 creates FB2 book processor and prepares necessary temporary directories.
 func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, overwrite bool, format OutputFmt, env *state.LocalEnv) (*Processor, error) {
 
-	kindle := format == OAzw3 || format == OMobi
+	doc, err := ParseFB2(r, unknownEncoding)
+	if err != nil {
+		return nil, err
+	}
+	return NewFB2Document(doc, src, dst, nodirs, stk, overwrite, format, env)
+}
+
+// NewFB2Document creates book processor for already parsed FB2 document. Document is copied and could be reused.
+func NewFB2Document(doc *etree.Document, src, dst string, nodirs, stk, overwrite bool, format OutputFmt, env *state.LocalEnv) (*Processor, error) {
 
 	u, err := uuid.NewRandom()
 	if err != nil {
@@ -116,14 +148,6 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 		env.Log.Warn("Unknown TOC page placement requested, turning off generation", zap.String("placement", env.Cfg.Doc.TOC.Placement))
 		place = TOCNone
 	}
-	var apnx APNXGeneration
-	if kindle {
-		apnx = ParseAPNXGenerationSring(env.Cfg.Doc.Kindlegen.PageMap)
-		if apnx == UnsupportedAPNXGeneration {
-			env.Log.Warn("Unknown APNX generation option requested, turning off", zap.String("apnx", env.Cfg.Doc.Kindlegen.PageMap))
-			apnx = APNXNone
-		}
-	}
 	var stamp StampPlacement
 	if len(env.Cfg.Doc.Cover.Placement) > 0 {
 		stamp = ParseStampPlacementString(env.Cfg.Doc.Cover.Placement)
@@ -140,6 +164,33 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 		}
 	}
 
+	subjects := GenreCodes
+	if len(env.Cfg.Doc.Genres.Subjects) > 0 {
+		subjects = ParseGenreSubjectsString(env.Cfg.Doc.Genres.Subjects)
+		if subjects == UnsupportedGenreSubjects {
+			env.Log.Warn("Unknown genre subjects mode requested, using default", zap.String("subjects", env.Cfg.Doc.Genres.Subjects))
+			subjects = GenreCodes
+		}
+	}
+
+	var collision FileNameCollision
+	if len(env.Cfg.Doc.FileNameCollision) > 0 {
+		collision = ParseFileNameCollisionString(env.Cfg.Doc.FileNameCollision)
+		if collision == UnsupportedFileNameCollision {
+			env.Log.Warn("Unknown file name collision handling requested, using default", zap.String("collision", env.Cfg.Doc.FileNameCollision))
+			collision = CollisionError
+		}
+	}
+
+	var layout HTMLLayout
+	if len(env.Cfg.Doc.HTML.Layout) > 0 {
+		layout = ParseHTMLLayoutString(env.Cfg.Doc.HTML.Layout)
+		if layout == UnsupportedHTMLLayout {
+			env.Log.Warn("Unknown html layout requested, using default", zap.String("layout", env.Cfg.Doc.HTML.Layout))
+			layout = HTMLSingle
+		}
+	}
+
 	p := &Processor{
 		kind:            InFb2,
 		src:             src,
@@ -147,14 +198,16 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 		nodirs:          nodirs,
 		stk:             stk,
 		overwrite:       overwrite,
-		format:          format,
 		notesMode:       notes,
 		tocType:         toct,
 		tocPlacement:    place,
-		kindlePageMap:   apnx,
 		stampPlacement:  stamp,
 		coverResize:     resize,
-		doc:             etree.NewDocument(),
+		genreSubjects:   subjects,
+		collision:       collision,
+		htmlLayout:      layout,
+		tocRules:        compileTOCRules(env.Cfg.Doc.TOC.Rules, env.Log),
+		doc:             doc.Copy(),
 		Book:            NewBook(u, filepath.Base(src)),
 		env:             env,
 		speechTransform: env.Cfg.GetTransformation("speech"),
@@ -163,11 +216,8 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 	}
 	p.doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
 
-	if kindle {
-		// Fail early
-		if p.kindlegenPath, err = env.Cfg.GetKindlegenPath(); err != nil {
-			return nil, err
-		}
+	if err := p.setFormat(format); err != nil {
+		return nil, err
 	}
 
 	// sanity checking
@@ -184,22 +234,8 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 		p.dashTransform.To = string(sym)
 	}
 
-	p.tmpDir, err = os.MkdirTemp("", "fb2c-")
-	if err != nil {
-		return nil, fmt.Errorf("unable to create temporary directory: %w", err)
-	}
-	env.Rpt.Store(fmt.Sprintf("fb2c-%s", u.String()), p.tmpDir)
-
-	if unknownEncoding {
-		// input file had no BOM mark - most likely was not Unicode
-		p.doc.ReadSettings = etree.ReadSettings{
-			CharsetReader: charset.NewReaderLabel,
-		}
-	}
-
-	// Read and parse fb2
-	if _, err := p.doc.ReadFrom(r); err != nil {
-		return nil, fmt.Errorf("unable to parse FB2: %w", err)
+	if err := p.createTmpDir(fmt.Sprintf("fb2c-%s", u.String())); err != nil {
+		return nil, err
 	}
 
 	// Save parsed document back to file for debugging
@@ -214,10 +250,84 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 	return p, nil
 }
 
-// Process does all the work.
-func (p *Processor) Process() error {
+// setFormat initializes processing parameters which depend on output format.
+func (p *Processor) setFormat(format OutputFmt) error {
 
-	if p.kind == InEpub {
+	kindle := format == OAzw3 || format == OMobi
+
+	p.format = format
+	p.kindlePageMap = APNXNone
+	if kindle {
+		p.kindlePageMap = ParseAPNXGenerationSring(p.env.Cfg.Doc.Kindlegen.PageMap)
+		if p.kindlePageMap == UnsupportedAPNXGeneration {
+			p.env.Log.Warn("Unknown APNX generation option requested, turning off", zap.String("apnx", p.env.Cfg.Doc.Kindlegen.PageMap))
+			p.kindlePageMap = APNXNone
+		}
+	}
+	p.fontObfuscate = FontObfuscationNone
+	if len(p.env.Cfg.Doc.Fonts.Obfuscation) > 0 {
+		p.fontObfuscate = ParseFontObfuscationString(p.env.Cfg.Doc.Fonts.Obfuscation)
+		if p.fontObfuscate == UnsupportedFontObfuscation {
+			p.env.Log.Warn("Unknown font obfuscation requested, turning off", zap.String("obfuscation", p.env.Cfg.Doc.Fonts.Obfuscation))
+			p.fontObfuscate = FontObfuscationNone
+		}
+		if kindle && p.fontObfuscate != FontObfuscationNone {
+			p.env.Log.Warn("Font obfuscation is not supported for Kindle formats, turning off", zap.String("obfuscation", p.env.Cfg.Doc.Fonts.Obfuscation))
+			p.fontObfuscate = FontObfuscationNone
+		}
+		if format == OHtml && p.fontObfuscate != FontObfuscationNone {
+			// browsers would not be able to use fonts
+			p.fontObfuscate = FontObfuscationNone
+		}
+	}
+	p.kindlegenPath = ""
+	if kindle {
+		// Fail early
+		var err error
+		if p.kindlegenPath, err = p.env.Cfg.GetKindlegenPath(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createTmpDir creates working directory and registers it with debug report under specified name.
+func (p *Processor) createTmpDir(name string) error {
+
+	var err error
+	if p.tmpDir, err = os.MkdirTemp("", "fb2c-"); err != nil {
+		return fmt.Errorf("unable to create temporary directory: %w", err)
+	}
+	p.env.Rpt.Store(name, p.tmpDir)
+	return nil
+}
+
+// Fork creates processor producing different output format (and possibly destination) out of the same book. When called
+// after Prepare format independent processing results are shared and only format specific steps are performed by
+// Process on returned processor. Original processor stays intact and could be forked again.
+func (p *Processor) Fork(format OutputFmt, dst string, stk bool) (*Processor, error) {
+
+	f := *p
+	f.dst, f.stk = dst, stk
+	f.Book = p.Book.clone()
+	if err := f.setFormat(format); err != nil {
+		return nil, err
+	}
+	if f.prepared && f.format == OKepub && f.Book.tokenizer == nil {
+		// language is known, but tokenizer was not necessary for format processor was prepared for
+		f.Book.tokenizer = newTokenizer(f.Book.Lang, f.env.Cfg, f.env.Log)
+	}
+	if err := f.createTmpDir(fmt.Sprintf("fb2c-%s-%s", p.Book.ID.String(), format.String())); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// Prepare performs format independent processing steps - parsing, hyphenation, images decoding, TOC. Their results
+// could be used to produce several output formats, see Fork.
+func (p *Processor) Prepare() error {
+
+	if p.kind == InEpub || p.prepared {
 		// later we may decide to clean epub, massage its stylesheet, etc.
 		return nil
 	}
@@ -243,18 +353,58 @@ func (p *Processor) Process() error {
 	if err := p.processImages(); err != nil {
 		return err
 	}
-	if err := p.generateTOCPage(); err != nil {
+	if err := p.processTOC(); err != nil {
 		return err
 	}
-	if err := p.generateCover(); err != nil {
+	if err := p.generateTOCPage(); err != nil {
 		return err
 	}
 	if err := p.generateNCX(); err != nil {
 		return err
 	}
+	p.prepared = true
+	return nil
+}
+
+// Process does all the work.
+func (p *Processor) Process() error {
+
+	if p.kind == InEpub {
+		// later we may decide to clean epub, massage its stylesheet, etc.
+		return nil
+	}
+
+	if err := p.Prepare(); err != nil {
+		return err
+	}
+
+	if isTextFormat(p.format) {
+		// images, stylesheet and package files are not necessary
+		return p.generateText()
+	}
+
+	// Format specific steps
+
+	if err := p.processKindleImages(); err != nil {
+		return err
+	}
+	if err := p.generateCover(); err != nil {
+		return err
+	}
+	if p.format == OPdf || p.format == ODocx || p.format == OOdt {
+		// documents are built from content when saved
+		return nil
+	}
 	if err := p.prepareStylesheet(); err != nil {
 		return err
 	}
+	if err := p.processFonts(); err != nil {
+		return err
+	}
+	if p.format == OHtml {
+		// content is turned into html pages when saved
+		return nil
+	}
 	if err := p.generatePagemap(); err != nil {
 		return err
 	}
@@ -267,7 +417,16 @@ func (p *Processor) Process() error {
 	return p.KepubifyXHTML()
 }
 
+// ProcessDescription only parses book description, it is enough when only book meta information is necessary.
+func (p *Processor) ProcessDescription() error {
+	if p.kind == InEpub {
+		return nil
+	}
+	return p.processDescription()
+}
+
 // Save makes the conversion results permanent by storing everything properly and cleaning temporary artifacts.
+// Empty name is returned when output file already exists and configuration tells to skip the book.
 func (p *Processor) Save() (string, error) {
 
 	p.env.Log.Debug("Saving content - starting", zap.String("tmp", p.tmpDir), zap.String("content", DirContent))
@@ -275,7 +434,18 @@ func (p *Processor) Save() (string, error) {
 		p.env.Log.Debug("Saving content - done", zap.Duration("elapsed", time.Since(start)))
 	}(time.Now())
 
-	if p.kind == InFb2 {
+	fname, err := p.resolveOutputName(p.prepareOutputName(), func(name string) bool {
+		return p.reserved[name] || fileExists(name)
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(fname) == 0 {
+		p.env.Log.Info("Output file already exists, skipping", zap.String("file", p.prepareOutputName()))
+		return "", nil
+	}
+
+	if p.kind == InFb2 && !isTextFormat(p.format) {
 		if err := p.Book.flushData(p.tmpDir); err != nil {
 			return "", err
 		}
@@ -293,9 +463,6 @@ func (p *Processor) Save() (string, error) {
 		}
 	}
 
-	fname := p.prepareOutputName()
-
-	var err error
 	switch p.format {
 	case OEpub:
 		err = p.FinalizeEPUB(fname)
@@ -305,93 +472,21 @@ func (p *Processor) Save() (string, error) {
 		err = p.FinalizeMOBI(fname)
 	case OAzw3:
 		err = p.FinalizeAZW3(fname)
+	case OTxt, OMd:
+		err = p.FinalizeText(fname)
+	case OHtml:
+		err = p.FinalizeHTML(fname)
+	case OPdf:
+		err = p.FinalizePDF(fname)
+	case ODocx:
+		err = p.FinalizeDOCX(fname)
+	case OOdt:
+		err = p.FinalizeODT(fname)
 	}
-	return fname, err
-}
-
-// SendToKindle will mail converted file to specified address and remove file if requested.
-func (p *Processor) SendToKindle(fname string) error {
-
-	if !p.stk || p.format != OEpub || len(fname) == 0 {
-		return nil
-	}
-
-	if !p.env.Cfg.SMTPConfig.IsValid() {
-		p.env.Log.Warn("Configuration for Send To Kindle is incorrect, skipping", zap.Any("configuration", p.env.Cfg.SMTPConfig))
-		return nil
-	}
-
-	p.env.Log.Debug("Sending content to Kindle - starting",
-		zap.String("from", p.env.Cfg.SMTPConfig.From),
-		zap.String("to", p.env.Cfg.SMTPConfig.To),
-		zap.String("file", fname),
-	)
-	defer func(start time.Time) {
-		p.env.Log.Debug("Sending content to Kindle - done", zap.Duration("elapsed", time.Since(start)))
-	}(time.Now())
-
-	// NOTE: Content-Type and Content-Disposition headers require special encoding (rfc2231/rfc5987/rfc8187)
-
-	ext := filepath.Ext(fname)
-	fullname := strings.TrimSuffix(filepath.Base(fname), ext)
-	safename := slug.Make(fullname)
-
-	m := gomail.NewMessage(gomail.SetCharset("UTF-8"), gomail.SetEncoding(gomail.Base64))
-	m.SetAddressHeader("From", p.env.Cfg.SMTPConfig.From, "fb2converter ")
-	m.SetAddressHeader("To", p.env.Cfg.SMTPConfig.To, "kindle device")
-	m.SetHeader("Subject", "Sent to Kindle: "+fullname+ext)
-	m.SetBody("text/plain", "This email has been sent by fb2converter")
-	m.Attach(fname,
-		gomail.Rename(safename+ext),
-		gomail.SetHeader(
-			map[string][]string{
-				"Content-Type":        {`application/epub+zip; name="` + mime.BEncoding.Encode("UTF-8", fullname+ext) + `"`},
-				"Content-Disposition": {`attachment; ` + EncodeContentDispFilename(safename+ext, fullname+ext)},
-			},
-		),
-	)
-
-	// debugging
-	if p.env.Rpt != nil {
-		var sf gomail.SendFunc = func(from string, to []string, m io.WriterTo) error {
-			buf, err := os.Create(filepath.Join(p.tmpDir, safename+".mail"))
-			if err != nil {
-				return err
-			}
-			defer buf.Close()
-			_, err = m.WriteTo(buf)
-			if err != nil {
-				return err
-			}
-			return nil
-		}
-		if err := gomail.Send(sf, m); err != nil {
-			return err
-		}
-	}
-
-	// real send
-	d := gomail.NewDialer(p.env.Cfg.SMTPConfig.Server, p.env.Cfg.SMTPConfig.Port, p.env.Cfg.SMTPConfig.User, p.env.Cfg.SMTPConfig.Password)
-
-	if err := d.DialAndSend(m); err != nil {
-		return fmt.Errorf("SentToKindle failed: %w", err)
-	}
-
-	if p.env.Cfg.SMTPConfig.DeleteOnSuccess {
-		p.env.Log.Debug("Deleting after send", zap.String("location", fname))
-		if err := os.Remove(fname); err != nil {
-			p.env.Log.Warn("Unable to delete after send", zap.String("location", fname), zap.Error(err))
-		}
-		if !p.nodirs {
-			// remove all empty directories in the path following p.dst
-			for outDir := filepath.Dir(fname); outDir != p.dst; outDir = filepath.Dir(outDir) {
-				if err := os.Remove(outDir); err != nil {
-					p.env.Log.Warn("Unable to delete after send", zap.String("location", outDir), zap.Error(err))
-				}
-			}
-		}
+	if err == nil && p.reserved != nil {
+		p.reserved[fname] = true
 	}
-	return nil
+	return fname, err
 }
 
 // Clean removes temporary files left after processing.
@@ -413,14 +508,8 @@ func (p *Processor) prepareOutputName() string {
 	}
 	outDir = filepath.Join(p.dst, outDir)
 
-	name := strings.TrimSuffix(filepath.Base(p.src), filepath.Ext(p.src))
-	if p.env.Cfg.Doc.FileNameTransliterate {
-		name = slug.Make(name)
-	}
-	outFile := config.CleanFileName(name) + "." + p.format.String()
-	if p.format == OKepub {
-		outFile += "." + OEpub.String()
-	}
+	ext := p.outputExt()
+	outFile := p.cleanName(strings.TrimSuffix(filepath.Base(p.src), filepath.Ext(p.src)), len(ext)) + ext
 
 	if p.kind == InFb2 && len(p.env.Cfg.Doc.FileNameFormat) > 0 {
 
@@ -431,25 +520,16 @@ func (p *Processor) prepareOutputName() string {
 			return dirs
 		}
 
-		name = filepath.FromSlash(ReplaceKeywords(p.env.Cfg.Doc.FileNameFormat, CreateFileNameKeywordsMap(p.Book, p.env.Cfg.Doc.AuthorFormatFileName, p.env.Cfg.Doc.SeqNumPos)))
+		name := filepath.FromSlash(ReplaceKeywords(p.env.Cfg.Doc.FileNameFormat, CreateFileNameKeywordsMap(p.Book, p.env.Cfg.Doc.AuthorFormatFileName, p.env.Cfg.Doc.SeqNumPos)))
 		if len(name) > 0 {
 			first := true
 			dirs := make([]string, 0, 16)
 			for head, tail := filepath.Split(strings.TrimSuffix(name, string(os.PathSeparator))); ; head, tail = filepath.Split(strings.TrimSuffix(head, string(os.PathSeparator))) {
 				if first {
-					if p.env.Cfg.Doc.FileNameTransliterate {
-						tail = slug.Make(tail)
-					}
-					outFile = config.CleanFileName(tail) + "." + p.format.String()
-					if p.format == OKepub {
-						outFile += "." + OEpub.String()
-					}
+					outFile = p.cleanName(tail, len(ext)) + ext
 					first = false
 				} else {
-					if p.env.Cfg.Doc.FileNameTransliterate {
-						tail = slug.Make(tail)
-					}
-					dirs = insertDir(dirs, config.CleanFileName(tail))
+					dirs = insertDir(dirs, p.cleanName(tail, 0))
 				}
 				if len(head) == 0 {
 					break
@@ -475,6 +555,7 @@ func (p *Processor) processDescription() error {
 			zap.Stringer("lang", p.Book.Lang),
 			zap.String("cover", p.Book.Cover),
 			zap.Strings("genres", p.Book.Genres),
+			zap.Strings("genre names", p.Book.GenreNames),
 			zap.String("authors", p.Book.BookAuthors(p.env.Cfg.Doc.AuthorFormat, false)),
 			zap.String("sequence", p.Book.SeqName),
 			zap.Int("sequence number", p.Book.SeqNum),
@@ -522,7 +603,7 @@ func (p *Processor) processDescription() error {
 						p.Book.hyph = newHyph(t, p.env.Log)
 					}
 					if p.format == OKepub {
-						p.Book.tokenizer = newTokenizer(t, p.env.Log)
+						p.Book.tokenizer = newTokenizer(t, p.env.Cfg, p.env.Log)
 					}
 				}
 			}
@@ -616,8 +697,17 @@ func (p *Processor) processDescription() error {
 	}
 
 	// Let's see if we need to correct any meta information - always comes last
+	p.overwriteMeta()
+	// genres could be overwritten, so they are resolved at the very end
+	p.resolveGenres()
+	return nil
+}
+
+// overwriteMeta replaces parsed book meta information with values configured for this book.
+func (p *Processor) overwriteMeta() {
+
 	if p.metaOverwrite == nil {
-		return nil
+		return
 	}
 
 	if len(p.metaOverwrite.ID) > 0 {
@@ -643,6 +733,9 @@ func (p *Processor) processDescription() error {
 				if p.env.Cfg.Doc.Hyphenate {
 					p.Book.hyph = newHyph(t, p.env.Log)
 				}
+				if p.format == OKepub {
+					p.Book.tokenizer = newTokenizer(t, p.env.Cfg, p.env.Log)
+				}
 			}
 		}
 	}
@@ -674,7 +767,6 @@ func (p *Processor) processDescription() error {
 		p.Book.Date = date
 		p.env.Log.Info("Meta overwrite", zap.String("date", p.Book.Date))
 	}
-	return nil
 }
 
 // processBodies processes book bodies, including main one.
@@ -874,9 +966,6 @@ func (p *Processor) processBinaries() error {
 
 		if !doNotTouch {
 			// see if any additional processing is requested
-			if !isImageSupported(b.imgType) && (p.format == OMobi || p.format == OAzw3) {
-				b.flags |= imageKindle
-			}
 			if p.env.Cfg.Doc.RemovePNGTransparency && imgType == "png" {
 				b.flags |= imageOpaquePNG
 			}
@@ -890,31 +979,6 @@ func (p *Processor) processBinaries() error {
 	return nil
 }
 
-// processLinks goes over generated documents and makes sure hanging anchors are properly anchored.
-func (p *Processor) processLinks() error {
-
-	p.env.Log.Debug("Processing links - start")
-	defer func(start time.Time) {
-		p.env.Log.Debug("Processing links - done", zap.Duration("elapsed", time.Since(start)))
-	}(time.Now())
-
-	for _, f := range p.Book.Files {
-		if f.doc == nil {
-			continue
-		}
-		for _, a := range f.doc.FindElements("//a[@href]") {
-			href := getAttrValue(a, "href")
-			if !strings.HasPrefix(href, "#") {
-				continue
-			}
-			if fname, ok := p.Book.LinksLocations[href[1:]]; ok {
-				a.CreateAttr("href", fname+href)
-			}
-		}
-	}
-	return nil
-}
-
 // processImages makes sure that images we use have suitable properties.
 func (p *Processor) processImages() error {
 
@@ -976,19 +1040,46 @@ func (p *Processor) processImages() error {
 				}
 			}
 		}
-	} else if p.env.Cfg.Doc.Cover.Default || p.format == OMobi || p.format == OAzw3 {
-		// For Kindle we always supply cover image if none is present, for others - only if asked to
-		b, err := p.getDefaultCover(len(p.Book.Images))
-		if err != nil {
-			// not found or cannot be decoded, misconfiguration - stop here
+	} else if p.env.Cfg.Doc.Cover.Default {
+		// For Kindle we always supply cover image if none is present (see processKindleImages), for others - only if asked to
+		return p.addDefaultCover()
+	}
+	return nil
+}
+
+// addDefaultCover supplies default cover image for the book.
+func (p *Processor) addDefaultCover() error {
+
+	b, err := p.getDefaultCover(len(p.Book.Images))
+	if err != nil {
+		// not found or cannot be decoded, misconfiguration - stop here
+		return err
+	}
+	p.env.Log.Debug("Providing default cover image")
+	p.Book.Cover = b.id
+	p.Book.Images = append(p.Book.Images, b)
+	if p.stampPlacement == StampNone {
+		// default cover always stamped
+		p.stampPlacement = StampMiddle
+	}
+	return nil
+}
+
+// processKindleImages makes sure Kindle devices could handle book images.
+func (p *Processor) processKindleImages() error {
+
+	if p.format != OMobi && p.format != OAzw3 {
+		return nil
+	}
+	if len(p.Book.Cover) == 0 && (p.metaOverwrite == nil || p.metaOverwrite.CoverImage != "remove cover") {
+		if err := p.addDefaultCover(); err != nil {
 			return err
 		}
-		p.env.Log.Debug("Providing default cover image")
-		p.Book.Cover = b.id
-		p.Book.Images = append(p.Book.Images, b)
-		if p.stampPlacement == StampNone {
-			// default cover always stamped
-			p.stampPlacement = StampMiddle
+	}
+	for _, b := range p.Book.Images {
+		// images which could not be decoded are stored as is
+		if b.img != nil && !isImageSupported(b.imgType) {
+			b.flags |= imageKindle
 		}
 	}
 	return nil
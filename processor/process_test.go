@@ -0,0 +1,92 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/state"
+)
+
+const testBook = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+<description>
+<title-info><author><first-name>Test</first-name><last-name>Author</last-name></author><book-title>Test Book</book-title><lang>en</lang></title-info>
+</description>
+<body><section><p>Text.</p></section></body>
+</FictionBook>`
+
+// newTestProcessor prepares processor for book using default configuration changed by update.
+func newTestProcessor(t *testing.T, book string, format OutputFmt, stk bool, update func(cfg *config.Config)) *Processor {
+	t.Helper()
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Path = t.TempDir()
+	if update != nil {
+		update(cfg)
+	}
+	p, err := NewFB2(strings.NewReader(book), false, "book.fb2", t.TempDir(), false, stk, false, format, &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = p.Clean() })
+	return p
+}
+
+// koboSpans returns text of all kobo spans in book content.
+func koboSpans(p *Processor) []string {
+	var res []string
+	for _, f := range p.Book.Files {
+		if f.doc == nil || f.ct != "application/xhtml+xml" {
+			continue
+		}
+		for _, e := range f.doc.FindElements("//span[@class='koboSpan']") {
+			res = append(res, extractText(e, true))
+		}
+	}
+	return res
+}
+
+func TestForkKepub(t *testing.T) {
+
+	const book = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+<description><title-info><book-title>Test</book-title><lang>en</lang></title-info></description>
+<body><section><p>Mr. Smith came home. He left.</p></section></body>
+</FictionBook>`
+
+	update := func(cfg *config.Config) {
+		cfg.Doc.Sentences.Abbreviations = map[string][]string{"en": {"mr"}}
+	}
+
+	single := newTestProcessor(t, book, OKepub, false, update)
+	if err := single.Process(); err != nil {
+		t.Fatal(err)
+	}
+	expected := koboSpans(single)
+	if !strings.Contains(strings.Join(expected, "|"), "|Mr. Smith came home.|He left.|") {
+		t.Fatalf("unexpected sentences %q", expected)
+	}
+
+	// several targets are produced by forks of processor prepared for epub
+	base := newTestProcessor(t, book, OEpub, false, update)
+	if err := base.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	fork, err := base.Fork(OKepub, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = fork.Clean() })
+	if err := fork.Process(); err != nil {
+		t.Fatal(err)
+	}
+	if got := koboSpans(fork); strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Errorf("forked kepub differs from single target one: %q, expected %q", got, expected)
+	}
+}
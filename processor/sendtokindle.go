@@ -0,0 +1,305 @@
+package processor
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gosimple/slug"
+	"go.uber.org/zap"
+	"gopkg.in/gomail.v2"
+
+	"fb2converter/config"
+)
+
+// formats accepted by Send to Kindle service and their mime types
+var stkMimeTypes = map[OutputFmt]string{
+	OEpub: "application/epub+zip",
+	OAzw3: "application/vnd.amazon.ebook",
+	OMobi: "application/x-mobipocket-ebook",
+}
+
+// CanSendToKindle checks if books in specified format could be mailed to Kindle.
+func CanSendToKindle(format OutputFmt) bool {
+	_, ok := stkMimeTypes[format]
+	return ok
+}
+
+// SendToKindle will mail converted file to all configured recipients and remove file if requested.
+func (p *Processor) SendToKindle(fname string) error {
+
+	if !p.stk || len(fname) == 0 {
+		return nil
+	}
+
+	cfg := &p.env.Cfg.SMTPConfig
+
+	ct, ok := stkMimeTypes[p.format]
+	if !ok {
+		p.env.Log.Warn("Send To Kindle does not support format, skipping", zap.Stringer("format", p.format))
+		return nil
+	}
+	if !cfg.IsValid() {
+		p.env.Log.Warn("Configuration for Send To Kindle is incorrect, skipping", zap.Any("configuration", cfg))
+		return nil
+	}
+	recipients := cfg.Recipients(p.format.String())
+	if len(recipients) == 0 {
+		p.env.Log.Warn("No Send To Kindle recipients accept format, skipping", zap.Stringer("format", p.format))
+		return nil
+	}
+
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return fmt.Errorf("SentToKindle failed: %w", err)
+	}
+	if limit := int64(cfg.MaxSize) << 20; limit > 0 && fi.Size() > limit {
+		return fmt.Errorf("SentToKindle failed: %s is %d bytes, larger than attachment size limit of %d MB", filepath.Base(fname), fi.Size(), cfg.MaxSize)
+	}
+
+	p.env.Log.Debug("Sending content to Kindle - starting",
+		zap.String("from", cfg.From),
+		zap.Strings("to", recipients),
+		zap.String("file", fname),
+	)
+	defer func(start time.Time) {
+		p.env.Log.Debug("Sending content to Kindle - done", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	dryRun := p.env.Cfg.GetDryRunDir()
+
+	var errs []error
+	for _, to := range recipients {
+		m := p.kindleMessage(fname, to, ct)
+
+		// debugging
+		if p.env.Rpt != nil {
+			if err := writeMessage(m, filepath.Join(p.tmpDir, slug.Make(to)+".mail")); err != nil {
+				return err
+			}
+		}
+
+		if len(dryRun) > 0 {
+			name := filepath.Join(dryRun, slug.Make(strings.TrimSuffix(filepath.Base(fname), filepath.Ext(fname)))+"_"+slug.Make(to)+".eml")
+			p.env.Log.Info("Dry run, mail stored instead of sending", zap.String("to", to), zap.String("location", name))
+			if err := os.MkdirAll(dryRun, 0700); err != nil {
+				return fmt.Errorf("SentToKindle failed: %w", err)
+			}
+			if err := writeMessage(m, name); err != nil {
+				return fmt.Errorf("SentToKindle failed: %w", err)
+			}
+			continue
+		}
+
+		if err := p.sendWithRetries(m, to); err != nil {
+			errs = append(errs, fmt.Errorf("SentToKindle to %s failed: %w", to, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	if cfg.DeleteOnSuccess && len(dryRun) == 0 {
+		p.env.Log.Debug("Deleting after send", zap.String("location", fname))
+		if err := os.Remove(fname); err != nil {
+			p.env.Log.Warn("Unable to delete after send", zap.String("location", fname), zap.Error(err))
+		}
+		if !p.nodirs {
+			// remove all empty directories in the path following p.dst
+			for outDir := filepath.Dir(fname); outDir != p.dst; outDir = filepath.Dir(outDir) {
+				if err := os.Remove(outDir); err != nil {
+					p.env.Log.Warn("Unable to delete after send", zap.String("location", outDir), zap.Error(err))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// kindleMessage prepares mail with book attached, subject and body are expanded from configured templates.
+func (p *Processor) kindleMessage(fname, to, ct string) *gomail.Message {
+
+	cfg := &p.env.Cfg.SMTPConfig
+
+	// NOTE: Content-Type and Content-Disposition headers require special encoding (rfc2231/rfc5987/rfc8187)
+
+	ext := filepath.Ext(fname)
+	fullname := strings.TrimSuffix(filepath.Base(fname), ext)
+	safename := slug.Make(fullname)
+
+	rd := CreateTitleKeywordsMap(p.Book, p.env.Cfg.Doc.SeqNumPos, p.src)
+	rd["#authors"] = p.Book.BookAuthors(p.env.Cfg.Doc.AuthorFormat, false)
+	rd["#author"] = p.Book.BookAuthors(p.env.Cfg.Doc.AuthorFormat, true)
+	rd["#format"] = p.format.String()
+	rd["#file"] = fullname + ext
+
+	m := gomail.NewMessage(gomail.SetCharset("UTF-8"), gomail.SetEncoding(gomail.Base64))
+	m.SetAddressHeader("From", cfg.From, "fb2converter ")
+	m.SetAddressHeader("To", to, "kindle device")
+	m.SetHeader("Subject", ReplaceKeywords(cfg.Subject, rd))
+	m.SetBody("text/plain", ReplaceKeywords(cfg.Body, rd))
+	m.Attach(fname,
+		gomail.Rename(safename+ext),
+		gomail.SetHeader(
+			map[string][]string{
+				"Content-Type":        {ct + `; name="` + mime.BEncoding.Encode("UTF-8", fullname+ext) + `"`},
+				"Content-Disposition": {`attachment; ` + EncodeContentDispFilename(safename+ext, fullname+ext)},
+			},
+		),
+	)
+	return m
+}
+
+// sendWithRetries sends mail retrying temporary failures with exponential backoff.
+func (p *Processor) sendWithRetries(m *gomail.Message, to string) error {
+
+	cfg := &p.env.Cfg.SMTPConfig
+	delay := time.Duration(cfg.RetryDelay) * time.Second
+
+	for attempt := 0; ; attempt++ {
+		err := gomail.Send(smtpSender(cfg), m)
+		if err == nil {
+			return nil
+		}
+		var perr *textproto.Error
+		if attempt >= cfg.Retries || (errors.As(err, &perr) && perr.Code >= 500) {
+			// out of attempts or permanent failure reported by server
+			return err
+		}
+		p.env.Log.Warn("Unable to send mail, will retry", zap.String("to", to), zap.Int("attempt", attempt+1), zap.Duration("delay", delay), zap.Error(err))
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func writeMessage(m *gomail.Message, fname string) error {
+	var sf gomail.SendFunc = func(from string, to []string, m io.WriterTo) error {
+		out, err := os.Create(fname)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		_, err = m.WriteTo(out)
+		return err
+	}
+	return gomail.Send(sf, m)
+}
+
+// smtpSender delivers mail according to configured connection security.
+func smtpSender(cfg *config.SMTPConfig) gomail.SendFunc {
+	return func(from string, to []string, msg io.WriterTo) error {
+
+		addr := net.JoinHostPort(cfg.Server, strconv.Itoa(cfg.Port))
+		tlsConfig := &tls.Config{ServerName: cfg.Server, InsecureSkipVerify: cfg.SkipVerify}
+		dialer := &net.Dialer{Timeout: 30 * time.Second}
+
+		// port 465 is reserved for submission over TLS, STARTTLS is never offered there
+		implicit := cfg.TLS == config.SMTPTLSImplicit || (cfg.TLS == config.SMTPTLSAuto && cfg.Port == 465)
+
+		var (
+			conn net.Conn
+			err  error
+		)
+		if implicit {
+			conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+		} else {
+			conn, err = dialer.Dial("tcp", addr)
+		}
+		if err != nil {
+			return err
+		}
+
+		c, err := smtp.NewClient(conn, cfg.Server)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		defer c.Close()
+
+		if !implicit && (cfg.TLS == config.SMTPTLSAuto || cfg.TLS == config.SMTPTLSStartTLS) {
+			if ok, _ := c.Extension("STARTTLS"); ok {
+				if err := c.StartTLS(tlsConfig); err != nil {
+					return err
+				}
+			} else if cfg.TLS == config.SMTPTLSStartTLS {
+				return errors.New("smtp server does not support STARTTLS")
+			}
+		}
+
+		if len(cfg.User) > 0 {
+			if ok, auths := c.Extension("AUTH"); ok {
+				var auth smtp.Auth
+				switch {
+				case strings.Contains(auths, "CRAM-MD5"):
+					auth = smtp.CRAMMD5Auth(cfg.User, cfg.Password)
+				case strings.Contains(auths, "LOGIN") && !strings.Contains(auths, "PLAIN"):
+					auth = &loginAuth{user: cfg.User, password: cfg.Password, host: cfg.Server}
+				default:
+					auth = smtp.PlainAuth("", cfg.User, cfg.Password, cfg.Server)
+				}
+				if err := c.Auth(auth); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := c.Mail(from); err != nil {
+			return err
+		}
+		for _, addr := range to {
+			if err := c.Rcpt(addr); err != nil {
+				return err
+			}
+		}
+		w, err := c.Data()
+		if err != nil {
+			return err
+		}
+		if _, err := msg.WriteTo(w); err != nil {
+			w.Close()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		return c.Quit()
+	}
+}
+
+// loginAuth implements LOGIN authentication some servers still insist on.
+type loginAuth struct {
+	user, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch {
+	case strings.EqualFold(string(fromServer), "username:"):
+		return []byte(a.user), nil
+	case strings.EqualFold(string(fromServer), "password:"):
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+}
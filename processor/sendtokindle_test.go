@@ -0,0 +1,99 @@
+package processor
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fb2converter/config"
+)
+
+// newSTKProcessor prepares processor ready to mail fname, configuration points to local server which is never contacted
+// in dry run mode.
+func newSTKProcessor(t *testing.T, update func(cfg *config.Config)) *Processor {
+	t.Helper()
+
+	p := newTestProcessor(t, testBook, OEpub, true, func(cfg *config.Config) {
+		cfg.SMTPConfig.Server, cfg.SMTPConfig.Port = "localhost", 25
+		cfg.SMTPConfig.From = "sender@example.com"
+		cfg.SMTPConfig.To = "kindle@example.com"
+		cfg.SMTPConfig.DryRun = "mail"
+		if update != nil {
+			update(cfg)
+		}
+	})
+	if err := p.ProcessDescription(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func writeSTKFile(t *testing.T, size int) string {
+	t.Helper()
+	fname := filepath.Join(t.TempDir(), "Test Book.epub")
+	if err := os.WriteFile(fname, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func TestSendToKindleDryRun(t *testing.T) {
+
+	p := newSTKProcessor(t, func(cfg *config.Config) {
+		cfg.SMTPConfig.Subject = "#title by #author (#format, #file)"
+		cfg.SMTPConfig.Body = "Book: #authors - #title"
+		cfg.SMTPConfig.DeleteOnSuccess = true
+		cfg.Doc.AuthorFormat = "#f #l"
+		cfg.SMTPConfig.Devices = []config.STKDevice{
+			{Name: "epub", To: "reader@example.com", Formats: []string{"EPUB"}},
+			{Name: "mobi", To: "old@example.com", Formats: []string{"mobi"}},
+		}
+	})
+	fname := writeSTKFile(t, 16)
+	if err := p.SendToKindle(fname); err != nil {
+		t.Fatal(err)
+	}
+
+	// relative dry run directory belongs to configuration
+	dir := filepath.Join(p.env.Cfg.Path, "mail")
+	names, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || filepath.Base(names[0]) != "test-book_kindleatexample-com.eml" || filepath.Base(names[1]) != "test-book_readeratexample-com.eml" {
+		t.Fatalf("expected mail for 2 recipients accepting epub in %s, got %v", dir, names)
+	}
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := string(data)
+		for _, expected := range []string{
+			"Subject: Test Book by Test Author (epub, Test Book.epub)",
+			base64.StdEncoding.EncodeToString([]byte("Book: Test Author - Test Book")),
+			`Content-Type: application/epub+zip; name="Test Book.epub"`,
+		} {
+			if !strings.Contains(msg, expected) {
+				t.Errorf("%s: %q not found in\n%s", filepath.Base(name), expected, msg)
+			}
+		}
+	}
+	if _, err := os.Stat(fname); err != nil {
+		t.Errorf("book must not be deleted in dry run: %v", err)
+	}
+}
+
+func TestSendToKindleSizeLimit(t *testing.T) {
+
+	p := newSTKProcessor(t, func(cfg *config.Config) { cfg.SMTPConfig.MaxSize = 1 })
+
+	if err := p.SendToKindle(writeSTKFile(t, 1<<20+1)); err == nil || !strings.Contains(err.Error(), "attachment size limit") {
+		t.Errorf("expected size limit error, got %v", err)
+	}
+	if err := p.SendToKindle(writeSTKFile(t, 1<<20)); err != nil {
+		t.Errorf("book within size limit: %v", err)
+	}
+}
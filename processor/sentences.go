@@ -1,8 +1,13 @@
 package processor
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
+	"os"
 	"path"
+	"path/filepath"
 	"strings"
 
 	"go.uber.org/zap"
@@ -10,6 +15,7 @@ import (
 	"golang.org/x/text/language/display"
 	"gopkg.in/neurosnap/sentences.v1"
 
+	"fb2converter/config"
 	"fb2converter/static"
 )
 
@@ -17,61 +23,116 @@ type tokenizer struct {
 	t *sentences.DefaultSentenceTokenizer
 }
 
-func newTokenizer(lang language.Tag, log *zap.Logger) *tokenizer {
+// readSentencesData loads tokenizer training data from user supplied directory, plain or gzip compressed.
+func readSentencesData(dir, name string) ([]byte, error) {
 
-	en := display.English.Languages()
+	fname := filepath.Join(dir, name+".json")
+	data, err := os.ReadFile(fname)
+	if err == nil {
+		return data, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.Open(fname + ".gz")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, gzr); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
 
-	// Let's hope this is enough
-	names := []func(string) string{
+// SentencesLanguageNames returns names under which sentences tokenizer data for the language could be stored, most
+// specific first.
+func SentencesLanguageNames(lang language.Tag) []string {
 
-		// language tag
-		func(_ string) string {
-			return strings.ToLower(en.Name(lang))
-		},
+	en := display.English.Languages()
 
-		// base language tag
-		func(_ string) string {
-			b, c := lang.Base()
-			if c != language.No {
-				return strings.ToLower(b.String())
-			}
-			log.Debug("unable to find language base with at least some confidence", zap.Stringer("lang", lang), zap.Stringer("base", b))
-			return ""
-		},
+	names := []string{strings.ToLower(en.Name(lang))}
+	if b, c := lang.Base(); c != language.No {
+		names = AppendIfMissing(names, strings.ToLower(b.String()))
+		names = AppendIfMissing(names, strings.ToLower(en.Name(b)))
 	}
+	return names
+}
+
+func newTokenizer(lang language.Tag, cfg *config.Config, log *zap.Logger) *tokenizer {
 
 	var (
-		dpat        []byte
-		err         error
-		lname, prev string
+		dpat  []byte
+		err   error
+		lname string
+		names = SentencesLanguageNames(lang)
+		dir   = cfg.GetSentencesPath()
 	)
 
-	for i := 0; i < len(names); i++ {
-		name := names[i](prev)
+	for _, name := range names {
 		if len(name) == 0 {
 			continue
 		}
-		dpat, err = static.Asset(path.Join(DirSentences, fmt.Sprintf("%s.json", name)))
-		if err != nil {
-			prev = name
-			continue
+		if len(dir) > 0 {
+			// user supplied data always takes precedence
+			if dpat, err = readSentencesData(dir, name); err == nil {
+				log.Debug("Using sentences tokenizer data", zap.String("dir", dir), zap.String("name", name))
+				lname = name
+				break
+			} else if !os.IsNotExist(err) {
+				log.Warn("Unable to read sentences tokenizer data", zap.String("dir", dir), zap.String("name", name), zap.Error(err))
+			}
+		}
+		if dpat, err = static.Asset(path.Join(DirSentences, fmt.Sprintf("%s.json", name))); err == nil {
+			lname = name
+			break
 		}
-		lname = name
-		break
 	}
 
+	abbrs := cfg.GetAbbreviations(append([]string{strings.ToLower(lang.String())}, names...)...)
+
+	var training *sentences.Storage
 	if len(lname) == 0 {
-		log.Warn("Unable to find suitable sentences tokenizer data, using english", zap.Stringer("language", lang))
-		dpat, err = static.Asset(path.Join(DirSentences, "english.json"))
-		if err != nil {
+		if len(dir) > 0 {
+			dpat, err = readSentencesData(dir, "english")
+		}
+		if len(dpat) == 0 {
+			dpat, err = static.Asset(path.Join(DirSentences, "english.json"))
+		}
+		switch {
+		case err == nil:
+			log.Warn("Unable to find suitable sentences tokenizer data, using english", zap.Stringer("language", lang))
+		case len(abbrs) > 0:
+			log.Warn("Unable to find suitable sentences tokenizer data, using abbreviations from configuration only", zap.Stringer("language", lang))
+			training = sentences.NewStorage()
+		default:
 			log.Warn("Unable to find english sentences tokenizer data, turning off sentences segmentation", zap.Error(err))
 			return nil
 		}
 	}
 
-	training, err := sentences.LoadTraining(dpat)
-	if err != nil {
-		log.Warn("Unable to load sentences tokenizer data, turning off sentences segmentation", zap.Error(err))
+	if training == nil {
+		if training, err = sentences.LoadTraining(dpat); err != nil {
+			log.Warn("Unable to load sentences tokenizer data, turning off sentences segmentation", zap.Error(err))
+			return nil
+		}
+	}
+
+	if len(abbrs) > 0 {
+		if training.AbbrevTypes == nil {
+			training.AbbrevTypes = make(sentences.SetString)
+		}
+		for _, a := range abbrs {
+			training.AbbrevTypes.Add(a)
+		}
+		log.Debug("Additional abbreviations for sentences tokenizer", zap.Stringer("language", lang), zap.Strings("abbreviations", abbrs))
 	}
 
 	return &tokenizer{t: sentences.NewSentenceTokenizer(training)}
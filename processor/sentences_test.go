@@ -0,0 +1,65 @@
+package processor
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+	"golang.org/x/text/language"
+	"gopkg.in/neurosnap/sentences.v1"
+
+	"fb2converter/config"
+)
+
+func TestTokenizerUserData(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cfg.Doc.Sentences.Path = dir
+
+	write := func(abbrs ...string) {
+		storage := sentences.NewStorage()
+		for _, a := range abbrs {
+			storage.AbbrevTypes.Add(a)
+		}
+		data, err := json.Marshal(storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Create(filepath.Join(dir, "english.json.gz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gzw := gzip.NewWriter(f)
+		if _, err := gzw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := gzw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const text = "We met zzq. Smith there."
+	write()
+	if got := splitSentences(newTokenizer(language.English, cfg, zap.NewNop()), text); len(got) != 2 {
+		t.Fatalf("unknown abbreviation should end sentence, got %q", got)
+	}
+	write("zzq")
+	if got := splitSentences(newTokenizer(language.English, cfg, zap.NewNop()), text); len(got) != 1 {
+		t.Errorf("user supplied data was not used, got %q", got)
+	}
+
+	cfg.Doc.Sentences.Abbreviations = map[string][]string{"en": {"qqz"}}
+	if got := splitSentences(newTokenizer(language.English, cfg, zap.NewNop()), "We met qqz. Smith there."); len(got) != 1 {
+		t.Errorf("configured abbreviations were not used, got %q", got)
+	}
+}
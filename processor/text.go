@@ -0,0 +1,614 @@
+package processor
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+
+	"fb2converter/etree"
+)
+
+// isTextFormat checks if output is rendered as a single text file rather than packaged XHTML.
+func isTextFormat(format OutputFmt) bool {
+	return format == OTxt || format == OMd
+}
+
+// textFallbacks are used for punctuation which could not be represented in requested text encoding.
+var textFallbacks = map[rune]string{
+	'—': "-", '–': "-", '‒': "-", '―': "-",
+	'«': `"`, '»': `"`, '“': `"`, '”': `"`, '„': `"`,
+	'‘': "'", '’': "'", '‚': "'",
+	'…': "...", ' ': " ",
+}
+
+// textNote is a note collected to be written at the end of the book.
+type textNote struct {
+	bodyName string
+	marker   string
+	body     string
+}
+
+// textRenderer turns processed XHTML content into plain text or Markdown.
+type textRenderer struct {
+	p     *Processor
+	md    bool
+	float bool
+	width int
+	out   strings.Builder
+	// prefix of the last written block
+	prefix string
+	// Markdown footnotes which bodies follow the current paragraph
+	refs      []int
+	footnotes []string
+	count     int
+	// notes collected for the end of the book
+	endnotes []textNote
+	noted    map[string]string
+}
+
+// generateText renders book content as a single text file.
+func (p *Processor) generateText() error {
+
+	p.env.Log.Debug("Generating text - start", zap.Stringer("format", p.format))
+	defer func(start time.Time) {
+		p.env.Log.Debug("Generating text - done", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	r := &textRenderer{
+		p:     p,
+		md:    p.format == OMd,
+		float: p.notesMode == NFloat || p.notesMode == NFloatOld || p.notesMode == NFloatNew,
+		width: p.env.Cfg.Doc.Text.LineWidth,
+		noted: make(map[string]string),
+	}
+	notes := p.floatNotesFiles()
+	for _, f := range p.Book.Files {
+		if f == nil || f.doc == nil || f.id == "toc" || f.transient&dataNotForSpline != 0 {
+			continue
+		}
+		if notes[f.id] {
+			// notes are collected from references
+			continue
+		}
+		body := f.doc.FindElement("./html/body")
+		if body == nil {
+			continue
+		}
+		r.blocks(body, "")
+	}
+	r.writeEndnotes()
+
+	text := r.out.String()
+	if name := p.env.Cfg.Doc.Text.Encoding; len(name) > 0 {
+		enc, err := ianaindex.IANA.Encoding(name)
+		if err != nil || enc == nil {
+			p.env.Log.Warn("Unknown text encoding requested, using UTF-8", zap.String("encoding", name))
+		} else {
+			p.text = encodeText(text, enc)
+			return nil
+		}
+	}
+	p.text = []byte(text)
+	return nil
+}
+
+// encodeText converts text to requested encoding replacing characters which could not be represented.
+func encodeText(text string, enc encoding.Encoding) []byte {
+
+	var (
+		res   = make([]byte, 0, len(text))
+		e     = enc.NewEncoder()
+		cache = make(map[rune][]byte)
+	)
+	for _, r := range text {
+		b, ok := cache[r]
+		if !ok {
+			var err error
+			if b, err = e.Bytes([]byte(string(r))); err != nil {
+				b = []byte("?")
+				if f, ok := textFallbacks[r]; ok {
+					b = []byte(f)
+				}
+			}
+			cache[r] = b
+		}
+		res = append(res, b...)
+	}
+	return res
+}
+
+// FinalizeText stores previously generated plain text or Markdown file.
+func (p *Processor) FinalizeText(fname string) error {
+
+	if _, err := os.Stat(fname); err == nil {
+		if !p.overwrite {
+			return fmt.Errorf("output file already exists: %s", fname)
+		}
+		p.env.Log.Warn("Overwriting existing file", zap.String("file", fname))
+		if err = os.Remove(fname); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	} else if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+		return fmt.Errorf("unable to create output directory: %w", err)
+	}
+	return os.WriteFile(fname, p.text, 0644)
+}
+
+// quote returns prefix for epigraphs, citations and annotations.
+func (r *textRenderer) quote() string {
+	if r.md {
+		return "> "
+	}
+	return "    "
+}
+
+func (r *textRenderer) blocks(e *etree.Element, prefix string) {
+	for _, c := range e.ChildElements() {
+		r.block(c, prefix)
+	}
+}
+
+func (r *textRenderer) block(c *etree.Element, prefix string) {
+
+	class := getAttrValue(c, "class")
+	switch {
+	case class == "titleblock":
+		r.heading(c, prefix)
+	case class == "epigraph", class == "cite", class == "annotation":
+		r.blocks(c, prefix+r.quote())
+	case class == "poem":
+		if r.md {
+			// indentation means code in Markdown
+			r.blocks(c, prefix)
+		} else {
+			r.blocks(c, prefix+"    ")
+		}
+	case class == "stanza":
+		r.stanza(c, prefix)
+	case class == "text-author":
+		r.paragraph(prefix, r.emphasis(normalizeSpaces(r.inline(c))))
+	case class == "emptyline":
+		if !r.md && r.out.Len() > 0 {
+			r.out.WriteString("\n")
+		}
+	case class == "blocknote":
+		r.blockNotes(c, prefix)
+	case class == "image", class == "section", class == "chapter_end", strings.HasPrefix(class, "vignette"):
+		// nothing to render
+	case c.Tag == "table":
+		r.table(c, prefix)
+	case c.Tag == "p" && class == "subtitle":
+		text := normalizeSpaces(r.inline(c))
+		if r.md && strings.IndexFunc(text, unicode.IsLetter) >= 0 {
+			text = "**" + text + "**"
+		}
+		r.paragraph(prefix, text)
+		r.flushFootnotes(prefix)
+	case c.Tag == "p":
+		r.paragraph(prefix, normalizeSpaces(r.inline(c)))
+		r.flushFootnotes(prefix)
+	case c.Tag == "div":
+		r.blocks(c, prefix)
+	default:
+		if text := normalizeSpaces(r.inline(c)); len(text) > 0 {
+			r.paragraph(prefix, text)
+		}
+	}
+}
+
+// write outputs block of lines separating it from the previous one by empty line.
+func (r *textRenderer) write(prefix string, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	if r.out.Len() > 0 {
+		if prefix == r.prefix {
+			r.out.WriteString(strings.TrimRight(prefix, " "))
+		}
+		r.out.WriteString("\n")
+	}
+	for _, l := range lines {
+		if len(l) == 0 {
+			r.out.WriteString(strings.TrimRight(prefix, " ") + "\n")
+			continue
+		}
+		r.out.WriteString(prefix + l + "\n")
+	}
+	r.prefix = prefix
+}
+
+func (r *textRenderer) paragraph(prefix, text string) {
+	if len(text) == 0 {
+		return
+	}
+	if r.md {
+		text = escapeMDLineStart(text)
+	}
+	r.write(prefix, wrapText(text, r.width-utf8.RuneCountInString(prefix)))
+}
+
+func (r *textRenderer) heading(c *etree.Element, prefix string) {
+
+	level, lines := 1, []string{}
+	for _, d := range c.ChildElements() {
+		class := getAttrValue(d, "class")
+		if len(class) < 2 || class[0] != 'h' {
+			continue
+		}
+		n, err := strconv.Atoi(class[1:])
+		if err != nil {
+			continue
+		}
+		level = n + 1
+		for _, t := range d.ChildElements() {
+			if text := normalizeSpaces(r.inline(t)); len(text) > 0 {
+				lines = append(lines, text)
+			}
+		}
+	}
+	if len(lines) == 0 {
+		return
+	}
+
+	if r.md {
+		title := lines[0]
+		for _, l := range lines[1:] {
+			if last, _ := utf8.DecodeLastRuneInString(title); unicode.IsPunct(last) {
+				title += " " + l
+			} else {
+				title += ". " + l
+			}
+		}
+		if level > 6 {
+			level = 6
+		}
+		r.write(prefix, []string{strings.Repeat("#", level) + " " + title})
+		r.flushFootnotes(prefix)
+		return
+	}
+
+	width := 0
+	for _, l := range lines {
+		if w := utf8.RuneCountInString(l); w > width {
+			width = w
+		}
+	}
+	underline := "-"
+	if level <= 2 {
+		underline = "="
+	}
+	r.write(prefix, append(lines, strings.Repeat(underline, width)))
+	r.flushFootnotes(prefix)
+}
+
+func (r *textRenderer) stanza(c *etree.Element, prefix string) {
+
+	var lines []string
+	flush := func() {
+		if r.md {
+			for i := 0; i < len(lines)-1; i++ {
+				// hard line break
+				lines[i] += "  "
+			}
+		}
+		r.write(prefix, lines)
+		lines = nil
+	}
+	for _, v := range c.ChildElements() {
+		if v.Tag != "p" || len(getAttrValue(v, "class")) > 0 {
+			flush()
+			r.block(v, prefix)
+			continue
+		}
+		text := normalizeSpaces(r.inline(v))
+		if r.md {
+			text = escapeMDLineStart(text)
+		}
+		lines = append(lines, text)
+	}
+	flush()
+	r.flushFootnotes(prefix)
+}
+
+func (r *textRenderer) blockNotes(c *etree.Element, prefix string) {
+
+	for _, n := range c.ChildElements() {
+		text := normalizeSpaces(r.inline(n))
+		if !r.md {
+			r.paragraph(prefix+"    ", text)
+			continue
+		}
+		if len(r.refs) > 0 {
+			r.footnotes = append(r.footnotes, fmt.Sprintf("[^%d]: %s", r.refs[0], text))
+			r.refs = r.refs[1:]
+		}
+	}
+	r.flushFootnotes(prefix)
+}
+
+// flushFootnotes writes Markdown footnotes referenced by the preceding paragraph.
+func (r *textRenderer) flushFootnotes(prefix string) {
+	if len(r.footnotes) == 0 {
+		return
+	}
+	r.write(prefix, r.footnotes)
+	r.footnotes = nil
+}
+
+func (r *textRenderer) table(c *etree.Element, prefix string) {
+
+	var (
+		rows [][]string
+		cols int
+	)
+	for _, tr := range c.FindElements(".//tr") {
+		var row []string
+		for _, td := range tr.ChildElements() {
+			text := normalizeSpaces(r.inline(td))
+			if r.md {
+				text = strings.ReplaceAll(text, "|", `\|`)
+			}
+			row = append(row, text)
+		}
+		if len(row) > cols {
+			cols = len(row)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return
+	}
+
+	lines := make([]string, 0, len(rows)+1)
+	for i, row := range rows {
+		for len(row) < cols {
+			row = append(row, "")
+		}
+		if !r.md {
+			lines = append(lines, strings.Join(row, " | "))
+			continue
+		}
+		lines = append(lines, "| "+strings.Join(row, " | ")+" |")
+		if i == 0 {
+			lines = append(lines, "|"+strings.Repeat(" --- |", cols))
+		}
+	}
+	r.write(prefix, lines)
+	r.flushFootnotes(prefix)
+}
+
+// inline renders element content as a single line of text.
+func (r *textRenderer) inline(e *etree.Element) string {
+
+	var sb strings.Builder
+	for _, t := range e.Child {
+		switch v := t.(type) {
+		case *etree.CharData:
+			sb.WriteString(r.chars(v.Data))
+		case *etree.Element:
+			sb.WriteString(r.element(v))
+			sb.WriteString(r.chars(v.Tail()))
+		}
+	}
+	return sb.String()
+}
+
+func (r *textRenderer) chars(text string) string {
+	text = strings.ReplaceAll(text, strSOFTHYPHEN, "")
+	if r.md {
+		text = escapeMD(text)
+	}
+	return text
+}
+
+func (r *textRenderer) element(e *etree.Element) string {
+
+	class := getAttrValue(e, "class")
+	switch {
+	case e.Tag == "img", e.Tag == "br":
+		return " "
+	case class == "notenum":
+		if r.md {
+			return ""
+		}
+		return r.inline(e)
+	case class == "inlineanchor", class == "blockanchor":
+		if !r.md {
+			if class == "inlineanchor" {
+				// note text follows
+				return ""
+			}
+			return r.inline(e)
+		}
+		r.count++
+		r.refs = append(r.refs, r.count)
+		return fmt.Sprintf("[^%d]", r.count)
+	case class == "inlinenote":
+		text := normalizeSpaces(r.inline(e))
+		if !r.md {
+			return " (" + text + ")"
+		}
+		if len(r.refs) > 0 {
+			r.footnotes = append(r.footnotes, fmt.Sprintf("[^%d]: %s", r.refs[0], text))
+			r.refs = r.refs[1:]
+		}
+		return ""
+	case e.Tag == "a":
+		return r.anchor(e)
+	case e.Tag == "code":
+		text := strings.ReplaceAll(strings.TrimSuffix(extractText(e, false), e.Tail()), strSOFTHYPHEN, "")
+		if !r.md {
+			return text
+		}
+		if strings.Contains(text, "`") {
+			return "`` " + text + " ``"
+		}
+		return "`" + text + "`"
+	case e.Tag == "sup", e.Tag == "sub":
+		if r.md {
+			return "<" + e.Tag + ">" + r.inline(e) + "</" + e.Tag + ">"
+		}
+	case class == "emphasis":
+		return r.emphasis(r.inline(e))
+	case class == "strong":
+		return r.mark("**", r.inline(e))
+	case class == "strike":
+		return r.mark("~~", r.inline(e))
+	}
+	return r.inline(e)
+}
+
+func (r *textRenderer) anchor(e *etree.Element) string {
+
+	text := r.inline(e)
+	href := getAttrValue(e, "href")
+	u, err := url.Parse(href)
+	if err != nil || len(href) == 0 {
+		return text
+	}
+
+	if n, ok := r.p.Book.Notes[u.Fragment]; ok && len(u.Scheme) == 0 && r.float {
+		if marker, ok := r.noted[u.Fragment]; ok {
+			return marker
+		}
+		marker := strings.TrimSpace(text)
+		if r.md {
+			r.count++
+			marker = fmt.Sprintf("[^%d]", r.count)
+		}
+		r.noted[u.Fragment] = marker
+		r.endnotes = append(r.endnotes, textNote{bodyName: n.bodyName, marker: marker, body: n.body})
+		return marker
+	}
+
+	if len(u.Scheme) == 0 || len(strings.TrimSpace(text)) == 0 {
+		// internal link
+		return text
+	}
+	if r.md {
+		return "[" + text + "](" + strings.NewReplacer("(", "%28", ")", "%29", " ", "%20").Replace(href) + ")"
+	}
+	if strings.TrimSpace(text) != href {
+		return text + " <" + href + ">"
+	}
+	return text
+}
+
+func (r *textRenderer) emphasis(text string) string {
+	return r.mark("*", text)
+}
+
+// mark surrounds text with Markdown markup keeping surrounding spaces outside of it.
+func (r *textRenderer) mark(m, text string) string {
+	if !r.md {
+		return text
+	}
+	trimmed := strings.TrimSpace(text)
+	if len(trimmed) == 0 {
+		return text
+	}
+	i := strings.Index(text, trimmed)
+	return text[:i] + m + trimmed + m + text[i+len(trimmed):]
+}
+
+// writeEndnotes adds notes collected from references at the end of the book.
+func (r *textRenderer) writeEndnotes() {
+
+	var body string
+	for _, n := range r.endnotes {
+		lines := strings.Split(strings.TrimSpace(n.body), "\n")
+		for i := range lines {
+			lines[i] = normalizeSpaces(lines[i])
+		}
+		if r.md {
+			r.write("", []string{n.marker + ": " + strings.Join(lines, "\n    ")})
+			continue
+		}
+		if n.bodyName != body {
+			body = n.bodyName
+			title := body
+			if t, ok := r.p.Book.NoteBodyTitles[body]; ok && len(t.title) > 0 {
+				title = t.title
+			}
+			title = normalizeSpaces(title)
+			r.write("", []string{title, strings.Repeat("=", utf8.RuneCountInString(title))})
+		}
+		lines[0] = n.marker + " " + lines[0]
+		r.write("", wrapLines(lines, r.width))
+	}
+}
+
+// normalizeSpaces collapses all breaking white space into single spaces, non-breaking spaces are kept.
+func normalizeSpaces(text string) string {
+	return strings.Join(strings.FieldsFunc(text, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	}), " ")
+}
+
+// wrapText breaks text into lines no longer than width characters (unless single word is longer). With width less than
+// 1 text is not wrapped.
+func wrapText(text string, width int) []string {
+
+	if width < 1 {
+		return []string{text}
+	}
+	var (
+		lines []string
+		line  string
+	)
+	for _, w := range strings.Split(text, " ") {
+		switch {
+		case len(line) == 0:
+			line = w
+		case utf8.RuneCountInString(line)+1+utf8.RuneCountInString(w) > width:
+			lines = append(lines, line)
+			line = w
+		default:
+			line += " " + w
+		}
+	}
+	return append(lines, line)
+}
+
+func wrapLines(lines []string, width int) []string {
+	var res []string
+	for _, l := range lines {
+		res = append(res, wrapText(l, width)...)
+	}
+	return res
+}
+
+var mdEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "<", `\<`, ">", `\>`, "#", `\#`, "~", `\~`)
+
+// escapeMD protects text characters which have special meaning in Markdown.
+func escapeMD(text string) string {
+	return mdEscaper.Replace(text)
+}
+
+// escapeMDLineStart protects paragraph start which would make it a list.
+func escapeMDLineStart(text string) string {
+
+	if strings.HasPrefix(text, "- ") || strings.HasPrefix(text, "+ ") {
+		return `\` + text
+	}
+	i := 0
+	for i < len(text) && text[i] >= '0' && text[i] <= '9' {
+		i++
+	}
+	if i > 0 && i < len(text)-1 && (text[i] == '.' || text[i] == ')') && text[i+1] == ' ' {
+		return text[:i] + `\` + text[i:]
+	}
+	return text
+}
@@ -0,0 +1,95 @@
+package processor
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+
+	"fb2converter/config"
+)
+
+func TestWrapText(t *testing.T) {
+
+	for _, tc := range []struct {
+		in    string
+		width int
+		out   []string
+	}{
+		{"one two three", 0, []string{"one two three"}},
+		{"one two three", 7, []string{"one two", "three"}},
+		{"Мороз и солнце; день чудесный", 14, []string{"Мороз и", "солнце; день", "чудесный"}},
+		{"verylongword x", 4, []string{"verylongword", "x"}},
+	} {
+		if out := wrapText(tc.in, tc.width); !reflect.DeepEqual(out, tc.out) {
+			t.Errorf("wrapText(%q, %d) = %q, expected %q", tc.in, tc.width, out, tc.out)
+		}
+	}
+}
+
+func TestMarkdownEscaping(t *testing.T) {
+
+	if out := escapeMD("* * * [1] a_b"); out != `\* \* \* \[1\] a\_b` {
+		t.Errorf("unexpected escaping %q", out)
+	}
+	for in, out := range map[string]string{
+		"1. Глава":  `1\. Глава`,
+		"- реплика": `\- реплика`,
+		"1812 год":  "1812 год",
+	} {
+		if res := escapeMDLineStart(in); res != out {
+			t.Errorf("escapeMDLineStart(%q) = %q, expected %q", in, res, out)
+		}
+	}
+}
+
+func TestEncodeText(t *testing.T) {
+
+	out := encodeText("Война — «мир»…", charmap.KOI8R)
+	if res, _ := charmap.KOI8R.NewDecoder().String(string(out)); res != `Война - "мир"...` {
+		t.Errorf("unexpected encoded text %q", res)
+	}
+}
+
+const notesBook = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description>
+<title-info>
+<author><first-name>Test</first-name><last-name>Author</last-name></author>
+<book-title>Notes Book</book-title>
+<lang>en</lang>
+</title-info>
+<document-info><id>1b3c5e7a-1111-2222-3333-444455556666</id></document-info>
+</description>
+<body><section><title><p>Chapter</p></title><p>Main text<a l:href="#n1" type="note">[1]</a> continues.</p><p>Comment<a l:href="#c1" type="note">[2]</a> follows.</p></section></body>
+<body name="notes"><title><p>Notes</p></title>
+<section id="n1"><title><p>1</p></title><p>Note body.</p></section>
+</body>
+<body name="comments"><title><p>Comments</p></title>
+<section id="c1"><title><p>1</p></title><subtitle>Comment body.</subtitle></section>
+</body>
+</FictionBook>`
+
+func TestTextNotes(t *testing.T) {
+
+	for _, format := range []OutputFmt{OTxt, OMd} {
+		for mode := NDefault; mode < UnsupportedNotesFmt; mode++ {
+			p := newTestProcessor(t, notesBook, format, false, func(cfg *config.Config) {
+				cfg.Doc.Notes.Mode = mode.String()
+			})
+			if err := p.Process(); err != nil {
+				t.Fatalf("%s %s: unable to process: %v", format, mode, err)
+			}
+			text := string(p.text)
+			if !strings.Contains(text, "Main text") || !strings.Contains(text, "continues.") {
+				t.Errorf("%s %s: text is missing\n%s", format, mode, text)
+			}
+			for _, note := range []string{"Note body.", "Comment body."} {
+				if n := strings.Count(text, note); n != 1 {
+					t.Errorf("%s %s: note %q is present %d times\n%s", format, mode, note, n, text)
+				}
+			}
+		}
+	}
+}
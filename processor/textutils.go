@@ -14,6 +14,8 @@ import (
 	"unicode"
 	"unicode/utf8"
 
+	"golang.org/x/text/language"
+
 	"fb2converter/config"
 )
 
@@ -164,6 +166,20 @@ func CreateAuthorKeywordsMap(an *config.AuthorName) map[string]string {
 	return rd
 }
 
+// TitleSort returns title suitable for sorting: for English books leading article is moved to the end, the same way
+// Calibre does it.
+func TitleSort(title string, lang language.Tag) string {
+	if base, _ := lang.Base(); base.String() != "en" {
+		return title
+	}
+	for _, article := range []string{"the ", "a ", "an "} {
+		if len(title) > len(article) && strings.EqualFold(title[:len(article)], article) {
+			return strings.TrimSpace(title[len(article):]) + ", " + title[:len(article)-1]
+		}
+	}
+	return title
+}
+
 // CreateTitleKeywordsMap prepares keywords map for replacement.
 func CreateTitleKeywordsMap(b *Book, pos int, src string) map[string]string {
 	rd := make(map[string]string)
@@ -234,6 +250,14 @@ func CreateFileNameKeywordsMap(b *Book, format string, pos int) map[string]strin
 	rd["#authors"] = b.BookAuthors(format, false)
 	rd["#author"] = b.BookAuthors(format, true)
 	rd["#bookid"] = b.ID.String()
+	rd["#genre"], rd["#genrecode"], rd["#genregroup"] = "", "", b.GenreGroup
+	if len(b.Genres) > 0 {
+		rd["#genrecode"] = b.Genres[0]
+		rd["#genre"] = b.Genres[0]
+		if len(b.GenreNames) > 0 {
+			rd["#genre"] = b.GenreNames[0]
+		}
+	}
 	return rd
 }
 
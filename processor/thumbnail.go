@@ -1,6 +1,7 @@
 package processor
 
 import (
+	"fmt"
 	"runtime/debug"
 
 	"go.uber.org/zap"
@@ -30,3 +31,58 @@ func ProduceThumbnail(fname, outdir string, w, h int, stretch bool, log *zap.Log
 	}
 	return r.SaveResult(outdir)
 }
+
+// KindleBook - results of thumbnail synchronization for a single book.
+type KindleBook struct {
+	Thumbnail   string // name of the thumbnail file Kindle looks for, empty when book has no ASIN
+	Created     bool   // thumbnail was written
+	Displayable bool   // Kindle will show thumbnail for the book
+	Fixed       bool   // book meta information was changed to make thumbnail visible
+	Encrypted   bool   // book is protected by DRM and was not changed
+}
+
+// SyncThumbnail produces thumbnail for the book similarly to ProduceThumbnail. When fix is requested it also changes
+// book meta information (cdetype, ASIN and content key) preventing Kindle from showing thumbnail.
+func SyncThumbnail(fname, outdir string, w, h int, stretch, fix bool, log *zap.Logger) (res KindleBook, err error) {
+
+	defer func() {
+		// Sometimes device will have files we cannot recognize and parse
+		if r := recover(); r != nil {
+			log.Debug("Thumbnail synchronization ended with panic", zap.String("file", fname), zap.ByteString("stack", debug.Stack()))
+			// do not stop on panic - give other files a chance to be processed
+			res, err = KindleBook{}, nil
+		}
+	}()
+
+	var r *mobi.Reader
+	if r, err = mobi.NewReader(fname, w, h, stretch, log); err != nil {
+		return res, err
+	}
+	if fix && !r.Displayable() && !r.Encrypted() {
+		if res.Fixed, err = mobi.FixThumbnailMeta(fname); err != nil {
+			return res, err
+		}
+		if r, err = mobi.NewReader(fname, w, h, stretch, log); err != nil {
+			return res, err
+		}
+	}
+	res.Thumbnail, res.Displayable, res.Encrypted = r.ThumbnailName(), r.Displayable(), r.Encrypted()
+	res.Created, err = r.SaveResult(outdir)
+	return res, err
+}
+
+// KindleThumbnailName returns name of the thumbnail file Kindle looks for the book. It works for encrypted books too.
+func KindleThumbnailName(fname string) (name string, err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			name, err = "", fmt.Errorf("unable to parse %s", fname)
+		}
+	}()
+
+	m, err := mobi.ReadMeta(fname)
+	if err != nil {
+		return "", err
+	}
+	return m.ThumbnailName(), nil
+}
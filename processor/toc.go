@@ -0,0 +1,181 @@
+package processor
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+)
+
+// tocRule assigns TOC level to main body entries with matching titles.
+type tocRule struct {
+	re    *regexp.Regexp
+	level htmlHeader
+}
+
+// compileTOCRules prepares configured TOC rules skipping invalid ones.
+func compileTOCRules(rules []config.TOCRule, log *zap.Logger) []tocRule {
+
+	var res []tocRule
+	for _, r := range rules {
+		if r.Level < 1 {
+			log.Warn("TOC rule level must be positive, ignoring", zap.String("match", r.Match), zap.Int("level", r.Level))
+			continue
+		}
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			log.Warn("Unable to compile TOC rule, ignoring", zap.String("match", r.Match), zap.Error(err))
+			continue
+		}
+		res = append(res, tocRule{re: re, level: htmlHeader(r.Level)})
+	}
+	return res
+}
+
+// processTOC normalizes collected TOC titles and applies level rules.
+func (p *Processor) processTOC() error {
+
+	p.env.Log.Debug("Processing TOC - start")
+	defer func(start time.Time) {
+		p.env.Log.Debug("Processing TOC - done", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	var parent htmlHeader
+	for _, te := range p.Book.TOC {
+		if p.env.Cfg.Doc.TOC.NormalizeTitles || p.env.Cfg.Doc.TOC.RomanToArabic {
+			lines := strings.Split(te.title, "\n")
+			for i, l := range lines {
+				if p.env.Cfg.Doc.TOC.NormalizeTitles {
+					l = normalizeTitle(l)
+				}
+				if p.env.Cfg.Doc.TOC.RomanToArabic {
+					l = romanToArabic(l, p.tocRules)
+				}
+				lines[i] = l
+			}
+			te.title = strings.Join(lines, "\n")
+		}
+		if len(te.bodyName) > 0 || te.main {
+			continue
+		}
+		if te.subtitle {
+			// levels of chapters could be changed by rules
+			te.level = parent + 1
+			continue
+		}
+		for _, r := range p.tocRules {
+			if r.re.MatchString(AllLines(te.title)) {
+				te.level = r.level
+				break
+			}
+		}
+		parent = te.level
+	}
+	return nil
+}
+
+// titleFromText makes TOC title out of the first characters of text, cutting on the word boundary.
+func titleFromText(text string, length int) string {
+
+	text = strings.Join(strings.Fields(text), " ")
+	if length <= 0 || utf8.RuneCountInString(text) <= length {
+		return text
+	}
+	runes := []rune(text)
+	cut := string(runes[:length])
+	if !unicode.IsSpace(runes[length]) {
+		if i := strings.LastIndexFunc(cut, unicode.IsSpace); i > 0 {
+			cut = cut[:i]
+		}
+	}
+	return strings.TrimRightFunc(cut, unicode.IsPunct) + "…"
+}
+
+// isTitleText checks if text could be used as title - it should have some letters or digits.
+func isTitleText(text string) bool {
+	return strings.IndexFunc(text, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) >= 0
+}
+
+// normalizeTitle collapses white space and removes trailing punctuation, keeping ending which changes meaning.
+func normalizeTitle(title string) string {
+
+	title = strings.Join(strings.Fields(title), " ")
+	return strings.TrimRightFunc(title, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune(".,;:-–—", r)
+	})
+}
+
+var (
+	romanPattern = regexp.MustCompile(`(^|\s)([IVXLCDM]+)(\s*[.:)\-–—]|\s*$)`)
+	romanValues  = map[byte]int{'I': 1, 'V': 5, 'X': 10, 'L': 50, 'C': 100, 'D': 500, 'M': 1000}
+)
+
+// parseRoman returns value of well formed roman numeral or 0.
+func parseRoman(s string) int {
+
+	var res int
+	for i := 0; i < len(s); i++ {
+		v := romanValues[s[i]]
+		if i+1 < len(s) && v < romanValues[s[i+1]] {
+			res -= v
+		} else {
+			res += v
+		}
+	}
+	// reject malformed numerals, like "IIII" or "VX"
+	if res <= 0 || res >= 4000 || toRoman(res) != s {
+		return 0
+	}
+	return res
+}
+
+func toRoman(n int) string {
+
+	var (
+		b      strings.Builder
+		values = []int{1000, 900, 500, 400, 100, 90, 50, 40, 10, 9, 5, 4, 1}
+		digits = []string{"M", "CM", "D", "CD", "C", "XC", "L", "XL", "X", "IX", "V", "IV", "I"}
+	)
+	for i, v := range values {
+		for ; n >= v; n -= v {
+			b.WriteString(digits[i])
+		}
+	}
+	return b.String()
+}
+
+// romanToArabic replaces roman numerals used for numbering in title with arabic ones. To avoid changing text, numeral
+// must be one of the first two words and be followed by punctuation or end the title ("Part IV", "XII. Name"). Single
+// letter could as well be an initial ("C. Darwin") or a pronoun ("I - the narrator"), so it is only converted when title
+// has no other words or matches one of TOC rules ("V.", "Chapter V" with rule for chapters).
+func romanToArabic(title string, rules []tocRule) string {
+
+	loc := romanPattern.FindStringSubmatchIndex(title)
+	if loc == nil || len(strings.Fields(title[:loc[4]])) > 1 {
+		return title
+	}
+	if loc[5]-loc[4] == 1 && (isTitleText(title[:loc[4]]) || isTitleText(title[loc[5]:])) && !matchTOCRules(title, rules) {
+		return title
+	}
+	n := parseRoman(title[loc[4]:loc[5]])
+	if n == 0 {
+		return title
+	}
+	return title[:loc[4]] + strconv.Itoa(n) + title[loc[5]:]
+}
+
+// matchTOCRules checks if title matches any of TOC rules.
+func matchTOCRules(title string, rules []tocRule) bool {
+	for _, r := range rules {
+		if r.re.MatchString(title) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package processor
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+)
+
+func TestTOCTitles(t *testing.T) {
+
+	for _, c := range []struct {
+		in, out string
+	}{
+		{"Part IV", "Part 4"},
+		{"XII. The Name", "12. The Name"},
+		{"Глава XIV - Утро", "Глава 14 - Утро"},
+		{"I Am Legend", "I Am Legend"},
+		{"What I Did", "What I Did"},
+		{"Part IIII", "Part IIII"},
+		{"Chapter MIX", "Chapter 1009"},
+		{"V", "5"},
+		{"I.", "1."},
+		{"C. Darwin", "C. Darwin"},
+		{"M. Gorky", "M. Gorky"},
+		{"I - the narrator", "I - the narrator"},
+		{"D) Mixed", "D) Mixed"},
+		{"Chapter V", "Chapter V"},
+	} {
+		if res := romanToArabic(c.in, nil); res != c.out {
+			t.Errorf("roman %q: expected %q, got %q", c.in, c.out, res)
+		}
+	}
+	rules := compileTOCRules([]config.TOCRule{{Match: `(?i)^(глава|chapter)\s`, Level: 2}}, zap.NewNop())
+	for _, c := range []struct {
+		in, out string
+	}{
+		{"Chapter V", "Chapter 5"},
+		{"Глава I. Начало", "Глава 1. Начало"},
+		{"C. Darwin", "C. Darwin"},
+		{"I - the narrator", "I - the narrator"},
+	} {
+		if res := romanToArabic(c.in, rules); res != c.out {
+			t.Errorf("roman %q with rules: expected %q, got %q", c.in, c.out, res)
+		}
+	}
+	for _, c := range []struct {
+		in, out string
+	}{
+		{"  Chapter   one.  ", "Chapter one"},
+		{"Why?", "Why?"},
+		{"Part 1 —", "Part 1"},
+	} {
+		if res := normalizeTitle(c.in); res != c.out {
+			t.Errorf("normalize %q: expected %q, got %q", c.in, c.out, res)
+		}
+	}
+	for _, c := range []struct {
+		in     string
+		length int
+		out    string
+	}{
+		{"Short text", 20, "Short text"},
+		{"Когда наступило утро, все проснулись", 21, "Когда наступило утро…"},
+		{"Longword", 4, "Long…"},
+	} {
+		if res := titleFromText(c.in, c.length); res != c.out {
+			t.Errorf("text %q: expected %q, got %q", c.in, c.out, res)
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package processor
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"unicode"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/language"
+	"gopkg.in/neurosnap/sentences.v1"
+
+	"fb2converter/etree"
+)
+
+// Punkt training parameters, values are the same as in NLTK implementation.
+const (
+	punktAbbrevThreshold    = 0.3  // abbreviation log likelihood cutoff
+	punktAbbrevBackoff      = 5    // upper cutoff for rare abbreviations detection
+	punktCollocationCutoff  = 7.88 // collocation log likelihood cutoff
+	punktSentStarterCutoff  = 30.0 // sentence starter log likelihood cutoff
+	punktMinCollocationFreq = 1    // minimal number of times collocation must appear to be considered
+)
+
+// orthographic context flags, must match sentences package values
+const (
+	orthoBegUc = 1 << 1
+	orthoMidUc = 1 << 2
+	orthoUnkUc = 1 << 3
+	orthoBegLc = 1 << 4
+	orthoMidLc = 1 << 5
+	orthoUnkLc = 1 << 6
+)
+
+// SentencesTrainer accumulates statistics from text corpus and produces punkt training data for sentences tokenizer.
+type SentencesTrainer struct {
+	log     *zap.Logger
+	words   *sentences.DefaultWordTokenizer
+	storage *sentences.Storage
+	//
+	typeFdist        map[string]int
+	typeTotal        int
+	periodTokens     int
+	sentBreaks       int
+	sentStarterFdist map[string]int
+	collocationFdist map[[2]string]int
+	//
+	books int
+	lang  language.Tag
+	// abbreviations returns additional abbreviations for corpus language
+	abbreviations func(language.Tag) []string
+}
+
+// NewSentencesTrainer returns pointer to trainer for corpus in lang. When lang is undefined language of the first
+// suitable book is used. Abbreviations for corpus language (if any) are always considered to be known.
+func NewSentencesTrainer(lang language.Tag, abbreviations func(language.Tag) []string, log *zap.Logger) *SentencesTrainer {
+
+	t := &SentencesTrainer{
+		log:              log,
+		words:            sentences.NewWordTokenizer(sentences.NewPunctStrings()),
+		storage:          sentences.NewStorage(),
+		typeFdist:        make(map[string]int),
+		sentStarterFdist: make(map[string]int),
+		collocationFdist: make(map[[2]string]int),
+		abbreviations:    abbreviations,
+	}
+	if lang != language.Und {
+		t.setLang(lang)
+	}
+	return t
+}
+
+// setLang fixes corpus language and adds its abbreviations.
+func (t *SentencesTrainer) setLang(lang language.Tag) {
+	t.lang = lang
+	if t.abbreviations == nil {
+		return
+	}
+	for _, a := range t.abbreviations(lang) {
+		t.storage.AbbrevTypes.Add(a)
+	}
+}
+
+// Books returns number of books used for training so far.
+func (t *SentencesTrainer) Books() int {
+	return t.books
+}
+
+// Lang returns corpus language, it is undefined until first suitable book is added unless it was specified.
+func (t *SentencesTrainer) Lang() language.Tag {
+	return t.lang
+}
+
+// AddBook parses FB2 document and uses text of its main body for training. Books in languages other than corpus
+// language are skipped. Returns book language and flag indicating if book was used.
+func (t *SentencesTrainer) AddBook(r io.Reader, unknownEncoding bool) (language.Tag, bool, error) {
+
+	doc := etree.NewDocument()
+	if unknownEncoding {
+		doc.ReadSettings = etree.ReadSettings{
+			CharsetReader: charset.NewReaderLabel,
+		}
+	}
+	if _, err := doc.ReadFrom(r); err != nil {
+		return language.Und, false, fmt.Errorf("unable to parse FB2: %w", err)
+	}
+
+	blang := language.Und
+	if e := doc.FindElement("./FictionBook/description/title-info/lang"); e != nil {
+		if l := strings.TrimSpace(e.Text()); len(l) > 0 {
+			if tag, err := language.Parse(l); err == nil {
+				blang = tag
+			}
+		}
+	}
+	if lang := t.lang; lang != language.Und {
+		lb, _ := lang.Base()
+		bb, _ := blang.Base()
+		if lb != bb {
+			return blang, false, nil
+		}
+	}
+
+	var paras []string
+	for _, body := range doc.FindElements("./FictionBook/body") {
+		if len(getAttrValue(body, "name")) > 0 {
+			// notes and comments
+			continue
+		}
+		for _, p := range body.FindElements(".//p") {
+			if s := strings.Join(strings.Fields(getTextFragment(p)), " "); len(s) > 0 {
+				paras = append(paras, s)
+			}
+		}
+	}
+	if len(paras) == 0 {
+		return blang, false, nil
+	}
+	if t.lang == language.Und {
+		// first book defines corpus language
+		t.setLang(blang)
+	}
+
+	t.Train(strings.Join(paras, "\n\n"))
+	t.books++
+	return blang, true, nil
+}
+
+// Train collects statistics from the text. It could be called multiple times, results are cumulative.
+func (t *SentencesTrainer) Train(text string) {
+
+	tokens := t.words.Tokenize(text, false)
+	if len(tokens) == 0 {
+		return
+	}
+
+	// find the frequency of each case-normalized type and count number of tokens ending with period
+	for _, tok := range tokens {
+		t.typeFdist[t.words.Type(tok)]++
+		t.typeTotal++
+		if t.words.HasPeriodFinal(tok) {
+			t.periodTokens++
+		}
+	}
+
+	// reclassify abbreviations on accumulated data
+	t.reclassifyAbbrevTypes()
+
+	// first pass annotation using known abbreviations
+	for _, tok := range tokens {
+		t.annotateType(tok)
+	}
+
+	t.collectOrthoContext(tokens)
+
+	for _, tok := range tokens {
+		if tok.SentBreak {
+			t.sentBreaks++
+		}
+	}
+
+	for i, tok := range tokens {
+		if !t.words.HasPeriodFinal(tok) || i+1 == len(tokens) {
+			continue
+		}
+		next := tokens[i+1]
+		if t.isRareAbbrevType(tok, next) {
+			t.storage.AbbrevTypes.Add(t.words.TypeNoPeriod(tok))
+		}
+		if t.isPotentialSentStarter(next, tok) {
+			t.sentStarterFdist[t.words.Type(next)]++
+		}
+		if t.isPotentialCollocation(tok, next) {
+			t.collocationFdist[[2]string{t.words.TypeNoPeriod(tok), t.words.TypeNoSentPeriod(next)}]++
+		}
+	}
+}
+
+// Finalize computes sentence starters and collocations and returns resulting training data.
+func (t *SentencesTrainer) Finalize() *sentences.Storage {
+
+	t.storage.SentStarters = make(sentences.SetString)
+	if t.sentBreaks > 0 {
+		for typ, atBreak := range t.sentStarterFdist {
+			if len(typ) == 0 {
+				continue
+			}
+			count := t.typeFdist[typ] + t.typeFdist[typ+"."]
+			if count < atBreak {
+				// needed after freq_threshold
+				continue
+			}
+			ll := colLogLikelihood(float64(t.sentBreaks), float64(count), float64(atBreak), float64(t.typeTotal))
+			if ll >= punktSentStarterCutoff && float64(t.typeTotal)/float64(t.sentBreaks) > float64(count)/float64(atBreak) {
+				t.storage.SentStarters.Add(typ)
+			}
+		}
+	}
+
+	t.storage.Collocations = make(sentences.SetString)
+	for pair, count := range t.collocationFdist {
+		if t.storage.SentStarters.Has(pair[0]) || t.storage.SentStarters.Has(pair[1]) {
+			continue
+		}
+		count1 := t.typeFdist[pair[0]] + t.typeFdist[pair[0]+"."]
+		count2 := t.typeFdist[pair[1]] + t.typeFdist[pair[1]+"."]
+		if count1 > 1 && count2 > 1 && punktMinCollocationFreq < count && count <= count1 && count <= count2 {
+			ll := colLogLikelihood(float64(count1), float64(count2), float64(count), float64(t.typeTotal))
+			if ll >= punktCollocationCutoff && float64(t.typeTotal)/float64(count1) > float64(count2)/float64(count) {
+				t.storage.Collocations.Add(pair[0] + "," + pair[1])
+			}
+		}
+	}
+
+	t.log.Debug("Sentences training finalized",
+		zap.Int("books", t.books),
+		zap.Int("tokens", t.typeTotal),
+		zap.Int("abbreviations", len(t.storage.AbbrevTypes)),
+		zap.Int("collocations", len(t.storage.Collocations)),
+		zap.Int("starters", len(t.storage.SentStarters)),
+		zap.Int("ortho", len(t.storage.OrthoContext)))
+
+	return t.storage
+}
+
+// reclassifyAbbrevTypes decides which types are abbreviations based on accumulated frequencies.
+func (t *SentencesTrainer) reclassifyAbbrevTypes() {
+
+	for typ := range t.typeFdist {
+
+		if !hasLetters(typ) || typ == "##number##" {
+			continue
+		}
+
+		var add bool
+		if strings.HasSuffix(typ, ".") {
+			if t.storage.AbbrevTypes.Has(typ) {
+				continue
+			}
+			typ = strings.TrimSuffix(typ, ".")
+			add = true
+		} else if !t.storage.AbbrevTypes.Has(typ) {
+			continue
+		}
+
+		periods := strings.Count(typ, ".") + 1
+		nonPeriods := len([]rune(typ)) - periods + 1
+
+		withPeriod := t.typeFdist[typ+"."]
+		withoutPeriod := t.typeFdist[typ]
+
+		ll := dunningLogLikelihood(float64(withPeriod+withoutPeriod), float64(t.periodTokens), float64(withPeriod), float64(t.typeTotal))
+
+		// apply three scaling factors to 'tweak' the basic log likelihood ratio
+		score := ll * math.Exp(-float64(nonPeriods)) * float64(periods) * math.Pow(float64(nonPeriods), -float64(withoutPeriod))
+
+		switch {
+		case score >= punktAbbrevThreshold && add:
+			t.storage.AbbrevTypes.Add(typ)
+		case score < punktAbbrevThreshold && !add:
+			t.storage.AbbrevTypes.Remove(typ)
+		}
+	}
+}
+
+// annotateType performs first pass annotation - exactly as sentences tokenizer does it.
+func (t *SentencesTrainer) annotateType(tok *sentences.Token) {
+
+	tok.SentBreak, tok.Abbr = false, false
+	if t.words.HasSentEndChars(tok) {
+		tok.SentBreak = true
+	} else if t.words.HasPeriodFinal(tok) && !strings.HasSuffix(tok.Tok, "..") {
+		typ := strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(tok.Tok, "."), "。"))
+		parts := strings.Split(typ, "-")
+		if t.storage.IsAbbr(typ, parts[len(parts)-1]) {
+			tok.Abbr = true
+		} else {
+			tok.SentBreak = true
+		}
+	}
+}
+
+// collectOrthoContext collects information about the contexts in which types occur.
+func (t *SentencesTrainer) collectOrthoContext(tokens []*sentences.Token) {
+
+	const (
+		ctxInternal = iota
+		ctxInitial
+		ctxUnknown
+	)
+
+	context := ctxInternal
+	for _, tok := range tokens {
+
+		// if we encounter a paragraph break, then it's a good sign that it's a sentence break
+		if tok.ParaStart && context != ctxUnknown {
+			context = ctxInitial
+		}
+		// if we're at the beginning of a line, then we can't decide between 'internal' and 'initial'
+		if tok.LineStart && context == ctxInternal {
+			context = ctxUnknown
+		}
+
+		var flag int
+		switch upper, lower := t.words.FirstUpper(tok), t.words.FirstLower(tok); {
+		case context == ctxInitial && upper:
+			flag = orthoBegUc
+		case context == ctxInternal && upper:
+			flag = orthoMidUc
+		case context == ctxUnknown && upper:
+			flag = orthoUnkUc
+		case context == ctxInitial && lower:
+			flag = orthoBegLc
+		case context == ctxInternal && lower:
+			flag = orthoMidLc
+		case context == ctxUnknown && lower:
+			flag = orthoUnkLc
+		}
+		if flag != 0 {
+			t.storage.OrthoContext[t.words.TypeNoSentPeriod(tok)] |= flag
+		}
+
+		// decide the context for the next token
+		switch {
+		case tok.SentBreak:
+			if t.isNumber(tok) || t.words.IsInitial(tok) {
+				context = ctxUnknown
+			} else {
+				context = ctxInitial
+			}
+		case tok.Abbr || t.words.IsEllipsis(tok):
+			context = ctxUnknown
+		default:
+			context = ctxInternal
+		}
+	}
+}
+
+// isRareAbbrevType - a word type is counted as a rare abbreviation if it was not already marked as abbreviation, occurs
+// fewer than punktAbbrevBackoff times and is followed by internal punctuation or by lower case word which never occurs
+// capitalized in the middle of the sentence.
+func (t *SentencesTrainer) isRareAbbrevType(cur, next *sentences.Token) bool {
+
+	if cur.Abbr || !cur.SentBreak {
+		return false
+	}
+
+	typ := t.words.TypeNoSentPeriod(cur)
+	count := t.typeFdist[typ] + t.typeFdist[strings.TrimSuffix(typ, ".")]
+	if t.storage.AbbrevTypes.Has(typ) || count >= punktAbbrevBackoff {
+		return false
+	}
+
+	if r := []rune(next.Tok); len(r) > 0 && strings.ContainsRune(";:,", r[0]) {
+		return true
+	}
+	if t.words.FirstLower(next) {
+		ortho := t.storage.OrthoContext[t.words.TypeNoSentPeriod(next)]
+		if ortho&orthoBegUc != 0 && ortho&orthoMidUc == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// isPotentialSentStarter - token following sentence break which is not a number or initial.
+func (t *SentencesTrainer) isPotentialSentStarter(cur, prev *sentences.Token) bool {
+	return prev.SentBreak && !(t.isNumber(prev) || t.words.IsInitial(prev)) && isAlpha(cur.Tok)
+}
+
+// isPotentialCollocation - period is preceded by number or initial and both tokens are words.
+func (t *SentencesTrainer) isPotentialCollocation(first, second *sentences.Token) bool {
+	return first.SentBreak && (t.isNumber(first) || t.words.IsInitial(first)) &&
+		hasLetters(t.words.Type(first)) && hasLetters(t.words.Type(second))
+}
+
+func (t *SentencesTrainer) isNumber(tok *sentences.Token) bool {
+	return strings.HasPrefix(t.words.Type(tok), "##number##")
+}
+
+func hasLetters(s string) bool {
+	return strings.IndexFunc(s, unicode.IsLetter) >= 0
+}
+
+func isAlpha(s string) bool {
+	return len(s) > 0 && strings.IndexFunc(s, func(r rune) bool { return !unicode.IsLetter(r) }) < 0
+}
+
+// xlogy returns x*log(y) treating 0*log(0) as 0.
+func xlogy(x, y float64) float64 {
+	if x == 0 {
+		return 0
+	}
+	return x * math.Log(y)
+}
+
+// dunningLogLikelihood calculates modified Dunning log-likelihood ratio scores for abbreviation candidates.
+func dunningLogLikelihood(countA, countB, countAB, n float64) float64 {
+
+	p1 := countB / n
+	const p2 = 0.99
+
+	null := xlogy(countAB, p1) + xlogy(countA-countAB, 1.0-p1)
+	alt := xlogy(countAB, p2) + xlogy(countA-countAB, 1.0-p2)
+
+	return -2.0 * (null - alt)
+}
+
+// colLogLikelihood calculates log-likelihood estimate for collocations and sentence starters.
+func colLogLikelihood(countA, countB, countAB, n float64) float64 {
+
+	p := countB / n
+	p1 := countAB / countA
+	var p2 float64
+	if n != countA {
+		p2 = (countB - countAB) / (n - countA)
+	}
+
+	summand1 := xlogy(countAB, p) + xlogy(countA-countAB, 1.0-p)
+	summand2 := xlogy(countB-countAB, p) + xlogy(n-countA-countB+countAB, 1.0-p)
+
+	var summand3, summand4 float64
+	if countA != countAB {
+		summand3 = xlogy(countAB, p1) + xlogy(countA-countAB, 1.0-p1)
+	}
+	if countB != countAB {
+		summand4 = xlogy(countB-countAB, p2) + xlogy(n-countA-countB+countAB, 1.0-p2)
+	}
+
+	return -2.0 * (summand1 + summand2 - summand3 - summand4)
+}
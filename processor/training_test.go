@@ -0,0 +1,71 @@
+package processor
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"golang.org/x/text/language"
+	"gopkg.in/neurosnap/sentences.v1"
+)
+
+func trainingBook(lang, text string) string {
+	return `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+<description><title-info><book-title>Corpus</book-title><lang>` + lang + `</lang></title-info></description>
+<body><section><p>` + text + `</p></section></body>
+<body name="notes"><section><p>Notes are not used.</p></section></body>
+</FictionBook>`
+}
+
+func TestSentencesTrainer(t *testing.T) {
+
+	var text strings.Builder
+	for _, name := range []string{"Watson", "Holmes", "Moriarty", "Hudson", "Lestrade", "Adler", "Mycroft", "Gregson"} {
+		text.WriteString("Yesterday I met Dr. " + name + " in the street. He was in a hurry. ")
+		text.WriteString("Then we talked to Dr. " + name + " again. It was late. ")
+	}
+
+	trainer := NewSentencesTrainer(language.Und, func(lang language.Tag) []string {
+		if lang == language.English {
+			return []string{"approx"}
+		}
+		return nil
+	}, zap.NewNop())
+
+	blang, used, err := trainer.AddBook(strings.NewReader(trainingBook("en", text.String())), false)
+	if err != nil || !used || blang != language.English {
+		t.Fatalf("book was not used: %v, %v, %v", blang, used, err)
+	}
+	if trainer.Lang() != language.English {
+		t.Errorf("corpus language should come from the first book, got %v", trainer.Lang())
+	}
+	if _, used, _ := trainer.AddBook(strings.NewReader(trainingBook("ru", "Текст. Другой текст.")), false); used {
+		t.Error("book in other language was used")
+	}
+	if trainer.Books() != 1 {
+		t.Errorf("expected 1 book, got %d", trainer.Books())
+	}
+
+	storage := trainer.Finalize()
+	for _, abbr := range []string{"dr", "approx"} {
+		if !storage.AbbrevTypes.Has(abbr) {
+			t.Errorf("abbreviation %q is missing", abbr)
+		}
+	}
+
+	// training data should be usable by tokenizer after round trip
+	data, err := json.Marshal(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	training, err := sentences.LoadTraining(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok := &tokenizer{t: sentences.NewSentenceTokenizer(training)}
+	if got := splitSentences(tok, "I saw Dr. Watson. He left."); len(got) != 2 {
+		t.Errorf("unexpected sentences %q", got)
+	}
+}
@@ -174,6 +174,18 @@ func (p *Processor) processBody(index int, from *etree.Element) (err error) {
 	return nil
 }
 
+// floatNotesFiles returns ids of files generated for notes bodies in floating modes. Every such body is a single file
+// named after the body, its content does not always keep notes formatting, so files are recognized by names.
+func (p *Processor) floatNotesFiles() map[string]bool {
+	files := make(map[string]bool)
+	if p.notesMode == NFloat || p.notesMode == NFloatOld || p.notesMode == NFloatNew {
+		for _, n := range p.Book.Notes {
+			files[GenSafeName(n.bodyName)] = true
+		}
+	}
+	return files
+}
+
 func (p *Processor) doTextTransformations(text string, breakable, tail bool) string {
 
 	if p.ctx().inParagraph && breakable {
@@ -220,7 +232,7 @@ func (p *Processor) doTextTransformations(text string, breakable, tail bool) str
 	return text
 }
 
-// formatText inserts page markers (for page map), kobo spans (if necessary) and hyphenates words if requested.
+// formatText inserts page markers (for page map) and hyphenates words if requested.
 func (p *Processor) formatText(in string, breakable, tail bool, to *etree.Element) {
 
 	in = p.doTextTransformations(in, breakable, tail)
@@ -231,20 +243,8 @@ func (p *Processor) formatText(in string, breakable, tail bool, to *etree.Elemen
 		dropcapFound        bool // if true - do not look for dropcap
 		buf                 strings.Builder
 		page, insertMarkers = p.Book.Pages[p.ctx().fname]
-		kobo                = p.format == OKepub
 	)
 
-	bufWriteString := func(text string, kobo bool) {
-		if kobo {
-			p.ctx().sentence++
-			buf.WriteString(`<span class="koboSpan" id=` + fmt.Sprintf("\"kobo.%d.%d\"", p.ctx().paragraph, p.ctx().sentence) + `>`)
-		}
-		buf.WriteString(html.EscapeString(text))
-		if kobo {
-			buf.WriteString(`</span>`)
-		}
-	}
-
 	buf.WriteString(`<root>`)
 
 	for k, sentence := range splitSentences(p.Book.tokenizer, in) {
@@ -270,7 +270,7 @@ func (p *Processor) formatText(in string, breakable, tail bool, to *etree.Elemen
 
 				if dropIndex > 0 {
 					buf.WriteString(`<span class="dropcaps">`)
-					bufWriteString(word[0:dropIndex], false)
+					buf.WriteString(html.EscapeString(word[0:dropIndex]))
 					buf.WriteString(`</span>`)
 					word = word[dropIndex:]
 				}
@@ -295,7 +295,7 @@ func (p *Processor) formatText(in string, breakable, tail bool, to *etree.Elemen
 
 			if insertMarkers && !tail && p.ctx().inParagraph && breakable && p.ctx().pageLength+textOutLen >= p.env.Cfg.Doc.CharsPerPage {
 				if len(textOut) > 0 {
-					bufWriteString(textOut, kobo)
+					buf.WriteString(html.EscapeString(textOut))
 				}
 				buf.WriteString(`<a class="pagemarker" id=` + fmt.Sprintf("\"page_%d\"/>", page))
 				p.ctx().pageLength, textOutLen, textOut = 0, 0, ""
@@ -303,7 +303,7 @@ func (p *Processor) formatText(in string, breakable, tail bool, to *etree.Elemen
 			}
 		}
 		if len(textOut) > 0 {
-			bufWriteString(textOut, kobo)
+			buf.WriteString(html.EscapeString(textOut))
 			p.ctx().pageLength, textOutLen, textOut = p.ctx().pageLength+textOutLen, 0, ""
 		}
 	}
@@ -468,8 +468,6 @@ func (p *Processor) transfer(from, to *etree.Element, decorations ...string) err
 		if tag == "p" {
 			p.ctx().inParagraph = true
 			defer func() { p.ctx().inParagraph = false }()
-			p.ctx().paragraph++
-			p.ctx().sentence = 0
 		}
 	}
 
@@ -489,6 +487,9 @@ func (p *Processor) transfer(from, to *etree.Element, decorations ...string) err
 					if body := p.ctx().out.FindElement("./html/body"); body != nil {
 						to, inner = body, body
 					}
+				} else if err == nil {
+					// ...and when content was split we continue in the copies of the current nodes
+					to, inner = p.ctx().relocated(to), p.ctx().relocated(inner)
 				}
 			} else {
 				// unexpected tag to transfer
@@ -622,37 +623,17 @@ func init() {
 
 func transferSubtitle(p *Processor, from, to *etree.Element) error {
 
-	if p.env.Cfg.Doc.ChapterPerFile {
-		t := from.Text()
-		if len(t) != 0 {
-			for _, dv := range p.env.Cfg.Doc.ChapterDividers {
-				if t == dv && !p.ctx().inHeader && !p.ctx().inSubHeader && len(p.ctx().bodyName) == 0 && !p.ctx().specialParagraph {
-					// open next XHTML
-					ns := []*etree.Attr{attr("xmlns", `http://www.w3.org/1999/xhtml`)}
-					if p.notesMode == NFloatNew {
-						ns = append(ns, attr("xmlns:epub", `http://www.idpf.org/2007/ops`))
-					}
-					var f *dataFile
-					to, f = p.ctx().createXHTML("", ns...)
-					// store it for future flushing
-					p.Book.Files = append(p.Book.Files, f)
-					p.Book.Pages[f.fname] = 0
-				}
+	var divider bool
+	if t := from.Text(); len(t) != 0 {
+		for _, dv := range p.env.Cfg.Doc.ChapterDividers {
+			if t == dv {
+				divider = true
+				break
 			}
 		}
 	}
-
-	p.ctx().inSubHeader = true
-	defer func() { p.ctx().inSubHeader = false }()
-	return p.transfer(from, to, "p", "subtitle")
-}
-
-func transferParagraph(p *Processor, from, to *etree.Element) error {
-
-	if p.env.Cfg.Doc.ChapterPerFile {
-		// Split content if requested
-		if pages, ok := p.Book.Pages[p.ctx().fname]; ok && pages >= p.env.Cfg.Doc.PagesPerFile &&
-			!p.ctx().inHeader && !p.ctx().inSubHeader && len(p.ctx().bodyName) == 0 && !p.ctx().specialParagraph {
+	if divider && !p.ctx().inHeader && !p.ctx().inSubHeader && len(p.ctx().bodyName) == 0 && !p.ctx().specialParagraph {
+		if p.env.Cfg.Doc.ChapterPerFile {
 			// open next XHTML
 			ns := []*etree.Attr{attr("xmlns", `http://www.w3.org/1999/xhtml`)}
 			if p.notesMode == NFloatNew {
@@ -664,13 +645,126 @@ func transferParagraph(p *Processor, from, to *etree.Element) error {
 			p.Book.Files = append(p.Book.Files, f)
 			p.Book.Pages[f.fname] = 0
 		}
+		if p.env.Cfg.Doc.TOC.Subtitles {
+			p.addSubtitleToTOC(from)
+		}
+	}
+
+	p.ctx().inSubHeader = true
+	defer func() { p.ctx().inSubHeader = false }()
+	return p.transfer(from, to, "p", "subtitle")
+}
+
+// addSubtitleToTOC adds chapter divider to TOC as a child of the current chapter.
+func (p *Processor) addSubtitleToTOC(from *etree.Element) {
+
+	title := SanitizeTitle(getTextFragment(from))
+	if !isTitleText(title) && p.env.Cfg.Doc.TOC.TitleFromText > 0 {
+		// name divider after the following text
+		if parent := from.Parent(); parent != nil {
+			var found bool
+			for _, e := range parent.ChildElements() {
+				if e == from {
+					found = true
+					continue
+				}
+				if found && e.Tag == "p" {
+					if t := titleFromText(getTextFragment(e), p.env.Cfg.Doc.TOC.TitleFromText); isTitleText(t) {
+						title = t
+						break
+					}
+				}
+			}
+		}
+	}
+
+	id := getAttrValue(from, "id")
+	if len(id) == 0 {
+		// NOTE: modifying attribute on SOURCE node!
+		id = fmt.Sprintf("tocref%d", p.ctx().tocIndex)
+		from.CreateAttr("id", id)
+		p.ctx().tocIndex++
+	} else {
+		id, _ = SanitizeName(id)
+	}
+
+	level := p.ctx().header
+	level.Inc()
+	p.Book.TOC = append(p.Book.TOC, &tocEntry{
+		ref:      p.ctx().fname + "#" + id,
+		title:    title,
+		level:    level,
+		bodyName: p.ctx().bodyName,
+		subtitle: true,
+	})
+}
+
+func transferParagraph(p *Processor, from, to *etree.Element) error {
+
+	if p.env.Cfg.Doc.ChapterPerFile && !p.ctx().inHeader && !p.ctx().inSubHeader && len(p.ctx().bodyName) == 0 && !p.ctx().specialParagraph {
+		// Split content if requested
+		pages, ok := p.Book.Pages[p.ctx().fname]
+		if ok && pages >= p.env.Cfg.Doc.PagesPerFile ||
+			p.env.Cfg.Doc.MaxFileSize > 0 && p.ctx().fileSize >= p.env.Cfg.Doc.MaxFileSize*1024 {
+			to = p.splitContent(to)
+		}
 	}
 
 	var css string
 	if p.ctx().inHeader {
 		css = "title"
 	}
-	return p.transfer(from, to, "p", css)
+
+	n := len(to.Child)
+	if err := p.transfer(from, to, "p", css); err != nil {
+		return err
+	}
+	if p.env.Cfg.Doc.MaxFileSize > 0 {
+		// paragraphs are the bulk of the content, so it is enough to account for them only
+		for _, t := range to.Child[n:] {
+			if e, ok := t.(*etree.Element); ok {
+				p.ctx().fileSize += len(getXMLFragmentFromElement(e, false))
+			}
+		}
+	}
+	return nil
+}
+
+// splitContent continues content in the next XHTML file. Elements enclosing current paragraph are recreated there
+// without ids (anchors stay where they were), so the rest of their content could be transferred into the copies. Links,
+// notes and TOC entries pointing to the content transferred later will refer to the new file.
+func (p *Processor) splitContent(to *etree.Element) *etree.Element {
+
+	var chain []*etree.Element
+	for e := to; e != nil && e.Tag != "body"; e = e.Parent() {
+		chain = append(chain, e)
+	}
+	body := p.ctx().out.FindElement("./html/body")
+
+	// open next XHTML
+	ns := []*etree.Attr{attr("xmlns", `http://www.w3.org/1999/xhtml`)}
+	if p.notesMode == NFloatNew {
+		ns = append(ns, attr("xmlns:epub", `http://www.idpf.org/2007/ops`))
+	}
+	next, f := p.ctx().createXHTML("", ns...)
+	// store it for future flushing
+	p.Book.Files = append(p.Book.Files, f)
+	p.Book.Pages[f.fname] = 0
+
+	if body != nil {
+		p.ctx().relocate(body, next)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		e := next.CreateElement(chain[i].Tag)
+		for _, a := range chain[i].Attr {
+			if len(a.Space) != 0 || a.Key != "id" {
+				e.Attr = append(e.Attr, a)
+			}
+		}
+		p.ctx().relocate(chain[i], e)
+		next = e
+	}
+	return next
 }
 
 func transferAnchor(p *Processor, from, to *etree.Element) error {
@@ -820,11 +914,14 @@ func transferSection(p *Processor, from, to *etree.Element) error {
 	// will be quite different, so if we want to keep some values for this section we need another stack
 	titler := p.ctx().sectionWithTitle.link()
 	texter := p.ctx().sectionTextLength.link()
+	start := p.ctx().fname
 	if err := p.transfer(from, to, "div", "section"); err != nil {
 		return err
 	}
 	hasTitle := titler()
 	textLength := texter()
+	// section content could be split between several files
+	to = p.ctx().relocated(to)
 
 	if len(p.ctx().bodyName) == 0 {
 		if textLength > 0 {
@@ -837,9 +934,17 @@ func transferSection(p *Processor, from, to *etree.Element) error {
 				}
 			} else if p.env.Cfg.Doc.TOC.NoTitleChapters {
 				// section does not have a title - make sure TOC is not empty
+				title := fmt.Sprintf("%d", p.ctx().findex)
+				if p.env.Cfg.Doc.TOC.TitleFromText > 0 {
+					if e := from.FindElement(".//p"); e != nil {
+						if t := titleFromText(getTextFragment(e), p.env.Cfg.Doc.TOC.TitleFromText); isTitleText(t) {
+							title = t
+						}
+					}
+				}
 				p.Book.TOC = append(p.Book.TOC, &tocEntry{
-					ref:      p.ctx().fname + "#" + fmt.Sprintf("secref%d", p.ctx().findex),
-					title:    fmt.Sprintf("%d", p.ctx().findex),
+					ref:      start + "#" + fmt.Sprintf("secref%d", p.ctx().findex),
+					title:    title,
 					level:    p.ctx().header,
 					bodyName: p.ctx().bodyName,
 				})
@@ -0,0 +1,173 @@
+package processor
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"fb2converter/config"
+	"fb2converter/etree"
+)
+
+// splitBook returns book with long chapters, citation spanning several files, links between chapters and notes.
+func splitBook() string {
+
+	var buf strings.Builder
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description><title-info><book-title>Split</book-title><lang>en</lang></title-info></description>
+<body>`)
+	for s := 1; s <= 3; s++ {
+		fmt.Fprintf(&buf, `<section id="chapter%d"><title><p>Chapter %d</p></title>`, s, s)
+		for i := 1; i <= 30; i++ {
+			id := ""
+			if i == 25 {
+				id = fmt.Sprintf(` id="para%d"`, s)
+			}
+			fmt.Fprintf(&buf, `<p%s>Paragraph %d of chapter %d with some text to make it long enough for splitting `+
+				`<a l:href="#n%d_%d" type="note">%d</a>, see <a l:href="#para%d">later part</a>.</p>`,
+				id, i, s, s, i, i, s%3+1)
+			if i == 10 {
+				buf.WriteString(`<cite>`)
+			}
+			if i == 20 {
+				buf.WriteString(`</cite>`)
+			}
+		}
+		buf.WriteString(`</section>`)
+	}
+	buf.WriteString(`</body><body name="notes"><title><p>Notes</p></title>`)
+	for s := 1; s <= 3; s++ {
+		for i := 1; i <= 30; i++ {
+			fmt.Fprintf(&buf, `<section id="n%d_%d"><title><p>%d</p></title><p>Note %d of chapter %d.</p></section>`, s, i, i, i, s)
+		}
+	}
+	buf.WriteString(`</body></FictionBook>`)
+	return buf.String()
+}
+
+func TestSplitBySize(t *testing.T) {
+
+	for mode := NDefault; mode < UnsupportedNotesFmt; mode++ {
+		p := newTestProcessor(t, splitBook(), OEpub, false, func(cfg *config.Config) {
+			cfg.Doc.MaxFileSize = 2
+			cfg.Doc.Notes.Mode = mode.String()
+		})
+		if err := p.Process(); err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+
+		ids := make(map[string]map[string]bool)
+		var content []*dataFile
+		for _, f := range p.Book.Files {
+			if f.doc == nil || f.ct != "application/xhtml+xml" {
+				continue
+			}
+			content = append(content, f)
+			ids[f.fname] = make(map[string]bool)
+			for _, e := range f.doc.FindElements("//*[@id]") {
+				ids[f.fname][getAttrValue(e, "id")] = true
+			}
+		}
+
+		var chapters []string
+		for _, f := range content {
+			if strings.HasPrefix(f.fname, "index") {
+				chapters = append(chapters, f.fname)
+			}
+		}
+		// every chapter is about 9KB
+		if len(chapters) < 9 {
+			t.Errorf("%s: content was not split by size, files %v", mode, chapters)
+		}
+
+		// paragraphs keep their order across files
+		var (
+			order []string
+			walk  func(e *etree.Element)
+		)
+		walk = func(e *etree.Element) {
+			if text := extractText(e, true); e.Tag == "p" && strings.HasPrefix(text, "Paragraph ") {
+				order = append(order, strings.Join(strings.Fields(text)[1:5], " "))
+				return
+			}
+			for _, c := range e.ChildElements() {
+				walk(c)
+			}
+		}
+		for _, f := range content {
+			walk(f.doc.Root())
+		}
+		for i, text := range order {
+			if expected := fmt.Sprintf("%d of chapter %d", i%30+1, i/30+1); text != expected {
+				t.Errorf("%s: paragraph %d is out of order: %q", mode, i, text)
+				break
+			}
+		}
+		if len(order) != 90 {
+			t.Errorf("%s: expected 90 paragraphs, got %d", mode, len(order))
+		}
+
+		check := func(where, href string) {
+			u, err := url.Parse(href)
+			if err != nil {
+				t.Errorf("%s: %s: bad link %q", mode, where, href)
+				return
+			}
+			if len(u.Scheme) > 0 {
+				return
+			}
+			fname := u.Path
+			if len(fname) == 0 {
+				fname = where
+			}
+			targets, ok := ids[fname]
+			if !ok {
+				t.Errorf("%s: %s: link %q points to unknown file", mode, where, href)
+				return
+			}
+			if len(u.Fragment) > 0 && !targets[u.Fragment] {
+				t.Errorf("%s: %s: link %q points to missing anchor", mode, where, href)
+			}
+		}
+		var links int
+		for _, f := range content {
+			for _, e := range f.doc.FindElements("//a[@href]") {
+				check(f.fname, getAttrValue(e, "href"))
+				links++
+			}
+		}
+		if links < 90 {
+			t.Errorf("%s: expected at least 90 links, got %d", mode, links)
+		}
+		for _, te := range p.Book.TOC {
+			check("toc", te.ref)
+		}
+
+		// citation continues in the next file without duplicating anchors
+		var cites int
+		for _, f := range content {
+			cites += len(f.doc.FindElements("//div[@class='cite']"))
+		}
+		if cites < 4 {
+			t.Errorf("%s: citation formatting was not preserved, %d blocks", mode, cites)
+		}
+		for _, f := range content {
+			seen := make(map[string]bool)
+			var unique func(e *etree.Element)
+			unique = func(e *etree.Element) {
+				if id := getAttrValue(e, "id"); len(id) > 0 {
+					if seen[id] {
+						t.Errorf("%s: %s: duplicate id %q", mode, f.fname, id)
+					}
+					seen[id] = true
+				}
+				for _, c := range e.ChildElements() {
+					unique(c)
+				}
+			}
+			unique(f.doc.Root())
+		}
+	}
+}